@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var errAttachmentsDisabled = errors.New("attachments are not configured")
+
+// room for the multipart headers around the file, on top of the file itself
+const multipartOverhead = 64 << 10
+
+// what may be uploaded, from the attachmentmaxbytes and attachmenttypes
+// environment variables
+type attachmentLimits struct {
+	maxBytes int64
+	types    []string //allowed content types, as sniffed from the file
+}
+
+var defaultAttachmentTypes = []string{"image/png", "image/jpeg", "image/gif", "application/pdf", "text/plain"}
+
+func attachmentLimitsFromEnv() attachmentLimits {
+	limits := attachmentLimits{
+		maxBytes: int64(envInt("attachmentmaxbytes", 10<<20)),
+		types:    defaultAttachmentTypes,
+	}
+	if v := os.Getenv("attachmenttypes"); v != "" {
+		limits.types = nil
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				limits.types = append(limits.types, t)
+			}
+		}
+	}
+	return limits
+}
+
+// describes an uploaded file. Message frames reference attachments by id and
+// the chat service fills in the rest from /api/chat/attachments/{id}/info.
+type AttachmentInfo struct {
+	ID          string `json:"id"`
+	ChatUUID    string `json:"chatuuid"`
+	Name        string `json:"name"`
+	ContentType string `json:"contenttype"`
+	Size        int64  `json:"size"`
+}
+
+func attachmentInfo(a dbquery.Attachment) AttachmentInfo {
+	return AttachmentInfo{
+		ID:          a.ID,
+		ChatUUID:    a.ChatUUID,
+		Name:        a.Name,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+	}
+}
+
+// works out who is uploading to which room. Visitors send their resume token,
+// which is only valid for their own room. Agents send their access token and
+// the room as the roomid query parameter, and need chats.join.
+func attachmentUploader(r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, signer *auth.JoinTokenSigner) (int64, string, int, error) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if signer != nil {
+		if claims, err := signer.ParseResume(token); err == nil {
+			userID, _ := claims.UserID()
+			return userID, claims.Room, http.StatusOK, nil
+		}
+	}
+
+	id, err := authenticate(r, dbqh, issuer)
+	if err != nil {
+		return 0, "", http.StatusUnauthorized, err
+	}
+	permissions, err := dbqh.GetUserPermissions(r.Context(), id.UserID)
+	if err != nil && !errors.Is(err, dbquery.ErrNotFound) {
+		return 0, "", http.StatusInternalServerError, err
+	}
+	if !auth.NewPermissionSet(permissions).Has(auth.ChatsJoin) {
+		return 0, "", http.StatusForbidden, errForbidden
+	}
+	room, err := uuid.Parse(r.URL.Query().Get("roomid"))
+	if err != nil {
+		return 0, "", http.StatusBadRequest, errors.New("roomid must be a uuid")
+	}
+	return id.UserID, room.String(), http.StatusOK, nil
+}
+
+// stores the file sent as the multipart field "file". Its content type is
+// sniffed rather than trusted from the client, and has to be one of the
+// allowed types.
+func uploadAttachment(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, signer *auth.JoinTokenSigner, store storage.Store, limits attachmentLimits) {
+	respondJson(&w)
+
+	if store == nil {
+		http.Error(w, errAttachmentsDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	userID, room, status, err := attachmentUploader(r, dbqh, issuer, signer)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limits.maxBytes+multipartOverhead)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("attachments can be at most %d bytes", limits.maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > limits.maxBytes {
+		http.Error(w, fmt.Sprintf("attachments can be at most %d bytes", limits.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(limits.types, contentType) {
+		http.Error(w, fmt.Sprintf("%s files can not be attached", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	a := dbquery.Attachment{
+		ID:          uuid.NewString(),
+		ChatUUID:    room,
+		UserID:      userID,
+		Name:        attachmentName(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+	}
+	a.StorageKey = a.ID
+
+	log.Println("Upload attachment api request:", userID, room, a.Name, a.ContentType, a.Size)
+
+	if err := store.Put(r.Context(), a.StorageKey, file, a.Size, a.ContentType); err != nil {
+		log.Println("error storing attachment", a.ID, err)
+		http.Error(w, "unable to store attachment", http.StatusInternalServerError)
+		return
+	}
+	if err := dbqh.AddAttachment(r.Context(), a); err != nil {
+		store.Delete(r.Context(), a.StorageKey)
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJson(w, attachmentInfo(a))
+}
+
+// the content type of the start of the file, without parameters, leaving the
+// file at its start
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return contentType, err
+}
+
+// the name the file is shown and downloaded as, without any directories the
+// client included
+func attachmentName(filename string) string {
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+func getAttachmentInfo(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	id := mux.Vars(r)["id"]
+	log.Println("Get attachment info api request:", id)
+
+	a, err := dbqh.GetAttachment(r.Context(), id)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	writeJson(w, attachmentInfo(a))
+}
+
+// serves the file itself. Attachment ids are unguessable, so like the room
+// ids the url is enough to fetch it. Only images are shown inline, anything
+// else is downloaded.
+func downloadAttachment(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, store storage.Store) {
+	if store == nil {
+		http.Error(w, errAttachmentsDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	log.Println("Download attachment api request:", id)
+
+	a, err := dbqh.GetAttachment(r.Context(), id)
+	if errors.Is(err, dbquery.ErrNotFound) || errors.Is(err, dbquery.ErrInvalidInput) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	body, err := store.Get(r.Context(), a.StorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("error reading attachment", a.ID, err)
+		http.Error(w, "unable to read attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(a.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	io.Copy(w, body)
+}
+
+// chooses where attachments are kept from the attachmentstore environment
+// variable, local (the default) or s3
+func newAttachmentStore() (storage.Store, error) {
+	switch backend := os.Getenv("attachmentstore"); backend {
+	case "", "local":
+		dir := os.Getenv("attachmentdir")
+		if dir == "" {
+			dir = "attachments"
+		}
+		store, err := storage.NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "s3":
+		store, err := storage.NewS3Store(storage.S3Config{
+			Endpoint:  os.Getenv("s3endpoint"),
+			Bucket:    os.Getenv("s3bucket"),
+			Region:    os.Getenv("s3region"),
+			AccessKey: os.Getenv("s3accesskey"),
+			SecretKey: os.Getenv("s3secretkey"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown attachmentstore %q, expected local or s3", backend)
+	}
+}
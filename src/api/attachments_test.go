@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a minimal png header, enough for the content type to be sniffed
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func uploadTestAttachment(h http.Handler, query string, token string, name string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(content)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/chat/attachments"+query, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUploadAttachment(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	join := decodeJoin(t, doSessionRequest(h, "POST", "/api/chat/visitorjoin", "", `{"name":"Jane"}`).Result())
+
+	rec := uploadTestAttachment(h, "", join.ResumeToken, `C:\photos\cat.png`, testPNG)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var info AttachmentInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ChatUUID != join.RoomID || info.Name != "cat.png" || info.ContentType != "image/png" || info.Size != int64(len(testPNG)) {
+		t.Errorf("uploaded attachment = %+v", info)
+	}
+
+	rec = doSessionRequest(h, "GET", "/api/chat/attachments/"+info.ID, "", "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testPNG) {
+		t.Fatalf("download: status %d, %q", rec.Code, rec.Body.String())
+	}
+	if ct, cd := rec.Header().Get("Content-Type"), rec.Header().Get("Content-Disposition"); ct != "image/png" || !strings.HasPrefix(cd, "inline") {
+		t.Errorf("download headers: Content-Type %q, Content-Disposition %q", ct, cd)
+	}
+	if rec := doSessionRequest(h, "GET", "/api/chat/attachments/6f1c0000-0000-0000-0000-000000000000", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing attachment: expected status 404, got %d", rec.Code)
+	}
+
+	agent := users["agent"].token
+	tests := []struct {
+		name    string
+		query   string
+		token   string
+		content []byte
+		status  int
+	}{
+		{"agent", "?roomid=" + join.RoomID, agent, []byte("hello"), http.StatusCreated},
+		{"agent without a room", "", agent, []byte("hello"), http.StatusBadRequest},
+		{"join token", "", join.Token, []byte("hello"), http.StatusUnauthorized},
+		{"no token", "", "", []byte("hello"), http.StatusUnauthorized},
+		{"disallowed type", "", join.ResumeToken, []byte("<html><script></script></html>"), http.StatusUnsupportedMediaType},
+		{"too large", "", join.ResumeToken, bytes.Repeat([]byte("a"), 2048), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := uploadTestAttachment(h, tt.query, tt.token, "file.txt", tt.content); rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAddMessageWithAttachments(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+	join := decodeJoin(t, doSessionRequest(h, "POST", "/api/chat/visitorjoin", "", `{"name":"Jane"}`).Result())
+
+	var info AttachmentInfo
+	if err := json.NewDecoder(uploadTestAttachment(h, "", join.ResumeToken, "notes.txt", []byte("notes")).Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/statusupdate", testServiceToken, `{"chatuuid":"`+join.RoomID+`","time":"2024-02-20 15:50:20.000000"}`); rec.Code != http.StatusOK {
+		t.Fatalf("starting the chat: status %d: %s", rec.Code, rec.Body.String())
+	}
+	message := func(attachment string) string {
+		return `{"chatuuid":"` + join.RoomID + `","userid":` + jsonInt(join.UserID) + `,"message":"see attached","time":"2024-02-20 15:50:22.000000","attachments":["` + attachment + `"]}`
+	}
+
+	if rec := doServiceRequest(h, "POST", "/api/chat/addmessage", testServiceToken, message(info.ID)); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/addmessage", testServiceToken, message(info.ID)); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("attachment sent twice: expected status 422, got %d", rec.Code)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/addmessage", testServiceToken, message("6f1c0000-0000-0000-0000-000000000000")); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown attachment: expected status 422, got %d", rec.Code)
+	}
+}
+
+func jsonInt(i int64) string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
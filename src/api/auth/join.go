@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	JoinToken   TokenType = "join"
+	ResumeToken TokenType = "resume"
+)
+
+// the role given in join tokens for external users, internal users get the
+// description of their role
+const VisitorRole = "visitor"
+
+// JoinClaims let the holder into a single chat room. The subject is the user
+// id, internal or external depending on Role. The chat service checks these
+// with Parse, using the same key.
+type JoinClaims struct {
+	Type TokenType `json:"typ"`
+	Room string    `json:"room"`
+	Role string    `json:"role"`
+	Name string    `json:"name"`
+	jwt.RegisteredClaims
+}
+
+func (c JoinClaims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// JoinTokenSigner signs short lived join tokens with a key shared with the
+// chat service. It also signs the resume tokens visitors keep to get back into
+// their room, which use the same claims but are only accepted by the api.
+type JoinTokenSigner struct {
+	key       []byte
+	ttl       time.Duration
+	resumeTTL time.Duration
+	now       func() time.Time
+}
+
+func NewJoinTokenSigner(key []byte, ttl time.Duration, resumeTTL time.Duration) (*JoinTokenSigner, error) {
+	if len(key) < minKeyLength {
+		return nil, ErrKeyTooShort
+	}
+	return &JoinTokenSigner{key: key, ttl: ttl, resumeTTL: resumeTTL, now: time.Now}, nil
+}
+
+// returns a token letting the user into room, and when it expires. The token
+// only needs to last until the WebSocket is open.
+func (js *JoinTokenSigner) Sign(userID int64, role string, name string, room string) (string, time.Time, error) {
+	return js.sign(JoinToken, js.ttl, userID, role, name, room)
+}
+
+// returns a token a visitor can exchange for a new join token to the same
+// room, for reconnecting without starting a new chat
+func (js *JoinTokenSigner) SignResume(userID int64, name string, room string) (string, time.Time, error) {
+	return js.sign(ResumeToken, js.resumeTTL, userID, VisitorRole, name, room)
+}
+
+func (js *JoinTokenSigner) sign(typ TokenType, ttl time.Duration, userID int64, role string, name string, room string) (string, time.Time, error) {
+	now := js.now()
+	expiresAt := now.Add(ttl)
+	claims := JoinClaims{
+		Type: typ,
+		Room: room,
+		Role: role,
+		Name: name,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(js.key)
+	return token, expiresAt, err
+}
+
+// verifies a join token, as the chat service does
+func (js *JoinTokenSigner) Parse(token string) (JoinClaims, error) {
+	return js.parse(token, JoinToken)
+}
+
+// verifies a resume token
+func (js *JoinTokenSigner) ParseResume(token string) (JoinClaims, error) {
+	return js.parse(token, ResumeToken)
+}
+
+func (js *JoinTokenSigner) parse(token string, want TokenType) (JoinClaims, error) {
+	var claims JoinClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return js.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(js.now),
+	)
+	if err != nil || claims.Type != want || claims.Room == "" || claims.Role == "" {
+		return JoinClaims{}, ErrInvalidToken
+	}
+	if _, err := claims.UserID(); err != nil {
+		return JoinClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinTokens(t *testing.T) {
+	js, err := NewJoinTokenSigner([]byte(strings.Repeat("j", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := js.Sign(7, VisitorRole, "Jane", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := js.Parse(token)
+	if id, _ := claims.UserID(); err != nil || id != 7 || claims.Role != VisitorRole || claims.Name != "Jane" || claims.Room != "room" {
+		t.Errorf("join claims = %+v, %v", claims, err)
+	}
+
+	other, err := NewJoinTokenSigner([]byte(strings.Repeat("o", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Parse(token); err != ErrInvalidToken {
+		t.Errorf("token signed with another key accepted: %v", err)
+	}
+
+	ti := newTestIssuer(t)
+	ti.key = js.key
+	tokens, err := ti.Issue(7, "session", ti.SessionExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Parse(tokens.Access); err != ErrInvalidToken {
+		t.Errorf("access token accepted as a join token: %v", err)
+	}
+
+	js.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := js.Parse(token); err != ErrInvalidToken {
+		t.Errorf("expired join token accepted: %v", err)
+	}
+}
+
+func TestResumeTokens(t *testing.T) {
+	js, err := NewJoinTokenSigner([]byte(strings.Repeat("j", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume, expiresAt, err := js.SignResume(7, "Jane", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d < 59*time.Minute {
+		t.Errorf("expected the resume token to last the resume ttl, expires in %s", d)
+	}
+
+	claims, err := js.ParseResume(resume)
+	if id, _ := claims.UserID(); err != nil || id != 7 || claims.Role != VisitorRole || claims.Name != "Jane" || claims.Room != "room" {
+		t.Errorf("resume claims = %+v, %v", claims, err)
+	}
+
+	// neither token can stand in for the other, so the chat service never
+	// accepts a long lived resume token
+	if _, err := js.Parse(resume); err != ErrInvalidToken {
+		t.Errorf("resume token accepted as a join token: %v", err)
+	}
+	join, _, err := js.Sign(7, VisitorRole, "Jane", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.ParseResume(join); err != ErrInvalidToken {
+		t.Errorf("join token accepted as a resume token: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Package auth holds the credential handling for internal users.
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt work factor for new hashes. Raising it causes existing hashes to be
+// replaced the next time their user logs in.
+const DefaultPasswordCost = 12
+
+// the work factor HashPassword uses, DefaultPasswordCost unless lowered, as
+// tests do to keep hashing fast
+var PasswordCost = DefaultPasswordCost
+
+var ErrPasswordTooLong = errors.New("password must be at most 72 bytes")
+
+// returns the bcrypt hash to store for password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", ErrPasswordTooLong
+	}
+	return string(hash), err
+}
+
+// reports whether password matches the stored value, and whether the stored
+// value should be replaced with a fresh HashPassword result. Rows written
+// before passwords were hashed hold the plain text, these still match so the
+// user can log in, and always need rehashing.
+func CheckPassword(stored string, password string) (ok bool, needsRehash bool) {
+	if !isBcryptHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < PasswordCost
+}
+
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// above the minimum, so a hash can be made at a lower cost than is wanted
+	PasswordCost = bcrypt.MinCost + 1
+	os.Exit(m.Run())
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "correct horse" || !isBcryptHash(hash) {
+		t.Fatalf("expected a bcrypt hash, got %q", hash)
+	}
+
+	if ok, rehash := CheckPassword(hash, "correct horse"); !ok || rehash {
+		t.Errorf("matching password: ok = %v, needsRehash = %v", ok, rehash)
+	}
+	if ok, _ := CheckPassword(hash, "wrong"); ok {
+		t.Error("wrong password matched")
+	}
+
+	if _, err := HashPassword(strings.Repeat("a", 73)); err != ErrPasswordTooLong {
+		t.Errorf("expected ErrPasswordTooLong, got %v", err)
+	}
+}
+
+func TestCheckPasswordLegacyPlainText(t *testing.T) {
+	if ok, rehash := CheckPassword("password", "password"); !ok || !rehash {
+		t.Errorf("legacy match: ok = %v, needsRehash = %v", ok, rehash)
+	}
+	if ok, rehash := CheckPassword("password", "Password"); ok || rehash {
+		t.Errorf("legacy mismatch: ok = %v, needsRehash = %v", ok, rehash)
+	}
+}
+
+func TestCheckPasswordOutdatedCost(t *testing.T) {
+	cheap, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash := CheckPassword(string(cheap), "pw"); !ok || !rehash {
+		t.Errorf("low cost hash: ok = %v, needsRehash = %v", ok, rehash)
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import "context"
+
+// Permission is an action a role may be allowed to take. Roles and the
+// permissions they hold are stored in the database, these are the actions
+// the API knows how to check.
+type Permission string
+
+const (
+	UsersRead   Permission = "users.read"   //view any internal user
+	UsersManage Permission = "users.manage" //add internal users and update any of them, including their role
+	RolesRead   Permission = "roles.read"   //view roles and their permissions
+	RolesManage Permission = "roles.manage" //add, update and delete roles
+	ChatsJoin   Permission = "chats.join"   //join chat rooms as an agent
+)
+
+var AllPermissions = []Permission{UsersRead, UsersManage, RolesRead, RolesManage, ChatsJoin}
+
+func (p Permission) Valid() bool {
+	for _, known := range AllPermissions {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// the permissions held by a user
+type PermissionSet map[Permission]bool
+
+func NewPermissionSet(permissions []string) PermissionSet {
+	set := PermissionSet{}
+	for _, p := range permissions {
+		set[Permission(p)] = true
+	}
+	return set
+}
+
+func (ps PermissionSet) Has(p Permission) bool {
+	return ps[p]
+}
+
+// reports whether every permission in other is also in ps, so a user holding ps
+// can grant other without gaining anything they do not already have
+func (ps PermissionSet) Covers(other []string) bool {
+	for _, p := range other {
+		if !ps[Permission(p)] {
+			return false
+		}
+	}
+	return true
+}
+
+type permissionsKey struct{}
+
+func ContextWithPermissions(ctx context.Context, ps PermissionSet) context.Context {
+	return context.WithValue(ctx, permissionsKey{}, ps)
+}
+
+// the permissions of the caller, empty if they were never looked up
+func PermissionsFromContext(ctx context.Context) PermissionSet {
+	ps, _ := ctx.Value(permissionsKey{}).(PermissionSet)
+	return ps
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type TokenType string
+
+const (
+	AccessToken  TokenType = "access"
+	RefreshToken TokenType = "refresh"
+)
+
+const minKeyLength = 32
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrKeyTooShort  = fmt.Errorf("token signing key must be at least %d bytes", minKeyLength)
+)
+
+// Claims carried by both token types. The subject is the internal user id and
+// SessionID ties the token to a row in the sessions table, so revoking the
+// session invalidates every token issued for it.
+type Claims struct {
+	Type      TokenType `json:"typ"`
+	SessionID string    `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+func (c Claims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// a signed access and refresh token pair
+type Tokens struct {
+	Access           string
+	Refresh          string
+	RefreshID        string //id of the refresh token, stored against the session
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+}
+
+// TokenIssuer signs and verifies session tokens with HMAC-SHA256
+type TokenIssuer struct {
+	key        []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+}
+
+func NewTokenIssuer(key []byte, accessTTL time.Duration, refreshTTL time.Duration) (*TokenIssuer, error) {
+	if len(key) < minKeyLength {
+		return nil, ErrKeyTooShort
+	}
+	return &TokenIssuer{
+		key:        key,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		now:        time.Now,
+	}, nil
+}
+
+// when a session started now should expire
+func (ti *TokenIssuer) SessionExpiry() time.Time {
+	return ti.now().Add(ti.refreshTTL)
+}
+
+// issues a token pair for the session. The refresh token never outlives
+// sessionExpiresAt, so refreshing does not extend a session.
+func (ti *TokenIssuer) Issue(userID int64, sessionID string, sessionExpiresAt time.Time) (Tokens, error) {
+	now := ti.now()
+	tokens := Tokens{
+		AccessExpiresAt:  now.Add(ti.accessTTL),
+		RefreshExpiresAt: sessionExpiresAt,
+	}
+	if tokens.AccessExpiresAt.After(sessionExpiresAt) {
+		tokens.AccessExpiresAt = sessionExpiresAt
+	}
+
+	var err error
+	if tokens.RefreshID, err = NewID(); err != nil {
+		return tokens, err
+	}
+	if tokens.Access, err = ti.sign(AccessToken, userID, sessionID, "", now, tokens.AccessExpiresAt); err != nil {
+		return tokens, err
+	}
+	tokens.Refresh, err = ti.sign(RefreshToken, userID, sessionID, tokens.RefreshID, now, tokens.RefreshExpiresAt)
+	return tokens, err
+}
+
+func (ti *TokenIssuer) sign(typ TokenType, userID int64, sessionID string, id string, issuedAt time.Time, expiresAt time.Time) (string, error) {
+	claims := Claims{
+		Type:      typ,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userID, 10),
+			ID:        id,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ti.key)
+}
+
+// verifies the signature, expiry and type of token. This does not check the
+// session is still valid, callers need to look it up.
+func (ti *TokenIssuer) Parse(token string, want TokenType) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return ti.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(ti.now),
+	)
+	if err != nil || claims.Type != want || claims.SessionID == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	if _, err := claims.UserID(); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// returns a random 128 bit hex id, used for sessions and refresh tokens
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID    int64
+	SessionID string
+	ExpiresAt time.Time //when the access token used expires
+}
+
+type identityKey struct{}
+
+func ContextWithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
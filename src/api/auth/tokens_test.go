@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T) *TokenIssuer {
+	t.Helper()
+	ti, err := NewTokenIssuer([]byte(strings.Repeat("k", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti
+}
+
+func TestIssueAndParse(t *testing.T) {
+	ti := newTestIssuer(t)
+	tokens, err := ti.Issue(7, "session", ti.SessionExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := ti.Parse(tokens.Access, AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := claims.UserID(); id != 7 || claims.SessionID != "session" {
+		t.Errorf("unexpected access claims %+v", claims)
+	}
+
+	claims, err = ti.Parse(tokens.Refresh, RefreshToken)
+	if err != nil || claims.ID != tokens.RefreshID {
+		t.Errorf("refresh claims = %+v, %v", claims, err)
+	}
+
+	if _, err := ti.Parse(tokens.Refresh, AccessToken); err != ErrInvalidToken {
+		t.Errorf("refresh token parsed as access token: %v", err)
+	}
+}
+
+func TestParseRejectsExpiredAndForeignTokens(t *testing.T) {
+	ti := newTestIssuer(t)
+	tokens, err := ti.Issue(7, "session", ti.SessionExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewTokenIssuer([]byte(strings.Repeat("o", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Parse(tokens.Access, AccessToken); err != ErrInvalidToken {
+		t.Errorf("token signed with another key accepted: %v", err)
+	}
+
+	ti.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := ti.Parse(tokens.Access, AccessToken); err != ErrInvalidToken {
+		t.Errorf("expired access token accepted: %v", err)
+	}
+	if _, err := ti.Parse(tokens.Refresh, RefreshToken); err != nil {
+		t.Errorf("refresh token should outlive the access token: %v", err)
+	}
+}
+
+func TestAccessTokenNeverOutlivesSession(t *testing.T) {
+	ti := newTestIssuer(t)
+	sessionEnd := time.Now().Add(10 * time.Second)
+	tokens, err := ti.Issue(7, "session", sessionEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessExpiresAt.After(sessionEnd) {
+		t.Errorf("access token expires at %v, after the session at %v", tokens.AccessExpiresAt, sessionEnd)
+	}
+}
+
+func TestNewTokenIssuerRejectsShortKey(t *testing.T) {
+	if _, err := NewTokenIssuer([]byte("short"), time.Minute, time.Hour); err != ErrKeyTooShort {
+		t.Errorf("expected ErrKeyTooShort, got %v", err)
+	}
+}
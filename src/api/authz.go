@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+)
+
+var errForbidden = errors.New("you do not have permission to do this")
+
+// wraps handler so it is only called for a valid session whose user's role
+// holds perm. With allowSelf a user without perm may still act on themselves,
+// meaning the {id} route variable is their own user id. The caller's
+// permissions are added to the request context for handlers needing finer
+// checks.
+func requirePermission(dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, perm auth.Permission, allowSelf bool, handler http.HandlerFunc) http.HandlerFunc {
+	return requireSession(dbqh, issuer, func(w http.ResponseWriter, r *http.Request) {
+		id, _ := auth.IdentityFromContext(r.Context())
+		permissions, err := dbqh.GetUserPermissions(r.Context(), id.UserID)
+		if err != nil && !errors.Is(err, dbquery.ErrNotFound) {
+			verifyDBErrorsAndReturn(w, err)
+			return
+		}
+
+		ps := auth.NewPermissionSet(permissions)
+		if !ps.Has(perm) && !(allowSelf && isSelf(r)) {
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(auth.ContextWithPermissions(r.Context(), ps)))
+	})
+}
+
+// the header the other chat-app services send the shared service token in
+const serviceTokenHeader = "X-Service-Token"
+
+var errServiceOnly = errors.New("this can only be called by the chat-app services")
+
+// reads the token shared by the chat-app services, which call the api on no
+// user's behalf. Without one the routes they call refuse every request.
+func serviceTokenFromEnv() string {
+	token := os.Getenv("servicetoken")
+	if token == "" {
+		log.Println("servicetoken is not set, service routes are disabled")
+	}
+	return token
+}
+
+// wraps handler so it is only called by the chat-app services, which send
+// token in the X-Service-Token header. An empty token lets nobody in.
+func requireService(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fromService(r, token) {
+			http.Error(w, errServiceOnly.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// reports whether r carries the service token
+func fromService(r *http.Request, token string) bool {
+	got := r.Header.Get(serviceTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// reports whether the {id} route variable is the caller's own user id
+func isSelf(r *http.Request) bool {
+	id, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		return false
+	}
+	target, err := idFromVars(r)
+	return err == nil && target == id.UserID
+}
+
+// checks the caller may give a user roleID. Only users.manage holders can
+// assign roles, and never one holding permissions they lack themselves.
+func authorizeRoleAssignment(r *http.Request, dbqh dbquery.DBQueryHandler, roleID int64) (int, error) {
+	ps := auth.PermissionsFromContext(r.Context())
+	if !ps.Has(auth.UsersManage) {
+		return http.StatusForbidden, errForbidden
+	}
+	role, err := dbqh.GetRole(r.Context(), roleID)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		return http.StatusUnprocessableEntity, errors.New("role does not exist")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ps.Covers(role.Permissions) {
+		return http.StatusForbidden, errForbidden
+	}
+	return http.StatusOK, nil
+}
+
+// checks the caller may change another user, which needs every permission the
+// user holds so supervisors cannot take over admin accounts
+func authorizeUserChange(r *http.Request, dbqh dbquery.DBQueryHandler, userID int64) (int, error) {
+	if isSelf(r) {
+		return http.StatusOK, nil
+	}
+	permissions, err := dbqh.GetUserPermissions(r.Context(), userID)
+	if err != nil && !errors.Is(err, dbquery.ErrNotFound) {
+		return http.StatusInternalServerError, err
+	}
+	if !auth.PermissionsFromContext(r.Context()).Covers(permissions) {
+		return http.StatusForbidden, errForbidden
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/storage"
+)
+
+// the service token the test servers' service routes accept
+const testServiceToken = "test-service-token"
+
+type authzTestUser struct {
+	id    int64
+	token string
+}
+
+// routes every endpoint the same way main does, backed by an in memory
+// database holding a logged in admin, supervisor and agent
+func newAuthzTestServer(t *testing.T) (http.Handler, map[string]authzTestUser) {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dbqh := newTestDB(t)
+	issuer := newTestTokenIssuer(t)
+	joinSigner := newTestJoinSigner(t)
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := attachmentLimits{maxBytes: 1024, types: defaultAttachmentTypes}
+
+	r := newRouter(dbqh, issuer, joinSigner, store, limits, testServiceToken)
+
+	admin := decodeTokens(t, doSessionRequest(r, "POST", "/api/users/login", "", `{"email":"admin@example.com","password":"password"}`))
+	users := map[string]authzTestUser{"admin": {admin.UserID, admin.AccessToken}}
+	for roleID, name := range map[int]string{2: "supervisor", 3: "agent"} {
+		body := fmt.Sprintf(`{"roleid":%d,"firstname":"%s","surname":"Test","email":"%s@example.com","password":"secret"}`, roleID, name, name)
+		if rec := doSessionRequest(r, "POST", "/api/users/addinternal", admin.AccessToken, body); rec.Code != http.StatusOK {
+			t.Fatalf("adding %s: status %d: %s", name, rec.Code, rec.Body.String())
+		}
+		login := decodeTokens(t, doSessionRequest(r, "POST", "/api/users/login", "", `{"email":"`+name+`@example.com","password":"secret"}`))
+		users[name] = authzTestUser{login.UserID, login.AccessToken}
+	}
+	return r, users
+}
+
+func TestUserRoutePermissions(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	agent, supervisor := users["agent"], users["supervisor"]
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"agent adds user", agent.token, "POST", "/api/users/addinternal", `{"roleid":3,"firstname":"a","surname":"b","email":"c@example.com","password":"d"}`, http.StatusForbidden},
+		{"agent reads self", agent.token, "GET", fmt.Sprintf("/api/users/getinternalbyid/%d", agent.id), "", http.StatusOK},
+		{"agent reads admin", agent.token, "GET", "/api/users/getinternalbyid/1", "", http.StatusForbidden},
+		{"agent updates self", agent.token, "PUT", fmt.Sprintf("/api/users/updateinternalbyid/%d", agent.id), `{"firstname":"Agent"}`, http.StatusOK},
+		{"agent promotes self", agent.token, "PUT", fmt.Sprintf("/api/users/updateinternalbyid/%d", agent.id), `{"roleid":1}`, http.StatusForbidden},
+		{"agent updates supervisor", agent.token, "PUT", fmt.Sprintf("/api/users/updateinternalbyid/%d", supervisor.id), `{"firstname":"x"}`, http.StatusForbidden},
+		{"supervisor adds admin", supervisor.token, "POST", "/api/users/addinternal", `{"roleid":1,"firstname":"a","surname":"b","email":"c@example.com","password":"d"}`, http.StatusForbidden},
+		{"supervisor promotes agent", supervisor.token, "PUT", fmt.Sprintf("/api/users/updateinternalbyid/%d", agent.id), `{"roleid":1}`, http.StatusForbidden},
+		{"supervisor updates admin", supervisor.token, "PUT", "/api/users/updateinternalbyid/1", `{"password":"mine"}`, http.StatusForbidden},
+		{"supervisor updates agent", supervisor.token, "PUT", fmt.Sprintf("/api/users/updateinternalbyid/%d", agent.id), `{"roleid":3,"surname":"Agent"}`, http.StatusOK},
+		{"supervisor manages roles", supervisor.token, "POST", "/api/roles", `{"description":"lead"}`, http.StatusForbidden},
+		{"agent reads roles", agent.token, "GET", "/api/roles", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := doSessionRequest(h, tt.method, tt.path, tt.token, tt.body); rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// sends a request as one of the chat-app services
+func doServiceRequest(h http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set(serviceTokenHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireService(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	tests := []struct {
+		name       string
+		configured string
+		sent       string
+		code       int
+	}{
+		{"matching token", "secret", "secret", http.StatusOK},
+		{"no token sent", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "secrets", http.StatusUnauthorized},
+		{"none configured", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := doServiceRequest(requireService(tt.configured, ok), "POST", "/", tt.sent, ""); rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d", tt.code, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRoleCRUD(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	admin := users["admin"].token
+
+	rec := doSessionRequest(h, "POST", "/api/roles", admin, `{"description":"lead","permissions":["users.read"]}`)
+	var role RoleInfo
+	if err := json.NewDecoder(rec.Body).Decode(&role); err != nil || role.ID == 0 {
+		t.Fatalf("add role: status %d, %+v, %v", rec.Code, role, err)
+	}
+	path := fmt.Sprintf("/api/roles/%d", role.ID)
+
+	if rec := doSessionRequest(h, "POST", "/api/roles", admin, `{"description":"bad","permissions":["everything"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown permission: expected status 400, got %d", rec.Code)
+	}
+
+	rec = doSessionRequest(h, "PUT", path, admin, `{"permissions":["users.read","roles.read"]}`)
+	if err := json.NewDecoder(rec.Body).Decode(&role); err != nil || role.Description != "lead" || len(role.Permissions) != 2 {
+		t.Fatalf("update role: status %d, %+v, %v", rec.Code, role, err)
+	}
+
+	var roles []RoleInfo
+	if err := json.NewDecoder(doSessionRequest(h, "GET", "/api/roles", admin, "").Body).Decode(&roles); err != nil || len(roles) != 4 {
+		t.Fatalf("get roles: %+v, %v", roles, err)
+	}
+
+	if rec := doSessionRequest(h, "PUT", "/api/roles/1", admin, `{"permissions":[]}`); rec.Code != http.StatusForbidden {
+		t.Errorf("changing admin permissions: expected status 403, got %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "DELETE", "/api/roles/3", admin, ""); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("deleting a role in use: expected status 422, got %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "DELETE", path, admin, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete role: expected status 204, got %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "GET", path, admin, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get deleted role: expected status 404, got %d", rec.Code)
+	}
+}
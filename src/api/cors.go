@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ryan-Har/chat-app/src/api/origin"
+)
+
+var (
+	corsMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	corsHeaders = []string{"X-Requested-With", "Content-Type", "Accept", "Authorization"}
+)
+
+// applies the origin policy to every request. Browsers on allowed origins get
+// the CORS headers, and their preflight requests are answered here. Requests
+// from any other origin are refused with 403.
+func enforceOrigins(policy *origin.Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := r.Header.Get("Origin")
+		if o == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if err := policy.CheckRequest(r); err != nil {
+			log.Println("rejecting request to", r.URL.Path+":", err)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", o)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/origin"
+)
+
+func TestEnforceOrigins(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	policy, err := origin.Parse("https://app.example.com", "/api/chat/visitorjoin=https://www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := enforceOrigins(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	do := func(method string, path string, o string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://api.internal"+path, nil)
+		if o != "" {
+			req.Header.Set("Origin", o)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/api/roles", "", false); rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("without an origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+	rec := do("GET", "/api/roles", "https://app.example.com", false)
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("allowed origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+	rec = do("OPTIONS", "/api/roles", "https://app.example.com", true)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Headers") == "" {
+		t.Errorf("preflight: status %d, headers %v", rec.Code, rec.Header())
+	}
+	if rec := do("POST", "/api/roles", "https://evil.com", false); rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+	if rec := do("OPTIONS", "/api/chat/visitorjoin", "https://app.example.com", true); rec.Code != http.StatusForbidden {
+		t.Errorf("origin not allowed by the route override: status %d", rec.Code)
+	}
+	if rec := do("POST", "/api/chat/visitorjoin", "https://www.example.com", false); rec.Code != http.StatusTeapot {
+		t.Errorf("origin allowed by the route override: status %d", rec.Code)
+	}
+}
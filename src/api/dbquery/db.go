@@ -6,618 +6,711 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/Ryan-Har/chat-app/src/api/migrations"
+	"github.com/lib/pq"
 )
 
 type DBQueryHandler interface {
-	AddExternalUser(name string, ip string) ([][]any, error)
-	GetExternalUser(name string, ip string) ([][]any, error)
-	GetExternalUserByID(id int64) ([][]any, error)
-	UpdateExternalUserByID(id int64, name string, ip string, email string) ([][]any, error)
-	ChatStart(uuid string, startTime string) ([][]any, error)
-	ChatEnd(uuid string, endTime string) ([][]any, error)
-	AddInternalUser(roleID int64, firstname string, surname string, email string, password string) ([][]any, error)
-	GetInternalUserByID(id int64) ([][]any, error)
-	UpdateInternalUserByID(id int64, roleID int64, firstname string, surname string, email string, password string) ([][]any, error)
-	AddMessageByUUID(uuid string, userid int64, message string, time string) ([][]any, error)
-	GetAllMessagesByUUID(uuid string) ([][]any, error)
-	GetAllChatsInProgress() ([][]any, error)
-	JoinChatParticipant(uuid string, userid int64, time string) ([][]any, error)
-	LeaveChatParticipant(uuid string, userid int64, time string) ([][]any, error)
-	GetOngoingChatParticipants() ([][]any, error)
-	GetOngoingChatMessages() ([][]any, error)
-	GetUserInfoByID(id int64) ([][]any, error)
-	GetInternalByEmail(email string) ([][]any, error)
+	AddExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error)
+	GetExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error)
+	GetExternalUserByID(ctx context.Context, id int64) (ExternalUser, error)
+	UpdateExternalUserByID(ctx context.Context, id int64, name string, ip string, email string) (ExternalUser, error)
+	ChatStart(ctx context.Context, uuid string, startTime string) error
+	ChatEnd(ctx context.Context, uuid string, endTime string) error
+	AddInternalUser(ctx context.Context, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error)
+	GetInternalUserByID(ctx context.Context, id int64) (InternalUser, error)
+	UpdateInternalUserByID(ctx context.Context, id int64, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error)
+	AddMessageByUUID(ctx context.Context, uuid string, userid int64, message string, time string) error
+	GetAllMessagesByUUID(ctx context.Context, uuid string) ([]ChatMessage, error)
+	GetAllChatsInProgress(ctx context.Context) ([]Chat, error)
+	JoinChatParticipant(ctx context.Context, uuid string, userid int64, time string) error
+	LeaveChatParticipant(ctx context.Context, uuid string, userid int64, time string) error
+	GetOngoingChatParticipants(ctx context.Context) ([]ChatParticipant, error)
+	GetOngoingChatMessages(ctx context.Context) ([]ChatMessage, error)
+	GetUserInfoByID(ctx context.Context, id int64) (UserInfo, error)
+	GetInternalByEmail(ctx context.Context, email string) (InternalUser, error)
+	CreateSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, id string) (Session, error)
+	RotateSessionRefresh(ctx context.Context, id string, oldRefreshID string, newRefreshID string) error
+	RevokeSession(ctx context.Context, id string) error
+	GetUserPermissions(ctx context.Context, userID int64) ([]string, error)
+	GetRoles(ctx context.Context) ([]Role, error)
+	GetRole(ctx context.Context, id int64) (Role, error)
+	AddRole(ctx context.Context, description string, permissions []string) (Role, error)
+	UpdateRole(ctx context.Context, id int64, description string, permissions []string) (Role, error)
+	DeleteRole(ctx context.Context, id int64) error
+	JoinRoom(ctx context.Context, room string, member string, instance string) (bool, error)
+	LeaveRoom(ctx context.Context, room string, member string, grace time.Duration) (bool, error)
+	ClearInstanceRooms(ctx context.Context, instance string) ([]string, error)
+	RenewInstance(ctx context.Context, instance string, ttl time.Duration) error
+	ExpireInstances(ctx context.Context, now time.Time) ([]string, error)
+	ExpireRooms(ctx context.Context, now time.Time) ([]string, error)
+	RoomActive(ctx context.Context, room string) (bool, error)
+	ChatEnded(ctx context.Context, uuid string) (bool, error)
+	AddAttachment(ctx context.Context, a Attachment) error
+	GetAttachment(ctx context.Context, id string) (Attachment, error)
+	AddMessageWithAttachments(ctx context.Context, uuid string, userid int64, message string, time string, attachments []string) error
+	AddMessages(ctx context.Context, messages []ChatMessage) error
 }
 
-type PostgresDBConfig struct {
-	DBUser     string
-	DBPassword string
-	DBName     string
-	DBHost     string
-	DBPort     string
-}
-
-type PostgresQueryHandler struct {
-	RequestChan chan dbQuery
-}
-
-type SqlLiteQueryHandler struct {
-	RequestChan chan dbQuery
-}
-
-func NewPostgresHandler(dbc PostgresDBConfig) (DBQueryHandler, error) {
-	var dbQueryHandler DBQueryHandler
-
-	ch := make(chan error)
-	dbRequestChan := make(chan dbQuery, 10) // Buffered for efficient queuing
-	go dbc.manageConnections(ch, dbRequestChan)
-	err := <-ch
-	if err != nil {
-		return nil, err
-	}
-	dbQueryHandler = PostgresQueryHandler{
-		RequestChan: dbRequestChan,
-	}
-	return dbQueryHandler, nil
-}
+// Errors returned by DBQueryHandler implementations. Driver errors are wrapped
+// so callers can check for these with errors.Is instead of matching strings.
+var (
+	ErrNotFound         = errors.New("record not found")
+	ErrConflict         = errors.New("record already exists")
+	ErrNoRowsChanged    = errors.New("no rows changed")
+	ErrInvalidInput     = errors.New("invalid input")
+	ErrMissingReference = errors.New("referenced record does not exist")
+	// the chat event the change was made for, set with WithEventID, has been
+	// applied already, so nothing was changed
+	ErrAlreadyProcessed = errors.New("event already processed")
+)
 
-type postgresDBConnector struct {
-	err error
-	PostgresDBConfig
-}
+type eventIDKey struct{}
 
-type dbQuery struct {
-	Query                   string
-	ExpectSingleRow         bool                 //true for single row, false if not
-	ReturnChan              chan [][]interface{} // Generic response channel
-	NumberOfColumnsExpected int                  //0 for no sql data returned
+// WithEventID returns a context marking the change it is used for as applying
+// the chat event id. ChatStart, ChatEnd, JoinChatParticipant,
+// LeaveChatParticipant, AddMessageByUUID and AddMessageWithAttachments record
+// the id along with the change, and return ErrAlreadyProcessed without
+// changing anything if it has been recorded before.
+func WithEventID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, eventIDKey{}, id)
 }
 
-type dbConnectionHandler interface {
-	manageConnections()
+func eventID(ctx context.Context) string {
+	id, _ := ctx.Value(eventIDKey{}).(string)
+	return id
 }
 
-// manages the dbConnectors
-func (dbc PostgresDBConfig) manageConnections(ch chan<- error, dbRequestChan chan dbQuery) {
-	dbConnectorChan := make(chan *postgresDBConnector, 1)
-	wk := &postgresDBConnector{
-		err:              nil,
-		PostgresDBConfig: dbc,
-	}
-
-	//first connection attempt before working to ensure connection is valid
-	db, err := connectToPostgres(dbc)
-	ch <- err
-	close(ch)
-	if err != nil {
-		return
-	} else {
-		db.Close()
-	}
-
-	go wk.work(dbConnectorChan, dbRequestChan)
+// records the ids of chat events being applied in processed_events,
+// returning those not recorded before, numbering the bind parameters from 1
+// with placeholder
+func recordEvents(ctx context.Context, tx *sql.Tx, ids []string, placeholder func(n int) string) (map[string]bool, error) {
+	recorded := make(map[string]bool, len(ids))
+	for start := 0; start < len(ids); start += maxInsertRows {
+		chunk := ids[start:min(start+maxInsertRows, len(ids))]
+		var query strings.Builder
+		query.WriteString("INSERT INTO processed_events (event_id) VALUES ")
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "(%s)", placeholder(i+1))
+			args[i] = id
+		}
+		query.WriteString(" ON CONFLICT (event_id) DO NOTHING RETURNING event_id")
 
-	for wk := range dbConnectorChan {
-		log.Printf("DBConnector stopped with err: %s", wk.err)
-		// reset err
-		wk.err = nil
-		// a goroutine has ended, restart it
-		go wk.work(dbConnectorChan, dbRequestChan)
+		rows, err := tx.QueryContext(ctx, query.String(), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			recorded[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
 	}
+	return recorded, nil
 }
 
-func connectToPostgres(dbc PostgresDBConfig) (*sql.DB, error) {
-	db, err := sql.Open("postgres",
-		fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			dbc.DBHost, dbc.DBPort, dbc.DBUser, dbc.DBPassword, dbc.DBName)) //consider secure password handling
+// records the chat event ctx is applying, if any. ErrAlreadyProcessed is
+// returned if it has been recorded before.
+func recordEvent(ctx context.Context, tx *sql.Tx, placeholder func(n int) string) error {
+	id := eventID(ctx)
+	if id == "" {
+		return nil
+	}
+	recorded, err := recordEvents(ctx, tx, []string{id}, placeholder)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err := db.Ping(); err != nil {
-		db.Close()
-		return nil, err
+	if !recorded[id] {
+		return ErrAlreadyProcessed
 	}
-	return db, nil
+	return nil
 }
 
-// manages the database connection and calls the query workers
-func (wk *postgresDBConnector) work(dbConnectorChan chan<- *postgresDBConnector, dbRequestChan chan dbQuery) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				wk.err = err
-			} else {
-				wk.err = fmt.Errorf("panic happened with %v", r)
+// the messages, of those with an EventID, whose event was not recorded
+// before. Each event's message is kept once.
+func unprocessedMessages(messages []ChatMessage, recorded map[string]bool) []ChatMessage {
+	kept := make([]ChatMessage, 0, len(messages))
+	for _, m := range messages {
+		if m.EventID != "" {
+			if !recorded[m.EventID] {
+				continue
 			}
-		} else {
-			wk.err = err
+			delete(recorded, m.EventID)
 		}
-		dbConnectorChan <- wk
-	}()
-
-	db, err := connectToPostgres(wk.PostgresDBConfig)
-	if err != nil {
-		panic(err)
+		kept = append(kept, m)
 	}
-	defer db.Close()
+	return kept
+}
 
-	for msg := range dbRequestChan {
-		if err := db.Ping(); err != nil {
-			dbRequestChan <- msg
-			panic(err)
+// the distinct event ids of messages
+func messageEventIDs(messages []ChatMessage) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range messages {
+		if m.EventID != "" && !seen[m.EventID] {
+			seen[m.EventID] = true
+			ids = append(ids, m.EventID)
 		}
+	}
+	return ids
+}
 
-		var sendResults [][]interface{}
-		fmt.Println("DB Query Running:", msg)
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+type ExternalUser struct {
+	ID     int64
+	Name   string
+	IPAddr string
+	Email  string
+}
 
-		//returns error if there is an error or bool true if all ok.
-		//it doesn't return an error or notify if no rows are changed. TBD
-		if msg.NumberOfColumnsExpected == 0 {
-			resp, err := db.ExecContext(ctx, msg.Query)
-			var singleResult []interface{}
-			if err != nil {
-				singleResult = append(singleResult, err)
-			} else if rows, _ := resp.RowsAffected(); rows == 0 {
-				singleResult = append(singleResult, errors.New("no rows changed"))
-			} else {
-				singleResult = append(singleResult, true)
-			}
-			sendResults = append(sendResults, singleResult)
-			fmt.Println("DB Query Response:", sendResults)
-			msg.ReturnChan <- sendResults
-			close(msg.ReturnChan)
-			continue
-		}
-
-		// Choose the appropriate method based on whether you expect a single value:
-		switch msg.ExpectSingleRow {
-		case true:
-			columns := make([]interface{}, msg.NumberOfColumnsExpected)
-			// Create a slice of pointers to the elements in the columns slice
-			columnPointers := make([]interface{}, len(columns))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
+type InternalUser struct {
+	ID        int64
+	RoleID    int64
+	FirstName string
+	Surname   string
+	Email     string
+	Password  string
+}
 
-			if err := db.QueryRowContext(ctx, msg.Query).Scan(columnPointers...); err != nil {
-				fmt.Println("error querying database:", err)
-				columns[0] = err
-			}
+type Chat struct {
+	UUID      string
+	StartTime string
+}
 
-			sendResults = append(sendResults, columns)
-			msg.ReturnChan <- sendResults
-			close(msg.ReturnChan)
-		case false:
+type ChatMessage struct {
+	ChatUUID string
+	UserID   int64
+	Message  string
+	Time     string
+	EventID  string //of the chat event which sent it, if known. Only used by AddMessages.
+}
 
-			rows, err := db.QueryContext(ctx, msg.Query)
-			if err != nil {
-				fmt.Println("error querying database:", err)
-				queryError := make([]interface{}, 1)
-				queryError[0] = err
-				sendResults = append(sendResults, queryError)
-				msg.ReturnChan <- sendResults
-				close(msg.ReturnChan)
-				continue // Skipping further processing for this query
-			}
-			// Process rows and fill the response interface as needed
-			defer rows.Close()
-
-			if rows.Next() {
-				columns := make([]interface{}, msg.NumberOfColumnsExpected)
-				columnPointers := make([]interface{}, len(columns))
-				for i := range columns {
-					columnPointers[i] = &columns[i]
-				}
-				if err := rows.Scan(columnPointers...); err != nil {
-					fmt.Println("error querying database:", err)
-					columns[0] = err
-				}
-				sendResults = append(sendResults, columns)
-				for rows.Next() {
-					columns := make([]interface{}, msg.NumberOfColumnsExpected)
-					columnPointers := make([]interface{}, len(columns))
-					for i := range columns {
-						columnPointers[i] = &columns[i]
-					}
-					if err := rows.Scan(columnPointers...); err != nil {
-						fmt.Println("error querying database:", err)
-						columns[0] = err
-					}
-					sendResults = append(sendResults, columns)
-				}
-			} else {
-				noResultsMessage := make([]interface{}, 1)
-				noResultsMessage[0] = errors.New("sql: no rows in result set")
-				sendResults = append(sendResults, noResultsMessage)
-			}
-			if err := rows.Err(); err != nil {
-				log.Fatal(err)
-			}
-			msg.ReturnChan <- sendResults
-			close(msg.ReturnChan)
-		}
-	}
-	return err
+type ChatParticipant struct {
+	ChatUUID string
+	UserID   int64
+	Active   bool
+	Internal bool
+	Name     string
 }
 
-func (pqh PostgresQueryHandler) AddExternalUser(name string, ip string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("SELECT add_external_user(%s, %s)",
-			singleQuote(doubleUpSingleQuotes(name)),
-			singleQuote(ip)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 1,
-		ExpectSingleRow:         true,
-	}
+// basic information shared by internal and external users
+type UserInfo struct {
+	ID        int64
+	CreatedAt string
+	Internal  bool
+	Name      string
+}
 
-	log.Println("Add external user DB Request:", dbq.Query)
+// login session of an internal user
+type Session struct {
+	ID        string
+	UserID    int64
+	RefreshID string //id of the refresh token which may currently be used
+	ExpiresAt int64  //unix seconds
+	Revoked   bool
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// a file uploaded to a chat. MessageID is 0 until the message it was sent
+// with has been stored.
+type Attachment struct {
+	ID          string
+	ChatUUID    string
+	UserID      int64 //uploader
+	MessageID   int64
+	Name        string
+	ContentType string
+	Size        int64
+	StorageKey  string
+	CreatedAt   string
+}
 
-	log.Println("Add external user DB Response:", resp)
+// a row of user_roles along with the permissions it holds
+type Role struct {
+	ID          int64
+	Description string
+	Permissions []string
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+// builds roles from rows of role id, description and permission, ordered by
+// role id. The permission is NULL for roles which have none.
+func scanRoles(rows *sql.Rows, roles *[]Role) error {
+	var id int64
+	var description string
+	var permission sql.NullString
+	if err := rows.Scan(&id, &description, &permission); err != nil {
+		return err
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if n := len(*roles); n == 0 || (*roles)[n-1].ID != id {
+		*roles = append(*roles, Role{ID: id, Description: description, Permissions: []string{}})
 	}
-	return resp, nil
-}
-
-func (pqh PostgresQueryHandler) GetExternalUser(name string, ip string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("SELECT user_id, name, ip_address, email FROM external_users WHERE name = %s AND ip_address = %s",
-			singleQuote(doubleUpSingleQuotes(name)),
-			singleQuote(ip)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         true,
+	if permission.Valid {
+		last := &(*roles)[len(*roles)-1]
+		last.Permissions = append(last.Permissions, permission.String)
 	}
+	return nil
+}
 
-	log.Println("Get external user DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+type PostgresDBConfig struct {
+	DBUser     string
+	DBPassword string
+	DBName     string
+	DBHost     string
+	DBPort     string
 
-	log.Println("Get external user DB Response:", resp)
+	MaxOpenConns    int           //0 uses defaultMaxOpenConns
+	MaxIdleConns    int           //0 uses defaultMaxIdleConns
+	ConnMaxLifetime time.Duration //0 keeps connections open indefinitely
+	QueryTimeout    time.Duration //deadline for each call, 0 uses defaultQueryTimeout
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	SkipMigrations bool //leave the schema alone instead of migrating it to the latest version
 }
 
-func (pqh PostgresQueryHandler) GetExternalUserByID(id int64) ([][]any, error) {
-	dbq := dbQuery{
-		Query:                   fmt.Sprintf("SELECT user_id, name, ip_address, email FROM external_users WHERE user_id = %d", id),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         true,
-	}
+const (
+	// rows written by each statement of a multi-row insert, keeping under
+	// the bind parameter limits of both databases
+	maxInsertRows = 500
 
-	log.Println("Get external user by id DB Request:", dbq.Query)
+	defaultMaxOpenConns = 20
+	defaultMaxIdleConns = 5
+	defaultQueryTimeout = 5 * time.Second
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	migrationTimeout = time.Minute
+)
 
-	log.Println("Get external user by id DB Response:", resp)
+// PostgresQueryHandler runs queries against a pooled *sql.DB. Calls are safe
+// to make concurrently, each one borrows a connection from the pool.
+type PostgresQueryHandler struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+func NewPostgresHandler(dbc PostgresDBConfig) (DBQueryHandler, error) {
+	db, err := OpenPostgres(dbc)
+	if err != nil {
+		return nil, err
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if !dbc.SkipMigrations {
+		if err := migrate(db, migrations.Postgres); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
-	return resp, nil
+	return newPostgresHandler(db, dbc.QueryTimeout), nil
 }
 
-func (pqh PostgresQueryHandler) UpdateExternalUserByID(id int64, name string, ip string, email string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("SELECT given_user_id, updated_name, updated_ip_address, updated_email FROM update_external_user_info(%d, %s, %s, %s)",
-			id,
-			singleQuote(doubleUpSingleQuotes(name)),
-			singleQuote(ip),
-			singleQuote(doubleUpSingleQuotes(email))),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         true,
+func newPostgresHandler(db *sql.DB, queryTimeout time.Duration) PostgresQueryHandler {
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
 	}
+	return PostgresQueryHandler{
+		db:           db,
+		queryTimeout: queryTimeout,
+	}
+}
 
-	log.Println("Update external user by id DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// opens the connection pool and checks the database can be reached. The pool
+// handles reconnecting after this, so there is no need to ping per query.
+func OpenPostgres(dbc PostgresDBConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres",
+		fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+			dbc.DBHost, dbc.DBPort, dbc.DBUser, dbc.DBPassword, dbc.DBName)) //consider secure password handling
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, dbc)
 
-	log.Println("Update external user by id DB Response:", resp)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+// brings the schema up to the latest embedded migration
+func migrate(db *sql.DB, dialect migrations.Dialect) error {
+	migrator, err := migrations.New(db, dialect)
+	if err != nil {
+		return err
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	if err := migrator.Up(ctx); err != nil {
+		return fmt.Errorf("migrating %s schema: %w", dialect, err)
 	}
-	return resp, nil
+	return nil
 }
 
-func (pqh PostgresQueryHandler) ChatStart(uuid string, startTime string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("INSERT INTO chat (uuid, start_time) VALUES (%s, %s)",
-			singleQuote(uuid),
-			singleQuote(startTime)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 0,
-		ExpectSingleRow:         true,
+func configurePool(db *sql.DB, dbc PostgresDBConfig) {
+	maxOpen, maxIdle := dbc.MaxOpenConns, dbc.MaxIdleConns
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenConns
 	}
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(dbc.ConnMaxLifetime)
+}
 
-	log.Println("Chat Start DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// applies the per call deadline, unless ctx already has an earlier one
+func (pqh PostgresQueryHandler) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, pqh.queryTimeout)
+}
 
-	log.Println("Chat Start DB Response:", resp)
+// runs a statement which returns no rows. ErrNoRowsChanged is returned if nothing was affected.
+func (pqh PostgresQueryHandler) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := pqh.withTimeout(ctx)
+	defer cancel()
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+	resp, err := pqh.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return translatePostgresError(err)
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if rows, _ := resp.RowsAffected(); rows == 0 {
+		return ErrNoRowsChanged
 	}
-	return resp, nil
+	return nil
 }
 
-func (pqh PostgresQueryHandler) ChatEnd(uuid string, endTime string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("UPDATE chat SET end_time = %s WHERE uuid = %s",
-			singleQuote(endTime),
-			singleQuote(uuid)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 0,
-		ExpectSingleRow:         true,
+// like exec, but when ctx carries an event id it is recorded in the same
+// transaction, and ErrAlreadyProcessed returned if it was recorded before
+func (pqh PostgresQueryHandler) execEvent(ctx context.Context, query string, args ...any) error {
+	if eventID(ctx) == "" {
+		return pqh.exec(ctx, query, args...)
 	}
+	return pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if err := recordEvent(ctx, tx, pgPlaceholder); err != nil {
+			return err
+		}
+		resp, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if rows, _ := resp.RowsAffected(); rows == 0 {
+			return ErrNoRowsChanged
+		}
+		return nil
+	})
+}
 
-	log.Println("Chat End DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+func pgPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
 
-	log.Println("Chat End DB Response:", resp)
+// runs a query expected to return a single row and scans it into dest
+func (pqh PostgresQueryHandler) queryRow(ctx context.Context, query string, args []any, dest ...any) error {
+	ctx, cancel := pqh.withTimeout(ctx)
+	defer cancel()
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if err := pqh.db.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
+		return translatePostgresError(err)
 	}
-	return resp, nil
+	return nil
 }
 
-func (pqh PostgresQueryHandler) AddInternalUser(roleID int64, firstname string, surname string, email string, password string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("SELECT add_internal_user(%d, %s, %s, %s, %s)",
-			roleID,
-			singleQuote(doubleUpSingleQuotes(firstname)),
-			singleQuote(doubleUpSingleQuotes(surname)),
-			singleQuote(doubleUpSingleQuotes(email)),
-			singleQuote(doubleUpSingleQuotes(password))),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 1,
-		ExpectSingleRow:         true,
-	}
+// runs a query and calls scan for each row returned
+func (pqh PostgresQueryHandler) query(ctx context.Context, query string, args []any, scan func(*sql.Rows) error) error {
+	ctx, cancel := pqh.withTimeout(ctx)
+	defer cancel()
 
-	log.Println("Add internal user DB Request:", dbq.Query)
+	rows, err := pqh.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return translatePostgresError(err)
+	}
+	defer rows.Close()
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return translatePostgresError(rows.Err())
+}
 
-	log.Println("Add internal user DB Response:", resp)
+// runs fn in a transaction, committing if it returns nil
+func (pqh PostgresQueryHandler) inTx(ctx context.Context, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := pqh.withTimeout(ctx)
+	defer cancel()
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+	tx, err := pqh.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translatePostgresError(err)
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if err := fn(ctx, tx); err != nil {
+		tx.Rollback()
+		return translatePostgresError(err)
 	}
-	return resp, nil
+	return translatePostgresError(tx.Commit())
 }
 
-func (pqh PostgresQueryHandler) GetInternalUserByID(id int64) ([][]any, error) {
-	dbq := dbQuery{
-		Query:                   fmt.Sprintf("SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE user_id = %d", id),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 6,
-		ExpectSingleRow:         true,
+// maps driver errors onto the package errors, keeping the original message
+func translatePostgresError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
 	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch {
+	case pqErr.Code == "23505": //unique_violation
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Message)
+	case pqErr.Code == "23503": //foreign_key_violation
+		return fmt.Errorf("%w: %s", ErrMissingReference, pqErr.Message)
+	case pqErr.Code.Class() == "22": //data exceptions, e.g. invalid input syntax for type uuid
+		return fmt.Errorf("%w: %s", ErrInvalidInput, pqErr.Message)
+	case pqErr.Code == "P0001" && strings.Contains(pqErr.Message, "record not found"): //raised by the update functions
+		return ErrNotFound
+	}
+	return err
+}
 
-	log.Println("Get internal user by id DB Request:", dbq.Query)
+func (pqh PostgresQueryHandler) AddExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error) {
+	query := "SELECT add_external_user($1, $2)"
+	log.Println("Add external user DB Request:", query)
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	eu := ExternalUser{Name: name, IPAddr: ip}
+	err := pqh.queryRow(ctx, query, []any{name, ip}, &eu.ID)
+	return eu, err
+}
 
-	log.Println("Get internal user by id DB Response:", resp)
+func (pqh PostgresQueryHandler) GetExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error) {
+	query := "SELECT user_id, name, ip_address, email FROM external_users WHERE name = $1 AND ip_address = $2"
+	log.Println("Get external user DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	return pqh.scanExternalUser(ctx, query, name, ip)
 }
 
-func (pqh PostgresQueryHandler) UpdateInternalUserByID(id int64, roleID int64, firstname string, surname string, email string, password string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("SELECT given_user_id, updated_role_id, updated_firstname, updated_surname, updated_email, updated_password FROM update_internal_user_info(%d, %d, %s, %s, %s, %s)",
-			id,
-			roleID,
-			singleQuote(doubleUpSingleQuotes(firstname)),
-			singleQuote(doubleUpSingleQuotes(surname)),
-			singleQuote(doubleUpSingleQuotes(email)),
-			singleQuote(doubleUpSingleQuotes(password))),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 6,
-		ExpectSingleRow:         true,
-	}
+func (pqh PostgresQueryHandler) GetExternalUserByID(ctx context.Context, id int64) (ExternalUser, error) {
+	query := "SELECT user_id, name, ip_address, email FROM external_users WHERE user_id = $1"
+	log.Println("Get external user by id DB Request:", query)
 
-	log.Println("Update internal user by id DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	return pqh.scanExternalUser(ctx, query, id)
+}
 
-	log.Println("Update internal user by id DB Response:", resp)
+func (pqh PostgresQueryHandler) UpdateExternalUserByID(ctx context.Context, id int64, name string, ip string, email string) (ExternalUser, error) {
+	query := "SELECT given_user_id, updated_name, updated_ip_address, updated_email FROM update_external_user_info($1, $2, $3, $4)"
+	log.Println("Update external user by id DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	return pqh.scanExternalUser(ctx, query, id, name, ip, email)
 }
 
-func (pqh PostgresQueryHandler) AddMessageByUUID(uuid string, userid int64, message string, time string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES (%s, %d, %s, %s)",
-			singleQuote(uuid),
-			userid,
-			singleQuote(doubleUpSingleQuotes(message)),
-			singleQuote(time)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 0,
-		ExpectSingleRow:         false,
+func (pqh PostgresQueryHandler) scanExternalUser(ctx context.Context, query string, args ...any) (ExternalUser, error) {
+	var eu ExternalUser
+	var name, ip, email sql.NullString
+	if err := pqh.queryRow(ctx, query, args, &eu.ID, &name, &ip, &email); err != nil {
+		return eu, err
 	}
+	eu.Name, eu.IPAddr, eu.Email = name.String, ip.String, email.String
+	return eu, nil
+}
 
-	log.Println("Add message by uuid DB Request:", dbq.Query)
+func (pqh PostgresQueryHandler) ChatStart(ctx context.Context, uuid string, startTime string) error {
+	query := "INSERT INTO chat (uuid, start_time) VALUES ($1, $2)"
+	log.Println("Chat Start DB Request:", query)
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	return pqh.execEvent(ctx, query, uuid, startTime)
+}
 
-	log.Println("Add message by uuid DB Response:", resp)
+func (pqh PostgresQueryHandler) ChatEnd(ctx context.Context, uuid string, endTime string) error {
+	query := "UPDATE chat SET end_time = $1 WHERE uuid = $2"
+	log.Println("Chat End DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	return pqh.execEvent(ctx, query, endTime, uuid)
 }
 
-func (pqh PostgresQueryHandler) GetAllMessagesByUUID(uuid string) ([][]any, error) {
-	dbq := dbQuery{
-		Query:                   fmt.Sprintf("SELECT chat_uuid::VARCHAR, user_id_from, message, timestamp::VARCHAR FROM chat_messages WHERE chat_uuid = %s ORDER BY timestamp ASC", singleQuote(uuid)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         false,
+func (pqh PostgresQueryHandler) AddInternalUser(ctx context.Context, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error) {
+	query := "SELECT add_internal_user($1, $2, $3, $4, $5)"
+	log.Println("Add internal user DB Request:", query)
+
+	iu := InternalUser{
+		RoleID:    roleID,
+		FirstName: firstname,
+		Surname:   surname,
+		Email:     email,
+		Password:  password,
 	}
+	err := pqh.queryRow(ctx, query, []any{roleID, firstname, surname, email, password}, &iu.ID)
+	return iu, err
+}
 
-	log.Println("Get all messages by uuid DB Request:", dbq.Query)
+func (pqh PostgresQueryHandler) GetInternalUserByID(ctx context.Context, id int64) (InternalUser, error) {
+	query := "SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE user_id = $1"
+	log.Println("Get internal user by id DB Request:", query)
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	return pqh.scanInternalUser(ctx, query, id)
+}
 
-	log.Println("Get all messages by uuid DB Response:", resp)
+func (pqh PostgresQueryHandler) UpdateInternalUserByID(ctx context.Context, id int64, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error) {
+	query := "SELECT given_user_id, updated_role_id, updated_firstname, updated_surname, updated_email, updated_password FROM update_internal_user_info($1, $2, $3, $4, $5, $6)"
+	log.Println("Update internal user by id DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	return pqh.scanInternalUser(ctx, query, id, roleID, firstname, surname, email, password)
 }
 
-func (pqh PostgresQueryHandler) GetAllChatsInProgress() ([][]any, error) {
-	dbq := dbQuery{
-		Query:                   "SELECT uuid::VARCHAR, start_time::VARCHAR FROM chat WHERE end_time is null",
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 2,
-		ExpectSingleRow:         false,
-	}
+func (pqh PostgresQueryHandler) GetInternalByEmail(ctx context.Context, email string) (InternalUser, error) {
+	query := "SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE email = $1"
+	log.Println("Get internal user by email DB Request:", query)
 
-	log.Println("Get all chats in progress DB Request:", dbq.Query)
+	return pqh.scanInternalUser(ctx, query, email)
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+func (pqh PostgresQueryHandler) scanInternalUser(ctx context.Context, query string, args ...any) (InternalUser, error) {
+	var iu InternalUser
+	err := pqh.queryRow(ctx, query, args, &iu.ID, &iu.RoleID, &iu.FirstName, &iu.Surname, &iu.Email, &iu.Password)
+	return iu, err
+}
 
-	log.Println("Get all chats in progress DB Response:", resp)
+func (pqh PostgresQueryHandler) AddMessageByUUID(ctx context.Context, uuid string, userid int64, message string, time string) error {
+	query := "INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES ($1, $2, $3, $4)"
+	log.Println("Add message by uuid DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	return pqh.execEvent(ctx, query, uuid, userid, message, time)
 }
 
-func (pqh PostgresQueryHandler) JoinChatParticipant(uuid string, userid int64, time string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("INSERT INTO chat_participant (chat_uuid, user_id, time_joined) VALUES (%s, %d, %s)",
-			singleQuote(uuid),
-			userid,
-			singleQuote(time)),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 0,
-		ExpectSingleRow:         false,
-	}
+// stores a message and links the attachments sent with it, which must have
+// been uploaded to the same chat and not sent already. ErrMissingReference is
+// returned, and nothing stored, otherwise.
+func (pqh PostgresQueryHandler) AddMessageWithAttachments(ctx context.Context, uuid string, userid int64, message string, time string, attachments []string) error {
+	query := "INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES ($1, $2, $3, $4) RETURNING id"
+	log.Println("Add message with attachments DB Request:", query)
 
-	log.Println("Join chat participant DB Request:", dbq.Query)
+	return pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if err := recordEvent(ctx, tx, pgPlaceholder); err != nil {
+			return err
+		}
+		var id int64
+		if err := tx.QueryRowContext(ctx, query, uuid, userid, message, time).Scan(&id); err != nil {
+			return err
+		}
+		for _, a := range attachments {
+			resp, err := tx.ExecContext(ctx, "UPDATE attachments SET message_id = $1 WHERE id = $2 AND chat_uuid = $3 AND message_id IS NULL", id, a, uuid)
+			if err != nil {
+				return err
+			}
+			if rows, _ := resp.RowsAffected(); rows == 0 {
+				return fmt.Errorf("%w: attachment %s", ErrMissingReference, a)
+			}
+		}
+		return nil
+	})
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// stores messages, which have no attachments, in one transaction using
+// multi-row inserts. Either all of them are stored or none are. Messages with
+// an EventID whose event has been applied already are skipped.
+func (pqh PostgresQueryHandler) AddMessages(ctx context.Context, messages []ChatMessage) error {
+	log.Println("Add messages DB Request:", len(messages))
 
-	log.Println("Join chat participant DB Response:", resp)
+	return pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		recorded, err := recordEvents(ctx, tx, messageEventIDs(messages), pgPlaceholder)
+		if err != nil {
+			return err
+		}
+		messages := unprocessedMessages(messages, recorded)
+		for start := 0; start < len(messages); start += maxInsertRows {
+			query, args := messagesInsert(messages[start:min(start+maxInsertRows, len(messages))], pgPlaceholder)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+// builds an insert of messages into chat_messages, numbering the bind
+// parameters from 1 with placeholder
+func messagesInsert(messages []ChatMessage, placeholder func(n int) string) (string, []any) {
+	var query strings.Builder
+	query.WriteString("INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES ")
+	args := make([]any, 0, len(messages)*4)
+	for i, m := range messages {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&query, "(%s, %s, %s, %s)", placeholder(n+1), placeholder(n+2), placeholder(n+3), placeholder(n+4))
+		args = append(args, m.ChatUUID, m.UserID, m.Message, m.Time)
 	}
-	return resp, nil
+	return query.String(), args
 }
 
-func (pqh PostgresQueryHandler) LeaveChatParticipant(uuid string, userid int64, time string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf("UPDATE chat_participant SET time_left = %s WHERE chat_uuid = %s AND user_id = %d",
-			singleQuote(time),
-			singleQuote(uuid),
-			userid),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 0,
-		ExpectSingleRow:         false,
-	}
+func (pqh PostgresQueryHandler) GetAllMessagesByUUID(ctx context.Context, uuid string) ([]ChatMessage, error) {
+	query := "SELECT chat_uuid::VARCHAR, user_id_from, message, timestamp::VARCHAR FROM chat_messages WHERE chat_uuid = $1 ORDER BY timestamp ASC"
+	log.Println("Get all messages by uuid DB Request:", query)
 
-	log.Println("Leave chat participant DB Request:", dbq.Query)
+	messages := []ChatMessage{}
+	err := pqh.query(ctx, query, []any{uuid}, func(rows *sql.Rows) error {
+		var cm ChatMessage
+		var ts sql.NullString
+		if err := rows.Scan(&cm.ChatUUID, &cm.UserID, &cm.Message, &ts); err != nil {
+			return err
+		}
+		cm.Time = ts.String
+		messages = append(messages, cm)
+		return nil
+	})
+	return messages, err
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+func (pqh PostgresQueryHandler) GetAllChatsInProgress(ctx context.Context) ([]Chat, error) {
+	query := "SELECT uuid::VARCHAR, start_time::VARCHAR FROM chat WHERE end_time is null"
+	log.Println("Get all chats in progress DB Request:", query)
 
-	log.Println("Leave chat participant DB Response:", resp)
+	chats := []Chat{}
+	err := pqh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var c Chat
+		if err := rows.Scan(&c.UUID, &c.StartTime); err != nil {
+			return err
+		}
+		chats = append(chats, c)
+		return nil
+	})
+	return chats, err
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+func (pqh PostgresQueryHandler) JoinChatParticipant(ctx context.Context, uuid string, userid int64, time string) error {
+	query := "INSERT INTO chat_participant (chat_uuid, user_id, time_joined) VALUES ($1, $2, $3)"
+	log.Println("Join chat participant DB Request:", query)
+
+	return pqh.execEvent(ctx, query, uuid, userid, time)
 }
 
-func (pqh PostgresQueryHandler) GetOngoingChatParticipants() ([][]any, error) {
-	dbq := dbQuery{
-		Query: `SELECT c.uuid::VARCHAR,
+func (pqh PostgresQueryHandler) LeaveChatParticipant(ctx context.Context, uuid string, userid int64, time string) error {
+	query := "UPDATE chat_participant SET time_left = $1 WHERE chat_uuid = $2 AND user_id = $3"
+	log.Println("Leave chat participant DB Request:", query)
+
+	return pqh.execEvent(ctx, query, time, uuid, userid)
+}
+
+// returns the participants of every chat which has not ended. Chats without
+// any participants are left out.
+func (pqh PostgresQueryHandler) GetOngoingChatParticipants(ctx context.Context) ([]ChatParticipant, error) {
+	query := `SELECT c.uuid::VARCHAR,
 				p.user_id,
 				CASE WHEN p.time_left IS NULL THEN TRUE ELSE FALSE END AS active,
 				u.internal,
@@ -632,31 +725,31 @@ func (pqh PostgresQueryHandler) GetOngoingChatParticipants() ([][]any, error) {
 			LEFT JOIN users u ON p.user_id = u.id
 			LEFT JOIN internal_users iu ON u.id = iu.user_id
 			LEFT JOIN external_users eu ON u.id = eu.user_id
-			ORDER BY uuid`,
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 5,
-		ExpectSingleRow:         false,
-	}
-
-	log.Println("Get ongoing chat participants DB Request:", dbq.Query)
-
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
-
-	log.Println("Get ongoing chat participants DB Response:", resp)
-
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+			ORDER BY uuid`
+	log.Println("Get ongoing chat participants DB Request:", query)
+
+	participants := []ChatParticipant{}
+	err := pqh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var cp ChatParticipant
+		var userID sql.NullInt64
+		var internal sql.NullBool
+		var name sql.NullString
+		if err := rows.Scan(&cp.ChatUUID, &userID, &cp.Active, &internal, &name); err != nil {
+			return err
+		}
+		if !userID.Valid {
+			return nil
+		}
+		cp.UserID, cp.Internal, cp.Name = userID.Int64, internal.Bool, name.String
+		participants = append(participants, cp)
+		return nil
+	})
+	return participants, err
 }
 
-func (pqh PostgresQueryHandler) GetOngoingChatMessages() ([][]any, error) {
-	dbq := dbQuery{
-		Query: `SELECT c.uuid::VARCHAR,
+// returns the messages of every chat which has not ended, oldest first
+func (pqh PostgresQueryHandler) GetOngoingChatMessages(ctx context.Context) ([]ChatMessage, error) {
+	query := `SELECT c.uuid::VARCHAR,
 				m.user_id_from,		
 				m.message,		
 				m.timestamp::VARCHAR as message_time
@@ -667,112 +760,422 @@ func (pqh PostgresQueryHandler) GetOngoingChatMessages() ([][]any, error) {
 				WHERE end_time IS null
 				) active_chats ON c.uuid = active_chats.uuid
 			LEFT JOIN chat_messages m ON c.uuid = m.chat_uuid
-			ORDER BY uuid, message_time asc`,
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         false,
-	}
+			ORDER BY uuid, message_time asc`
+	log.Println("Get ongoing chat messages DB Request:", query)
+
+	messages := []ChatMessage{}
+	err := pqh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var cm ChatMessage
+		var userID sql.NullInt64
+		var message, ts sql.NullString
+		if err := rows.Scan(&cm.ChatUUID, &userID, &message, &ts); err != nil {
+			return err
+		}
+		if !message.Valid {
+			return nil
+		}
+		cm.UserID, cm.Message, cm.Time = userID.Int64, message.String, ts.String
+		messages = append(messages, cm)
+		return nil
+	})
+	return messages, err
+}
+
+// gives the user id, created at time and internal or external bool
+func (pqh PostgresQueryHandler) GetUserInfoByID(ctx context.Context, id int64) (UserInfo, error) {
+	query := `SELECT u.id,
+					u.created_at::VARCHAR,
+					u.internal,
+					COALESCE(iu.firstname || ' ' || iu.surname, eu.name) AS name
+				FROM users u 
+					LEFT JOIN internal_users iu ON u.id = iu.user_id
+					LEFT JOIN external_users eu ON u.id = eu.user_id
+				WHERE u.id = $1`
+	log.Println("Get user info by id DB Request:", query)
+
+	var ui UserInfo
+	var name sql.NullString
+	if err := pqh.queryRow(ctx, query, []any{id}, &ui.ID, &ui.CreatedAt, &ui.Internal, &name); err != nil {
+		return ui, err
+	}
+	ui.Name = name.String
+	return ui, nil
+}
 
-	log.Println("Get ongoing chat messages DB Request:", dbq.Query)
+func (pqh PostgresQueryHandler) CreateSession(ctx context.Context, session Session) error {
+	query := "INSERT INTO sessions (id, user_id, refresh_id, expires_at) VALUES ($1, $2, $3, $4)"
+	log.Println("Create session DB Request:", query)
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+	return pqh.exec(ctx, query, session.ID, session.UserID, session.RefreshID, session.ExpiresAt)
+}
 
-	log.Println("Get ongoing chat messages DB Response:", resp)
+func (pqh PostgresQueryHandler) GetSession(ctx context.Context, id string) (Session, error) {
+	query := "SELECT id, user_id, refresh_id, expires_at, revoked FROM sessions WHERE id = $1"
+	log.Println("Get session DB Request:", query)
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
-	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
-	}
-	return resp, nil
+	var s Session
+	err := pqh.queryRow(ctx, query, []any{id}, &s.ID, &s.UserID, &s.RefreshID, &s.ExpiresAt, &s.Revoked)
+	return s, err
 }
 
-// gives the user id, created at time and internal or external bool
-func (pqh PostgresQueryHandler) GetUserInfoByID(id int64) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf(`SELECT u.id,
-						u.created_at::VARCHAR,
-						u.internal,
-						COALESCE(iu.firstname || ' ' || iu.surname, eu.name) AS name
-					FROM users u 
-						LEFT JOIN internal_users iu ON u.id = iu.user_id
-						LEFT JOIN external_users eu ON u.id = eu.user_id
-					WHERE u.id = %d`, id),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 4,
-		ExpectSingleRow:         true,
-	}
+// swaps the refresh id, only if oldRefreshID is still the current one and the
+// session has not been revoked. ErrNoRowsChanged is returned otherwise.
+func (pqh PostgresQueryHandler) RotateSessionRefresh(ctx context.Context, id string, oldRefreshID string, newRefreshID string) error {
+	query := "UPDATE sessions SET refresh_id = $1 WHERE id = $2 AND refresh_id = $3 AND NOT revoked"
+	log.Println("Rotate session refresh DB Request:", query)
 
-	log.Println("Get user info by id DB Request:", dbq.Query)
+	return pqh.exec(ctx, query, newRefreshID, id, oldRefreshID)
+}
+
+func (pqh PostgresQueryHandler) RevokeSession(ctx context.Context, id string) error {
+	query := "UPDATE sessions SET revoked = TRUE WHERE id = $1"
+	log.Println("Revoke session DB Request:", query)
+
+	return pqh.exec(ctx, query, id)
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// returns the permissions held through the role of an internal user
+func (pqh PostgresQueryHandler) GetUserPermissions(ctx context.Context, userID int64) ([]string, error) {
+	query := `SELECT rp.permission
+			FROM internal_users iu
+			INNER JOIN role_permissions rp ON iu.role_id = rp.role_id
+			WHERE iu.user_id = $1
+			ORDER BY rp.permission`
+	log.Println("Get user permissions DB Request:", query)
+
+	permissions := []string{}
+	err := pqh.query(ctx, query, []any{userID}, func(rows *sql.Rows) error {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return err
+		}
+		permissions = append(permissions, p)
+		return nil
+	})
+	return permissions, err
+}
 
-	log.Println("Get user info by id DB Response:", resp)
+func (pqh PostgresQueryHandler) GetRoles(ctx context.Context) ([]Role, error) {
+	query := `SELECT r.id, r.description, rp.permission
+			FROM user_roles r
+			LEFT JOIN role_permissions rp ON r.id = rp.role_id
+			ORDER BY r.id, rp.permission`
+	log.Println("Get roles DB Request:", query)
+
+	roles := []Role{}
+	err := pqh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		return scanRoles(rows, &roles)
+	})
+	return roles, err
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+func (pqh PostgresQueryHandler) GetRole(ctx context.Context, id int64) (Role, error) {
+	query := `SELECT r.id, r.description, rp.permission
+			FROM user_roles r
+			LEFT JOIN role_permissions rp ON r.id = rp.role_id
+			WHERE r.id = $1
+			ORDER BY rp.permission`
+	log.Println("Get role DB Request:", query)
+
+	roles := []Role{}
+	err := pqh.query(ctx, query, []any{id}, func(rows *sql.Rows) error {
+		return scanRoles(rows, &roles)
+	})
+	if err != nil {
+		return Role{}, err
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	if len(roles) == 0 {
+		return Role{}, ErrNotFound
 	}
-	return resp, nil
+	return roles[0], nil
 }
 
-func (pqh PostgresQueryHandler) GetInternalByEmail(email string) ([][]any, error) {
-	dbq := dbQuery{
-		Query: fmt.Sprintf(`SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE email = %s`,
-			singleQuote(doubleUpSingleQuotes(email))),
-		ReturnChan:              make(chan [][]interface{}),
-		NumberOfColumnsExpected: 6,
-		ExpectSingleRow:         true,
-	}
+func (pqh PostgresQueryHandler) AddRole(ctx context.Context, description string, permissions []string) (Role, error) {
+	log.Println("Add role DB Request:", description)
 
-	log.Println("Get internal user by email DB Request:", dbq.Query)
+	role := Role{Description: description, Permissions: permissions}
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "INSERT INTO user_roles (description) VALUES ($1) RETURNING id", description).Scan(&role.ID)
+		if err != nil {
+			return err
+		}
+		return pqh.setRolePermissions(ctx, tx, role.ID, permissions)
+	})
+	return role, err
+}
 
-	pqh.RequestChan <- dbq
-	resp, ok := <-dbq.ReturnChan
+// updates the description, unless it is empty, and replaces the permissions,
+// unless they are nil
+func (pqh PostgresQueryHandler) UpdateRole(ctx context.Context, id int64, description string, permissions []string) (Role, error) {
+	log.Println("Update role DB Request:", id)
 
-	log.Println("Get internal user by email Response:", resp)
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		resp, err := tx.ExecContext(ctx, "UPDATE user_roles SET description = COALESCE(NULLIF($1, ''), description) WHERE id = $2", description, id)
+		if err != nil {
+			return err
+		}
+		if rows, _ := resp.RowsAffected(); rows == 0 {
+			return ErrNotFound
+		}
+		if permissions == nil {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = $1", id); err != nil {
+			return err
+		}
+		return pqh.setRolePermissions(ctx, tx, id, permissions)
+	})
+	if err != nil {
+		return Role{}, err
+	}
+	return pqh.GetRole(ctx, id)
+}
 
-	if !ok {
-		return resp, errors.New("channel closed, no data")
+func (pqh PostgresQueryHandler) setRolePermissions(ctx context.Context, tx *sql.Tx, id int64, permissions []string) error {
+	for _, p := range permissions {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO role_permissions (role_id, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, p); err != nil {
+			return err
+		}
 	}
-	if err := checkSqlResponseForErrors(resp, dbq.ExpectSingleRow); err != nil {
-		return resp, err
+	return nil
+}
+
+// deletes a role and its permissions. Roles still held by a user cannot be
+// deleted, ErrMissingReference is returned for those.
+func (pqh PostgresQueryHandler) DeleteRole(ctx context.Context, id int64) error {
+	query := "DELETE FROM user_roles WHERE id = $1"
+	log.Println("Delete role DB Request:", query)
+
+	err := pqh.exec(ctx, query, id)
+	if errors.Is(err, ErrNoRowsChanged) {
+		return ErrNotFound
 	}
-	return resp, nil
+	return err
 }
 
-// adds single quotes around any string
-func singleQuote(s string) string {
-	return "'" + s + "'"
+func (pqh PostgresQueryHandler) AddAttachment(ctx context.Context, a Attachment) error {
+	query := "INSERT INTO attachments (id, chat_uuid, user_id, name, content_type, size, storage_key) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	log.Println("Add attachment DB Request:", query)
+
+	return pqh.exec(ctx, query, a.ID, a.ChatUUID, a.UserID, a.Name, a.ContentType, a.Size, a.StorageKey)
+}
+
+func (pqh PostgresQueryHandler) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	query := "SELECT id::VARCHAR, chat_uuid::VARCHAR, user_id, message_id, name, content_type, size, storage_key, created_at::VARCHAR FROM attachments WHERE id = $1"
+	log.Println("Get attachment DB Request:", query)
+
+	var a Attachment
+	var messageID sql.NullInt64
+	err := pqh.queryRow(ctx, query, []any{id}, &a.ID, &a.ChatUUID, &a.UserID, &messageID, &a.Name, &a.ContentType, &a.Size, &a.StorageKey, &a.CreatedAt)
+	a.MessageID = messageID.Int64
+	return a, err
 }
 
-// returns doubled up single quotes. e.g Lay's -> Lay”s. Need to escape for storing in database
-func doubleUpSingleQuotes(str string) string {
-	var modified string
-	for _, char := range str {
-		switch char {
-		case '\'':
-			modified += "''"
-		default:
-			modified += string(char)
+// takes a lock on room until the transaction ends, so membership changes to
+// it are serialised across every api replica
+func lockRoom(ctx context.Context, tx *sql.Tx, room string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", room)
+	return err
+}
+
+// records member joining room through a chat instance, reporting whether they
+// are the only member, meaning the chat has just started. Rejoining a room in
+// its grace period resumes the chat instead.
+func (pqh PostgresQueryHandler) JoinRoom(ctx context.Context, room string, member string, instance string) (bool, error) {
+	log.Println("Join room DB Request:", room, member)
+
+	var members int
+	var resumed int64
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if err := lockRoom(ctx, tx, room); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO room_members (room_id, member_id, instance_id) VALUES ($1, $2, $3)", room, member, instance); err != nil {
+			return err
 		}
+		resp, err := tx.ExecContext(ctx, "DELETE FROM room_grace WHERE room_id = $1", room)
+		if err != nil {
+			return err
+		}
+		resumed, _ = resp.RowsAffected()
+		return tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_members WHERE room_id = $1", room).Scan(&members)
+	})
+	return members == 1 && resumed == 0, err
+}
+
+// removes member from room, reporting whether they were the last one, meaning
+// the chat has ended. With a grace period the last member leaving only starts
+// it, the chat ends when ExpireRooms finds nobody rejoined in time.
+func (pqh PostgresQueryHandler) LeaveRoom(ctx context.Context, room string, member string, grace time.Duration) (bool, error) {
+	log.Println("Leave room DB Request:", room, member)
+
+	var members int
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if err := lockRoom(ctx, tx, room); err != nil {
+			return err
+		}
+		if err := pqh.removeRoomMembers(ctx, tx, "DELETE FROM room_members WHERE room_id = $1 AND member_id = $2", room, member, &members); err != nil {
+			return err
+		}
+		if members > 0 || grace <= 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO room_grace (room_id, ends_at) VALUES ($1, $2) ON CONFLICT (room_id) DO UPDATE SET ends_at = excluded.ends_at", room, time.Now().Add(grace).Unix())
+		return err
+	})
+	return err == nil && members == 0 && grace <= 0, err
+}
+
+// removes every member connected through instance, returning the rooms left
+// empty. Chat instances call this on startup to tidy up after a crash.
+func (pqh PostgresQueryHandler) ClearInstanceRooms(ctx context.Context, instance string) ([]string, error) {
+	log.Println("Clear instance rooms DB Request:", instance)
+
+	ended := []string{}
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		rooms, err := pqh.clearInstance(ctx, tx, instance)
+		ended = append(ended, rooms...)
+		return err
+	})
+	return ended, err
+}
+
+// records that instance is still running, for ttl from now
+func (pqh PostgresQueryHandler) RenewInstance(ctx context.Context, instance string, ttl time.Duration) error {
+	query := "INSERT INTO instance_leases (instance_id, expires_at) VALUES ($1, $2) ON CONFLICT (instance_id) DO UPDATE SET expires_at = excluded.expires_at"
+	log.Println("Renew instance DB Request:", query)
+
+	return pqh.exec(ctx, query, instance, time.Now().Add(ttl).Unix())
+}
+
+// removes the members of every instance whose lease ran out by now, as one
+// that crashed will never clear them itself, returning the rooms left empty.
+// Each instance is cleared in its own transaction and only once, whichever
+// chat instance asks. On an error the rooms already ended are still returned.
+func (pqh PostgresQueryHandler) ExpireInstances(ctx context.Context, now time.Time) ([]string, error) {
+	log.Println("Expire instances DB Request:", now.Unix())
+
+	var instances []string
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		instances, err = queryRooms(ctx, tx, "SELECT instance_id FROM instance_leases WHERE expires_at <= $1 ORDER BY instance_id", now.Unix())
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return modified
+	ended := []string{}
+	for _, instance := range instances {
+		err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+			resp, err := tx.ExecContext(ctx, "DELETE FROM instance_leases WHERE instance_id = $1 AND expires_at <= $2", instance, now.Unix())
+			if err != nil {
+				return err
+			}
+			//renewed since, or cleared by another api replica
+			if rows, _ := resp.RowsAffected(); rows == 0 {
+				return nil
+			}
+			rooms, err := pqh.clearInstance(ctx, tx, instance)
+			if err == nil {
+				ended = append(ended, rooms...)
+			}
+			return err
+		})
+		if err != nil {
+			return ended, err
+		}
+	}
+	return ended, nil
 }
 
-func checkSqlResponseForErrors(sqlResponse [][]any, expectSingleRow bool) error {
-	if expectSingleRow {
-		if len(sqlResponse) != 1 { //only expecting a single response
-			return errors.New("db returned a result which is not correct, please review logs")
+// removes every member connected through instance, returning the rooms left empty
+func (pqh PostgresQueryHandler) clearInstance(ctx context.Context, tx *sql.Tx, instance string) ([]string, error) {
+	rooms, err := queryRooms(ctx, tx, "SELECT DISTINCT room_id FROM room_members WHERE instance_id = $1 ORDER BY room_id", instance)
+	if err != nil {
+		return nil, err
+	}
+	var ended []string
+	for _, room := range rooms {
+		if err := lockRoom(ctx, tx, room); err != nil {
+			return nil, err
+		}
+		var members int
+		if err := pqh.removeRoomMembers(ctx, tx, "DELETE FROM room_members WHERE room_id = $1 AND instance_id = $2", room, instance, &members); err != nil {
+			return nil, err
+		}
+		if members == 0 {
+			ended = append(ended, room)
 		}
 	}
-	if err, ok := sqlResponse[0][0].(error); ok {
+	return ended, nil
+}
+
+// ends the rooms whose grace period is over at now, returning them. Each room
+// is only returned once, whichever chat instance asks.
+func (pqh PostgresQueryHandler) ExpireRooms(ctx context.Context, now time.Time) ([]string, error) {
+	log.Println("Expire rooms DB Request:", now.Unix())
+
+	ended := []string{}
+	err := pqh.inTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		rooms, err := queryRooms(ctx, tx, "DELETE FROM room_grace WHERE ends_at <= $1 RETURNING room_id", now.Unix())
+		ended = append(ended, rooms...)
+		return err
+	})
+	return ended, err
+}
+
+// reports whether room has members, or is in its grace period, so can still
+// be joined. Members only count while their instance's lease lasts, so a room
+// whose instance has gone is not resumed.
+func (pqh PostgresQueryHandler) RoomActive(ctx context.Context, room string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM room_members m JOIN instance_leases l ON l.instance_id = m.instance_id WHERE m.room_id = $1 AND l.expires_at > $2) OR EXISTS (SELECT 1 FROM room_grace WHERE room_id = $1)"
+	log.Println("Room active DB Request:", query)
+
+	var active bool
+	err := pqh.queryRow(ctx, query, []any{room, time.Now().Unix()}, &active)
+	return active, err
+}
+
+// reports whether the chat has ended, ErrNotFound if it was never started
+func (pqh PostgresQueryHandler) ChatEnded(ctx context.Context, uuid string) (bool, error) {
+	query := "SELECT end_time IS NOT NULL FROM chat WHERE uuid = $1"
+	log.Println("Chat ended DB Request:", query)
+
+	var ended bool
+	err := pqh.queryRow(ctx, query, []any{uuid}, &ended)
+	return ended, err
+}
+
+// runs a delete of members from room and counts who is left
+func (pqh PostgresQueryHandler) removeRoomMembers(ctx context.Context, tx *sql.Tx, query string, room string, arg string, members *int) error {
+	resp, err := tx.ExecContext(ctx, query, room, arg)
+	if err != nil {
 		return err
 	}
-	return nil
+	if rows, _ := resp.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_members WHERE room_id = $1", room).Scan(members)
+}
+
+// lists the rooms returned by query. Rooms holding members of an instance are
+// listed in order, so rooms are always locked in the same order.
+func queryRooms(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}, query string, arg any) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
 }
@@ -0,0 +1,85 @@
+package dbquery
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simulated network round trip to the database for each statement
+const benchLatency = time.Millisecond
+
+var benchCallers = []int{1, 4, 16, 64}
+
+// runs b.N calls of fn spread across the given number of concurrent callers
+// and reports the achieved throughput.
+func runConcurrent(b *testing.B, callers int, fn func() error) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var wg sync.WaitGroup
+	work := make(chan struct{}, b.N)
+	for i := 0; i < b.N; i++ {
+		work <- struct{}{}
+	}
+	close(work)
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				if err := fn(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "queries/s")
+}
+
+func BenchmarkGetOngoingChatMessages(b *testing.B) {
+	for _, callers := range benchCallers {
+		b.Run(fmt.Sprintf("callers=%d", callers), func(b *testing.B) {
+			d := newRecordingDriver(
+				[]driver.Value{"d935fb72-796d-4418-8a36-bc228d143790", int64(1), "hello", "2024-02-20 15:50:20.123456"},
+				[]driver.Value{"d935fb72-796d-4418-8a36-bc228d143790", int64(2), "hi", "2024-02-20 15:50:21.123456"},
+			)
+			d.latency = benchLatency
+			h, err := d.handlerWithConfig(PostgresDBConfig{MaxOpenConns: 64, MaxIdleConns: 64})
+			if err != nil {
+				b.Fatal(err)
+			}
+			runConcurrent(b, callers, func() error {
+				_, err := h.GetOngoingChatMessages(context.Background())
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkAddMessageByUUID(b *testing.B) {
+	for _, callers := range benchCallers {
+		b.Run(fmt.Sprintf("callers=%d", callers), func(b *testing.B) {
+			d := newRecordingDriver()
+			d.latency = benchLatency
+			h, err := d.handlerWithConfig(PostgresDBConfig{MaxOpenConns: 64, MaxIdleConns: 64})
+			if err != nil {
+				b.Fatal(err)
+			}
+			runConcurrent(b, callers, func() error {
+				return h.AddMessageByUUID(context.Background(), "d935fb72-796d-4418-8a36-bc228d143790", 1, "hello", "2024-02-20 15:50:20.123456")
+			})
+		})
+	}
+}
@@ -1,8 +1,10 @@
-package dbquery
+package dbquery_test
 
 import (
+	"context"
 	"testing"
 
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
 	"github.com/Ryan-Har/chat-app/src/api/mocks"
 	"github.com/golang/mock/gomock"
 )
@@ -15,9 +17,9 @@ func TestAddExternalUser(t *testing.T) {
 
 	exampleName := "John Doe"
 	exampleIP := "192.168.1.1"
-	mockDBQuery.EXPECT().AddExternalUser(exampleName, exampleIP).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().AddExternalUser(gomock.Any(), exampleName, exampleIP).Return(dbquery.ExternalUser{}, nil)
 
-	_, err := mockDBQuery.AddExternalUser(exampleName, exampleIP)
+	_, err := mockDBQuery.AddExternalUser(context.Background(), exampleName, exampleIP)
 
 	if err != nil {
 		t.Errorf("Unexpected error during AddExternalUser: %v", err)
@@ -32,9 +34,9 @@ func TestGetExternalUser(t *testing.T) {
 
 	exampleName := "John Doe"
 	exampleIP := "192.168.1.1"
-	mockDBQuery.EXPECT().GetExternalUser(exampleName, exampleIP).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().GetExternalUser(gomock.Any(), exampleName, exampleIP).Return(dbquery.ExternalUser{}, nil)
 
-	_, err := mockDBQuery.GetExternalUser(exampleName, exampleIP)
+	_, err := mockDBQuery.GetExternalUser(context.Background(), exampleName, exampleIP)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetExternalUser: %v", err)
@@ -48,9 +50,9 @@ func TestGetExternalUserByID(t *testing.T) {
 	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
 
 	var exampleid int64 = 52
-	mockDBQuery.EXPECT().GetExternalUserByID(exampleid).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().GetExternalUserByID(gomock.Any(), exampleid).Return(dbquery.ExternalUser{}, nil)
 
-	_, err := mockDBQuery.GetExternalUserByID(exampleid)
+	_, err := mockDBQuery.GetExternalUserByID(context.Background(), exampleid)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetExternalUserByID: %v", err)
@@ -65,9 +67,9 @@ func TestChatStart(t *testing.T) {
 
 	exampleUuid := "d935fb72-796d-4418-8a36-bc228d143790"
 	exampleTime := "2024-02-20 15:50:20.123456"
-	mockDBQuery.EXPECT().ChatStart(exampleUuid, exampleTime).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().ChatStart(gomock.Any(), exampleUuid, exampleTime).Return(nil)
 
-	_, err := mockDBQuery.ChatStart(exampleUuid, exampleTime)
+	err := mockDBQuery.ChatStart(context.Background(), exampleUuid, exampleTime)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetExternalUserByID: %v", err)
@@ -82,9 +84,9 @@ func TestChatEnd(t *testing.T) {
 
 	exampleUuid := "d935fb72-796d-4418-8a36-bc228d143790"
 	exampleTime := "2024-02-20 15:50:20.123456"
-	mockDBQuery.EXPECT().ChatEnd(exampleUuid, exampleTime).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().ChatEnd(gomock.Any(), exampleUuid, exampleTime).Return(nil)
 
-	_, err := mockDBQuery.ChatEnd(exampleUuid, exampleTime)
+	err := mockDBQuery.ChatEnd(context.Background(), exampleUuid, exampleTime)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetExternalUserByID: %v", err)
@@ -99,9 +101,9 @@ func TestAddInternalUser(t *testing.T) {
 
 	var exampleid int64 = 1
 	exampleString := "John"
-	mockDBQuery.EXPECT().AddInternalUser(exampleid, exampleString, exampleString, exampleString, exampleString).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().AddInternalUser(gomock.Any(), exampleid, exampleString, exampleString, exampleString, exampleString).Return(dbquery.InternalUser{}, nil)
 
-	_, err := mockDBQuery.AddInternalUser(exampleid, exampleString, exampleString, exampleString, exampleString)
+	_, err := mockDBQuery.AddInternalUser(context.Background(), exampleid, exampleString, exampleString, exampleString, exampleString)
 
 	if err != nil {
 		t.Errorf("Unexpected error during AddInternalUser: %v", err)
@@ -115,9 +117,9 @@ func TestGetInternalUserByID(t *testing.T) {
 	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
 
 	var exampleid int64 = 52
-	mockDBQuery.EXPECT().GetInternalUserByID(exampleid).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().GetInternalUserByID(gomock.Any(), exampleid).Return(dbquery.InternalUser{}, nil)
 
-	_, err := mockDBQuery.GetInternalUserByID(exampleid)
+	_, err := mockDBQuery.GetInternalUserByID(context.Background(), exampleid)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetInternalUserByID: %v", err)
@@ -132,9 +134,9 @@ func TestUpdateInternalUserByID(t *testing.T) {
 
 	var exampleid int64 = 1
 	exampleString := "John"
-	mockDBQuery.EXPECT().UpdateInternalUserByID(exampleid, exampleid, exampleString, exampleString, exampleString, exampleString).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().UpdateInternalUserByID(gomock.Any(), exampleid, exampleid, exampleString, exampleString, exampleString, exampleString).Return(dbquery.InternalUser{}, nil)
 
-	_, err := mockDBQuery.UpdateInternalUserByID(exampleid, exampleid, exampleString, exampleString, exampleString, exampleString)
+	_, err := mockDBQuery.UpdateInternalUserByID(context.Background(), exampleid, exampleid, exampleString, exampleString, exampleString, exampleString)
 
 	if err != nil {
 		t.Errorf("Unexpected error during UpdateInternalUserByID: %v", err)
@@ -151,9 +153,9 @@ func TestAddMessageByUUID(t *testing.T) {
 	exampleUuid := "d935fb72-796d-4418-8a36-bc228d143790"
 	exampleTime := "2024-02-20 15:50:20.123456"
 	exampleString := "John"
-	mockDBQuery.EXPECT().AddMessageByUUID(exampleUuid, exampleid, exampleString, exampleTime).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().AddMessageByUUID(gomock.Any(), exampleUuid, exampleid, exampleString, exampleTime).Return(nil)
 
-	_, err := mockDBQuery.AddMessageByUUID(exampleUuid, exampleid, exampleString, exampleTime)
+	err := mockDBQuery.AddMessageByUUID(context.Background(), exampleUuid, exampleid, exampleString, exampleTime)
 
 	if err != nil {
 		t.Errorf("Unexpected error during AddMessageByUUID: %v", err)
@@ -168,9 +170,9 @@ func TestGetAllMessagesByUUID(t *testing.T) {
 	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
 
 	exampleUuid := "d935fb72-796d-4418-8a36-bc228d143790"
-	mockDBQuery.EXPECT().GetAllMessagesByUUID(exampleUuid).Return([][]any{}, nil)
+	mockDBQuery.EXPECT().GetAllMessagesByUUID(gomock.Any(), exampleUuid).Return([]dbquery.ChatMessage{}, nil)
 
-	_, err := mockDBQuery.GetAllMessagesByUUID(exampleUuid)
+	_, err := mockDBQuery.GetAllMessagesByUUID(context.Background(), exampleUuid)
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetAllMessagesByUUID: %v", err)
@@ -183,9 +185,9 @@ func TestGetAllChatsInProgress(t *testing.T) {
 
 	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
 
-	mockDBQuery.EXPECT().GetAllChatsInProgress().Return([][]any{}, nil)
+	mockDBQuery.EXPECT().GetAllChatsInProgress(gomock.Any()).Return([]dbquery.Chat{}, nil)
 
-	_, err := mockDBQuery.GetAllChatsInProgress()
+	_, err := mockDBQuery.GetAllChatsInProgress(context.Background())
 
 	if err != nil {
 		t.Errorf("Unexpected error during GetAllChatsInProgress: %v", err)
@@ -0,0 +1,121 @@
+package dbquery
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// recordingDriver is a minimal database/sql driver which records every statement
+// and its arguments, and answers queries with a fixed result set.
+type recordingDriver struct {
+	mu       sync.Mutex
+	executed []recordedStatement
+	result   [][]driver.Value
+	latency  time.Duration //simulated round trip for every statement
+}
+
+type recordedStatement struct {
+	Query string
+	Args  []any
+}
+
+func newRecordingDriver(result ...[]driver.Value) *recordingDriver {
+	return &recordingDriver{result: result}
+}
+
+func (d *recordingDriver) handler() (DBQueryHandler, error) {
+	return d.handlerWithConfig(PostgresDBConfig{})
+}
+
+func (d *recordingDriver) handlerWithConfig(dbc PostgresDBConfig) (DBQueryHandler, error) {
+	db := sql.OpenDB(d)
+	configurePool(db, dbc)
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return newPostgresHandler(db, dbc.QueryTimeout), nil
+}
+
+func (d *recordingDriver) last() recordedStatement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.executed) == 0 {
+		return recordedStatement{}
+	}
+	return d.executed[len(d.executed)-1]
+}
+
+func (d *recordingDriver) record(query string, args []driver.NamedValue) {
+	time.Sleep(d.latency)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rs := recordedStatement{Query: query}
+	for _, a := range args {
+		rs.Args = append(rs.Args, a.Value)
+	}
+	d.executed = append(d.executed, rs)
+}
+
+func (d *recordingDriver) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{d}, nil
+}
+func (d *recordingDriver) Driver() driver.Driver            { return d }
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+func (c *recordingConn) Close() error { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+func (c *recordingConn) Ping(context.Context) error {
+	return nil
+}
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(query, args)
+	return &recordingRows{rows: c.d.result}, nil
+}
+
+type recordingRows struct {
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *recordingRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("col%d", i)
+	}
+	return cols
+}
+
+func (r *recordingRows) Close() error { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
@@ -0,0 +1,138 @@
+package dbquery
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+var hostileInputs = []string{
+	"Robert'); DROP TABLE users;--",
+	"O'Brien",
+	"1.2.3.4' OR '1'='1",
+	"d935fb72-796d-4418-8a36-bc228d143790'; DELETE FROM chat;--",
+	`\'; SELECT pg_sleep(10);--`,
+}
+
+func TestHostileInputIsPassedAsArguments(t *testing.T) {
+	for _, hostile := range hostileInputs {
+		cases := []struct {
+			name     string
+			result   [][]driver.Value
+			call     func(DBQueryHandler) error
+			wantArgs []any
+		}{
+			{
+				name:   "AddExternalUser",
+				result: [][]driver.Value{{int64(7)}},
+				call: func(h DBQueryHandler) error {
+					_, err := h.AddExternalUser(context.Background(), hostile, hostile)
+					return err
+				},
+				wantArgs: []any{hostile, hostile},
+			},
+			{
+				name:   "GetExternalUser",
+				result: [][]driver.Value{{int64(7), hostile, hostile, nil}},
+				call: func(h DBQueryHandler) error {
+					_, err := h.GetExternalUser(context.Background(), hostile, hostile)
+					return err
+				},
+				wantArgs: []any{hostile, hostile},
+			},
+			{
+				name: "ChatStart",
+				call: func(h DBQueryHandler) error {
+					return h.ChatStart(context.Background(), hostile, "2024-02-20 15:50:20.123456")
+				},
+				wantArgs: []any{hostile, "2024-02-20 15:50:20.123456"},
+			},
+			{
+				name: "JoinChatParticipant",
+				call: func(h DBQueryHandler) error {
+					return h.JoinChatParticipant(context.Background(), hostile, 3, "2024-02-20 15:50:20.123456")
+				},
+				wantArgs: []any{hostile, int64(3), "2024-02-20 15:50:20.123456"},
+			},
+			{
+				name: "AddMessageByUUID",
+				call: func(h DBQueryHandler) error {
+					return h.AddMessageByUUID(context.Background(), hostile, 3, hostile, "2024-02-20 15:50:20.123456")
+				},
+				wantArgs: []any{hostile, int64(3), hostile, "2024-02-20 15:50:20.123456"},
+			},
+			{
+				name:   "GetAllMessagesByUUID",
+				result: [][]driver.Value{{hostile, int64(3), "hello", "2024-02-20 15:50:20.123456"}},
+				call: func(h DBQueryHandler) error {
+					_, err := h.GetAllMessagesByUUID(context.Background(), hostile)
+					return err
+				},
+				wantArgs: []any{hostile},
+			},
+			{
+				name:   "UpdateInternalUserByID",
+				result: [][]driver.Value{{int64(1), int64(1), hostile, hostile, hostile, hostile}},
+				call: func(h DBQueryHandler) error {
+					_, err := h.UpdateInternalUserByID(context.Background(), 1, 1, hostile, hostile, hostile, hostile)
+					return err
+				},
+				wantArgs: []any{int64(1), int64(1), hostile, hostile, hostile, hostile},
+			},
+			{
+				name:   "GetInternalByEmail",
+				result: [][]driver.Value{{int64(1), int64(1), "a", "b", hostile, "c"}},
+				call: func(h DBQueryHandler) error {
+					_, err := h.GetInternalByEmail(context.Background(), hostile)
+					return err
+				},
+				wantArgs: []any{hostile},
+			},
+		}
+
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				d := newRecordingDriver(tc.result...)
+				h, err := d.handler()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := tc.call(h); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				got := d.last()
+				if strings.Contains(got.Query, hostile) {
+					t.Errorf("input was interpolated into the query: %s", got.Query)
+				}
+				if !reflect.DeepEqual(got.Args, tc.wantArgs) {
+					t.Errorf("expected args %q to be passed verbatim, got %q", tc.wantArgs, got.Args)
+				}
+			})
+		}
+	}
+}
+
+func TestTranslatePostgresError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{sql.ErrNoRows, ErrNotFound},
+		{&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}, ErrConflict},
+		{&pq.Error{Code: "23503", Message: "violates foreign key constraint"}, ErrMissingReference},
+		{&pq.Error{Code: "22P02", Message: "invalid input syntax for type uuid"}, ErrInvalidInput},
+		{&pq.Error{Code: "P0001", Message: "record not found"}, ErrNotFound},
+	}
+	for _, tc := range cases {
+		if got := translatePostgresError(tc.err); !errors.Is(got, tc.want) {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,988 @@
+package dbquery
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/migrations"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// timestamp format used for created_at, matching what postgres returns for timestamptz::VARCHAR
+const sqliteNow = "strftime('%Y-%m-%d %H:%M:%f+00', 'now')"
+
+type SqlLiteDBConfig struct {
+	Path         string        //database file, or :memory: for a throwaway database
+	QueryTimeout time.Duration //deadline for each call, 0 uses defaultQueryTimeout
+
+	SkipMigrations bool //leave the schema alone instead of migrating it to the latest version
+}
+
+// SqlLiteQueryHandler implements DBQueryHandler on a local SQLite database. The
+// logic of the postgres functions in migrations/postgres is done here in Go,
+// inside a transaction.
+type SqlLiteQueryHandler struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// opens the database at dbc.Path, migrating it to the latest schema unless told not to
+func NewSqlLiteHandler(dbc SqlLiteDBConfig) (DBQueryHandler, error) {
+	db, err := OpenSqlLite(dbc)
+	if err != nil {
+		return nil, err
+	}
+	if !dbc.SkipMigrations {
+		if err := migrate(db, migrations.SqlLite); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	queryTimeout := dbc.QueryTimeout
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+	return SqlLiteQueryHandler{
+		db:           db,
+		queryTimeout: queryTimeout,
+	}, nil
+}
+
+// opens the database file, turning on foreign key checks for every connection
+func OpenSqlLite(dbc SqlLiteDBConfig) (*sql.DB, error) {
+	if dbc.Path == "" {
+		return nil, errors.New("sqlite database path must be provided")
+	}
+
+	dsn := "file:" + dbc.Path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	if dbc.Path != ":memory:" {
+		dsn += "&_pragma=journal_mode(WAL)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dbc.Path == ":memory:" {
+		//every connection to :memory: gets its own empty database, so only ever use one
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (slh SqlLiteQueryHandler) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, slh.queryTimeout)
+}
+
+// runs a statement which returns no rows. ErrNoRowsChanged is returned if nothing was affected.
+func (slh SqlLiteQueryHandler) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := slh.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := slh.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return translateSqlLiteError(err)
+	}
+	if rows, _ := resp.RowsAffected(); rows == 0 {
+		return ErrNoRowsChanged
+	}
+	return nil
+}
+
+// like exec, but when ctx carries an event id it is recorded in the same
+// transaction, and ErrAlreadyProcessed returned if it was recorded before
+func (slh SqlLiteQueryHandler) execEvent(ctx context.Context, query string, args ...any) error {
+	if eventID(ctx) == "" {
+		return slh.exec(ctx, query, args...)
+	}
+	return slh.inTx(ctx, func(tx *sql.Tx) error {
+		if err := recordEvent(ctx, tx, sqlitePlaceholder); err != nil {
+			return err
+		}
+		resp, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if rows, _ := resp.RowsAffected(); rows == 0 {
+			return ErrNoRowsChanged
+		}
+		return nil
+	})
+}
+
+func sqlitePlaceholder(int) string {
+	return "?"
+}
+
+// runs a query expected to return a single row and scans it into dest
+func (slh SqlLiteQueryHandler) queryRow(ctx context.Context, query string, args []any, dest ...any) error {
+	ctx, cancel := slh.withTimeout(ctx)
+	defer cancel()
+
+	if err := slh.db.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
+		return translateSqlLiteError(err)
+	}
+	return nil
+}
+
+// runs a query and calls scan for each row returned
+func (slh SqlLiteQueryHandler) query(ctx context.Context, query string, args []any, scan func(*sql.Rows) error) error {
+	ctx, cancel := slh.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := slh.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return translateSqlLiteError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return translateSqlLiteError(rows.Err())
+}
+
+// runs fn in a transaction, committing if it returns nil
+func (slh SqlLiteQueryHandler) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := slh.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := slh.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateSqlLiteError(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return translateSqlLiteError(err)
+	}
+	return translateSqlLiteError(tx.Commit())
+}
+
+// like inTx, but takes the database write lock up front. Reads in a deferred
+// transaction do not block other writers, so this is needed when a decision
+// is made on what was read.
+func (slh SqlLiteQueryHandler) inImmediateTx(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	ctx, cancel := slh.withTimeout(ctx)
+	defer cancel()
+
+	conn, err := slh.db.Conn(ctx)
+	if err != nil {
+		return translateSqlLiteError(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return translateSqlLiteError(err)
+	}
+	if err := fn(conn); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return translateSqlLiteError(err)
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return translateSqlLiteError(err)
+	}
+	return nil
+}
+
+// maps driver errors onto the package errors, keeping the original message
+func translateSqlLiteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	var sqlErr *sqlite.Error
+	if !errors.As(err, &sqlErr) {
+		return err
+	}
+	switch sqlErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return fmt.Errorf("%w: %s", ErrConflict, sqlErr.Error())
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%w: %s", ErrMissingReference, sqlErr.Error())
+	case sqlite3.SQLITE_CONSTRAINT_NOTNULL, sqlite3.SQLITE_CONSTRAINT_CHECK:
+		return fmt.Errorf("%w: %s", ErrInvalidInput, sqlErr.Error())
+	}
+	return err
+}
+
+// SQLite has no uuid type, so check and normalise uuids the way postgres would
+// before they are stored or compared. Braces and hyphens are optional on input,
+// the result is always lower case with hyphens.
+func normaliseUUID(uuid string) (string, error) {
+	hex := strings.ToLower(strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(uuid, "{"), "}"), "-", ""))
+	if len(hex) != 32 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%w: invalid input syntax for type uuid: %q", ErrInvalidInput, uuid)
+	}
+	return hex[0:8] + "-" + hex[8:12] + "-" + hex[12:16] + "-" + hex[16:20] + "-" + hex[20:32], nil
+}
+
+// port of add_external_user
+func (slh SqlLiteQueryHandler) AddExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error) {
+	query := "INSERT INTO external_users (user_id, name, ip_address) VALUES (?, ?, ?)"
+	log.Println("Add external user DB Request:", query)
+
+	eu := ExternalUser{Name: name, IPAddr: ip}
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		resp, err := tx.ExecContext(ctx, "INSERT INTO users (created_at, internal) VALUES ("+sqliteNow+", FALSE)")
+		if err != nil {
+			return err
+		}
+		if eu.ID, err = resp.LastInsertId(); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, eu.ID, name, ip)
+		return err
+	})
+	return eu, err
+}
+
+func (slh SqlLiteQueryHandler) GetExternalUser(ctx context.Context, name string, ip string) (ExternalUser, error) {
+	query := "SELECT user_id, name, ip_address, email FROM external_users WHERE name = ? AND ip_address = ?"
+	log.Println("Get external user DB Request:", query)
+
+	return slh.scanExternalUser(ctx, query, name, ip)
+}
+
+func (slh SqlLiteQueryHandler) GetExternalUserByID(ctx context.Context, id int64) (ExternalUser, error) {
+	query := "SELECT user_id, name, ip_address, email FROM external_users WHERE user_id = ?"
+	log.Println("Get external user by id DB Request:", query)
+
+	return slh.scanExternalUser(ctx, query, id)
+}
+
+// port of update_external_user_info, empty values leave the field unchanged
+func (slh SqlLiteQueryHandler) UpdateExternalUserByID(ctx context.Context, id int64, name string, ip string, email string) (ExternalUser, error) {
+	log.Println("Update external user by id DB Request:", id)
+
+	eu := ExternalUser{ID: id}
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			"SELECT COALESCE(name, ''), COALESCE(ip_address, ''), COALESCE(email, '') FROM external_users WHERE user_id = ?",
+			id).Scan(&eu.Name, &eu.IPAddr, &eu.Email)
+		if err != nil {
+			return err
+		}
+
+		eu.Name = coalesce(name, eu.Name)
+		eu.IPAddr = coalesce(ip, eu.IPAddr)
+		eu.Email = coalesce(email, eu.Email)
+
+		_, err = tx.ExecContext(ctx, "UPDATE external_users SET name = ?, ip_address = ?, email = ? WHERE user_id = ?",
+			eu.Name, eu.IPAddr, eu.Email, id)
+		return err
+	})
+	return eu, err
+}
+
+func (slh SqlLiteQueryHandler) scanExternalUser(ctx context.Context, query string, args ...any) (ExternalUser, error) {
+	var eu ExternalUser
+	var name, ip, email sql.NullString
+	if err := slh.queryRow(ctx, query, args, &eu.ID, &name, &ip, &email); err != nil {
+		return eu, err
+	}
+	eu.Name, eu.IPAddr, eu.Email = name.String, ip.String, email.String
+	return eu, nil
+}
+
+func (slh SqlLiteQueryHandler) ChatStart(ctx context.Context, uuid string, startTime string) error {
+	query := "INSERT INTO chat (uuid, start_time) VALUES (?, ?)"
+	log.Println("Chat Start DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.execEvent(ctx, query, uuid, startTime)
+}
+
+func (slh SqlLiteQueryHandler) ChatEnd(ctx context.Context, uuid string, endTime string) error {
+	query := "UPDATE chat SET end_time = ? WHERE uuid = ?"
+	log.Println("Chat End DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.execEvent(ctx, query, endTime, uuid)
+}
+
+// port of add_internal_user
+func (slh SqlLiteQueryHandler) AddInternalUser(ctx context.Context, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error) {
+	log.Println("Add internal user DB Request:", email)
+
+	iu := InternalUser{
+		RoleID:    roleID,
+		FirstName: firstname,
+		Surname:   surname,
+		Email:     email,
+		Password:  password,
+	}
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		resp, err := tx.ExecContext(ctx, "INSERT INTO users (created_at, internal) VALUES ("+sqliteNow+", TRUE)")
+		if err != nil {
+			return err
+		}
+		if iu.ID, err = resp.LastInsertId(); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO internal_users (user_id, role_id, firstname, surname, email, password) VALUES (?, ?, ?, ?, ?, ?)",
+			iu.ID, roleID, firstname, surname, email, password)
+		return err
+	})
+	return iu, err
+}
+
+func (slh SqlLiteQueryHandler) GetInternalUserByID(ctx context.Context, id int64) (InternalUser, error) {
+	query := "SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE user_id = ?"
+	log.Println("Get internal user by id DB Request:", query)
+
+	return slh.scanInternalUser(ctx, query, id)
+}
+
+// port of update_internal_user_info, empty values and a 0 role id leave the field unchanged
+func (slh SqlLiteQueryHandler) UpdateInternalUserByID(ctx context.Context, id int64, roleID int64, firstname string, surname string, email string, password string) (InternalUser, error) {
+	log.Println("Update internal user by id DB Request:", id)
+
+	iu := InternalUser{ID: id}
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			"SELECT role_id, firstname, surname, email, password FROM internal_users WHERE user_id = ?",
+			id).Scan(&iu.RoleID, &iu.FirstName, &iu.Surname, &iu.Email, &iu.Password)
+		if err != nil {
+			return err
+		}
+
+		if roleID != 0 {
+			iu.RoleID = roleID
+		}
+		iu.FirstName = coalesce(firstname, iu.FirstName)
+		iu.Surname = coalesce(surname, iu.Surname)
+		iu.Email = coalesce(email, iu.Email)
+		iu.Password = coalesce(password, iu.Password)
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE internal_users SET role_id = ?, firstname = ?, surname = ?, email = ?, password = ? WHERE user_id = ?",
+			iu.RoleID, iu.FirstName, iu.Surname, iu.Email, iu.Password, id)
+		return err
+	})
+	return iu, err
+}
+
+func (slh SqlLiteQueryHandler) GetInternalByEmail(ctx context.Context, email string) (InternalUser, error) {
+	query := "SELECT user_id, role_id, firstname, surname, email, password FROM internal_users WHERE email = ?"
+	log.Println("Get internal user by email DB Request:", query)
+
+	return slh.scanInternalUser(ctx, query, email)
+}
+
+func (slh SqlLiteQueryHandler) scanInternalUser(ctx context.Context, query string, args ...any) (InternalUser, error) {
+	var iu InternalUser
+	err := slh.queryRow(ctx, query, args, &iu.ID, &iu.RoleID, &iu.FirstName, &iu.Surname, &iu.Email, &iu.Password)
+	return iu, err
+}
+
+func (slh SqlLiteQueryHandler) AddMessageByUUID(ctx context.Context, uuid string, userid int64, message string, time string) error {
+	query := "INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES (?, ?, ?, ?)"
+	log.Println("Add message by uuid DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.execEvent(ctx, query, uuid, userid, message, time)
+}
+
+// stores a message and links the attachments sent with it, which must have
+// been uploaded to the same chat and not sent already. ErrMissingReference is
+// returned, and nothing stored, otherwise.
+func (slh SqlLiteQueryHandler) AddMessageWithAttachments(ctx context.Context, uuid string, userid int64, message string, time string, attachments []string) error {
+	log.Println("Add message with attachments DB Request:", uuid, attachments)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.inTx(ctx, func(tx *sql.Tx) error {
+		if err := recordEvent(ctx, tx, sqlitePlaceholder); err != nil {
+			return err
+		}
+		resp, err := tx.ExecContext(ctx, "INSERT INTO chat_messages (chat_uuid, user_id_from, message, timestamp) VALUES (?, ?, ?, ?)", uuid, userid, message, time)
+		if err != nil {
+			return err
+		}
+		id, err := resp.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, a := range attachments {
+			a, err := normaliseUUID(a)
+			if err != nil {
+				return err
+			}
+			resp, err := tx.ExecContext(ctx, "UPDATE attachments SET message_id = ? WHERE id = ? AND chat_uuid = ? AND message_id IS NULL", id, a, uuid)
+			if err != nil {
+				return err
+			}
+			if rows, _ := resp.RowsAffected(); rows == 0 {
+				return fmt.Errorf("%w: attachment %s", ErrMissingReference, a)
+			}
+		}
+		return nil
+	})
+}
+
+// stores messages, which have no attachments, in one transaction using
+// multi-row inserts. Either all of them are stored or none are. Messages with
+// an EventID whose event has been applied already are skipped.
+func (slh SqlLiteQueryHandler) AddMessages(ctx context.Context, messages []ChatMessage) error {
+	log.Println("Add messages DB Request:", len(messages))
+
+	normalised := make([]ChatMessage, len(messages))
+	for i, m := range messages {
+		uuid, err := normaliseUUID(m.ChatUUID)
+		if err != nil {
+			return err
+		}
+		m.ChatUUID = uuid
+		normalised[i] = m
+	}
+	return slh.inTx(ctx, func(tx *sql.Tx) error {
+		recorded, err := recordEvents(ctx, tx, messageEventIDs(normalised), sqlitePlaceholder)
+		if err != nil {
+			return err
+		}
+		normalised := unprocessedMessages(normalised, recorded)
+		for start := 0; start < len(normalised); start += maxInsertRows {
+			query, args := messagesInsert(normalised[start:min(start+maxInsertRows, len(normalised))], sqlitePlaceholder)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (slh SqlLiteQueryHandler) GetAllMessagesByUUID(ctx context.Context, uuid string) ([]ChatMessage, error) {
+	query := "SELECT chat_uuid, user_id_from, message, timestamp FROM chat_messages WHERE chat_uuid = ? ORDER BY timestamp ASC"
+	log.Println("Get all messages by uuid DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []ChatMessage{}
+	err = slh.query(ctx, query, []any{uuid}, func(rows *sql.Rows) error {
+		var cm ChatMessage
+		var ts sql.NullString
+		if err := rows.Scan(&cm.ChatUUID, &cm.UserID, &cm.Message, &ts); err != nil {
+			return err
+		}
+		cm.Time = ts.String
+		messages = append(messages, cm)
+		return nil
+	})
+	return messages, err
+}
+
+func (slh SqlLiteQueryHandler) GetAllChatsInProgress(ctx context.Context) ([]Chat, error) {
+	query := "SELECT uuid, start_time FROM chat WHERE end_time is null"
+	log.Println("Get all chats in progress DB Request:", query)
+
+	chats := []Chat{}
+	err := slh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var c Chat
+		if err := rows.Scan(&c.UUID, &c.StartTime); err != nil {
+			return err
+		}
+		chats = append(chats, c)
+		return nil
+	})
+	return chats, err
+}
+
+func (slh SqlLiteQueryHandler) JoinChatParticipant(ctx context.Context, uuid string, userid int64, time string) error {
+	query := "INSERT INTO chat_participant (chat_uuid, user_id, time_joined) VALUES (?, ?, ?)"
+	log.Println("Join chat participant DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.execEvent(ctx, query, uuid, userid, time)
+}
+
+func (slh SqlLiteQueryHandler) LeaveChatParticipant(ctx context.Context, uuid string, userid int64, time string) error {
+	query := "UPDATE chat_participant SET time_left = ? WHERE chat_uuid = ? AND user_id = ?"
+	log.Println("Leave chat participant DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return slh.execEvent(ctx, query, time, uuid, userid)
+}
+
+// returns the participants of every chat which has not ended
+func (slh SqlLiteQueryHandler) GetOngoingChatParticipants(ctx context.Context) ([]ChatParticipant, error) {
+	query := `SELECT c.uuid,
+				p.user_id,
+				p.time_left IS NULL AS active,
+				u.internal,
+				COALESCE(iu.firstname || ' ' || iu.surname, eu.name) AS name
+			FROM chat c
+			INNER JOIN chat_participant p ON c.uuid = p.chat_uuid
+			LEFT JOIN users u ON p.user_id = u.id
+			LEFT JOIN internal_users iu ON u.id = iu.user_id
+			LEFT JOIN external_users eu ON u.id = eu.user_id
+			WHERE c.end_time IS NULL
+			ORDER BY c.uuid`
+	log.Println("Get ongoing chat participants DB Request:", query)
+
+	participants := []ChatParticipant{}
+	err := slh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var cp ChatParticipant
+		var internal sql.NullBool
+		var name sql.NullString
+		if err := rows.Scan(&cp.ChatUUID, &cp.UserID, &cp.Active, &internal, &name); err != nil {
+			return err
+		}
+		cp.Internal, cp.Name = internal.Bool, name.String
+		participants = append(participants, cp)
+		return nil
+	})
+	return participants, err
+}
+
+// returns the messages of every chat which has not ended, oldest first
+func (slh SqlLiteQueryHandler) GetOngoingChatMessages(ctx context.Context) ([]ChatMessage, error) {
+	query := `SELECT c.uuid,
+				m.user_id_from,
+				m.message,
+				m.timestamp AS message_time
+			FROM chat c
+			INNER JOIN chat_messages m ON c.uuid = m.chat_uuid
+			WHERE c.end_time IS NULL
+			ORDER BY c.uuid, message_time ASC`
+	log.Println("Get ongoing chat messages DB Request:", query)
+
+	messages := []ChatMessage{}
+	err := slh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		var cm ChatMessage
+		var ts sql.NullString
+		if err := rows.Scan(&cm.ChatUUID, &cm.UserID, &cm.Message, &ts); err != nil {
+			return err
+		}
+		cm.Time = ts.String
+		messages = append(messages, cm)
+		return nil
+	})
+	return messages, err
+}
+
+// gives the user id, created at time and internal or external bool
+func (slh SqlLiteQueryHandler) GetUserInfoByID(ctx context.Context, id int64) (UserInfo, error) {
+	query := `SELECT u.id,
+					u.created_at,
+					u.internal,
+					COALESCE(iu.firstname || ' ' || iu.surname, eu.name) AS name
+				FROM users u
+					LEFT JOIN internal_users iu ON u.id = iu.user_id
+					LEFT JOIN external_users eu ON u.id = eu.user_id
+				WHERE u.id = ?`
+	log.Println("Get user info by id DB Request:", query)
+
+	var ui UserInfo
+	var name sql.NullString
+	if err := slh.queryRow(ctx, query, []any{id}, &ui.ID, &ui.CreatedAt, &ui.Internal, &name); err != nil {
+		return ui, err
+	}
+	ui.Name = name.String
+	return ui, nil
+}
+
+func (slh SqlLiteQueryHandler) CreateSession(ctx context.Context, session Session) error {
+	query := "INSERT INTO sessions (id, user_id, refresh_id, expires_at) VALUES (?, ?, ?, ?)"
+	log.Println("Create session DB Request:", query)
+
+	return slh.exec(ctx, query, session.ID, session.UserID, session.RefreshID, session.ExpiresAt)
+}
+
+func (slh SqlLiteQueryHandler) GetSession(ctx context.Context, id string) (Session, error) {
+	query := "SELECT id, user_id, refresh_id, expires_at, revoked FROM sessions WHERE id = ?"
+	log.Println("Get session DB Request:", query)
+
+	var s Session
+	err := slh.queryRow(ctx, query, []any{id}, &s.ID, &s.UserID, &s.RefreshID, &s.ExpiresAt, &s.Revoked)
+	return s, err
+}
+
+// swaps the refresh id, only if oldRefreshID is still the current one and the
+// session has not been revoked. ErrNoRowsChanged is returned otherwise.
+func (slh SqlLiteQueryHandler) RotateSessionRefresh(ctx context.Context, id string, oldRefreshID string, newRefreshID string) error {
+	query := "UPDATE sessions SET refresh_id = ? WHERE id = ? AND refresh_id = ? AND NOT revoked"
+	log.Println("Rotate session refresh DB Request:", query)
+
+	return slh.exec(ctx, query, newRefreshID, id, oldRefreshID)
+}
+
+func (slh SqlLiteQueryHandler) RevokeSession(ctx context.Context, id string) error {
+	query := "UPDATE sessions SET revoked = TRUE WHERE id = ?"
+	log.Println("Revoke session DB Request:", query)
+
+	return slh.exec(ctx, query, id)
+}
+
+// returns the permissions held through the role of an internal user
+func (slh SqlLiteQueryHandler) GetUserPermissions(ctx context.Context, userID int64) ([]string, error) {
+	query := `SELECT rp.permission
+			FROM internal_users iu
+			INNER JOIN role_permissions rp ON iu.role_id = rp.role_id
+			WHERE iu.user_id = ?
+			ORDER BY rp.permission`
+	log.Println("Get user permissions DB Request:", query)
+
+	permissions := []string{}
+	err := slh.query(ctx, query, []any{userID}, func(rows *sql.Rows) error {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return err
+		}
+		permissions = append(permissions, p)
+		return nil
+	})
+	return permissions, err
+}
+
+func (slh SqlLiteQueryHandler) GetRoles(ctx context.Context) ([]Role, error) {
+	query := `SELECT r.id, r.description, rp.permission
+			FROM user_roles r
+			LEFT JOIN role_permissions rp ON r.id = rp.role_id
+			ORDER BY r.id, rp.permission`
+	log.Println("Get roles DB Request:", query)
+
+	roles := []Role{}
+	err := slh.query(ctx, query, nil, func(rows *sql.Rows) error {
+		return scanRoles(rows, &roles)
+	})
+	return roles, err
+}
+
+func (slh SqlLiteQueryHandler) GetRole(ctx context.Context, id int64) (Role, error) {
+	query := `SELECT r.id, r.description, rp.permission
+			FROM user_roles r
+			LEFT JOIN role_permissions rp ON r.id = rp.role_id
+			WHERE r.id = ?
+			ORDER BY rp.permission`
+	log.Println("Get role DB Request:", query)
+
+	roles := []Role{}
+	err := slh.query(ctx, query, []any{id}, func(rows *sql.Rows) error {
+		return scanRoles(rows, &roles)
+	})
+	if err != nil {
+		return Role{}, err
+	}
+	if len(roles) == 0 {
+		return Role{}, ErrNotFound
+	}
+	return roles[0], nil
+}
+
+func (slh SqlLiteQueryHandler) AddRole(ctx context.Context, description string, permissions []string) (Role, error) {
+	log.Println("Add role DB Request:", description)
+
+	role := Role{Description: description, Permissions: permissions}
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		resp, err := tx.ExecContext(ctx, "INSERT INTO user_roles (description) VALUES (?)", description)
+		if err != nil {
+			return err
+		}
+		if role.ID, err = resp.LastInsertId(); err != nil {
+			return err
+		}
+		return slh.setRolePermissions(ctx, tx, role.ID, permissions)
+	})
+	return role, err
+}
+
+// updates the description, unless it is empty, and replaces the permissions,
+// unless they are nil
+func (slh SqlLiteQueryHandler) UpdateRole(ctx context.Context, id int64, description string, permissions []string) (Role, error) {
+	log.Println("Update role DB Request:", id)
+
+	err := slh.inTx(ctx, func(tx *sql.Tx) error {
+		resp, err := tx.ExecContext(ctx, "UPDATE user_roles SET description = COALESCE(NULLIF(?, ''), description) WHERE id = ?", description, id)
+		if err != nil {
+			return err
+		}
+		if rows, _ := resp.RowsAffected(); rows == 0 {
+			return ErrNotFound
+		}
+		if permissions == nil {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = ?", id); err != nil {
+			return err
+		}
+		return slh.setRolePermissions(ctx, tx, id, permissions)
+	})
+	if err != nil {
+		return Role{}, err
+	}
+	return slh.GetRole(ctx, id)
+}
+
+func (slh SqlLiteQueryHandler) setRolePermissions(ctx context.Context, tx *sql.Tx, id int64, permissions []string) error {
+	for _, p := range permissions {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO role_permissions (role_id, permission) VALUES (?, ?)", id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes a role and its permissions. Roles still held by a user cannot be
+// deleted, ErrMissingReference is returned for those.
+func (slh SqlLiteQueryHandler) DeleteRole(ctx context.Context, id int64) error {
+	query := "DELETE FROM user_roles WHERE id = ?"
+	log.Println("Delete role DB Request:", query)
+
+	err := slh.exec(ctx, query, id)
+	if errors.Is(err, ErrNoRowsChanged) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// records member joining room through a chat instance, reporting whether they
+// are the only member, meaning the chat has just started. Rejoining a room in
+// its grace period resumes the chat instead.
+func (slh SqlLiteQueryHandler) JoinRoom(ctx context.Context, room string, member string, instance string) (bool, error) {
+	log.Println("Join room DB Request:", room, member)
+
+	var members int
+	var resumed int64
+	err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, "INSERT INTO room_members (room_id, member_id, instance_id) VALUES (?, ?, ?)", room, member, instance); err != nil {
+			return err
+		}
+		resp, err := conn.ExecContext(ctx, "DELETE FROM room_grace WHERE room_id = ?", room)
+		if err != nil {
+			return err
+		}
+		resumed, _ = resp.RowsAffected()
+		return conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_members WHERE room_id = ?", room).Scan(&members)
+	})
+	return members == 1 && resumed == 0, err
+}
+
+// removes member from room, reporting whether they were the last one, meaning
+// the chat has ended. With a grace period the last member leaving only starts
+// it, the chat ends when ExpireRooms finds nobody rejoined in time.
+func (slh SqlLiteQueryHandler) LeaveRoom(ctx context.Context, room string, member string, grace time.Duration) (bool, error) {
+	log.Println("Leave room DB Request:", room, member)
+
+	var members int
+	err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+		if err := slh.removeRoomMembers(ctx, conn, "DELETE FROM room_members WHERE room_id = ? AND member_id = ?", room, member, &members); err != nil {
+			return err
+		}
+		if members > 0 || grace <= 0 {
+			return nil
+		}
+		_, err := conn.ExecContext(ctx, "INSERT INTO room_grace (room_id, ends_at) VALUES (?, ?) ON CONFLICT (room_id) DO UPDATE SET ends_at = excluded.ends_at", room, time.Now().Add(grace).Unix())
+		return err
+	})
+	return err == nil && members == 0 && grace <= 0, err
+}
+
+// removes every member connected through instance, returning the rooms left
+// empty. Chat instances call this on startup to tidy up after a crash.
+func (slh SqlLiteQueryHandler) ClearInstanceRooms(ctx context.Context, instance string) ([]string, error) {
+	log.Println("Clear instance rooms DB Request:", instance)
+
+	ended := []string{}
+	err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+		rooms, err := slh.clearInstance(ctx, conn, instance)
+		ended = append(ended, rooms...)
+		return err
+	})
+	return ended, err
+}
+
+// records that instance is still running, for ttl from now
+func (slh SqlLiteQueryHandler) RenewInstance(ctx context.Context, instance string, ttl time.Duration) error {
+	query := "INSERT INTO instance_leases (instance_id, expires_at) VALUES (?, ?) ON CONFLICT (instance_id) DO UPDATE SET expires_at = excluded.expires_at"
+	log.Println("Renew instance DB Request:", query)
+
+	return slh.exec(ctx, query, instance, time.Now().Add(ttl).Unix())
+}
+
+// removes the members of every instance whose lease ran out by now, as one
+// that crashed will never clear them itself, returning the rooms left empty.
+// Each instance is cleared in its own transaction and only once, whichever
+// chat instance asks. On an error the rooms already ended are still returned.
+func (slh SqlLiteQueryHandler) ExpireInstances(ctx context.Context, now time.Time) ([]string, error) {
+	log.Println("Expire instances DB Request:", now.Unix())
+
+	var instances []string
+	err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+		var err error
+		instances, err = queryRooms(ctx, conn, "SELECT instance_id FROM instance_leases WHERE expires_at <= ? ORDER BY instance_id", now.Unix())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ended := []string{}
+	for _, instance := range instances {
+		err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+			resp, err := conn.ExecContext(ctx, "DELETE FROM instance_leases WHERE instance_id = ? AND expires_at <= ?", instance, now.Unix())
+			if err != nil {
+				return err
+			}
+			//renewed since, or cleared by another request
+			if rows, _ := resp.RowsAffected(); rows == 0 {
+				return nil
+			}
+			rooms, err := slh.clearInstance(ctx, conn, instance)
+			if err == nil {
+				ended = append(ended, rooms...)
+			}
+			return err
+		})
+		if err != nil {
+			return ended, err
+		}
+	}
+	return ended, nil
+}
+
+// removes every member connected through instance, returning the rooms left empty
+func (slh SqlLiteQueryHandler) clearInstance(ctx context.Context, conn *sql.Conn, instance string) ([]string, error) {
+	rooms, err := queryRooms(ctx, conn, "SELECT DISTINCT room_id FROM room_members WHERE instance_id = ? ORDER BY room_id", instance)
+	if err != nil {
+		return nil, err
+	}
+	var ended []string
+	for _, room := range rooms {
+		var members int
+		if err := slh.removeRoomMembers(ctx, conn, "DELETE FROM room_members WHERE room_id = ? AND instance_id = ?", room, instance, &members); err != nil {
+			return nil, err
+		}
+		if members == 0 {
+			ended = append(ended, room)
+		}
+	}
+	return ended, nil
+}
+
+// ends the rooms whose grace period is over at now, returning them. Each room
+// is only returned once, whichever chat instance asks.
+func (slh SqlLiteQueryHandler) ExpireRooms(ctx context.Context, now time.Time) ([]string, error) {
+	log.Println("Expire rooms DB Request:", now.Unix())
+
+	ended := []string{}
+	err := slh.inImmediateTx(ctx, func(conn *sql.Conn) error {
+		rooms, err := queryRooms(ctx, conn, "DELETE FROM room_grace WHERE ends_at <= ? RETURNING room_id", now.Unix())
+		ended = append(ended, rooms...)
+		return err
+	})
+	return ended, err
+}
+
+// reports whether room has members, or is in its grace period, so can still
+// be joined. Members only count while their instance's lease lasts, so a room
+// whose instance has gone is not resumed.
+func (slh SqlLiteQueryHandler) RoomActive(ctx context.Context, room string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM room_members m JOIN instance_leases l ON l.instance_id = m.instance_id WHERE m.room_id = ? AND l.expires_at > ?) OR EXISTS (SELECT 1 FROM room_grace WHERE room_id = ?)"
+	log.Println("Room active DB Request:", query)
+
+	var active bool
+	err := slh.queryRow(ctx, query, []any{room, time.Now().Unix(), room}, &active)
+	return active, err
+}
+
+// reports whether the chat has ended, ErrNotFound if it was never started
+func (slh SqlLiteQueryHandler) ChatEnded(ctx context.Context, uuid string) (bool, error) {
+	query := "SELECT end_time IS NOT NULL FROM chat WHERE uuid = ?"
+	log.Println("Chat ended DB Request:", query)
+
+	uuid, err := normaliseUUID(uuid)
+	if err != nil {
+		return false, err
+	}
+	var ended bool
+	err = slh.queryRow(ctx, query, []any{uuid}, &ended)
+	return ended, err
+}
+
+func (slh SqlLiteQueryHandler) AddAttachment(ctx context.Context, a Attachment) error {
+	query := "INSERT INTO attachments (id, chat_uuid, user_id, name, content_type, size, storage_key) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	log.Println("Add attachment DB Request:", query)
+
+	id, err := normaliseUUID(a.ID)
+	if err != nil {
+		return err
+	}
+	chat, err := normaliseUUID(a.ChatUUID)
+	if err != nil {
+		return err
+	}
+	return slh.exec(ctx, query, id, chat, a.UserID, a.Name, a.ContentType, a.Size, a.StorageKey)
+}
+
+func (slh SqlLiteQueryHandler) GetAttachment(ctx context.Context, id string) (Attachment, error) {
+	query := "SELECT id, chat_uuid, user_id, message_id, name, content_type, size, storage_key, created_at FROM attachments WHERE id = ?"
+	log.Println("Get attachment DB Request:", query)
+
+	id, err := normaliseUUID(id)
+	if err != nil {
+		return Attachment{}, err
+	}
+	var a Attachment
+	var messageID sql.NullInt64
+	err = slh.queryRow(ctx, query, []any{id}, &a.ID, &a.ChatUUID, &a.UserID, &messageID, &a.Name, &a.ContentType, &a.Size, &a.StorageKey, &a.CreatedAt)
+	a.MessageID = messageID.Int64
+	return a, err
+}
+
+// runs a delete of members from room and counts who is left
+func (slh SqlLiteQueryHandler) removeRoomMembers(ctx context.Context, conn *sql.Conn, query string, room string, arg string, members *int) error {
+	resp, err := conn.ExecContext(ctx, query, room, arg)
+	if err != nil {
+		return err
+	}
+	if rows, _ := resp.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_members WHERE room_id = ?", room).Scan(members)
+}
+
+// returns value, or fallback if value is empty, like the NULLIF/COALESCE in the postgres functions
+func coalesce(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,503 @@
+package dbquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSqlLiteHandler(t *testing.T) DBQueryHandler {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h, err := NewSqlLiteHandler(SqlLiteDBConfig{Path: ":memory:"})
+	if err != nil {
+		t.Fatalf("opening sqlite: %v", err)
+	}
+	return h
+}
+
+func TestSqlLiteExternalUsers(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	added, err := h.AddExternalUser(ctx, "O'Brien", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("AddExternalUser: %v", err)
+	}
+	if added.ID <= 1 {
+		t.Errorf("expected an id after the seeded admin, got %d", added.ID)
+	}
+
+	got, err := h.GetExternalUser(ctx, "O'Brien", "127.0.0.1")
+	if err != nil || got != added {
+		t.Errorf("GetExternalUser = %+v, %v, want %+v", got, err, added)
+	}
+
+	updated, err := h.UpdateExternalUserByID(ctx, added.ID, "", "", "obrien@example.com")
+	if err != nil {
+		t.Fatalf("UpdateExternalUserByID: %v", err)
+	}
+	want := ExternalUser{ID: added.ID, Name: "O'Brien", IPAddr: "127.0.0.1", Email: "obrien@example.com"}
+	if updated != want {
+		t.Errorf("UpdateExternalUserByID = %+v, want %+v", updated, want)
+	}
+	if got, _ := h.GetExternalUserByID(ctx, added.ID); got != want {
+		t.Errorf("GetExternalUserByID = %+v, want %+v", got, want)
+	}
+
+	if _, err := h.UpdateExternalUserByID(ctx, 999, "x", "", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of missing user: expected ErrNotFound, got %v", err)
+	}
+	if _, err := h.GetExternalUserByID(ctx, 999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get of missing user: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSqlLiteInternalUsers(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	admin, err := h.GetInternalByEmail(ctx, "admin@example.com")
+	if err != nil || admin.ID != 1 {
+		t.Fatalf("seeded admin: got %+v, %v", admin, err)
+	}
+
+	added, err := h.AddInternalUser(ctx, 1, "Jane", "Doe", "jane@example.com", "secret")
+	if err != nil {
+		t.Fatalf("AddInternalUser: %v", err)
+	}
+	updated, err := h.UpdateInternalUserByID(ctx, added.ID, 0, "Janet", "", "", "")
+	if err != nil {
+		t.Fatalf("UpdateInternalUserByID: %v", err)
+	}
+	want := InternalUser{ID: added.ID, RoleID: 1, FirstName: "Janet", Surname: "Doe", Email: "jane@example.com", Password: "secret"}
+	if updated != want {
+		t.Errorf("UpdateInternalUserByID = %+v, want %+v", updated, want)
+	}
+
+	ui, err := h.GetUserInfoByID(ctx, added.ID)
+	if err != nil || !ui.Internal || ui.Name != "Janet Doe" || ui.CreatedAt == "" {
+		t.Errorf("GetUserInfoByID = %+v, %v", ui, err)
+	}
+
+	if _, err := h.AddInternalUser(ctx, 42, "No", "Role", "norole@example.com", "secret"); !errors.Is(err, ErrMissingReference) {
+		t.Errorf("unknown role: expected ErrMissingReference, got %v", err)
+	}
+}
+
+func TestSqlLiteChatLifecycle(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	const uuid = "d935fb72-796d-4418-8a36-bc228d143790"
+	user, err := h.AddExternalUser(ctx, "guest", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("AddExternalUser: %v", err)
+	}
+
+	if err := h.ChatStart(ctx, uuid, "2024-02-20 15:50:20.123456"); err != nil {
+		t.Fatalf("ChatStart: %v", err)
+	}
+	if err := h.ChatStart(ctx, "D935FB72796D44188A36BC228D143790", "2024-02-20 15:50:20.123456"); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate chat: expected ErrConflict, got %v", err)
+	}
+	if err := h.ChatStart(ctx, "not-a-uuid", "2024-02-20 15:50:20.123456"); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("bad uuid: expected ErrInvalidInput, got %v", err)
+	}
+
+	if ended, err := h.ChatEnded(ctx, uuid); err != nil || ended {
+		t.Errorf("ChatEnded in progress = %v, %v", ended, err)
+	}
+	if _, err := h.ChatEnded(ctx, "6f1c0000-0000-0000-0000-000000000000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ChatEnded for a missing chat: expected ErrNotFound, got %v", err)
+	}
+
+	if err := h.JoinChatParticipant(ctx, uuid, user.ID, "2024-02-20 15:50:21.000000"); err != nil {
+		t.Fatalf("JoinChatParticipant: %v", err)
+	}
+	if err := h.AddMessageByUUID(ctx, uuid, user.ID, "second", "2024-02-20 15:50:23.000000"); err != nil {
+		t.Fatalf("AddMessageByUUID: %v", err)
+	}
+	if err := h.AddMessageByUUID(ctx, uuid, user.ID, "first", "2024-02-20 15:50:22.000000"); err != nil {
+		t.Fatalf("AddMessageByUUID: %v", err)
+	}
+	if err := h.AddMessageByUUID(ctx, uuid, 999, "ghost", "2024-02-20 15:50:22.000000"); !errors.Is(err, ErrMissingReference) {
+		t.Errorf("unknown user: expected ErrMissingReference, got %v", err)
+	}
+
+	messages, err := h.GetOngoingChatMessages(ctx)
+	if err != nil || len(messages) != 2 || messages[0].Message != "first" {
+		t.Errorf("GetOngoingChatMessages = %+v, %v", messages, err)
+	}
+	participants, err := h.GetOngoingChatParticipants(ctx)
+	if err != nil || len(participants) != 1 || !participants[0].Active || participants[0].Name != "guest" {
+		t.Errorf("GetOngoingChatParticipants = %+v, %v", participants, err)
+	}
+
+	if err := h.LeaveChatParticipant(ctx, uuid, user.ID, "2024-02-20 15:51:00.000000"); err != nil {
+		t.Fatalf("LeaveChatParticipant: %v", err)
+	}
+	if err := h.ChatEnd(ctx, uuid, "2024-02-20 15:51:00.000000"); err != nil {
+		t.Fatalf("ChatEnd: %v", err)
+	}
+	if ended, err := h.ChatEnded(ctx, uuid); err != nil || !ended {
+		t.Errorf("ChatEnded after ChatEnd = %v, %v", ended, err)
+	}
+	if err := h.ChatEnd(ctx, "6f1c0000-0000-0000-0000-000000000000", "2024-02-20 15:51:00.000000"); !errors.Is(err, ErrNoRowsChanged) {
+		t.Errorf("ending missing chat: expected ErrNoRowsChanged, got %v", err)
+	}
+
+	chats, err := h.GetAllChatsInProgress(ctx)
+	if err != nil || len(chats) != 0 {
+		t.Errorf("GetAllChatsInProgress = %+v, %v", chats, err)
+	}
+	all, err := h.GetAllMessagesByUUID(ctx, uuid)
+	if err != nil || len(all) != 2 {
+		t.Errorf("GetAllMessagesByUUID = %+v, %v", all, err)
+	}
+}
+
+func TestSqlLiteSchemaIsReapplied(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "chat.db")
+	for i := 0; i < 2; i++ {
+		h, err := NewSqlLiteHandler(SqlLiteDBConfig{Path: path})
+		if err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		if _, err := h.GetInternalByEmail(context.Background(), "admin@example.com"); err != nil {
+			t.Fatalf("open %d: admin missing: %v", i, err)
+		}
+		h.(SqlLiteQueryHandler).db.Close()
+	}
+}
+
+func TestSqlLiteRoles(t *testing.T) {
+	h := newTestSqlLiteHandler(t)
+	ctx := context.Background()
+
+	admin, err := h.GetUserPermissions(ctx, 1)
+	if err != nil || !slices.Contains(admin, "roles.manage") {
+		t.Fatalf("seeded admin permissions = %v, %v", admin, err)
+	}
+
+	role, err := h.AddRole(ctx, "lead", []string{"users.read"})
+	if err != nil {
+		t.Fatalf("AddRole: %v", err)
+	}
+	updated, err := h.UpdateRole(ctx, role.ID, "", []string{})
+	if err != nil || updated.Description != "lead" || len(updated.Permissions) != 0 {
+		t.Errorf("UpdateRole = %+v, %v", updated, err)
+	}
+	if _, err := h.UpdateRole(ctx, 99, "x", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of missing role: expected ErrNotFound, got %v", err)
+	}
+
+	if err := h.DeleteRole(ctx, 1); !errors.Is(err, ErrMissingReference) {
+		t.Errorf("delete of role in use: expected ErrMissingReference, got %v", err)
+	}
+	if err := h.DeleteRole(ctx, role.ID); err != nil {
+		t.Fatalf("DeleteRole: %v", err)
+	}
+	if _, err := h.GetRole(ctx, role.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get of deleted role: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSqlLiteRoomMembers(t *testing.T) {
+	h := newTestSqlLiteHandler(t)
+	ctx := context.Background()
+
+	if first, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil || !first {
+		t.Fatalf("first JoinRoom = %v, %v", first, err)
+	}
+	if first, err := h.JoinRoom(ctx, "room", "agent", "chat-2"); err != nil || first {
+		t.Fatalf("second JoinRoom = %v, %v", first, err)
+	}
+	if _, err := h.JoinRoom(ctx, "room", "agent", "chat-2"); !errors.Is(err, ErrConflict) {
+		t.Errorf("joining twice: expected ErrConflict, got %v", err)
+	}
+	if _, err := h.JoinRoom(ctx, "other", "visitor2", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if last, err := h.LeaveRoom(ctx, "room", "agent", 0); err != nil || last {
+		t.Errorf("LeaveRoom with a member left = %v, %v", last, err)
+	}
+	if _, err := h.LeaveRoom(ctx, "room", "agent", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("leaving twice: expected ErrNotFound, got %v", err)
+	}
+
+	ended, err := h.ClearInstanceRooms(ctx, "chat-1")
+	if err != nil || !slices.Equal(ended, []string{"other", "room"}) {
+		t.Errorf("ClearInstanceRooms = %v, %v", ended, err)
+	}
+	if first, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil || !first {
+		t.Errorf("JoinRoom after clearing = %v, %v", first, err)
+	}
+}
+
+func TestSqlLiteRoomActiveNeedsLease(t *testing.T) {
+	h := newTestSqlLiteHandler(t)
+	ctx := context.Background()
+
+	if _, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := h.RoomActive(ctx, "room"); err != nil || active {
+		t.Errorf("RoomActive through an instance without a lease = %v, %v", active, err)
+	}
+	if err := h.RenewInstance(ctx, "chat-1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := h.RoomActive(ctx, "room"); err != nil || !active {
+		t.Errorf("RoomActive while the lease lasts = %v, %v", active, err)
+	}
+	if err := h.RenewInstance(ctx, "chat-1", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := h.RoomActive(ctx, "room"); err != nil || active {
+		t.Errorf("RoomActive once the lease ran out = %v, %v", active, err)
+	}
+}
+
+func TestSqlLiteInstanceLeases(t *testing.T) {
+	h := newTestSqlLiteHandler(t)
+	ctx := context.Background()
+
+	for _, instance := range []string{"chat-1", "chat-2"} {
+		if err := h.RenewInstance(ctx, instance, time.Minute); err != nil {
+			t.Fatalf("RenewInstance %s: %v", instance, err)
+		}
+	}
+	if _, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.JoinRoom(ctx, "shared", "visitor2", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.JoinRoom(ctx, "shared", "agent", "chat-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rooms, err := h.ExpireInstances(ctx, time.Now()); err != nil || len(rooms) != 0 {
+		t.Errorf("ExpireInstances while the leases last = %v, %v", rooms, err)
+	}
+	// chat-2 renews, chat-1 has crashed and does not
+	if err := h.RenewInstance(ctx, "chat-2", 3*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	rooms, err := h.ExpireInstances(ctx, time.Now().Add(2*time.Minute))
+	if err != nil || !slices.Equal(rooms, []string{"room"}) {
+		t.Errorf("ExpireInstances after chat-1's lease ran out = %v, %v", rooms, err)
+	}
+	if rooms, err := h.ExpireInstances(ctx, time.Now().Add(2*time.Minute)); err != nil || len(rooms) != 0 {
+		t.Errorf("expected an expired instance to only be cleared once, got %v, %v", rooms, err)
+	}
+	if active, err := h.RoomActive(ctx, "shared"); err != nil || !active {
+		t.Errorf("RoomActive with a member on a running instance = %v, %v", active, err)
+	}
+	if last, err := h.LeaveRoom(ctx, "shared", "agent", 0); err != nil || !last {
+		t.Errorf("expected chat-2's member to be the last in the shared room, got %v, %v", last, err)
+	}
+}
+
+func TestSqlLiteRoomGrace(t *testing.T) {
+	h := newTestSqlLiteHandler(t)
+	ctx := context.Background()
+
+	if _, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ended, err := h.LeaveRoom(ctx, "room", "visitor", time.Minute); err != nil || ended {
+		t.Fatalf("LeaveRoom with a grace period = %v, %v", ended, err)
+	}
+	if active, err := h.RoomActive(ctx, "room"); err != nil || !active {
+		t.Errorf("RoomActive in the grace period = %v, %v", active, err)
+	}
+	if rooms, err := h.ExpireRooms(ctx, time.Now()); err != nil || len(rooms) != 0 {
+		t.Errorf("ExpireRooms before the grace period ends = %v, %v", rooms, err)
+	}
+
+	// rejoining resumes the chat rather than starting it again
+	if first, err := h.JoinRoom(ctx, "room", "visitor-again", "chat-2"); err != nil || first {
+		t.Errorf("JoinRoom in the grace period = %v, %v", first, err)
+	}
+	if ended, err := h.LeaveRoom(ctx, "room", "visitor-again", time.Minute); err != nil || ended {
+		t.Fatalf("LeaveRoom after resuming = %v, %v", ended, err)
+	}
+
+	rooms, err := h.ExpireRooms(ctx, time.Now().Add(2*time.Minute))
+	if err != nil || !slices.Equal(rooms, []string{"room"}) {
+		t.Errorf("ExpireRooms after the grace period = %v, %v", rooms, err)
+	}
+	if rooms, err := h.ExpireRooms(ctx, time.Now().Add(2*time.Minute)); err != nil || len(rooms) != 0 {
+		t.Errorf("expected an expired room to only be returned once, got %v, %v", rooms, err)
+	}
+	if active, err := h.RoomActive(ctx, "room"); err != nil || active {
+		t.Errorf("RoomActive after the chat ended = %v, %v", active, err)
+	}
+	if first, err := h.JoinRoom(ctx, "room", "visitor", "chat-1"); err != nil || !first {
+		t.Errorf("JoinRoom after the chat ended = %v, %v", first, err)
+	}
+}
+
+func TestSqlLiteAttachments(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	const chat = "d935fb72-796d-4418-8a36-bc228d143790"
+	user, err := h.AddExternalUser(ctx, "guest", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("AddExternalUser: %v", err)
+	}
+	a := Attachment{
+		ID:          "0f8b2c1e-7d44-4d8e-9a51-3c7e5b2a9f10",
+		ChatUUID:    chat,
+		UserID:      user.ID,
+		Name:        "photo.png",
+		ContentType: "image/png",
+		Size:        1234,
+		StorageKey:  "0f8b2c1e-7d44-4d8e-9a51-3c7e5b2a9f10",
+	}
+	// uploads can happen before the chat row is written
+	if err := h.AddAttachment(ctx, a); err != nil {
+		t.Fatalf("AddAttachment: %v", err)
+	}
+	if err := h.AddAttachment(ctx, a); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate attachment: expected ErrConflict, got %v", err)
+	}
+	if _, err := h.GetAttachment(ctx, "6f1c0000-0000-0000-0000-000000000000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing attachment: expected ErrNotFound, got %v", err)
+	}
+
+	if err := h.ChatStart(ctx, chat, "2024-02-20 15:50:20.123456"); err != nil {
+		t.Fatalf("ChatStart: %v", err)
+	}
+	if err := h.AddMessageWithAttachments(ctx, "6f1c0000-0000-0000-0000-000000000000", user.ID, "wrong chat", "2024-02-20 15:50:21.000000", []string{a.ID}); !errors.Is(err, ErrMissingReference) {
+		t.Errorf("attachment from another chat: expected ErrMissingReference, got %v", err)
+	}
+	if err := h.AddMessageWithAttachments(ctx, chat, user.ID, "here it is", "2024-02-20 15:50:22.000000", []string{a.ID}); err != nil {
+		t.Fatalf("AddMessageWithAttachments: %v", err)
+	}
+	if err := h.AddMessageWithAttachments(ctx, chat, user.ID, "again", "2024-02-20 15:50:23.000000", []string{a.ID}); !errors.Is(err, ErrMissingReference) {
+		t.Errorf("attachment sent twice: expected ErrMissingReference, got %v", err)
+	}
+
+	got, err := h.GetAttachment(ctx, a.ID)
+	if err != nil || got.MessageID == 0 || got.Name != a.Name || got.Size != a.Size || got.ChatUUID != chat {
+		t.Errorf("GetAttachment = %+v, %v", got, err)
+	}
+	// the failed sends must not have left messages behind
+	if messages, err := h.GetAllMessagesByUUID(ctx, chat); err != nil || len(messages) != 1 {
+		t.Errorf("GetAllMessagesByUUID = %+v, %v", messages, err)
+	}
+}
+
+func TestSqlLiteAddMessages(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	const chat = "d935fb72-796d-4418-8a36-bc228d143790"
+	if err := h.ChatStart(ctx, chat, "2024-02-20 15:50:20.123456"); err != nil {
+		t.Fatalf("ChatStart: %v", err)
+	}
+	// more than one statement's worth
+	messages := make([]ChatMessage, maxInsertRows+2)
+	for i := range messages {
+		messages[i] = ChatMessage{ChatUUID: strings.ToUpper(chat), UserID: 1, Message: fmt.Sprint(i), Time: "2024-02-20 15:50:21.000000"}
+	}
+	if err := h.AddMessages(ctx, messages); err != nil {
+		t.Fatalf("AddMessages: %v", err)
+	}
+	got, err := h.GetAllMessagesByUUID(ctx, chat)
+	if err != nil || len(got) != len(messages) {
+		t.Fatalf("GetAllMessagesByUUID = %d messages, %v", len(got), err)
+	}
+
+	// a message for a chat that does not exist fails the whole batch
+	err = h.AddMessages(ctx, []ChatMessage{
+		{ChatUUID: chat, UserID: 1, Message: "kept?", Time: "2024-02-20 15:50:22.000000"},
+		{ChatUUID: "6f1c0000-0000-0000-0000-000000000000", UserID: 1, Message: "no chat", Time: "2024-02-20 15:50:22.000000"},
+	})
+	if !errors.Is(err, ErrMissingReference) {
+		t.Errorf("message for a missing chat: expected ErrMissingReference, got %v", err)
+	}
+	if got, _ := h.GetAllMessagesByUUID(ctx, chat); len(got) != len(messages) {
+		t.Errorf("expected the failed batch to store nothing, got %d messages", len(got))
+	}
+}
+
+func TestSqlLiteEventIDs(t *testing.T) {
+	ctx := context.Background()
+	h := newTestSqlLiteHandler(t)
+
+	const chat = "5b0f6c3e-58a6-4c5e-9d0a-1f3ad3c1b7e2"
+	if err := h.ChatStart(WithEventID(ctx, "start"), chat, "2024-02-20 15:50:20.123456"); err != nil {
+		t.Fatalf("ChatStart: %v", err)
+	}
+	if err := h.ChatStart(WithEventID(ctx, "start"), chat, "2024-02-20 15:50:20.123456"); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Errorf("ChatStart redelivered: expected ErrAlreadyProcessed, got %v", err)
+	}
+	if err := h.JoinChatParticipant(WithEventID(ctx, "join"), chat, 1, "2024-02-20 15:50:21.000000"); err != nil {
+		t.Fatalf("JoinChatParticipant: %v", err)
+	}
+	if err := h.JoinChatParticipant(WithEventID(ctx, "join"), chat, 1, "2024-02-20 15:50:21.000000"); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Errorf("JoinChatParticipant redelivered: expected ErrAlreadyProcessed, got %v", err)
+	}
+	if err := h.AddMessageByUUID(WithEventID(ctx, "hello"), chat, 1, "hello", "2024-02-20 15:50:22.000000"); err != nil {
+		t.Fatalf("AddMessageByUUID: %v", err)
+	}
+	if err := h.AddMessageByUUID(WithEventID(ctx, "hello"), chat, 1, "hello", "2024-02-20 15:50:22.000000"); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Errorf("AddMessageByUUID redelivered: expected ErrAlreadyProcessed, got %v", err)
+	}
+	if participants, err := h.GetOngoingChatParticipants(ctx); err != nil || len(participants) != 1 {
+		t.Errorf("GetOngoingChatParticipants = %+v, %v", participants, err)
+	}
+
+	// a change that fails does not record its event, so it can be retried
+	const other = "0c1d2e3f-4a5b-4c6d-8e7f-8091a2b3c4d5"
+	if err := h.ChatEnd(WithEventID(ctx, "end"), other, "2024-02-20 15:50:23.000000"); !errors.Is(err, ErrNoRowsChanged) {
+		t.Fatalf("ChatEnd of a missing chat: expected ErrNoRowsChanged, got %v", err)
+	}
+	if err := h.ChatStart(ctx, other, "2024-02-20 15:50:20.000000"); err != nil {
+		t.Fatalf("ChatStart: %v", err)
+	}
+	if err := h.ChatEnd(WithEventID(ctx, "end"), other, "2024-02-20 15:50:23.000000"); err != nil {
+		t.Errorf("ChatEnd retried: %v", err)
+	}
+
+	// batches skip messages already stored, and repeats within the batch
+	err := h.AddMessages(ctx, []ChatMessage{
+		{ChatUUID: chat, UserID: 1, Message: "hello", Time: "2024-02-20 15:50:22.000000", EventID: "hello"},
+		{ChatUUID: chat, UserID: 1, Message: "new", Time: "2024-02-20 15:50:24.000000", EventID: "new"},
+		{ChatUUID: chat, UserID: 1, Message: "new", Time: "2024-02-20 15:50:24.000000", EventID: "new"},
+		{ChatUUID: chat, UserID: 1, Message: "no id", Time: "2024-02-20 15:50:25.000000"},
+	})
+	if err != nil {
+		t.Fatalf("AddMessages: %v", err)
+	}
+	messages, err := h.GetAllMessagesByUUID(ctx, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, m := range messages {
+		texts = append(texts, m.Message)
+	}
+	if strings.Join(texts, ",") != "hello,new,no id" {
+		t.Errorf("expected each event's message stored once, got %q", texts)
+	}
+}
@@ -0,0 +1,169 @@
+// Package events defines the envelope used for every message published to
+// the broker by the chat service and read by the consumer and app services,
+// which import it from the api module.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the envelope version written by this package. Decode
+// accepts any version up to and including this one.
+const SchemaVersion = 1
+
+type EventType string
+
+const (
+	ChatStarted       EventType = "chat_started"
+	ParticipantJoined EventType = "participant_joined"
+	ParticipantLeft   EventType = "participant_left"
+	MessagePosted     EventType = "message_posted"
+	ChatEnded         EventType = "chat_ended"
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported event schema version")
+var ErrUnknownType = errors.New("unknown event type")
+
+// Event is the versioned envelope sent over the broker. ID is unique to each
+// event and stays the same when it is redelivered, so it can be used to apply
+// the event only once. Events converted from legacy messages have none.
+type Event struct {
+	ID      string    `json:"id,omitempty"`
+	Version int       `json:"version"`
+	Type    EventType `json:"type"`
+	Payload Payload   `json:"payload"`
+}
+
+// Payload carries the data for an event. Which fields are set depends on the
+// event type, e.g. Text is only set for message_posted.
+type Payload struct {
+	Roomid  string `json:"roomid"`
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+	Text    string `json:"text,omitempty"`
+	UserID  int64  `json:"userid,omitempty"`
+	Time    string `json:"time"`
+	// ids of the uploaded files sent with a message
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// LegacyMessage is the pre-envelope message format, where the event type was
+// inferred from MessageText. It is only accepted by Decode while producers are
+// being migrated.
+type LegacyMessage struct {
+	Roomid      string `json:"roomid"`
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	MessageText string `json:"messagetext"`
+	UserID      int64  `json:"userid"`
+	Time        string `json:"time"`
+}
+
+// magic strings used by the legacy format to mark non message events
+const (
+	legacyChatStarted       = "Start of chat"
+	legacyParticipantJoined = "User joined chat"
+	legacyParticipantLeft   = "User left chat"
+	legacyChatEnded         = "End of chat"
+)
+
+// New creates an event with a new random ID
+func New(eventType EventType, payload Payload) Event {
+	return Event{
+		ID:      newID(),
+		Version: SchemaVersion,
+		Type:    eventType,
+		Payload: payload,
+	}
+}
+
+// a random (version 4) UUID
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (t EventType) Valid() bool {
+	switch t {
+	case ChatStarted, ParticipantJoined, ParticipantLeft, MessagePosted, ChatEnded:
+		return true
+	}
+	return false
+}
+
+func (e Event) Marshal() ([]byte, error) {
+	if !e.Type.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, e.Type)
+	}
+	return json.Marshal(e)
+}
+
+// Decode reads either a versioned envelope or a legacy message from body.
+func Decode(body []byte) (Event, error) {
+	var probe struct {
+		Version int       `json:"version"`
+		Type    EventType `json:"type"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return Event{}, err
+	}
+
+	if probe.Version == 0 && probe.Type == "" {
+		var lm LegacyMessage
+		if err := json.Unmarshal(body, &lm); err != nil {
+			return Event{}, err
+		}
+		return FromLegacy(lm), nil
+	}
+
+	if probe.Version < 1 || probe.Version > SchemaVersion {
+		return Event{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, probe.Version)
+	}
+	if !probe.Type.Valid() {
+		return Event{}, fmt.Errorf("%w: %q", ErrUnknownType, probe.Type)
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		return Event{}, err
+	}
+	return e, nil
+}
+
+// FromLegacy converts a legacy message into an event, using the old
+// MessageText conventions to work out the event type. Legacy messages have no
+// id, and the event is given none as it would differ on each redelivery.
+func FromLegacy(lm LegacyMessage) Event {
+	e := Event{
+		Version: SchemaVersion,
+		Payload: Payload{
+			Roomid:  lm.Roomid,
+			Name:    lm.Name,
+			Address: lm.Address,
+			UserID:  lm.UserID,
+			Time:    lm.Time,
+		},
+	}
+	switch lm.MessageText {
+	case legacyChatStarted:
+		e.Type = ChatStarted
+	case legacyParticipantJoined:
+		e.Type = ParticipantJoined
+	case legacyParticipantLeft:
+		e.Type = ParticipantLeft
+	case legacyChatEnded:
+		e.Type = ChatEnded
+	default: //must be a message
+		e.Type = MessagePosted
+		e.Payload.Text = lm.MessageText
+	}
+	return e
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	t.Run("message text is never treated as an event type", func(t *testing.T) {
+		b, err := New(MessagePosted, Payload{Roomid: "room", Text: "End of chat", UserID: 3}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := Decode(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if e.Type != MessagePosted || e.Payload.Text != "End of chat" {
+			t.Errorf("expected message_posted with original text, got %+v", e)
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		_, err := Decode([]byte(`{"version":99,"type":"chat_started","payload":{"roomid":"room"}}`))
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := Decode([]byte(`{"version":1,"type":"chat_exploded","payload":{"roomid":"room"}}`))
+		if !errors.Is(err, ErrUnknownType) {
+			t.Errorf("expected ErrUnknownType, got %v", err)
+		}
+	})
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	cases := map[string]EventType{
+		"Start of chat":    ChatStarted,
+		"User joined chat": ParticipantJoined,
+		"User left chat":   ParticipantLeft,
+		"End of chat":      ChatEnded,
+		"hello":            MessagePosted,
+	}
+	for text, want := range cases {
+		body := []byte(`{"roomid":"room","messagetext":"` + text + `","userid":4,"time":"2024-02-20 15:50:20.123456"}`)
+		e, err := Decode(body)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", text, err)
+		}
+		if e.Type != want {
+			t.Errorf("%q: expected %s, got %s", text, want, e.Type)
+		}
+		if e.Version != SchemaVersion || e.Payload.Roomid != "room" || e.Payload.UserID != 4 {
+			t.Errorf("%q: payload not converted: %+v", text, e)
+		}
+	}
+}
+
+func TestEventIDs(t *testing.T) {
+	a := New(ChatStarted, Payload{Roomid: "room"})
+	b := New(ChatStarted, Payload{Roomid: "room"})
+	if a.ID == "" || a.ID == b.ID {
+		t.Fatalf("expected each event to get its own id, got %q and %q", a.ID, b.ID)
+	}
+
+	body, err := a.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != a.ID {
+		t.Errorf("expected id %q to survive being sent, got %q", a.ID, e.ID)
+	}
+
+	e, err = Decode([]byte(`{"roomid":"room","messagetext":"hello","userid":4,"time":"2024-02-20 15:50:20.123456"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "" {
+		t.Errorf("expected legacy messages to have no id, got %q", e.ID)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/google/uuid"
+)
+
+var errJoinDisabled = errors.New("chat join tokens are not configured")
+
+type VisitorJoinRequest struct {
+	Name string `json:"name"`
+}
+
+type VisitorResumeRequest struct {
+	ResumeToken string `json:"resume_token"`
+}
+
+type AgentJoinRequest struct {
+	RoomID string `json:"roomid"`
+}
+
+// returned with a join token, which is passed to the chat service as
+// /ws?token=<token> and is only valid for roomid
+type JoinResponse struct {
+	UserID    int64  `json:"userid"`
+	RoomID    string `json:"roomid"`
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"` //seconds until the token expires
+
+	// visitors also get a resume token, which is exchanged at
+	// /api/chat/visitorresume for a new join token to the same room
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// starts a new chat for a visitor, finding or creating their external user and
+// returning a token for a newly generated room
+func joinChatAsVisitor(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, signer *auth.JoinTokenSigner, serviceToken string) {
+	respondJson(&w)
+
+	if signer == nil {
+		http.Error(w, errJoinDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var vjr VisitorJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&vjr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if vjr.Name == "" {
+		http.Error(w, errors.New("name must be provided").Error(), http.StatusBadRequest)
+		return
+	}
+	ip := visitorIP(r, serviceToken)
+
+	log.Println("Visitor join api request")
+
+	eu, err := dbqh.GetExternalUser(r.Context(), vjr.Name, ip)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		eu, err = dbqh.AddExternalUser(r.Context(), vjr.Name, ip)
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJoinToken(w, signer, eu.ID, auth.VisitorRole, eu.Name, uuid.NewString(), true)
+}
+
+// the address a visitor joined from. Only the user site, which passes joins on
+// with the service token, is trusted to give it in X-Forwarded-For, anyone
+// else is recorded under the address they connected from.
+func visitorIP(r *http.Request, serviceToken string) string {
+	if fromService(r, serviceToken) {
+		if forwarded := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); forwarded != "" {
+			return forwarded
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lets a visitor back into their room after a refresh or dropped connection.
+// Once the chat has ended, its grace period having passed with nobody in the
+// room, 410 is returned and the visitor has to start a new chat.
+func resumeChatAsVisitor(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, signer *auth.JoinTokenSigner) {
+	respondJson(&w)
+
+	if signer == nil {
+		http.Error(w, errJoinDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var vrr VisitorResumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&vrr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	claims, err := signer.ParseResume(vrr.ResumeToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	userID, _ := claims.UserID()
+
+	log.Println("Visitor resume api request:", userID, claims.Room)
+
+	active, err := dbqh.RoomActive(r.Context(), claims.Room)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	if !active {
+		http.Error(w, "chat has ended", http.StatusGone)
+		return
+	}
+
+	writeJoinToken(w, signer, userID, auth.VisitorRole, claims.Name, claims.Room, true)
+}
+
+// lets an agent holding chats.join into an existing room
+func joinChatAsAgent(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, signer *auth.JoinTokenSigner) {
+	respondJson(&w)
+
+	if signer == nil {
+		http.Error(w, errJoinDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var ajr AgentJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&ajr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room, err := uuid.Parse(ajr.RoomID)
+	if err != nil {
+		http.Error(w, "roomid must be a uuid", http.StatusBadRequest)
+		return
+	}
+
+	id, _ := auth.IdentityFromContext(r.Context())
+	log.Println("Agent join api request:", id.UserID, room)
+
+	if status, err := joinableRoom(r, dbqh, room.String()); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	iu, err := dbqh.GetInternalUserByID(r.Context(), id.UserID)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	role, err := dbqh.GetRole(r.Context(), iu.RoleID)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJoinToken(w, signer, iu.ID, role.Description, fmt.Sprintf("%s %s", iu.FirstName, iu.Surname), room.String(), false)
+}
+
+// checks room is a chat in progress, either with members in it or its grace
+// period, or recorded as started and not yet ended
+func joinableRoom(r *http.Request, dbqh dbquery.DBQueryHandler, room string) (int, error) {
+	active, err := dbqh.RoomActive(r.Context(), room)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if active {
+		return http.StatusOK, nil
+	}
+	ended, err := dbqh.ChatEnded(r.Context(), room)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		return http.StatusNotFound, errors.New("chat does not exist")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if ended {
+		return http.StatusConflict, errors.New("chat has ended")
+	}
+	return http.StatusOK, nil
+}
+
+// writes a join token for room, along with a resume token if resumable
+func writeJoinToken(w http.ResponseWriter, signer *auth.JoinTokenSigner, userID int64, role string, name string, room string, resumable bool) {
+	token, expiresAt, err := signer.Sign(userID, role, name, room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jr := JoinResponse{
+		UserID:    userID,
+		RoomID:    room,
+		Token:     token,
+		ExpiresIn: int64(time.Until(expiresAt).Seconds()),
+	}
+	if resumable {
+		if jr.ResumeToken, _, err = signer.SignResume(userID, name, room); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, jr)
+}
+
+// builds the join token signer from the jointokensecret, jointokenttl and
+// resumetokenttl environment variables. The secret has to match the chat
+// service's, so unlike tokensecret there is no random fallback.
+func newJoinTokenSigner() (*auth.JoinTokenSigner, error) {
+	secret := os.Getenv("jointokensecret")
+	if secret == "" {
+		return nil, errors.New("jointokensecret is not set")
+	}
+	return auth.NewJoinTokenSigner([]byte(secret), envDuration("jointokenttl", time.Minute), envDuration("resumetokenttl", time.Hour))
+}
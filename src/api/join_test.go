@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+)
+
+func newTestJoinSigner(t *testing.T) *auth.JoinTokenSigner {
+	t.Helper()
+	signer, err := auth.NewJoinTokenSigner([]byte(strings.Repeat("j", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func decodeJoin(t *testing.T, resp *http.Response) JoinResponse {
+	t.Helper()
+	var jr JoinResponse
+	if err := json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		t.Fatal(err)
+	}
+	return jr
+}
+
+func TestVisitorJoin(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+	signer := newTestJoinSigner(t)
+
+	rec := doSessionRequest(h, "POST", "/api/chat/visitorjoin", "", `{"name":"Jane"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	first := decodeJoin(t, rec.Result())
+	claims, err := signer.Parse(first.Token)
+	if id, _ := claims.UserID(); err != nil || id != first.UserID || claims.Room != first.RoomID || claims.Role != auth.VisitorRole || claims.Name != "Jane" {
+		t.Fatalf("visitor join claims = %+v, %v for %+v", claims, err, first)
+	}
+
+	second := decodeJoin(t, doSessionRequest(h, "POST", "/api/chat/visitorjoin", "", `{"name":"Jane"}`).Result())
+	if second.UserID != first.UserID || second.RoomID == first.RoomID {
+		t.Errorf("expected the same visitor in a new room, got %+v then %+v", first, second)
+	}
+}
+
+func TestVisitorJoinAddress(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	admin := users["admin"].token
+
+	ipOf := func(join JoinResponse) string {
+		t.Helper()
+		var eu ExternalUserInfo
+		rec := doSessionRequest(h, "GET", fmt.Sprintf("/api/users/getexternalbyid/%d", join.UserID), admin, "")
+		if err := json.NewDecoder(rec.Body).Decode(&eu); err != nil {
+			t.Fatalf("status %d: %v", rec.Code, err)
+		}
+		return eu.IPAddr
+	}
+	join := func(serviceToken string) JoinResponse {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/chat/visitorjoin", strings.NewReader(`{"name":"Jane","ipaddr":"10.9.9.9"}`))
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		if serviceToken != "" {
+			req.Header.Set(serviceTokenHeader, serviceToken)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return decodeJoin(t, rec.Result())
+	}
+
+	// httptest requests come from 192.0.2.1
+	if ip := ipOf(join("")); ip != "192.0.2.1" {
+		t.Errorf("joining directly: expected the connection's address, got %q", ip)
+	}
+	if ip := ipOf(join("not-the-token")); ip != "192.0.2.1" {
+		t.Errorf("with the wrong service token: expected the connection's address, got %q", ip)
+	}
+	if ip := ipOf(join(testServiceToken)); ip != "10.0.0.1" {
+		t.Errorf("through the user site: expected the forwarded address, got %q", ip)
+	}
+}
+
+func TestVisitorResume(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+	signer := newTestJoinSigner(t)
+
+	join := decodeJoin(t, doSessionRequest(h, "POST", "/api/chat/visitorjoin", "", `{"name":"Jane"}`).Result())
+	if join.ResumeToken == "" {
+		t.Fatal("expected a resume token for the visitor")
+	}
+	resume := `{"resume_token":"` + join.ResumeToken + `"}`
+
+	// the room is only known once the visitor has connected to it
+	if rec := doSessionRequest(h, "POST", "/api/chat/visitorresume", "", resume); rec.Code != http.StatusGone {
+		t.Errorf("before connecting: expected status 410, got %d", rec.Code)
+	}
+
+	presence := `{"roomid":"` + join.RoomID + `","memberid":"m1","instance":"chat-1","grace":60}`
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/join", "", presence); rec.Code != http.StatusUnauthorized {
+		t.Errorf("presence join without the service token: expected status 401, got %d", rec.Code)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/join", testServiceToken, presence); rec.Code != http.StatusOK {
+		t.Fatalf("presence join: status %d", rec.Code)
+	}
+	// the visitor's instance has no lease, as if it had crashed, so they start afresh
+	if rec := doSessionRequest(h, "POST", "/api/chat/visitorresume", "", resume); rec.Code != http.StatusGone {
+		t.Errorf("connected through an instance without a lease: expected status 410, got %d", rec.Code)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/renew", testServiceToken, `{"instance":"chat-1","lease":30}`); rec.Code != http.StatusOK {
+		t.Fatalf("renewing: status %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "POST", "/api/chat/visitorresume", "", resume); rec.Code != http.StatusOK {
+		t.Errorf("connected through a running instance: expected status 200, got %d", rec.Code)
+	}
+	rec := doServiceRequest(h, "POST", "/api/chat/presence/leave", testServiceToken, presence)
+	var left PresenceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&left); err != nil || left.Ended {
+		t.Fatalf("leaving with a grace period: %+v, %v", left, err)
+	}
+
+	rec = doSessionRequest(h, "POST", "/api/chat/visitorresume", "", resume)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("in the grace period: expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resumed := decodeJoin(t, rec.Result())
+	claims, err := signer.Parse(resumed.Token)
+	if id, _ := claims.UserID(); err != nil || id != join.UserID || claims.Room != join.RoomID || claims.Name != "Jane" || resumed.ResumeToken == "" {
+		t.Errorf("resumed join = %+v, claims %+v, %v", resumed, claims, err)
+	}
+
+	if rec := doSessionRequest(h, "POST", "/api/chat/visitorresume", "", `{"resume_token":"`+join.Token+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("join token as a resume token: expected status 401, got %d", rec.Code)
+	}
+}
+
+func TestInstanceLease(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/renew", testServiceToken, `{"instance":"chat-1"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("renewing without a lease: expected status 400, got %d", rec.Code)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/renew", testServiceToken, `{"instance":"chat-1","lease":30}`); rec.Code != http.StatusOK {
+		t.Fatalf("renewing: status %d: %s", rec.Code, rec.Body.String())
+	}
+	presence := `{"roomid":"room","memberid":"m1","instance":"chat-1"}`
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/join", testServiceToken, presence); rec.Code != http.StatusOK {
+		t.Fatalf("presence join: status %d", rec.Code)
+	}
+
+	// the lease still has time to run, so the instance's chats carry on
+	rec := doServiceRequest(h, "POST", "/api/chat/presence/expire", testServiceToken, `{"instance":"chat-2"}`)
+	var expired PresenceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&expired); err != nil || len(expired.Rooms) != 0 {
+		t.Errorf("expire while the lease lasts = %+v, %v", expired, err)
+	}
+}
+
+func TestAgentJoin(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	signer := newTestJoinSigner(t)
+	agent := users["agent"]
+
+	const room = "7d6f2f8e-3c3b-4f63-a0a5-0a3a4bb8e0f1"
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"`+room+`"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("room nobody is in: expected status 404, got %d", rec.Code)
+	}
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/renew", testServiceToken, `{"instance":"chat-1","lease":30}`); rec.Code != http.StatusOK {
+		t.Fatalf("renewing: status %d", rec.Code)
+	}
+	presence := `{"roomid":"` + room + `","memberid":"m1","instance":"chat-1"}`
+	if rec := doServiceRequest(h, "POST", "/api/chat/presence/join", testServiceToken, presence); rec.Code != http.StatusOK {
+		t.Fatalf("presence join: status %d", rec.Code)
+	}
+
+	rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"`+room+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	claims, err := signer.Parse(decodeJoin(t, rec.Result()).Token)
+	if id, _ := claims.UserID(); err != nil || id != agent.id || claims.Room != room || claims.Role != "agent" || claims.Name != "agent Test" {
+		t.Errorf("agent join claims = %+v, %v", claims, err)
+	}
+
+	// recorded as started, though this instance has not heard of anyone in it
+	const recorded = "0b7e1f3a-9c2d-4e5f-8a6b-7c8d9e0f1a2b"
+	if rec := doServiceRequest(h, "POST", "/api/chat/statusupdate", testServiceToken, `{"chatuuid":"`+recorded+`","time":"2024-02-20 15:50:20.000000"}`); rec.Code != http.StatusOK {
+		t.Fatalf("starting the chat: status %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"`+recorded+`"}`); rec.Code != http.StatusOK {
+		t.Errorf("chat in progress: expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doServiceRequest(h, "PUT", "/api/chat/statusupdate", testServiceToken, `{"chatuuid":"`+recorded+`","time":"2024-02-20 15:55:20.000000"}`); rec.Code != http.StatusOK {
+		t.Fatalf("ending the chat: status %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"`+recorded+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("ended chat: expected status 409, got %d", rec.Code)
+	}
+
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"not-a-room"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad room: expected status 400, got %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", "", `{"roomid":"`+room+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no session: expected status 401, got %d", rec.Code)
+	}
+
+	admin := users["admin"].token
+	if rec := doSessionRequest(h, "PUT", "/api/roles/3", admin, `{"permissions":[]}`); rec.Code != http.StatusOK {
+		t.Fatalf("removing chats.join from agents: status %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "POST", "/api/chat/agentjoin", agent.token, `{"roomid":"`+room+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("without chats.join: expected status 403, got %d", rec.Code)
+	}
+}
@@ -1,21 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"reflect"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/Ryan-Har/chat-app/src/api/auth"
 	"github.com/Ryan-Har/chat-app/src/api/dbquery"
-	"github.com/gorilla/handlers"
+	"github.com/Ryan-Har/chat-app/src/api/origin"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 )
 
 type ExternalUserInfo struct {
@@ -25,13 +24,17 @@ type ExternalUserInfo struct {
 	EmailAddr string `json:"email,omitempty"`
 }
 
-type idResponse struct {
-	ID int64
+func externalUserInfoFromDB(eu dbquery.ExternalUser) ExternalUserInfo {
+	return ExternalUserInfo{
+		ID:        eu.ID,
+		Name:      eu.Name,
+		IPAddr:    eu.IPAddr,
+		EmailAddr: eu.Email,
+	}
 }
 
 // responds with user information of added user
 func addExternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	var eui *ExternalUserInfo
@@ -47,32 +50,18 @@ func addExternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQuer
 	}
 	log.Println("Add external user api request:", eui)
 
-	resp, err := dbqh.AddExternalUser(eui.Name, eui.IPAddr)
+	eu, err := dbqh.AddExternalUser(r.Context(), eui.Name, eui.IPAddr)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := idResponse{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-	eui.ID = structToVerify.ID
-	err = json.NewEncoder(w).Encode(eui)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	eui.ID = eu.ID
+	writeJson(w, eui)
 }
 
 // responds with user information of added user, if exists
 func getExternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	var eui *ExternalUserInfo
@@ -88,77 +77,40 @@ func getExternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQuer
 	}
 	log.Println("Get external user api request:", eui)
 
-	resp, err := dbqh.GetExternalUser(eui.Name, eui.IPAddr)
+	eu, err := dbqh.GetExternalUser(r.Context(), eui.Name, eui.IPAddr)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := ExternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-	eui.ID, eui.EmailAddr = structToVerify.ID, structToVerify.EmailAddr
-	err = json.NewEncoder(w).Encode(eui)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
-
+	eui.ID, eui.EmailAddr = eu.ID, eu.Email
+	writeJson(w, eui)
 }
 
 func getExternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
-	idString := mux.Vars(r)["id"]
-	idInt, err := strconv.Atoi(idString)
+	id, err := idFromVars(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	eui := &ExternalUserInfo{}
-	eui.ID = int64(idInt)
-
-	log.Println("Get external user by ID api request:", eui.ID)
+	log.Println("Get external user by ID api request:", id)
 
-	resp, err := dbqh.GetExternalUserByID(eui.ID)
+	eu, err := dbqh.GetExternalUserByID(r.Context(), id)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := ExternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-
-	eui.Name, eui.IPAddr, eui.EmailAddr = structToVerify.Name, structToVerify.IPAddr, structToVerify.EmailAddr
-
-	err = json.NewEncoder(w).Encode(eui)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, externalUserInfoFromDB(eu))
 }
 
 func updateExternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
-	idString := mux.Vars(r)["id"]
-	idInt, err := strconv.Atoi(idString)
+	id, err := idFromVars(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -172,36 +124,21 @@ func updateExternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery
 		return
 	}
 	//overwrite id with int provided in the url, incase it's different to that applied in the body
-	eui.ID = int64(idInt)
+	eui.ID = id
 
 	log.Println("Update external user by ID api request:", eui.ID)
 
-	resp, err := dbqh.UpdateExternalUserByID(eui.ID, eui.Name, eui.IPAddr, eui.EmailAddr)
-	if err != nil {
-		verifyDBErrorsAndReturn(w, err)
+	eu, err := dbqh.UpdateExternalUserByID(r.Context(), eui.ID, eui.Name, eui.IPAddr, eui.EmailAddr)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
 		return
 	}
-
-	structToVerify := ExternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-	if eui.ID != structToVerify.ID {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error verifying db results. Error: %v", err)
-		return
-	}
-	err = json.NewEncoder(w).Encode(structToVerify)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
+		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
+	writeJson(w, externalUserInfoFromDB(eu))
 }
 
 func updateChatStatus(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
@@ -219,15 +156,16 @@ func updateChatStatus(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQue
 		return
 	}
 
+	ctx := eventContext(r)
 	if r.Method == "POST" {
 		log.Println("Chat start api request:", cut.ChatUUID)
-		if _, err := dbqh.ChatStart(cut.ChatUUID, verifiedTime); err != nil {
+		if err := dbqh.ChatStart(ctx, cut.ChatUUID, verifiedTime); err != nil {
 			verifyDBErrorsAndReturn(w, err)
 			return
 		}
 	} else {
 		log.Println("Chat end api request:", cut.ChatUUID)
-		if _, err := dbqh.ChatEnd(cut.ChatUUID, verifiedTime); err != nil {
+		if err := dbqh.ChatEnd(ctx, cut.ChatUUID, verifiedTime); err != nil {
 			verifyDBErrorsAndReturn(w, err)
 			return
 		}
@@ -235,7 +173,6 @@ func updateChatStatus(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQue
 }
 
 func addInternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	var iui *InternalUserInfo
@@ -245,81 +182,57 @@ func addInternalUser(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQuer
 		return
 	}
 
-	if iui.RoleID == 0 || iui.FirstName == "" || iui.Surname == "" || iui.EmailAddr == "" || iui.HashedPassword == "" {
+	if iui.RoleID == 0 || iui.FirstName == "" || iui.Surname == "" || iui.EmailAddr == "" || iui.Password == "" {
 		http.Error(w, errors.New("the following information needs to be provided: roleid, firstname, surname, email, password").Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Println("Add internal user api request:", iui)
+	log.Println("Add internal user api request:", iui.EmailAddr)
 
-	resp, err := dbqh.AddInternalUser(iui.RoleID, iui.FirstName, iui.Surname, iui.EmailAddr, iui.HashedPassword)
-	if err != nil {
-		verifyDBErrorsAndReturn(w, err)
+	if code, err := authorizeRoleAssignment(r, dbqh, iui.RoleID); err != nil {
+		http.Error(w, err.Error(), code)
 		return
 	}
 
-	structToVerify := idResponse{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
+	hash, err := auth.HashPassword(iui.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	iui.ID = structToVerify.ID
-	err = json.NewEncoder(w).Encode(iui)
+
+	iu, err := dbqh.AddInternalUser(r.Context(), iui.RoleID, iui.FirstName, iui.Surname, iui.EmailAddr, hash)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
+		verifyDBErrorsAndReturn(w, err)
 		return
 	}
+
+	writeJson(w, internalUserResponseFromDB(iu))
 }
 
 func getInternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
-	idString := mux.Vars(r)["id"]
-	idInt, err := strconv.Atoi(idString)
+	id, err := idFromVars(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	iui := &InternalUserInfo{}
-	iui.ID = int64(idInt)
+	log.Println("Get internal user by ID api request:", id)
 
-	log.Println("Get internal user by ID api request:", iui.ID)
-
-	resp, err := dbqh.GetInternalUserByID(iui.ID)
+	iu, err := dbqh.GetInternalUserByID(r.Context(), id)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := InternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-
-	err = json.NewEncoder(w).Encode(structToVerify)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, internalUserResponseFromDB(iu))
 }
 
 func updateInternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
-	idString := mux.Vars(r)["id"]
-	idInt, err := strconv.Atoi(idString)
+	id, err := idFromVars(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -332,40 +245,45 @@ func updateInternalUserByID(w http.ResponseWriter, r *http.Request, dbqh dbquery
 		return
 	}
 	//overwrite id with int provided in the url, incase it's different to that applied in the body
-	iui.ID = int64(idInt)
+	iui.ID = id
 
 	log.Println("Update internal user by ID api request:", iui.ID)
 
-	resp, err := dbqh.UpdateInternalUserByID(iui.ID, iui.RoleID, iui.FirstName, iui.Surname, iui.EmailAddr, iui.HashedPassword)
-	if err != nil {
-		verifyDBErrorsAndReturn(w, err)
+	if code, err := authorizeUserChange(r, dbqh, iui.ID); err != nil {
+		http.Error(w, err.Error(), code)
 		return
 	}
+	//a roleid of 0 leaves the current role in place
+	if iui.RoleID != 0 {
+		if code, err := authorizeRoleAssignment(r, dbqh, iui.RoleID); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+	}
 
-	structToVerify := InternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
+	//an empty password leaves the current one in place
+	var hash string
+	if iui.Password != "" {
+		if hash, err = auth.HashPassword(iui.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	if iui.ID != structToVerify.ID {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error verifying db results")
+
+	iu, err := dbqh.UpdateInternalUserByID(r.Context(), iui.ID, iui.RoleID, iui.FirstName, iui.Surname, iui.EmailAddr, hash)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
 		return
 	}
-	err = json.NewEncoder(w).Encode(structToVerify)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
+		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
+	writeJson(w, internalUserResponseFromDB(iu))
 }
 
 func addMessage(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	var cm *ChatMessageWithUuid
@@ -377,7 +295,12 @@ func addMessage(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHand
 
 	log.Println("Add chat message api request:", cm)
 
-	_, err = dbqh.AddMessageByUUID(cm.ChatUUID, cm.UserID, cm.Message, cm.Time)
+	ctx := eventContext(r)
+	if len(cm.Attachments) > 0 {
+		err = dbqh.AddMessageWithAttachments(ctx, cm.ChatUUID, cm.UserID, cm.Message, cm.Time, cm.Attachments)
+	} else {
+		err = dbqh.AddMessageByUUID(ctx, cm.ChatUUID, cm.UserID, cm.Message, cm.Time)
+	}
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
@@ -385,77 +308,54 @@ func addMessage(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHand
 }
 
 func getAllMessages(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	uuid := mux.Vars(r)["uuid"]
 
 	log.Println("get all message request for uuid api request:", uuid)
 
-	resp, err := dbqh.GetAllMessagesByUUID(uuid)
+	messages, err := dbqh.GetAllMessagesByUUID(r.Context(), uuid)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
 	respSlice := []ChatMessageWithUuid{}
-
-	for i := range resp {
-		structToVerify := ChatMessageWithUuid{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(resp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		respSlice = append(respSlice, structToVerify)
+	for _, m := range messages {
+		respSlice = append(respSlice, ChatMessageWithUuid{
+			ChatUUID: m.ChatUUID,
+			UserID:   m.UserID,
+			Message:  m.Message,
+			Time:     m.Time,
+		})
 	}
 
-	err = json.NewEncoder(w).Encode(respSlice)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, respSlice)
 }
 
-func getChatsInProgress(w http.ResponseWriter, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
+func getChatsInProgress(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
 	respondJson(&w)
 
 	log.Println("get chats in progress api request")
 
-	resp, err := dbqh.GetAllChatsInProgress()
+	chats, err := dbqh.GetAllChatsInProgress(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
 	respSlice := []ChatUuidTime{}
-
-	for i := range resp {
-		structToVerify := ChatUuidTime{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(resp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		respSlice = append(respSlice, structToVerify)
+	for _, c := range chats {
+		respSlice = append(respSlice, ChatUuidTime{
+			ChatUUID: c.UUID,
+			Time:     c.StartTime,
+		})
 	}
 
-	err = json.NewEncoder(w).Encode(respSlice)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, respSlice)
 }
 
 func chatParticipantUpdate(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
 	var jl *JoinLeave
@@ -471,15 +371,16 @@ func chatParticipantUpdate(w http.ResponseWriter, r *http.Request, dbqh dbquery.
 		return
 	}
 
+	ctx := eventContext(r)
 	if r.Method == "POST" {
 		log.Println("Join chat participant api request:", jl)
-		if _, err := dbqh.JoinChatParticipant(jl.ChatUUID, jl.UserID, verifiedTime); err != nil {
+		if err := dbqh.JoinChatParticipant(ctx, jl.ChatUUID, jl.UserID, verifiedTime); err != nil {
 			verifyDBErrorsAndReturn(w, err)
 			return
 		}
 	} else if r.Method == "PUT" {
 		log.Println("Leave chat participant api request:", jl)
-		if _, err := dbqh.LeaveChatParticipant(jl.ChatUUID, jl.UserID, verifiedTime); err != nil {
+		if err := dbqh.LeaveChatParticipant(ctx, jl.ChatUUID, jl.UserID, verifiedTime); err != nil {
 			verifyDBErrorsAndReturn(w, err)
 			return
 		}
@@ -489,177 +390,113 @@ func chatParticipantUpdate(w http.ResponseWriter, r *http.Request, dbqh dbquery.
 	}
 }
 
-func GetAllOngoingChatParticipants(w http.ResponseWriter, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
+func GetAllOngoingChatParticipants(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
 	respondJson(&w)
 
 	log.Println("Get all ongoing chat participants api request:")
 
-	resp, err := dbqh.GetOngoingChatParticipants()
+	participants, err := dbqh.GetOngoingChatParticipants(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
 	respSlice := []ChatParticipantWithUuid{}
-
-	for i := range resp {
-		structToVerify := ChatParticipantWithUuid{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(resp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		respSlice = append(respSlice, structToVerify)
+	for _, p := range participants {
+		respSlice = append(respSlice, ChatParticipantWithUuid{
+			ChatUUID: p.ChatUUID,
+			UserID:   p.UserID,
+			Active:   p.Active,
+			Internal: p.Internal,
+			Name:     p.Name,
+		})
 	}
 
-	err = json.NewEncoder(w).Encode(respSlice)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, respSlice)
 }
 
-func GetAllOngoingChatMessages(w http.ResponseWriter, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
+func GetAllOngoingChatMessages(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
 	respondJson(&w)
 
 	log.Println("Get all ongoing chat messages api request:")
 
-	resp, err := dbqh.GetOngoingChatMessages()
+	messages, err := dbqh.GetOngoingChatMessages(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
 	respSlice := []ChatMessageWithUuid{}
-
-	for i := range resp {
-		structToVerify := ChatMessageWithUuid{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(resp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		respSlice = append(respSlice, structToVerify)
+	for _, m := range messages {
+		respSlice = append(respSlice, ChatMessageWithUuid{
+			ChatUUID: m.ChatUUID,
+			UserID:   m.UserID,
+			Message:  m.Message,
+			Time:     m.Time,
+		})
 	}
 
-	err = json.NewEncoder(w).Encode(respSlice)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, respSlice)
 }
 
-func GetAllOngoingChatInformation(w http.ResponseWriter, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
+func GetAllOngoingChatInformation(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
 	respondJson(&w)
 
 	log.Println("Get all ongoing chat information api request:")
 
-	cmresp, err := dbqh.GetOngoingChatMessages()
+	messages, err := dbqh.GetOngoingChatMessages(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
-	cmSlice := []ChatMessageWithUuid{}
-
-	for i := range cmresp {
-		structToVerify := ChatMessageWithUuid{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(cmresp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		cmSlice = append(cmSlice, structToVerify)
-	}
 
-	cpresp, err := dbqh.GetOngoingChatParticipants()
+	participants, err := dbqh.GetOngoingChatParticipants(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
-	cpSlice := []ChatParticipantWithUuid{}
 
-	for i := range cpresp {
-		structToVerify := ChatParticipantWithUuid{}
-		intToStruct := interface{}(&structToVerify)
-
-		if err := convertSliceToStruct(cpresp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
-		}
-		cpSlice = append(cpSlice, structToVerify)
-	}
-
-	ctresp, err := dbqh.GetAllChatsInProgress()
+	chats, err := dbqh.GetAllChatsInProgress(r.Context())
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
-	ctSlice := []ChatUuidTime{}
 
-	for i := range ctresp {
-		structToVerify := ChatUuidTime{}
-		intToStruct := interface{}(&structToVerify)
+	chatInfo := []ChatInformation{}
 
-		if err := convertSliceToStruct(ctresp[i], intToStruct); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-			return
+	for _, c := range chats {
+		chat := ChatInformation{
+			ChatUUID:      c.UUID,
+			ChatStartTime: c.StartTime,
+			Participants:  []ChatParticipant{},
+			Messages:      []ChatMessage{},
 		}
-		ctSlice = append(ctSlice, structToVerify)
-	}
-
-	chatInfo := []ChatInformation{}
 
-	for i := range ctSlice {
-		chat := ChatInformation{}
-		chat.ChatUUID = ctSlice[i].ChatUUID
-		chat.ChatStartTime = ctSlice[i].Time
-
-		for j := range cpSlice {
-			if cpSlice[j].ChatUUID == ctSlice[i].ChatUUID {
-				participant := ChatParticipant{
-					UserID:   cpSlice[j].UserID,
-					Active:   cpSlice[j].Active,
-					Internal: cpSlice[j].Internal,
-					Name:     cpSlice[j].Name,
-				}
-				chat.Participants = append(chat.Participants, participant)
+		for _, p := range participants {
+			if p.ChatUUID == c.UUID {
+				chat.Participants = append(chat.Participants, ChatParticipant{
+					UserID:   p.UserID,
+					Active:   p.Active,
+					Internal: p.Internal,
+					Name:     p.Name,
+				})
 			}
 		}
 
-		for k := range cmSlice {
-			if cmSlice[k].ChatUUID == ctSlice[i].ChatUUID {
-				message := ChatMessage{
-					UserID:  cmSlice[k].UserID,
-					Message: cmSlice[k].Message,
-					Time:    cmSlice[k].Time,
-				}
-				chat.Messages = append(chat.Messages, message)
+		for _, m := range messages {
+			if m.ChatUUID == c.UUID {
+				chat.Messages = append(chat.Messages, ChatMessage{
+					UserID:  m.UserID,
+					Message: m.Message,
+					Time:    m.Time,
+				})
 			}
 		}
 
 		chatInfo = append(chatInfo, chat)
 	}
 
-	err = json.NewEncoder(w).Encode(chatInfo)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
-
+	writeJson(w, chatInfo)
 }
 
 type BasicUserInfo struct {
@@ -670,46 +507,31 @@ type BasicUserInfo struct {
 }
 
 func getUserInfoByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
 	respondJson(&w)
 
-	idString := mux.Vars(r)["id"]
-	idInt, err := strconv.Atoi(idString)
+	id, err := idFromVars(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	bui := &BasicUserInfo{}
-	bui.ID = int64(idInt)
+	log.Println("Get internal user by ID api request:", id)
 
-	log.Println("Get internal user by ID api request:", bui.ID)
-
-	resp, err := dbqh.GetUserInfoByID(bui.ID)
+	ui, err := dbqh.GetUserInfoByID(r.Context(), id)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := BasicUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-
-	err = json.NewEncoder(w).Encode(structToVerify)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
-	}
+	writeJson(w, BasicUserInfo{
+		ID:          ui.ID,
+		TimeCreated: ui.CreatedAt,
+		Internal:    ui.Internal,
+		Name:        ui.Name,
+	})
 }
 
-func loginWithUsernameAndPassword(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
-	enableCors(&w)
+func loginWithUsernameAndPassword(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer) {
 	respondJson(&w)
 
 	var iui *InternalUserInfo
@@ -719,82 +541,39 @@ func loginWithUsernameAndPassword(w http.ResponseWriter, r *http.Request, dbqh d
 		return
 	}
 
-	if iui.EmailAddr == "" || iui.HashedPassword == "" {
+	if iui.EmailAddr == "" || iui.Password == "" {
 		http.Error(w, errors.New("email and password must be provided").Error(), http.StatusBadRequest)
 		return
 	}
 	log.Println("Login user api request")
 
-	resp, err := dbqh.GetInternalByEmail(iui.EmailAddr)
+	iu, err := dbqh.GetInternalByEmail(r.Context(), iui.EmailAddr)
 	if err != nil {
 		verifyDBErrorsAndReturn(w, err)
 		return
 	}
 
-	structToVerify := InternalUserInfo{}
-	intToStruct := interface{}(&structToVerify)
-
-	if err := convertSliceToStruct(resp[0], intToStruct); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error converting db results to struct. Error: %v", err.Error())
-		return
-	}
-
-	if structToVerify.HashedPassword != iui.HashedPassword {
+	ok, needsRehash := auth.CheckPassword(iu.Password, iui.Password)
+	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	err = json.NewEncoder(w).Encode(structToVerify.ID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error converting result to JSON")
-		return
+	if needsRehash {
+		rehashPassword(r, dbqh, iu.ID, iui.Password)
 	}
-}
-
-// takes a slice of fields provided by a db query and a struct as an interface and converts to the requested struct as an interface.
-func convertSliceToStruct(sl []interface{}, str interface{}) error {
-	//TODO: add checking for this function to ensure that the length of each interface is correct.
-
-	strValue := reflect.ValueOf(str)
-	if strValue.Kind() == reflect.Ptr && strValue.Elem().Kind() == reflect.Struct {
-		// Iterate over the fields of the struct and set values
-		for i := 0; i < strValue.Elem().NumField(); i++ {
-
-			//skip if the slice index interface is nil
-			if checkNil(sl[i]) {
-				continue
-			}
 
-			field := strValue.Elem().Field(i)
-			fmt.Printf("content: %v, field type: %v\n", sl[i], field.Kind())
-			if field.CanSet() {
-				// Set a value based on the field type
-				switch field.Kind() {
-				case reflect.String:
-					if i < len(sl) && reflect.TypeOf(sl[i]).Kind() == reflect.String {
-						field.SetString(sl[i].(string))
-					}
-				case reflect.Int:
-					if i < len(sl) && reflect.TypeOf(sl[i]).Kind() == reflect.Int64 { //all structs should only use int64
-						field.SetInt(sl[i].(int64))
-					}
-				case reflect.Int64:
-					if i < len(sl) && reflect.TypeOf(sl[i]).Kind() == reflect.Int64 {
-						field.SetInt(sl[i].(int64))
-					}
-				case reflect.Bool:
-					if i < len(sl) && reflect.TypeOf(sl[i]).Kind() == reflect.Bool {
-						field.SetBool(sl[i].(bool))
-					}
-				}
-			}
-		}
+	startSession(w, r, dbqh, issuer, iu.ID)
+}
 
-		return nil
-	} else {
-		return fmt.Errorf("%v is not a pointer to a struct", str)
+// replaces a legacy plain text or outdated hash after a successful login. The
+// login still succeeds if this fails, it will be retried on the next one.
+func rehashPassword(r *http.Request, dbqh dbquery.DBQueryHandler, id int64, password string) {
+	hash, err := auth.HashPassword(password)
+	if err == nil {
+		_, err = dbqh.UpdateInternalUserByID(r.Context(), id, 0, "", "", "", hash)
+	}
+	if err != nil {
+		log.Println("error rehashing password for user", id, err)
 	}
 }
 
@@ -838,53 +617,86 @@ type ChatUuidTime struct {
 }
 
 type InternalUserInfo struct {
-	ID             int64  `json:"id,omitempty"`
-	RoleID         int64  `json:"roleid"`
-	FirstName      string `json:"firstname"`
-	Surname        string `json:"surname"`
-	EmailAddr      string `json:"email,omitempty"`
-	HashedPassword string `json:"password"`
+	ID        int64  `json:"id,omitempty"`
+	RoleID    int64  `json:"roleid"`
+	FirstName string `json:"firstname"`
+	Surname   string `json:"surname"`
+	EmailAddr string `json:"email,omitempty"`
+	Password  string `json:"password"` //plain text, only ever read from requests
+}
+
+// InternalUserResponse is what the API returns for an internal user, it never
+// includes the password
+type InternalUserResponse struct {
+	ID        int64  `json:"id"`
+	RoleID    int64  `json:"roleid"`
+	FirstName string `json:"firstname"`
+	Surname   string `json:"surname"`
+	EmailAddr string `json:"email,omitempty"`
+}
+
+func internalUserResponseFromDB(iu dbquery.InternalUser) InternalUserResponse {
+	return InternalUserResponse{
+		ID:        iu.ID,
+		RoleID:    iu.RoleID,
+		FirstName: iu.FirstName,
+		Surname:   iu.Surname,
+		EmailAddr: iu.Email,
+	}
 }
 
 type ChatMessageWithUuid struct {
-	ChatUUID string `json:"chatuuid"`
-	UserID   int64  `json:"userid"`
-	Message  string `json:"message"`
-	Time     string `json:"time"`
+	ChatUUID    string   `json:"chatuuid"`
+	UserID      int64    `json:"userid"`
+	Message     string   `json:"message"`
+	Time        string   `json:"time"`
+	Attachments []string `json:"attachments,omitempty"` //ids of uploaded attachments sent with the message
 }
 
 func verifyDBErrorsAndReturn(w http.ResponseWriter, err error) {
 	switch {
-	case err.Error() == "sql: no rows in result set":
+	case errors.Is(err, dbquery.ErrNotFound):
 		w.WriteHeader(http.StatusNoContent)
 		fmt.Fprintf(w, "no results")
-	case err.Error() == "pq: record not found":
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "record not found")
-	case strings.HasPrefix(err.Error(), "pq: invalid input syntax"):
+	case errors.Is(err, dbquery.ErrInvalidInput):
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err.Error())
-	case err.Error() == "no rows changed": //this is used for updates, when we're expecting a row to be updated
+	case errors.Is(err, dbquery.ErrNoRowsChanged): //this is used for updates, when we're expecting a row to be updated
 		w.WriteHeader(http.StatusUnprocessableEntity)
-	case strings.HasPrefix(err.Error(), "pq: duplicate key value violates unique constraint"):
-		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, dbquery.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
 		fmt.Fprint(w, err.Error())
-	case strings.Contains(err.Error(), "violates foreign key constraint"):
+	case errors.Is(err, dbquery.ErrMissingReference):
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		fmt.Fprint(w, err.Error())
+	case errors.Is(err, dbquery.ErrAlreadyProcessed): //a redelivered event, it was applied the first time
+		fmt.Fprint(w, "already processed")
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "error when running database query: %v", err.Error())
 	}
 }
 
-// returns true if interface is nil
-func checkNil(myInterface interface{}) bool {
-	switch myInterface.(type) {
-	case nil:
-		return true
-	default:
-		return false
+// the request's context, carrying the id of the chat event it applies from
+// the Idempotency-Key header if set, so that the event is applied only once
+func eventContext(r *http.Request) context.Context {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return dbquery.WithEventID(r.Context(), key)
+	}
+	return r.Context()
+}
+
+// returns the {id} url variable as an int64
+func idFromVars(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error converting result to JSON")
+		return
 	}
 }
 
@@ -902,88 +714,112 @@ func respondJson(w *http.ResponseWriter) {
 	(*w).Header().Set("Content-Type", "application/json")
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
+// returns the integer value of the environment variable, or def if unset or invalid
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %d", v, name, def)
+		return def
+	}
+	return i
+}
+
+// returns the duration value (e.g. 5s, 1m) of the environment variable, or def if unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %s", v, name, def)
+		return def
+	}
+	return d
+}
+
+// chooses the database backend from the dbbackend environment variable,
+// postgres (the default) or sqlite
+func newDBQueryHandler() (dbquery.DBQueryHandler, error) {
+	switch backend := os.Getenv("dbbackend"); backend {
+	case "", "postgres":
+		return dbquery.NewPostgresHandler(postgresConfig())
+	case "sqlite":
+		return dbquery.NewSqlLiteHandler(sqlLiteConfig())
+	default:
+		return nil, fmt.Errorf("unknown dbbackend %q, expected postgres or sqlite", backend)
+	}
+}
+
+func postgresConfig() dbquery.PostgresDBConfig {
+	return dbquery.PostgresDBConfig{
+		DBUser:          os.Getenv("POSTGRES_USER"),
+		DBPassword:      os.Getenv("POSTGRES_PASSWORD"),
+		DBName:          os.Getenv("POSTGRES_DB"),
+		DBHost:          os.Getenv("dbhost"),
+		DBPort:          os.Getenv("dbport"),
+		MaxOpenConns:    envInt("dbmaxopenconns", 0),
+		MaxIdleConns:    envInt("dbmaxidleconns", 0),
+		ConnMaxLifetime: envDuration("dbconnmaxlifetime", 0),
+		QueryTimeout:    envDuration("dbquerytimeout", 0),
+		SkipMigrations:  os.Getenv("dbskipmigrations") == "true",
+	}
+}
+
+func sqlLiteConfig() dbquery.SqlLiteDBConfig {
+	path := os.Getenv("sqlitepath")
+	if path == "" {
+		path = "chat-app.db"
+	}
+	return dbquery.SqlLiteDBConfig{
+		Path:           path,
+		QueryTimeout:   envDuration("dbquerytimeout", 0),
+		SkipMigrations: os.Getenv("dbskipmigrations") == "true",
+	}
 }
 
 func main() {
-	var dbuser string = os.Getenv("POSTGRES_USER")
-	var dbpassword string = os.Getenv("POSTGRES_PASSWORD")
-	var dbname string = os.Getenv("POSTGRES_DB")
-	var dbhost string = os.Getenv("dbhost")
-	var dbport string = os.Getenv("dbport")
-
-	dbQueryHandler, err := dbquery.NewPostgresHandler(dbquery.PostgresDBConfig{
-		DBUser:     dbuser,
-		DBPassword: dbpassword,
-		DBName:     dbname,
-		DBHost:     dbhost,
-		DBPort:     dbport,
-	})
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalln("migrate:", err)
+		}
+		return
+	}
+
+	dbQueryHandler, err := newDBQueryHandler()
 	if err != nil {
 		log.Panicln("error connecting to database", err.Error())
 	}
 
-	// Where ORIGIN_ALLOWED is like `scheme://dns[:port]`, or `*` (insecure)
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Accept"})
-	//originsOk := handlers.AllowedOrigins([]string{os.Getenv("ORIGIN_ALLOWED")})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	//methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "POST"})
-
-	r := mux.NewRouter()
-	r.HandleFunc("/api/users/addexternal", func(w http.ResponseWriter, r *http.Request) {
-		addExternalUser(w, r, dbQueryHandler)
-	}).Methods("POST")
-	r.HandleFunc("/api/users/getexternal", func(w http.ResponseWriter, r *http.Request) {
-		getExternalUser(w, r, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/users/getexternalbyid/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getExternalUserByID(w, r, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/users/updateexternalbyid/{id}", func(w http.ResponseWriter, r *http.Request) {
-		updateExternalUserByID(w, r, dbQueryHandler)
-	}).Methods("PUT")
-	r.HandleFunc("/api/chat/statusupdate", func(w http.ResponseWriter, r *http.Request) {
-		updateChatStatus(w, r, dbQueryHandler)
-	}).Methods("POST", "PUT")
-	r.HandleFunc("/api/users/addinternal", func(w http.ResponseWriter, r *http.Request) {
-		addInternalUser(w, r, dbQueryHandler)
-	}).Methods("POST")
-	r.HandleFunc("/api/users/getinternalbyid/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getInternalUserByID(w, r, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/users/updateinternalbyid/{id}", func(w http.ResponseWriter, r *http.Request) {
-		updateInternalUserByID(w, r, dbQueryHandler)
-	}).Methods("PUT")
-	r.HandleFunc("/api/chat/addmessage", func(w http.ResponseWriter, r *http.Request) {
-		addMessage(w, r, dbQueryHandler)
-	}).Methods("POST")
-	r.HandleFunc("/api/chat/getallmessages/{uuid}", func(w http.ResponseWriter, r *http.Request) {
-		getAllMessages(w, r, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/chat/participantupdate", func(w http.ResponseWriter, r *http.Request) {
-		chatParticipantUpdate(w, r, dbQueryHandler)
-	}).Methods("POST", "PUT")
-	r.HandleFunc("/api/chat/inprogress/time", func(w http.ResponseWriter, r *http.Request) {
-		getChatsInProgress(w, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/chat/inprogress/messages", func(w http.ResponseWriter, r *http.Request) {
-		GetAllOngoingChatMessages(w, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/chat/inprogress/participants", func(w http.ResponseWriter, r *http.Request) {
-		GetAllOngoingChatParticipants(w, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/chat/inprogress/info", func(w http.ResponseWriter, r *http.Request) {
-		GetAllOngoingChatInformation(w, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/users/getbasicbyid/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getUserInfoByID(w, r, dbQueryHandler)
-	}).Methods("GET")
-	r.HandleFunc("/api/users/login", func(w http.ResponseWriter, r *http.Request) {
-		loginWithUsernameAndPassword(w, r, dbQueryHandler)
-	}).Methods("POST")
+	tokenIssuer, err := newTokenIssuer()
+	if err != nil {
+		log.Panicln("error creating token issuer", err.Error())
+	}
+
+	joinSigner, err := newJoinTokenSigner()
+	if err != nil {
+		log.Println("chat join tokens are disabled:", err)
+	}
+
+	attachmentStore, err := newAttachmentStore()
+	if err != nil {
+		log.Println("attachments are disabled:", err)
+	}
+	attachmentLimits := attachmentLimitsFromEnv()
+
+	serviceToken := serviceTokenFromEnv()
+
+	originPolicy, err := origin.FromEnv()
+	if err != nil {
+		log.Panicln("error reading the origin policy", err.Error())
+	}
+
+	r := newRouter(dbQueryHandler, tokenIssuer, joinSigner, attachmentStore, attachmentLimits, serviceToken)
 
 	fmt.Printf("Starting server  at port 8001\n")
-	log.Fatal(http.ListenAndServe(":8001", handlers.CORS(originsOk, headersOk, methodsOk)(r)))
+	log.Fatal(http.ListenAndServe(":8001", enforceOrigins(originPolicy, r)))
 }
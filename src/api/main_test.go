@@ -1,9 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
 )
 
+func TestMain(m *testing.M) {
+	// hashing at the production cost makes the tests take minutes
+	auth.PasswordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
 func TestVerifyTimeFormat(t *testing.T) {
 	t.Run("yyyy-MM-dd HH:mm:ss.SSSSSS format", func(t *testing.T) {
 		if _, err := verifyTimeFormat("2024-02-27 15:35:20.311231"); err != nil {
@@ -17,3 +37,149 @@ func TestVerifyTimeFormat(t *testing.T) {
 		}
 	})
 }
+
+func TestVerifyDBErrorsAndReturn(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{dbquery.ErrNotFound, http.StatusNoContent},
+		{dbquery.ErrInvalidInput, http.StatusBadRequest},
+		{dbquery.ErrNoRowsChanged, http.StatusUnprocessableEntity},
+		{dbquery.ErrMissingReference, http.StatusUnprocessableEntity},
+		{dbquery.ErrConflict, http.StatusConflict},
+		{fmt.Errorf("wrapped: %w", dbquery.ErrConflict), http.StatusConflict},
+		{dbquery.ErrAlreadyProcessed, http.StatusOK},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			verifyDBErrorsAndReturn(rec, tt.err)
+			if rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d", tt.code, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRedeliveredEvents(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+	const room = "3f2a9c1e-7b4d-4e6f-a1c2-d3e4f5a6b7c8"
+	send := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(serviceTokenHeader, testServiceToken)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	requests := []struct {
+		method string
+		path   string
+		key    string
+		body   string
+	}{
+		{"POST", "/api/chat/statusupdate", "start", `{"chatuuid":"` + room + `","time":"2024-02-20 15:50:20.000000"}`},
+		{"POST", "/api/chat/participantupdate", "join", `{"chatuuid":"` + room + `","userid":1,"time":"2024-02-20 15:50:21.000000"}`},
+		{"POST", "/api/chat/addmessage", "hello", `{"chatuuid":"` + room + `","userid":1,"message":"hello","time":"2024-02-20 15:50:22.000000"}`},
+	}
+	for _, req := range requests {
+		for i := 0; i < 2; i++ {
+			if rec := send(req.method, req.path, req.key, req.body); rec.Code != http.StatusOK {
+				t.Fatalf("%s delivery %d: expected status 200, got %d: %s", req.key, i+1, rec.Code, rec.Body.String())
+			}
+		}
+	}
+	// without a key the message is stored again
+	send("POST", "/api/chat/addmessage", "", requests[2].body)
+
+	rec := send("GET", "/api/chat/getallmessages/"+room, "", "")
+	if n := strings.Count(rec.Body.String(), `"hello"`); n != 2 {
+		t.Errorf("expected the message stored once per key, got %d: %s", n, rec.Body.String())
+	}
+}
+
+func TestLoginRehashesLegacyPassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
+
+	mockDBQuery.EXPECT().GetInternalByEmail(gomock.Any(), "admin@example.com").
+		Return(dbquery.InternalUser{ID: 1, Email: "admin@example.com", Password: "password"}, nil)
+	mockDBQuery.EXPECT().UpdateInternalUserByID(gomock.Any(), int64(1), int64(0), "", "", "", gomock.Any()).
+		DoAndReturn(func(_ context.Context, id, roleID int64, firstname, surname, email, password string) (dbquery.InternalUser, error) {
+			if ok, rehash := auth.CheckPassword(password, "password"); !ok || rehash {
+				t.Errorf("expected a current bcrypt hash of the password, got %q", password)
+			}
+			return dbquery.InternalUser{ID: id, Password: password}, nil
+		})
+
+	mockDBQuery.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+
+	req := httptest.NewRequest("POST", "/api/users/login", strings.NewReader(`{"email":"admin@example.com","password":"password"}`))
+	rec := httptest.NewRecorder()
+	loginWithUsernameAndPassword(rec, req, mockDBQuery, newTestTokenIssuer(t))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestLoginRejectsWrongPassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
+
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockDBQuery.EXPECT().GetInternalByEmail(gomock.Any(), "jane@example.com").
+		Return(dbquery.InternalUser{ID: 2, Password: hash}, nil)
+
+	req := httptest.NewRequest("POST", "/api/users/login", strings.NewReader(`{"email":"jane@example.com","password":"guess"}`))
+	rec := httptest.NewRecorder()
+	loginWithUsernameAndPassword(rec, req, mockDBQuery, newTestTokenIssuer(t))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestInternalUserResponsesOmitPassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDBQuery := mock_dbquery.NewMockDBQueryHandler(ctrl)
+
+	stored := dbquery.InternalUser{ID: 2, RoleID: 1, FirstName: "Jane", Surname: "Doe", Email: "jane@example.com", Password: "$2a$12$secrethash"}
+	mockDBQuery.EXPECT().GetRole(gomock.Any(), int64(1)).Return(dbquery.Role{ID: 1, Permissions: []string{"users.manage"}}, nil)
+	mockDBQuery.EXPECT().GetUserPermissions(gomock.Any(), int64(2)).Return([]string{"users.manage"}, nil)
+	mockDBQuery.EXPECT().AddInternalUser(gomock.Any(), int64(1), "Jane", "Doe", "jane@example.com", gomock.Not("secret")).Return(stored, nil)
+	mockDBQuery.EXPECT().GetInternalUserByID(gomock.Any(), int64(2)).Return(stored, nil)
+	mockDBQuery.EXPECT().UpdateInternalUserByID(gomock.Any(), int64(2), int64(0), "Janet", "", "", "").Return(stored, nil)
+
+	requests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request, dbquery.DBQueryHandler)
+		req     *http.Request
+	}{
+		{"add", addInternalUser, httptest.NewRequest("POST", "/", strings.NewReader(`{"roleid":1,"firstname":"Jane","surname":"Doe","email":"jane@example.com","password":"secret"}`))},
+		{"get", getInternalUserByID, mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"id": "2"})},
+		{"update", updateInternalUserByID, mux.SetURLVars(httptest.NewRequest("PUT", "/", strings.NewReader(`{"firstname":"Janet"}`)), map[string]string{"id": "2"})},
+	}
+	admin := auth.NewPermissionSet([]string{"users.read", "users.manage"})
+	for _, tt := range requests {
+		ctx := auth.ContextWithIdentity(tt.req.Context(), auth.Identity{UserID: 1})
+		ctx = auth.ContextWithPermissions(ctx, admin)
+		rec := httptest.NewRecorder()
+		tt.handler(rec, tt.req.WithContext(ctx), mockDBQuery)
+		if body := rec.Body.String(); strings.Contains(body, "password") || strings.Contains(body, "secret") {
+			t.Errorf("%s: response contains the password: %s", tt.name, body)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/migrations"
+)
+
+const migrateUsage = "usage: migrate status | up | down | to <version>"
+
+// handles the migrate subcommand, e.g. `main migrate status`. The database is
+// chosen with the same environment variables the API uses.
+func runMigrate(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, dialect, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db, dialect)
+	if err != nil {
+		return err
+	}
+	return migrateCommand(context.Background(), migrator, args, out)
+}
+
+func migrateCommand(ctx context.Context, migrator *migrations.Migrator, args []string, out io.Writer) error {
+	switch args[0] {
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+	case "up":
+		if err := migrator.Up(ctx); err != nil {
+			return err
+		}
+	case "down":
+		if err := migrator.Down(ctx); err != nil {
+			return err
+		}
+	case "to":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := migrator.To(ctx, version); err != nil {
+			return err
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	version, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema at version %d (latest %d)\n", version, migrator.Latest())
+	return nil
+}
+
+// opens the configured database without migrating it
+func openDB() (*sql.DB, migrations.Dialect, error) {
+	switch backend := os.Getenv("dbbackend"); backend {
+	case "", "postgres":
+		db, err := dbquery.OpenPostgres(postgresConfig())
+		return db, migrations.Postgres, err
+	case "sqlite":
+		db, err := dbquery.OpenSqlLite(sqlLiteConfig())
+		return db, migrations.SqlLite, err
+	default:
+		return nil, "", fmt.Errorf("unknown dbbackend %q, expected postgres or sqlite", backend)
+	}
+}
@@ -0,0 +1,293 @@
+// Package migrations keeps the database schema up to date. Migrations are
+// numbered sql files embedded per dialect, named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, and the versions applied to a database are
+// recorded in its schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SqlLite  Dialect = "sqlite"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+var (
+	ErrUnknownDialect = errors.New("unknown migration dialect")
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration //sorted by version
+}
+
+// returns a Migrator for the migrations embedded for dialect
+func New(db *sql.DB, dialect Dialect) (*Migrator, error) {
+	migrations, err := load(files, string(dialect))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// reads every migration in dir, checking each version has both an up and a down file
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDialect, dir)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has more than one name: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// the highest version available to apply
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// the highest version applied to the database, 0 if none are
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// lists every known migration and whether it has been applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		at, ok := applied[mig.Version]
+		status = append(status, Status{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return status, nil
+}
+
+// applies every migration which has not been applied yet
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// rolls back the most recently applied migration, if there is one
+func (m *Migrator) Down(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil || version == 0 {
+		return err
+	}
+
+	previous := 0
+	for _, mig := range m.migrations {
+		if mig.Version < version {
+			previous = mig.Version
+		}
+	}
+	return m.To(ctx, previous)
+}
+
+// applies or rolls back migrations until exactly the versions up to and
+// including version are applied. Version 0 rolls back everything.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	for _, mig := range m.migrations {
+		if mig.Version <= version {
+			if err := m.run(ctx, mig, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if mig := m.migrations[i]; mig.Version > version {
+			if err := m.run(ctx, mig, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// returns the applied versions and when they were applied
+func (m *Migrator) applied(ctx context.Context) (map[int]string, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, CAST(applied_at AS VARCHAR) FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]string{}
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// applies (up) or rolls back (down) a single migration in its own transaction.
+// Nothing happens if the migration is already in the requested state, which is
+// checked after taking the lock so API replicas starting together do not race.
+func (m *Migrator) run(ctx context.Context, mig Migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.dialect == Postgres {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))"); err != nil {
+			return err
+		}
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations WHERE version = "+m.placeholder(1), mig.Version).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if (count > 0) == up {
+		return nil
+	}
+
+	if up {
+		if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+			return fmt.Errorf("applying migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ("+m.placeholder(1)+", "+m.placeholder(2)+")", mig.Version, mig.Name)
+	} else {
+		if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = "+m.placeholder(1), mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) placeholder(n int) string {
+	if m.dialect == Postgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
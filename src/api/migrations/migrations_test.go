@@ -0,0 +1,158 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file::memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	for _, dialect := range []Dialect{Postgres, SqlLite} {
+		migrations, err := load(files, string(dialect))
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		if len(migrations) == 0 || migrations[0].Version != 1 || migrations[0].Name != "baseline" {
+			t.Errorf("%s: expected baseline as the first migration, got %+v", dialect, migrations)
+		}
+	}
+
+	if _, err := New(nil, "mysql"); !errors.Is(err, ErrUnknownDialect) {
+		t.Errorf("expected ErrUnknownDialect, got %v", err)
+	}
+}
+
+func TestLoadRejectsIncompleteMigrations(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"d/0001_a.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"bad name": {
+			"d/1-a.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"two names": {
+			"d/0001_a.up.sql":   {Data: []byte("SELECT 1")},
+			"d/0001_b.down.sql": {Data: []byte("SELECT 1")},
+		},
+	}
+	for name, fsys := range cases {
+		if _, err := load(fsys, "d"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMigratorUpDownTo(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	m := &Migrator{db: db, dialect: SqlLite, migrations: []Migration{
+		{Version: 1, Name: "one", Up: "CREATE TABLE one (id INTEGER)", Down: "DROP TABLE one"},
+		{Version: 2, Name: "two", Up: "CREATE TABLE two (id INTEGER)", Down: "DROP TABLE two"},
+		{Version: 5, Name: "five", Up: "CREATE TABLE five (id INTEGER)", Down: "DROP TABLE five"},
+	}}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("second Up should be a no-op: %v", err)
+	}
+	if v, _ := m.Version(ctx); v != 5 || !tableExists(t, db, "five") {
+		t.Fatalf("expected version 5 after Up, got %d", v)
+	}
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if v, _ := m.Version(ctx); v != 2 || tableExists(t, db, "five") {
+		t.Errorf("expected version 2 after Down, got %d", v)
+	}
+
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatalf("To(0): %v", err)
+	}
+	if tableExists(t, db, "one") || tableExists(t, db, "two") {
+		t.Error("expected every table to be dropped")
+	}
+
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatalf("To(2): %v", err)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.Applied != (s.Version <= 2) {
+			t.Errorf("version %d: applied = %v", s.Version, s.Applied)
+		}
+	}
+
+	if err := m.To(ctx, 3); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	m := &Migrator{db: db, dialect: SqlLite, migrations: []Migration{
+		{Version: 1, Name: "broken", Up: "CREATE TABLE half (id INTEGER); SELECT * FROM missing", Down: "DROP TABLE half"},
+	}}
+
+	if err := m.Up(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+	if v, _ := m.Version(ctx); v != 0 || tableExists(t, db, "half") {
+		t.Errorf("expected nothing to be applied, got version %d", v)
+	}
+}
+
+func TestSqlLiteBaselineRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	m, err := New(db, SqlLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m.Up(ctx); err != nil {
+			t.Fatalf("Up: %v", err)
+		}
+		var email string
+		if err := db.QueryRow("SELECT email FROM internal_users WHERE user_id = 1").Scan(&email); err != nil || email != "admin@example.com" {
+			t.Fatalf("seeded admin: %q, %v", email, err)
+		}
+		if err := m.To(ctx, 0); err != nil {
+			t.Fatalf("To(0): %v", err)
+		}
+		if tableExists(t, db, "users") {
+			t.Fatal("expected baseline down to drop users")
+		}
+	}
+}
@@ -0,0 +1,12 @@
+DROP FUNCTION IF EXISTS update_internal_user_info(INT, INT, VARCHAR, VARCHAR, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS add_internal_user(INT, VARCHAR, VARCHAR, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS update_external_user_info(INT, VARCHAR, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS add_external_user(VARCHAR, VARCHAR);
+
+DROP TABLE IF EXISTS "chat_participant";
+DROP TABLE IF EXISTS "chat_messages";
+DROP TABLE IF EXISTS "chat";
+DROP TABLE IF EXISTS "internal_users";
+DROP TABLE IF EXISTS "external_users";
+DROP TABLE IF EXISTS "users";
+DROP TABLE IF EXISTS "user_roles";
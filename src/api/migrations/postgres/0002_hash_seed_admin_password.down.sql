@@ -0,0 +1,3 @@
+UPDATE internal_users
+SET password = 'password'
+WHERE user_id = 1 AND password = '$2a$12$iXKZEBAAZOC9YlyRrzDuZuy3Nt7r0EWrD5ORfPuLLouQUZIWpLNZW';
@@ -0,0 +1,13 @@
+-- Login sessions for internal users. expires_at is in unix seconds so it is
+-- compared the same way on every backend. refresh_id is the id of the only
+-- refresh token which may currently be used, it changes on every refresh.
+CREATE TABLE IF NOT EXISTS "sessions" (
+        "id" varchar NOT NULL PRIMARY KEY,
+        "user_id" integer NOT NULL REFERENCES "users"("id"),
+        "refresh_id" varchar NOT NULL,
+        "created_at" timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        "expires_at" bigint NOT NULL,
+        "revoked" BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS "sessions_user_id" ON "sessions" ("user_id");
@@ -0,0 +1,21 @@
+-- Permissions held by each role, see auth/permissions.go for the ones the API checks.
+CREATE TABLE IF NOT EXISTS "role_permissions" (
+        "role_id" integer NOT NULL REFERENCES "user_roles"("id") ON DELETE CASCADE,
+        "permission" varchar NOT NULL,
+        PRIMARY KEY ("role_id", "permission")
+);
+
+insert into user_roles (id, description) values (2, 'supervisor') on conflict do nothing;
+insert into user_roles (id, description) values (3, 'agent') on conflict do nothing;
+
+SELECT SETVAL((SELECT PG_GET_SERIAL_SEQUENCE('"user_roles"', 'id')), (SELECT (MAX("id") + 1) FROM "user_roles"), FALSE);
+
+insert into role_permissions (role_id, permission) values
+    (1, 'users.read'),
+    (1, 'users.manage'),
+    (1, 'roles.read'),
+    (1, 'roles.manage'),
+    (2, 'users.read'),
+    (2, 'users.manage'),
+    (2, 'roles.read')
+on conflict do nothing;
@@ -0,0 +1,6 @@
+-- Lets every built in role join chat rooms, see auth/join.go.
+insert into role_permissions (role_id, permission) values
+    (1, 'chats.join'),
+    (2, 'chats.join'),
+    (3, 'chats.join')
+on conflict do nothing;
@@ -0,0 +1,12 @@
+-- Who is connected to each chat room, across every chat service instance.
+-- Joins and leaves are serialised per room so exactly one instance sees the
+-- first member arrive and the last one go.
+CREATE TABLE IF NOT EXISTS "room_members" (
+        "room_id" varchar NOT NULL,
+        "member_id" varchar NOT NULL,
+        "instance_id" varchar NOT NULL,
+        "joined_at" timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY ("room_id", "member_id")
+);
+
+CREATE INDEX IF NOT EXISTS "room_members_instance_id" ON "room_members" ("instance_id");
@@ -0,0 +1,9 @@
+-- Rooms whose last member has left but which may still be resumed. The chat
+-- ends once ends_at, in unix seconds like sessions.expires_at, passes without
+-- anyone rejoining.
+CREATE TABLE IF NOT EXISTS "room_grace" (
+        "room_id" varchar PRIMARY KEY,
+        "ends_at" bigint NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "room_grace_ends_at" ON "room_grace" ("ends_at");
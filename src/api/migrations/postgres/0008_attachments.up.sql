@@ -0,0 +1,18 @@
+-- Files uploaded to chats, the contents are kept in the attachment store under
+-- storage_key. A file can be uploaded before the chat row has been written, so
+-- chat_uuid is not a foreign key. message_id is set once the message the file
+-- was sent with is stored.
+CREATE TABLE IF NOT EXISTS "attachments" (
+        "id" uuid PRIMARY KEY,
+        "chat_uuid" uuid NOT NULL,
+        "user_id" integer NOT NULL REFERENCES "users"("id"),
+        "message_id" integer REFERENCES "chat_messages"("id") ON DELETE SET NULL,
+        "name" varchar NOT NULL,
+        "content_type" varchar NOT NULL,
+        "size" bigint NOT NULL,
+        "storage_key" varchar NOT NULL,
+        "created_at" timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS "attachments_chat_uuid" ON "attachments" ("chat_uuid");
+CREATE INDEX IF NOT EXISTS "attachments_message_id" ON "attachments" ("message_id");
@@ -0,0 +1,9 @@
+-- IDs of the chat events already applied, so an event delivered more than
+-- once is only applied the first time. Rows are never needed again once an
+-- event can no longer be redelivered, and can be pruned by processed_at.
+CREATE TABLE IF NOT EXISTS "processed_events" (
+        "event_id" varchar PRIMARY KEY,
+        "processed_at" timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS "processed_events_processed_at" ON "processed_events" ("processed_at");
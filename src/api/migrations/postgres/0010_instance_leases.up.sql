@@ -0,0 +1,9 @@
+-- Chat instances which are still running. Each renews its lease while it
+-- runs, and once expires_at, in unix seconds like room_grace.ends_at, passes
+-- the instance is taken to have gone and its room members are removed.
+CREATE TABLE IF NOT EXISTS "instance_leases" (
+        "instance_id" varchar PRIMARY KEY,
+        "expires_at" bigint NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "instance_leases_expires_at" ON "instance_leases" ("expires_at");
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS "chat_participant";
+DROP TABLE IF EXISTS "chat_messages";
+DROP TABLE IF EXISTS "chat";
+DROP TABLE IF EXISTS "internal_users";
+DROP TABLE IF EXISTS "external_users";
+DROP TABLE IF EXISTS "users";
+DROP TABLE IF EXISTS "user_roles";
@@ -0,0 +1,62 @@
+-- SQLite equivalent of postgres/0001_baseline.up.sql.
+-- Timestamps are stored as text in the same format postgres returns them in.
+-- The plpgsql functions have no SQLite equivalent, dbquery/sqlite.go does the same work in Go.
+
+CREATE TABLE IF NOT EXISTS "user_roles" (
+        "id" INTEGER NOT NULL PRIMARY KEY,
+        "description" TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "users" (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "created_at" TEXT NOT NULL,
+        "internal" BOOLEAN NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "external_users" (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "user_id" INTEGER NOT NULL REFERENCES "users"("id"),
+        "name" TEXT,
+        "email" TEXT,
+        "ip_address" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "internal_users" (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "user_id" INTEGER NOT NULL REFERENCES "users"("id"),
+        "role_id" INTEGER NOT NULL REFERENCES "user_roles"("id"),
+        "firstname" TEXT NOT NULL,
+        "surname" TEXT NOT NULL,
+        "email" TEXT NOT NULL,
+        "password" TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "chat" (
+        "uuid" TEXT NOT NULL PRIMARY KEY,
+        "start_time" TEXT NOT NULL,
+        "end_time" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "chat_messages" (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "chat_uuid" TEXT NOT NULL REFERENCES "chat"("uuid"),
+        "user_id_from" INTEGER NOT NULL REFERENCES "users"("id"),
+        "message" TEXT NOT NULL,
+        "timestamp" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "chat_participant" (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "chat_uuid" TEXT NOT NULL REFERENCES "chat"("uuid"),
+        "user_id" INTEGER NOT NULL REFERENCES "users"("id"),
+        "time_joined" TEXT,
+        "time_left" TEXT
+);
+
+INSERT OR IGNORE INTO user_roles (id, description) VALUES (1, 'admin');
+
+INSERT OR IGNORE INTO users (id, created_at, internal) VALUES (1, strftime('%Y-%m-%d %H:%M:%f+00', 'now'), TRUE);
+
+INSERT INTO internal_users (user_id, role_id, firstname, surname, email, password)
+SELECT 1, 1, 'admin', 'user', 'admin@example.com', 'password'
+WHERE NOT EXISTS (SELECT 1 FROM internal_users WHERE user_id = 1);
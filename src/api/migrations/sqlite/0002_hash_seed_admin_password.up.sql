@@ -0,0 +1,5 @@
+-- The baseline seeds the admin with the plain text password 'password'. Store
+-- the bcrypt hash of it instead, unless the password has already been changed.
+UPDATE internal_users
+SET password = '$2a$12$iXKZEBAAZOC9YlyRrzDuZuy3Nt7r0EWrD5ORfPuLLouQUZIWpLNZW'
+WHERE user_id = 1 AND password = 'password';
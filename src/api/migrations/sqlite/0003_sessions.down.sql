@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "sessions_user_id";
+DROP TABLE IF EXISTS "sessions";
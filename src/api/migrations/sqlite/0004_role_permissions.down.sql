@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS "role_permissions";
+
+DELETE FROM user_roles
+WHERE id IN (2, 3) AND NOT EXISTS (SELECT 1 FROM internal_users WHERE role_id = user_roles.id);
@@ -0,0 +1,18 @@
+-- Permissions held by each role, see auth/permissions.go for the ones the API checks.
+CREATE TABLE IF NOT EXISTS "role_permissions" (
+        "role_id" INTEGER NOT NULL REFERENCES "user_roles"("id") ON DELETE CASCADE,
+        "permission" TEXT NOT NULL,
+        PRIMARY KEY ("role_id", "permission")
+);
+
+insert or ignore into user_roles (id, description) values (2, 'supervisor');
+insert or ignore into user_roles (id, description) values (3, 'agent');
+
+insert or ignore into role_permissions (role_id, permission) values
+    (1, 'users.read'),
+    (1, 'users.manage'),
+    (1, 'roles.read'),
+    (1, 'roles.manage'),
+    (2, 'users.read'),
+    (2, 'users.manage'),
+    (2, 'roles.read');
@@ -0,0 +1,12 @@
+-- Who is connected to each chat room, across every chat service instance.
+-- Joins and leaves are serialised per room so exactly one instance sees the
+-- first member arrive and the last one go.
+CREATE TABLE IF NOT EXISTS "room_members" (
+        "room_id" TEXT NOT NULL,
+        "member_id" TEXT NOT NULL,
+        "instance_id" TEXT NOT NULL,
+        "joined_at" TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00', 'now')),
+        PRIMARY KEY ("room_id", "member_id")
+);
+
+CREATE INDEX IF NOT EXISTS "room_members_instance_id" ON "room_members" ("instance_id");
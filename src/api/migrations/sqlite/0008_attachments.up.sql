@@ -0,0 +1,18 @@
+-- Files uploaded to chats, the contents are kept in the attachment store under
+-- storage_key. A file can be uploaded before the chat row has been written, so
+-- chat_uuid is not a foreign key. message_id is set once the message the file
+-- was sent with is stored.
+CREATE TABLE IF NOT EXISTS "attachments" (
+        "id" TEXT PRIMARY KEY,
+        "chat_uuid" TEXT NOT NULL,
+        "user_id" INTEGER NOT NULL REFERENCES "users"("id"),
+        "message_id" INTEGER REFERENCES "chat_messages"("id") ON DELETE SET NULL,
+        "name" TEXT NOT NULL,
+        "content_type" TEXT NOT NULL,
+        "size" INTEGER NOT NULL,
+        "storage_key" TEXT NOT NULL,
+        "created_at" TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS "attachments_chat_uuid" ON "attachments" ("chat_uuid");
+CREATE INDEX IF NOT EXISTS "attachments_message_id" ON "attachments" ("message_id");
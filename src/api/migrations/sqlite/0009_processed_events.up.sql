@@ -0,0 +1,9 @@
+-- IDs of the chat events already applied, so an event delivered more than
+-- once is only applied the first time. Rows are never needed again once an
+-- event can no longer be redelivered, and can be pruned by processed_at.
+CREATE TABLE IF NOT EXISTS "processed_events" (
+        "event_id" TEXT PRIMARY KEY,
+        "processed_at" TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS "processed_events_processed_at" ON "processed_events" ("processed_at");
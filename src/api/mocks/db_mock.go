@@ -5,8 +5,11 @@
 package mock_dbquery
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
+	dbquery "github.com/Ryan-Har/chat-app/src/api/dbquery"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -33,182 +36,589 @@ func (m *MockDBQueryHandler) EXPECT() *MockDBQueryHandlerMockRecorder {
 	return m.recorder
 }
 
+// AddAttachment mocks base method.
+func (m *MockDBQueryHandler) AddAttachment(arg0 context.Context, arg1 dbquery.Attachment) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddAttachment", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddAttachment indicates an expected call of AddAttachment.
+func (mr *MockDBQueryHandlerMockRecorder) AddAttachment(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAttachment", reflect.TypeOf((*MockDBQueryHandler)(nil).AddAttachment), arg0, arg1)
+}
+
 // AddExternalUser mocks base method.
-func (m *MockDBQueryHandler) AddExternalUser(arg0, arg1 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) AddExternalUser(arg0 context.Context, arg1, arg2 string) (dbquery.ExternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddExternalUser", arg0, arg1)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "AddExternalUser", arg0, arg1, arg2)
+	ret0, _ := ret[0].(dbquery.ExternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddExternalUser indicates an expected call of AddExternalUser.
-func (mr *MockDBQueryHandlerMockRecorder) AddExternalUser(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) AddExternalUser(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddExternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).AddExternalUser), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddExternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).AddExternalUser), arg0, arg1, arg2)
 }
 
 // AddInternalUser mocks base method.
-func (m *MockDBQueryHandler) AddInternalUser(arg0 int64, arg1, arg2, arg3, arg4 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) AddInternalUser(arg0 context.Context, arg1 int64, arg2, arg3, arg4, arg5 string) (dbquery.InternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddInternalUser", arg0, arg1, arg2, arg3, arg4)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "AddInternalUser", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(dbquery.InternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddInternalUser indicates an expected call of AddInternalUser.
-func (mr *MockDBQueryHandlerMockRecorder) AddInternalUser(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) AddInternalUser(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddInternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).AddInternalUser), arg0, arg1, arg2, arg3, arg4)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddInternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).AddInternalUser), arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
 // AddMessageByUUID mocks base method.
-func (m *MockDBQueryHandler) AddMessageByUUID(arg0 string, arg1 int64, arg2, arg3 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) AddMessageByUUID(arg0 context.Context, arg1 string, arg2 int64, arg3, arg4 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddMessageByUUID", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddMessageByUUID indicates an expected call of AddMessageByUUID.
+func (mr *MockDBQueryHandlerMockRecorder) AddMessageByUUID(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessageByUUID", reflect.TypeOf((*MockDBQueryHandler)(nil).AddMessageByUUID), arg0, arg1, arg2, arg3, arg4)
+}
+
+// AddMessageWithAttachments mocks base method.
+func (m *MockDBQueryHandler) AddMessageWithAttachments(arg0 context.Context, arg1 string, arg2 int64, arg3, arg4 string, arg5 []string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddMessageByUUID", arg0, arg1, arg2, arg3)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "AddMessageWithAttachments", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddMessageWithAttachments indicates an expected call of AddMessageWithAttachments.
+func (mr *MockDBQueryHandlerMockRecorder) AddMessageWithAttachments(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessageWithAttachments", reflect.TypeOf((*MockDBQueryHandler)(nil).AddMessageWithAttachments), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+// AddMessages mocks base method.
+func (m *MockDBQueryHandler) AddMessages(arg0 context.Context, arg1 []dbquery.ChatMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddMessages", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddMessages indicates an expected call of AddMessages.
+func (mr *MockDBQueryHandlerMockRecorder) AddMessages(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessages", reflect.TypeOf((*MockDBQueryHandler)(nil).AddMessages), arg0, arg1)
+}
+
+// AddRole mocks base method.
+func (m *MockDBQueryHandler) AddRole(arg0 context.Context, arg1 string, arg2 []string) (dbquery.Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddRole", arg0, arg1, arg2)
+	ret0, _ := ret[0].(dbquery.Role)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// AddMessageByUUID indicates an expected call of AddMessageByUUID.
-func (mr *MockDBQueryHandlerMockRecorder) AddMessageByUUID(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+// AddRole indicates an expected call of AddRole.
+func (mr *MockDBQueryHandlerMockRecorder) AddRole(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMessageByUUID", reflect.TypeOf((*MockDBQueryHandler)(nil).AddMessageByUUID), arg0, arg1, arg2, arg3)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddRole", reflect.TypeOf((*MockDBQueryHandler)(nil).AddRole), arg0, arg1, arg2)
 }
 
 // ChatEnd mocks base method.
-func (m *MockDBQueryHandler) ChatEnd(arg0, arg1 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) ChatEnd(arg0 context.Context, arg1, arg2 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ChatEnd", arg0, arg1)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "ChatEnd", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ChatEnd indicates an expected call of ChatEnd.
+func (mr *MockDBQueryHandlerMockRecorder) ChatEnd(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChatEnd", reflect.TypeOf((*MockDBQueryHandler)(nil).ChatEnd), arg0, arg1, arg2)
+}
+
+// ChatEnded mocks base method.
+func (m *MockDBQueryHandler) ChatEnded(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChatEnded", arg0, arg1)
+	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// ChatEnd indicates an expected call of ChatEnd.
-func (mr *MockDBQueryHandlerMockRecorder) ChatEnd(arg0, arg1 interface{}) *gomock.Call {
+// ChatEnded indicates an expected call of ChatEnded.
+func (mr *MockDBQueryHandlerMockRecorder) ChatEnded(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChatEnd", reflect.TypeOf((*MockDBQueryHandler)(nil).ChatEnd), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChatEnded", reflect.TypeOf((*MockDBQueryHandler)(nil).ChatEnded), arg0, arg1)
 }
 
 // ChatStart mocks base method.
-func (m *MockDBQueryHandler) ChatStart(arg0, arg1 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) ChatStart(arg0 context.Context, arg1, arg2 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ChatStart", arg0, arg1)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "ChatStart", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ChatStart indicates an expected call of ChatStart.
+func (mr *MockDBQueryHandlerMockRecorder) ChatStart(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChatStart", reflect.TypeOf((*MockDBQueryHandler)(nil).ChatStart), arg0, arg1, arg2)
+}
+
+// ClearInstanceRooms mocks base method.
+func (m *MockDBQueryHandler) ClearInstanceRooms(arg0 context.Context, arg1 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearInstanceRooms", arg0, arg1)
+	ret0, _ := ret[0].([]string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// ChatStart indicates an expected call of ChatStart.
-func (mr *MockDBQueryHandlerMockRecorder) ChatStart(arg0, arg1 interface{}) *gomock.Call {
+// ClearInstanceRooms indicates an expected call of ClearInstanceRooms.
+func (mr *MockDBQueryHandlerMockRecorder) ClearInstanceRooms(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearInstanceRooms", reflect.TypeOf((*MockDBQueryHandler)(nil).ClearInstanceRooms), arg0, arg1)
+}
+
+// CreateSession mocks base method.
+func (m *MockDBQueryHandler) CreateSession(arg0 context.Context, arg1 dbquery.Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSession", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSession indicates an expected call of CreateSession.
+func (mr *MockDBQueryHandlerMockRecorder) CreateSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSession", reflect.TypeOf((*MockDBQueryHandler)(nil).CreateSession), arg0, arg1)
+}
+
+// DeleteRole mocks base method.
+func (m *MockDBQueryHandler) DeleteRole(arg0 context.Context, arg1 int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRole", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteRole indicates an expected call of DeleteRole.
+func (mr *MockDBQueryHandlerMockRecorder) DeleteRole(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRole", reflect.TypeOf((*MockDBQueryHandler)(nil).DeleteRole), arg0, arg1)
+}
+
+// ExpireInstances mocks base method.
+func (m *MockDBQueryHandler) ExpireInstances(arg0 context.Context, arg1 time.Time) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireInstances", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExpireInstances indicates an expected call of ExpireInstances.
+func (mr *MockDBQueryHandlerMockRecorder) ExpireInstances(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireInstances", reflect.TypeOf((*MockDBQueryHandler)(nil).ExpireInstances), arg0, arg1)
+}
+
+// ExpireRooms mocks base method.
+func (m *MockDBQueryHandler) ExpireRooms(arg0 context.Context, arg1 time.Time) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireRooms", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExpireRooms indicates an expected call of ExpireRooms.
+func (mr *MockDBQueryHandlerMockRecorder) ExpireRooms(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChatStart", reflect.TypeOf((*MockDBQueryHandler)(nil).ChatStart), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireRooms", reflect.TypeOf((*MockDBQueryHandler)(nil).ExpireRooms), arg0, arg1)
 }
 
 // GetAllChatsInProgress mocks base method.
-func (m *MockDBQueryHandler) GetAllChatsInProgress() ([][]interface{}, error) {
+func (m *MockDBQueryHandler) GetAllChatsInProgress(arg0 context.Context) ([]dbquery.Chat, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAllChatsInProgress")
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "GetAllChatsInProgress", arg0)
+	ret0, _ := ret[0].([]dbquery.Chat)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAllChatsInProgress indicates an expected call of GetAllChatsInProgress.
-func (mr *MockDBQueryHandlerMockRecorder) GetAllChatsInProgress() *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) GetAllChatsInProgress(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllChatsInProgress", reflect.TypeOf((*MockDBQueryHandler)(nil).GetAllChatsInProgress))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllChatsInProgress", reflect.TypeOf((*MockDBQueryHandler)(nil).GetAllChatsInProgress), arg0)
 }
 
 // GetAllMessagesByUUID mocks base method.
-func (m *MockDBQueryHandler) GetAllMessagesByUUID(arg0 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) GetAllMessagesByUUID(arg0 context.Context, arg1 string) ([]dbquery.ChatMessage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAllMessagesByUUID", arg0)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "GetAllMessagesByUUID", arg0, arg1)
+	ret0, _ := ret[0].([]dbquery.ChatMessage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAllMessagesByUUID indicates an expected call of GetAllMessagesByUUID.
-func (mr *MockDBQueryHandlerMockRecorder) GetAllMessagesByUUID(arg0 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) GetAllMessagesByUUID(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMessagesByUUID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetAllMessagesByUUID), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMessagesByUUID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetAllMessagesByUUID), arg0, arg1)
+}
+
+// GetAttachment mocks base method.
+func (m *MockDBQueryHandler) GetAttachment(arg0 context.Context, arg1 string) (dbquery.Attachment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAttachment", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.Attachment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAttachment indicates an expected call of GetAttachment.
+func (mr *MockDBQueryHandlerMockRecorder) GetAttachment(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttachment", reflect.TypeOf((*MockDBQueryHandler)(nil).GetAttachment), arg0, arg1)
 }
 
 // GetExternalUser mocks base method.
-func (m *MockDBQueryHandler) GetExternalUser(arg0, arg1 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) GetExternalUser(arg0 context.Context, arg1, arg2 string) (dbquery.ExternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetExternalUser", arg0, arg1)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "GetExternalUser", arg0, arg1, arg2)
+	ret0, _ := ret[0].(dbquery.ExternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetExternalUser indicates an expected call of GetExternalUser.
-func (mr *MockDBQueryHandlerMockRecorder) GetExternalUser(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) GetExternalUser(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).GetExternalUser), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExternalUser", reflect.TypeOf((*MockDBQueryHandler)(nil).GetExternalUser), arg0, arg1, arg2)
 }
 
 // GetExternalUserByID mocks base method.
-func (m *MockDBQueryHandler) GetExternalUserByID(arg0 int64) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) GetExternalUserByID(arg0 context.Context, arg1 int64) (dbquery.ExternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetExternalUserByID", arg0)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "GetExternalUserByID", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.ExternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetExternalUserByID indicates an expected call of GetExternalUserByID.
-func (mr *MockDBQueryHandlerMockRecorder) GetExternalUserByID(arg0 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) GetExternalUserByID(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetExternalUserByID), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetExternalUserByID), arg0, arg1)
+}
+
+// GetInternalByEmail mocks base method.
+func (m *MockDBQueryHandler) GetInternalByEmail(arg0 context.Context, arg1 string) (dbquery.InternalUser, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetInternalByEmail", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.InternalUser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetInternalByEmail indicates an expected call of GetInternalByEmail.
+func (mr *MockDBQueryHandlerMockRecorder) GetInternalByEmail(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInternalByEmail", reflect.TypeOf((*MockDBQueryHandler)(nil).GetInternalByEmail), arg0, arg1)
 }
 
 // GetInternalUserByID mocks base method.
-func (m *MockDBQueryHandler) GetInternalUserByID(arg0 int64) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) GetInternalUserByID(arg0 context.Context, arg1 int64) (dbquery.InternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetInternalUserByID", arg0)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "GetInternalUserByID", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.InternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetInternalUserByID indicates an expected call of GetInternalUserByID.
-func (mr *MockDBQueryHandlerMockRecorder) GetInternalUserByID(arg0 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) GetInternalUserByID(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetInternalUserByID), arg0, arg1)
+}
+
+// GetOngoingChatMessages mocks base method.
+func (m *MockDBQueryHandler) GetOngoingChatMessages(arg0 context.Context) ([]dbquery.ChatMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOngoingChatMessages", arg0)
+	ret0, _ := ret[0].([]dbquery.ChatMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOngoingChatMessages indicates an expected call of GetOngoingChatMessages.
+func (mr *MockDBQueryHandlerMockRecorder) GetOngoingChatMessages(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOngoingChatMessages", reflect.TypeOf((*MockDBQueryHandler)(nil).GetOngoingChatMessages), arg0)
+}
+
+// GetOngoingChatParticipants mocks base method.
+func (m *MockDBQueryHandler) GetOngoingChatParticipants(arg0 context.Context) ([]dbquery.ChatParticipant, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOngoingChatParticipants", arg0)
+	ret0, _ := ret[0].([]dbquery.ChatParticipant)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOngoingChatParticipants indicates an expected call of GetOngoingChatParticipants.
+func (mr *MockDBQueryHandlerMockRecorder) GetOngoingChatParticipants(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetInternalUserByID), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOngoingChatParticipants", reflect.TypeOf((*MockDBQueryHandler)(nil).GetOngoingChatParticipants), arg0)
+}
+
+// GetRole mocks base method.
+func (m *MockDBQueryHandler) GetRole(arg0 context.Context, arg1 int64) (dbquery.Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRole", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.Role)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRole indicates an expected call of GetRole.
+func (mr *MockDBQueryHandlerMockRecorder) GetRole(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRole", reflect.TypeOf((*MockDBQueryHandler)(nil).GetRole), arg0, arg1)
+}
+
+// GetRoles mocks base method.
+func (m *MockDBQueryHandler) GetRoles(arg0 context.Context) ([]dbquery.Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRoles", arg0)
+	ret0, _ := ret[0].([]dbquery.Role)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRoles indicates an expected call of GetRoles.
+func (mr *MockDBQueryHandlerMockRecorder) GetRoles(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRoles", reflect.TypeOf((*MockDBQueryHandler)(nil).GetRoles), arg0)
+}
+
+// GetSession mocks base method.
+func (m *MockDBQueryHandler) GetSession(arg0 context.Context, arg1 string) (dbquery.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSession", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSession indicates an expected call of GetSession.
+func (mr *MockDBQueryHandlerMockRecorder) GetSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSession", reflect.TypeOf((*MockDBQueryHandler)(nil).GetSession), arg0, arg1)
+}
+
+// GetUserInfoByID mocks base method.
+func (m *MockDBQueryHandler) GetUserInfoByID(arg0 context.Context, arg1 int64) (dbquery.UserInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserInfoByID", arg0, arg1)
+	ret0, _ := ret[0].(dbquery.UserInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserInfoByID indicates an expected call of GetUserInfoByID.
+func (mr *MockDBQueryHandlerMockRecorder) GetUserInfoByID(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserInfoByID", reflect.TypeOf((*MockDBQueryHandler)(nil).GetUserInfoByID), arg0, arg1)
+}
+
+// GetUserPermissions mocks base method.
+func (m *MockDBQueryHandler) GetUserPermissions(arg0 context.Context, arg1 int64) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserPermissions", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserPermissions indicates an expected call of GetUserPermissions.
+func (mr *MockDBQueryHandlerMockRecorder) GetUserPermissions(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserPermissions", reflect.TypeOf((*MockDBQueryHandler)(nil).GetUserPermissions), arg0, arg1)
+}
+
+// JoinChatParticipant mocks base method.
+func (m *MockDBQueryHandler) JoinChatParticipant(arg0 context.Context, arg1 string, arg2 int64, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JoinChatParticipant", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// JoinChatParticipant indicates an expected call of JoinChatParticipant.
+func (mr *MockDBQueryHandlerMockRecorder) JoinChatParticipant(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JoinChatParticipant", reflect.TypeOf((*MockDBQueryHandler)(nil).JoinChatParticipant), arg0, arg1, arg2, arg3)
+}
+
+// JoinRoom mocks base method.
+func (m *MockDBQueryHandler) JoinRoom(arg0 context.Context, arg1, arg2, arg3 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JoinRoom", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// JoinRoom indicates an expected call of JoinRoom.
+func (mr *MockDBQueryHandlerMockRecorder) JoinRoom(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JoinRoom", reflect.TypeOf((*MockDBQueryHandler)(nil).JoinRoom), arg0, arg1, arg2, arg3)
+}
+
+// LeaveChatParticipant mocks base method.
+func (m *MockDBQueryHandler) LeaveChatParticipant(arg0 context.Context, arg1 string, arg2 int64, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaveChatParticipant", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LeaveChatParticipant indicates an expected call of LeaveChatParticipant.
+func (mr *MockDBQueryHandlerMockRecorder) LeaveChatParticipant(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaveChatParticipant", reflect.TypeOf((*MockDBQueryHandler)(nil).LeaveChatParticipant), arg0, arg1, arg2, arg3)
+}
+
+// LeaveRoom mocks base method.
+func (m *MockDBQueryHandler) LeaveRoom(arg0 context.Context, arg1, arg2 string, arg3 time.Duration) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaveRoom", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LeaveRoom indicates an expected call of LeaveRoom.
+func (mr *MockDBQueryHandlerMockRecorder) LeaveRoom(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaveRoom", reflect.TypeOf((*MockDBQueryHandler)(nil).LeaveRoom), arg0, arg1, arg2, arg3)
+}
+
+// RenewInstance mocks base method.
+func (m *MockDBQueryHandler) RenewInstance(arg0 context.Context, arg1 string, arg2 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RenewInstance", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RenewInstance indicates an expected call of RenewInstance.
+func (mr *MockDBQueryHandlerMockRecorder) RenewInstance(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenewInstance", reflect.TypeOf((*MockDBQueryHandler)(nil).RenewInstance), arg0, arg1, arg2)
+}
+
+// RevokeSession mocks base method.
+func (m *MockDBQueryHandler) RevokeSession(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeSession", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeSession indicates an expected call of RevokeSession.
+func (mr *MockDBQueryHandlerMockRecorder) RevokeSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeSession", reflect.TypeOf((*MockDBQueryHandler)(nil).RevokeSession), arg0, arg1)
+}
+
+// RoomActive mocks base method.
+func (m *MockDBQueryHandler) RoomActive(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RoomActive", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RoomActive indicates an expected call of RoomActive.
+func (mr *MockDBQueryHandlerMockRecorder) RoomActive(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RoomActive", reflect.TypeOf((*MockDBQueryHandler)(nil).RoomActive), arg0, arg1)
+}
+
+// RotateSessionRefresh mocks base method.
+func (m *MockDBQueryHandler) RotateSessionRefresh(arg0 context.Context, arg1, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateSessionRefresh", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RotateSessionRefresh indicates an expected call of RotateSessionRefresh.
+func (mr *MockDBQueryHandlerMockRecorder) RotateSessionRefresh(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateSessionRefresh", reflect.TypeOf((*MockDBQueryHandler)(nil).RotateSessionRefresh), arg0, arg1, arg2, arg3)
 }
 
 // UpdateExternalUserByID mocks base method.
-func (m *MockDBQueryHandler) UpdateExternalUserByID(arg0 int64, arg1, arg2, arg3 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) UpdateExternalUserByID(arg0 context.Context, arg1 int64, arg2, arg3, arg4 string) (dbquery.ExternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateExternalUserByID", arg0, arg1, arg2, arg3)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "UpdateExternalUserByID", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(dbquery.ExternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // UpdateExternalUserByID indicates an expected call of UpdateExternalUserByID.
-func (mr *MockDBQueryHandlerMockRecorder) UpdateExternalUserByID(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) UpdateExternalUserByID(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateExternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).UpdateExternalUserByID), arg0, arg1, arg2, arg3)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateExternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).UpdateExternalUserByID), arg0, arg1, arg2, arg3, arg4)
 }
 
 // UpdateInternalUserByID mocks base method.
-func (m *MockDBQueryHandler) UpdateInternalUserByID(arg0, arg1 int64, arg2, arg3, arg4, arg5 string) ([][]interface{}, error) {
+func (m *MockDBQueryHandler) UpdateInternalUserByID(arg0 context.Context, arg1, arg2 int64, arg3, arg4, arg5, arg6 string) (dbquery.InternalUser, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateInternalUserByID", arg0, arg1, arg2, arg3, arg4, arg5)
-	ret0, _ := ret[0].([][]interface{})
+	ret := m.ctrl.Call(m, "UpdateInternalUserByID", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+	ret0, _ := ret[0].(dbquery.InternalUser)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // UpdateInternalUserByID indicates an expected call of UpdateInternalUserByID.
-func (mr *MockDBQueryHandlerMockRecorder) UpdateInternalUserByID(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+func (mr *MockDBQueryHandlerMockRecorder) UpdateInternalUserByID(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateInternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).UpdateInternalUserByID), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+}
+
+// UpdateRole mocks base method.
+func (m *MockDBQueryHandler) UpdateRole(arg0 context.Context, arg1 int64, arg2 string, arg3 []string) (dbquery.Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateRole", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(dbquery.Role)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateRole indicates an expected call of UpdateRole.
+func (mr *MockDBQueryHandlerMockRecorder) UpdateRole(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateInternalUserByID", reflect.TypeOf((*MockDBQueryHandler)(nil).UpdateInternalUserByID), arg0, arg1, arg2, arg3, arg4, arg5)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateRole", reflect.TypeOf((*MockDBQueryHandler)(nil).UpdateRole), arg0, arg1, arg2, arg3)
 }
@@ -0,0 +1,179 @@
+// Package origin decides which browser origins may call a service, for CORS
+// in the api and WebSocket upgrades in the chat service, which imports it from
+// the api module.
+package origin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Policy is a set of allowed origins, with overrides for some routes. The
+// zero value allows nothing but same origin requests.
+type Policy struct {
+	allowed []pattern
+	routes  []route //longest prefix first
+}
+
+type route struct {
+	prefix  string
+	allowed []pattern
+}
+
+// pattern is an allowed origin. host may start with "*." to allow any
+// subdomain, and any is set for "*", which allows every origin.
+type pattern struct {
+	any    bool
+	scheme string
+	host   string
+	port   string
+}
+
+// reads the policy from the allowedorigins and routeorigins environment
+// variables, see Parse. Without allowedorigins every origin is allowed, as
+// before the policy existed.
+func FromEnv() (*Policy, error) {
+	allowed, ok := os.LookupEnv("allowedorigins")
+	if !ok {
+		allowed = "*"
+	}
+	return Parse(allowed, os.Getenv("routeorigins"))
+}
+
+// builds a policy from a comma separated list of origins, such as
+// "https://app.example.com,https://*.example.com", and route overrides such as
+// "/api/chat/visitorjoin=https://www.example.com;/ws=*". A request is checked
+// against the override with the longest matching path prefix, or the allowed
+// list if none match.
+func Parse(allowed string, routes string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.allowed, err = parseList(allowed); err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(routes, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		prefix, list, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("route override %q should be /path=origin,origin", entry)
+		}
+		r := route{prefix: prefix}
+		if r.allowed, err = parseList(list); err != nil {
+			return nil, fmt.Errorf("route override for %s: %w", prefix, err)
+		}
+		p.routes = append(p.routes, r)
+	}
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		return len(p.routes[i].prefix) > len(p.routes[j].prefix)
+	})
+	return p, nil
+}
+
+func parseList(list string) ([]pattern, error) {
+	var patterns []pattern
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func parsePattern(s string) (pattern, error) {
+	if s == "*" {
+		return pattern{any: true}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return pattern{}, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", s)
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return pattern{}, fmt.Errorf("invalid origin %q, wildcards are only allowed as the first label", s)
+	}
+	return pattern{scheme: strings.ToLower(u.Scheme), host: host, port: u.Port()}, nil
+}
+
+func (p pattern) matches(o *url.URL) bool {
+	if p.any {
+		return true
+	}
+	if p.scheme != strings.ToLower(o.Scheme) || p.port != o.Port() {
+		return false
+	}
+	host := strings.ToLower(o.Hostname())
+	if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == p.host
+}
+
+func (p pattern) String() string {
+	if p.any {
+		return "*"
+	}
+	s := p.scheme + "://" + p.host
+	if p.port != "" {
+		s += ":" + p.port
+	}
+	return s
+}
+
+// the patterns applying to path
+func (p *Policy) forPath(path string) (string, []pattern) {
+	for _, r := range p.routes {
+		if strings.HasPrefix(path, r.prefix) {
+			return r.prefix, r.allowed
+		}
+	}
+	return "", p.allowed
+}
+
+// checks whether a browser on origin may call path. Requests from the
+// service's own host are always allowed. The error says why an origin was
+// rejected.
+func (p *Policy) Check(path string, origin string, host string) error {
+	o, err := url.Parse(origin)
+	if err != nil || o.Scheme == "" || o.Host == "" {
+		return fmt.Errorf("malformed origin %q", origin)
+	}
+	if strings.EqualFold(o.Host, host) {
+		return nil
+	}
+	prefix, allowed := p.forPath(path)
+	for _, pat := range allowed {
+		if pat.matches(o) {
+			return nil
+		}
+	}
+	list := make([]string, len(allowed))
+	for i, pat := range allowed {
+		list[i] = pat.String()
+	}
+	if prefix != "" {
+		return fmt.Errorf("origin %s is not in the origins allowed for %s: %v", origin, prefix, list)
+	}
+	return fmt.Errorf("origin %s is not in the allowed origins: %v", origin, list)
+}
+
+// checks the request's Origin header, allowing requests without one as they
+// do not come from a browser page on another origin
+func (p *Policy) CheckRequest(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	return p.Check(r.URL.Path, origin, r.Host)
+}
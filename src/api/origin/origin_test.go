@@ -0,0 +1,79 @@
+package origin
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := Parse("https://app.example.com, https://*.example.org, http://localhost:30005", "/api/chat/visitorjoin=https://www.example.com;/api/chat=*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		path   string
+		origin string
+		ok     bool
+	}{
+		{"exact", "/api/users/login", "https://app.example.com", true},
+		{"exact, case insensitive", "/api/users/login", "https://APP.example.com", true},
+		{"wrong scheme", "/api/users/login", "http://app.example.com", false},
+		{"wrong port", "/api/users/login", "https://app.example.com:8443", false},
+		{"with port", "/api/users/login", "http://localhost:30005", true},
+		{"subdomain", "/api/users/login", "https://chat.example.org", true},
+		{"nested subdomain", "/api/users/login", "https://a.b.example.org", true},
+		{"wildcard does not cover the apex", "/api/users/login", "https://example.org", false},
+		{"suffix is not a subdomain", "/api/users/login", "https://evilexample.org", false},
+		{"unlisted", "/api/users/login", "https://evil.com", false},
+		{"same host", "/api/users/login", "http://api.internal:8001", true},
+		{"malformed", "/api/users/login", "null", false},
+		{"route override", "/api/chat/visitorjoin", "https://www.example.com", true},
+		{"route override replaces the default list", "/api/chat/visitorjoin", "https://app.example.com", false},
+		{"shorter override", "/api/chat/addmessage", "https://evil.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.path, tt.origin, "api.internal:8001")
+			if (err == nil) != tt.ok {
+				t.Errorf("Check(%s, %s) = %v, expected allowed %v", tt.path, tt.origin, err, tt.ok)
+			}
+		})
+	}
+
+	err = p.Check("/api/chat/visitorjoin", "https://evil.com", "api.internal:8001")
+	if err == nil || !strings.Contains(err.Error(), "/api/chat/visitorjoin") || !strings.Contains(err.Error(), "https://www.example.com") {
+		t.Errorf("expected the error to name the route and what it allows, got %v", err)
+	}
+}
+
+func TestParseRejectsInvalidOrigins(t *testing.T) {
+	for _, tt := range []struct{ allowed, routes string }{
+		{"example.com", ""},
+		{"https://example.com/path", ""},
+		{"https://a.*.example.com", ""},
+		{"*", "api=https://example.com"},
+		{"*", "/api=ftp//example.com"},
+	} {
+		if _, err := Parse(tt.allowed, tt.routes); err == nil {
+			t.Errorf("Parse(%q, %q): expected an error", tt.allowed, tt.routes)
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	var p Policy
+	r := httptest.NewRequest("GET", "http://chat.internal/ws", nil)
+	if err := p.CheckRequest(r); err != nil {
+		t.Errorf("without an Origin header: %v", err)
+	}
+	r.Header.Set("Origin", "http://chat.internal")
+	if err := p.CheckRequest(r); err != nil {
+		t.Errorf("same origin: %v", err)
+	}
+	r.Header.Set("Origin", "https://elsewhere.com")
+	if err := p.CheckRequest(r); err == nil {
+		t.Error("expected the zero policy to reject other origins")
+	}
+}
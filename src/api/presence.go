@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+)
+
+// sent by chat instances as participants connect and disconnect. memberid is
+// unique to the connection, so the same user can be in a room twice.
+type PresenceRequest struct {
+	RoomID   string `json:"roomid"`
+	MemberID string `json:"memberid"`
+	Instance string `json:"instance"`
+	Grace    int64  `json:"grace,omitempty"` //seconds an emptied room can be resumed for before the chat ends
+	Lease    int64  `json:"lease,omitempty"` //seconds the instance is taken to be running for, if it does not renew
+}
+
+// tells the chat instance whether the change started or ended the chat, which
+// is decided here so only one instance announces it
+type PresenceResponse struct {
+	Started bool     `json:"started,omitempty"`
+	Ended   bool     `json:"ended,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"` //rooms ended by clearing an instance, its lease running out or their grace period passing
+}
+
+func joinRoom(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	var pr PresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pr.RoomID == "" || pr.MemberID == "" || pr.Instance == "" {
+		http.Error(w, errors.New("the following information needs to be provided: roomid, memberid, instance").Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Join room api request:", pr.RoomID, pr.MemberID)
+
+	started, err := dbqh.JoinRoom(r.Context(), pr.RoomID, pr.MemberID, pr.Instance)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	writeJson(w, PresenceResponse{Started: started})
+}
+
+func leaveRoom(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	var pr PresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pr.RoomID == "" || pr.MemberID == "" {
+		http.Error(w, errors.New("the following information needs to be provided: roomid, memberid").Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Leave room api request:", pr.RoomID, pr.MemberID)
+
+	ended, err := dbqh.LeaveRoom(r.Context(), pr.RoomID, pr.MemberID, time.Duration(pr.Grace)*time.Second)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	writeJson(w, PresenceResponse{Ended: ended})
+}
+
+// forgets everyone connected through an instance, used when it restarts
+func clearInstanceRooms(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	var pr PresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pr.Instance == "" {
+		http.Error(w, errors.New("the following information needs to be provided: instance").Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Clear instance rooms api request:", pr.Instance)
+
+	rooms, err := dbqh.ClearInstanceRooms(r.Context(), pr.Instance)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	writeJson(w, PresenceResponse{Rooms: rooms})
+}
+
+// keeps an instance's lease, which chat instances renew while they run
+func renewInstance(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	var pr PresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pr.Instance == "" || pr.Lease <= 0 {
+		http.Error(w, errors.New("the following information needs to be provided: instance, lease").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := dbqh.RenewInstance(r.Context(), pr.Instance, time.Duration(pr.Lease)*time.Second); err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	writeJson(w, PresenceResponse{})
+}
+
+// ends the chats whose grace period has passed, and those left empty by
+// instances whose lease ran out. Chat instances call this regularly, each
+// ended room is returned to only one of them.
+func expireRooms(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	now := time.Now()
+	//rooms are returned even on an error, as they are already emptied
+	ended, err := dbqh.ExpireInstances(r.Context(), now)
+	if err != nil {
+		log.Println("error expiring chat instances:", err)
+	}
+	rooms, err := dbqh.ExpireRooms(r.Context(), now)
+	if err != nil && len(ended) == 0 {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("error expiring rooms:", err)
+	}
+	writeJson(w, PresenceResponse{Rooms: append(ended, rooms...)})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+)
+
+// the built in admin role, its permissions cannot be changed and it cannot be
+// deleted so there is always a way back in
+const adminRoleID = 1
+
+type RoleInfo struct {
+	ID          int64    `json:"id"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func roleInfoFromDB(role dbquery.Role) RoleInfo {
+	return RoleInfo{
+		ID:          role.ID,
+		Description: role.Description,
+		Permissions: role.Permissions,
+	}
+}
+
+func getRoles(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	log.Println("Get roles api request")
+
+	roles, err := dbqh.GetRoles(r.Context())
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	ri := make([]RoleInfo, 0, len(roles))
+	for _, role := range roles {
+		ri = append(ri, roleInfoFromDB(role))
+	}
+	writeJson(w, ri)
+}
+
+func getRoleByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	id, err := idFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Get role by ID api request:", id)
+
+	role, err := dbqh.GetRole(r.Context(), id)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJson(w, roleInfoFromDB(role))
+}
+
+func addRole(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	var ri RoleInfo
+	if err := json.NewDecoder(r.Body).Decode(&ri); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ri.Description == "" {
+		http.Error(w, errors.New("the following information needs to be provided: description").Error(), http.StatusBadRequest)
+		return
+	}
+	if ri.Permissions == nil {
+		ri.Permissions = []string{}
+	}
+
+	log.Println("Add role api request:", ri.Description)
+
+	if code, err := authorizeGrant(r, ri.Permissions); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	role, err := dbqh.AddRole(r.Context(), ri.Description, ri.Permissions)
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJson(w, roleInfoFromDB(role))
+}
+
+// updates the description and permissions of a role. An empty description or
+// missing permissions leave the current ones in place, an empty permissions
+// list removes them all.
+func updateRoleByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	respondJson(&w)
+
+	id, err := idFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ri RoleInfo
+	if err := json.NewDecoder(r.Body).Decode(&ri); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Update role by ID api request:", id)
+
+	if id == adminRoleID && ri.Permissions != nil {
+		http.Error(w, "the permissions of the admin role cannot be changed", http.StatusForbidden)
+		return
+	}
+	if code, err := authorizeGrant(r, ri.Permissions); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	role, err := dbqh.UpdateRole(r.Context(), id, ri.Description, ri.Permissions)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJson(w, roleInfoFromDB(role))
+}
+
+// deletes a role, which fails with 422 while any user still holds it
+func deleteRoleByID(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	id, err := idFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("Delete role by ID api request:", id)
+
+	if id == adminRoleID {
+		http.Error(w, "the admin role cannot be deleted", http.StatusForbidden)
+		return
+	}
+
+	err = dbqh.DeleteRole(r.Context(), id)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lists the permissions roles can be given
+func getPermissions(w http.ResponseWriter, r *http.Request) {
+	respondJson(&w)
+
+	writeJson(w, auth.AllPermissions)
+}
+
+// checks every permission is one the api knows, and that the caller holds it
+// so nobody can create a role more powerful than their own
+func authorizeGrant(r *http.Request, permissions []string) (int, error) {
+	for _, p := range permissions {
+		if !auth.Permission(p).Valid() {
+			return http.StatusBadRequest, fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	if !auth.PermissionsFromContext(r.Context()).Covers(permissions) {
+		return http.StatusForbidden, errForbidden
+	}
+	return http.StatusOK, nil
+}
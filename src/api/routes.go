@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/storage"
+	"github.com/gorilla/mux"
+)
+
+// routes every endpoint of the api. Each is either for users, checked with
+// requirePermission or requireSession, for the other chat-app services,
+// checked with requireService, or public and listed here with the reason:
+//
+//	POST /api/users/login              the caller has no session yet
+//	POST /api/auth/refresh             checks the refresh token itself
+//	POST /api/chat/visitorjoin         visitors have no account
+//	POST /api/chat/visitorresume       checks the resume token itself
+//	POST /api/chat/attachments         checks the access or resume token itself
+//	GET  /api/chat/attachments/{id}    attachment ids are unguessable, so pages can link them directly
+func newRouter(dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, joinSigner *auth.JoinTokenSigner, store storage.Store, limits attachmentLimits, serviceToken string) *mux.Router {
+	r := mux.NewRouter()
+
+	// sessions
+	r.HandleFunc("/api/users/login", func(w http.ResponseWriter, r *http.Request) {
+		loginWithUsernameAndPassword(w, r, dbqh, issuer)
+	}).Methods("POST")
+	r.HandleFunc("/api/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+		refreshSession(w, r, dbqh, issuer)
+	}).Methods("POST")
+	r.HandleFunc("/api/auth/logout", requireSession(dbqh, issuer, func(w http.ResponseWriter, r *http.Request) {
+		logout(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/auth/introspect", requireSession(dbqh, issuer, introspect)).Methods("GET")
+
+	// users
+	r.HandleFunc("/api/users/addexternal", requirePermission(dbqh, issuer, auth.UsersManage, false, func(w http.ResponseWriter, r *http.Request) {
+		addExternalUser(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/users/getexternal", requirePermission(dbqh, issuer, auth.UsersRead, false, func(w http.ResponseWriter, r *http.Request) {
+		getExternalUser(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/users/getexternalbyid/{id}", requirePermission(dbqh, issuer, auth.UsersRead, false, func(w http.ResponseWriter, r *http.Request) {
+		getExternalUserByID(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/users/updateexternalbyid/{id}", requirePermission(dbqh, issuer, auth.UsersManage, false, func(w http.ResponseWriter, r *http.Request) {
+		updateExternalUserByID(w, r, dbqh)
+	})).Methods("PUT")
+	r.HandleFunc("/api/users/addinternal", requirePermission(dbqh, issuer, auth.UsersManage, false, func(w http.ResponseWriter, r *http.Request) {
+		addInternalUser(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/users/getinternalbyid/{id}", requirePermission(dbqh, issuer, auth.UsersRead, true, func(w http.ResponseWriter, r *http.Request) {
+		getInternalUserByID(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/users/updateinternalbyid/{id}", requirePermission(dbqh, issuer, auth.UsersManage, true, func(w http.ResponseWriter, r *http.Request) {
+		updateInternalUserByID(w, r, dbqh)
+	})).Methods("PUT")
+	r.HandleFunc("/api/users/getbasicbyid/{id}", requirePermission(dbqh, issuer, auth.UsersRead, true, func(w http.ResponseWriter, r *http.Request) {
+		getUserInfoByID(w, r, dbqh)
+	})).Methods("GET")
+
+	// roles
+	r.HandleFunc("/api/roles", requirePermission(dbqh, issuer, auth.RolesRead, false, func(w http.ResponseWriter, r *http.Request) {
+		getRoles(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/roles", requirePermission(dbqh, issuer, auth.RolesManage, false, func(w http.ResponseWriter, r *http.Request) {
+		addRole(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/roles/{id}", requirePermission(dbqh, issuer, auth.RolesRead, false, func(w http.ResponseWriter, r *http.Request) {
+		getRoleByID(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/roles/{id}", requirePermission(dbqh, issuer, auth.RolesManage, false, func(w http.ResponseWriter, r *http.Request) {
+		updateRoleByID(w, r, dbqh)
+	})).Methods("PUT")
+	r.HandleFunc("/api/roles/{id}", requirePermission(dbqh, issuer, auth.RolesManage, false, func(w http.ResponseWriter, r *http.Request) {
+		deleteRoleByID(w, r, dbqh)
+	})).Methods("DELETE")
+	r.HandleFunc("/api/permissions", requirePermission(dbqh, issuer, auth.RolesRead, false, getPermissions)).Methods("GET")
+
+	// joining chats
+	r.HandleFunc("/api/chat/visitorjoin", func(w http.ResponseWriter, r *http.Request) {
+		joinChatAsVisitor(w, r, dbqh, joinSigner, serviceToken)
+	}).Methods("POST")
+	r.HandleFunc("/api/chat/visitorresume", func(w http.ResponseWriter, r *http.Request) {
+		resumeChatAsVisitor(w, r, dbqh, joinSigner)
+	}).Methods("POST")
+	r.HandleFunc("/api/chat/agentjoin", requirePermission(dbqh, issuer, auth.ChatsJoin, false, func(w http.ResponseWriter, r *http.Request) {
+		joinChatAsAgent(w, r, dbqh, joinSigner)
+	})).Methods("POST")
+
+	// chat events, recorded by the consumer
+	r.HandleFunc("/api/chat/statusupdate", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		updateChatStatus(w, r, dbqh)
+	})).Methods("POST", "PUT")
+	r.HandleFunc("/api/chat/addmessage", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		addMessage(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/chat/participantupdate", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		chatParticipantUpdate(w, r, dbqh)
+	})).Methods("POST", "PUT")
+
+	// chat history and the chats in progress
+	r.HandleFunc("/api/chat/getallmessages/{uuid}", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		getAllMessages(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/chat/inprogress/time", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		getChatsInProgress(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/chat/inprogress/messages", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		GetAllOngoingChatMessages(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/chat/inprogress/participants", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		GetAllOngoingChatParticipants(w, r, dbqh)
+	})).Methods("GET")
+	r.HandleFunc("/api/chat/inprogress/info", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		GetAllOngoingChatInformation(w, r, dbqh)
+	})).Methods("GET")
+
+	// room membership, kept by the chat service
+	r.HandleFunc("/api/chat/presence/join", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		joinRoom(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/chat/presence/leave", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		leaveRoom(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/chat/presence/clear", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		clearInstanceRooms(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/chat/presence/renew", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		renewInstance(w, r, dbqh)
+	})).Methods("POST")
+	r.HandleFunc("/api/chat/presence/expire", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		expireRooms(w, r, dbqh)
+	})).Methods("POST")
+
+	// attachments
+	r.HandleFunc("/api/chat/attachments", func(w http.ResponseWriter, r *http.Request) {
+		uploadAttachment(w, r, dbqh, issuer, joinSigner, store, limits)
+	}).Methods("POST")
+	r.HandleFunc("/api/chat/attachments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		downloadAttachment(w, r, dbqh, store)
+	}).Methods("GET")
+	r.HandleFunc("/api/chat/attachments/{id}/info", requireService(serviceToken, func(w http.ResponseWriter, r *http.Request) {
+		getAttachmentInfo(w, r, dbqh)
+	})).Methods("GET")
+
+	return r
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// the routes newRouter documents as public, by method and path
+var publicRoutes = map[string]bool{
+	"POST /api/users/login":          true,
+	"POST /api/auth/refresh":         true,
+	"POST /api/chat/visitorjoin":     true,
+	"POST /api/chat/visitorresume":   true,
+	"POST /api/chat/attachments":     true,
+	"GET /api/chat/attachments/{id}": true,
+}
+
+// every route not listed as public has to turn away a caller with no
+// credentials, so a route added without a check fails here
+func TestEveryRouteIsChecked(t *testing.T) {
+	h, _ := newAuthzTestServer(t)
+	router := h.(*mux.Router)
+
+	seen := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("%s: every route should be limited to its methods", tmpl)
+			return nil
+		}
+		path := strings.NewReplacer("{id}", "1", "{uuid}", "3f2a9c1e-7b4d-4e6f-a1c2-d3e4f5a6b7c8").Replace(tmpl)
+		for _, method := range methods {
+			name := method + " " + tmpl
+			seen[name] = true
+			if publicRoutes[name] {
+				continue
+			}
+			if rec := doSessionRequest(h, method, path, "", "{}"); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s: expected status 401 without credentials, got %d", name, rec.Code)
+			}
+			if rec := doServiceRequest(h, method, path, "not-the-token", "{}"); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s: expected status 401 with the wrong service token, got %d", name, rec.Code)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range publicRoutes {
+		if !seen[name] {
+			t.Errorf("%s is listed as public but not routed", name)
+		}
+	}
+}
+
+func TestServiceRoutesRejectSessions(t *testing.T) {
+	h, users := newAuthzTestServer(t)
+	admin := users["admin"].token
+
+	for _, path := range []string{"/api/chat/inprogress/info", "/api/chat/getallmessages/3f2a9c1e-7b4d-4e6f-a1c2-d3e4f5a6b7c8", "/api/chat/attachments/1/info"} {
+		if rec := doSessionRequest(h, "GET", path, admin, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected an admin session to be refused, got %d", path, rec.Code)
+		}
+		if rec := doServiceRequest(h, "GET", path, testServiceToken, ""); rec.Code == http.StatusUnauthorized {
+			t.Errorf("%s: expected the service token to be accepted", path)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+)
+
+// returned by login and refresh
+type TokenResponse struct {
+	UserID       int64  `json:"userid"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` //seconds until the access token expires
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// returned by introspect for a valid access token
+type IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	UserID    int64  `json:"userid"`
+	SessionID string `json:"sessionid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// creates a session for a user who has just logged in and responds with its tokens
+func startSession(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, userID int64) {
+	sessionID, err := auth.NewID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expiresAt := issuer.SessionExpiry()
+
+	tokens, err := issuer.Issue(userID, sessionID, expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = dbqh.CreateSession(r.Context(), dbquery.Session{
+		ID:        sessionID,
+		UserID:    userID,
+		RefreshID: tokens.RefreshID,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJson(w, tokenResponse(userID, tokens))
+}
+
+// exchanges a refresh token for a new token pair. Each refresh token can only
+// be used once, presenting one which has already been used revokes the session
+// as it has most likely been stolen.
+func refreshSession(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer) {
+	respondJson(&w)
+
+	var rr RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := issuer.Parse(rr.RefreshToken, auth.RefreshToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Println("Refresh session api request:", claims.SessionID)
+
+	session, err := activeSession(r, dbqh, claims.SessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := issuer.Issue(session.UserID, session.ID, time.Unix(session.ExpiresAt, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = dbqh.RotateSessionRefresh(r.Context(), session.ID, claims.ID, tokens.RefreshID)
+	if errors.Is(err, dbquery.ErrNoRowsChanged) {
+		log.Println("refresh token reused, revoking session:", session.ID)
+		if err := dbqh.RevokeSession(r.Context(), session.ID); err != nil {
+			log.Println("error revoking session", session.ID, err)
+		}
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+
+	writeJson(w, tokenResponse(session.UserID, tokens))
+}
+
+// revokes the session of the access token used, every token issued for it stops working
+func logout(w http.ResponseWriter, r *http.Request, dbqh dbquery.DBQueryHandler) {
+	id, _ := auth.IdentityFromContext(r.Context())
+	log.Println("Logout api request:", id.SessionID)
+
+	if err := dbqh.RevokeSession(r.Context(), id.SessionID); err != nil {
+		verifyDBErrorsAndReturn(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lets the other services check an access token and find out who it belongs to
+func introspect(w http.ResponseWriter, r *http.Request) {
+	respondJson(&w)
+
+	id, _ := auth.IdentityFromContext(r.Context())
+	writeJson(w, IntrospectResponse{
+		Active:    true,
+		UserID:    id.UserID,
+		SessionID: id.SessionID,
+		ExpiresAt: id.ExpiresAt.Unix(),
+	})
+}
+
+// wraps handler so it is only called with a valid access token, given as
+// "Authorization: Bearer <token>". The caller's identity is added to the
+// request context.
+func requireSession(dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := authenticate(r, dbqh, issuer)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r.WithContext(auth.ContextWithIdentity(r.Context(), id)))
+	}
+}
+
+func authenticate(r *http.Request, dbqh dbquery.DBQueryHandler, issuer *auth.TokenIssuer) (auth.Identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return auth.Identity{}, auth.ErrInvalidToken
+	}
+	claims, err := issuer.Parse(token, auth.AccessToken)
+	if err != nil {
+		return auth.Identity{}, err
+	}
+	session, err := activeSession(r, dbqh, claims.SessionID)
+	if err != nil {
+		return auth.Identity{}, err
+	}
+	return auth.Identity{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// looks up a session, treating revoked and expired sessions as invalid
+func activeSession(r *http.Request, dbqh dbquery.DBQueryHandler, id string) (dbquery.Session, error) {
+	session, err := dbqh.GetSession(r.Context(), id)
+	if errors.Is(err, dbquery.ErrNotFound) {
+		return session, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return session, err
+	}
+	if session.Revoked || time.Now().Unix() >= session.ExpiresAt {
+		return session, auth.ErrInvalidToken
+	}
+	return session, nil
+}
+
+func tokenResponse(userID int64, tokens auth.Tokens) TokenResponse {
+	return TokenResponse{
+		UserID:       userID,
+		AccessToken:  tokens.Access,
+		RefreshToken: tokens.Refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(tokens.AccessExpiresAt).Seconds()),
+	}
+}
+
+// builds the token issuer from the tokensecret, accesstokenttl and
+// refreshtokenttl environment variables. Without a secret a random one is
+// used, which means sessions do not survive a restart and only work with a
+// single API replica.
+func newTokenIssuer() (*auth.TokenIssuer, error) {
+	secret := []byte(os.Getenv("tokensecret"))
+	if len(secret) == 0 {
+		log.Println("tokensecret is not set, using a random key. Sessions will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return auth.NewTokenIssuer(secret,
+		envDuration("accesstokenttl", 15*time.Minute),
+		envDuration("refreshtokenttl", 12*time.Hour))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+)
+
+func newTestTokenIssuer(t *testing.T) *auth.TokenIssuer {
+	t.Helper()
+	issuer, err := auth.NewTokenIssuer([]byte(strings.Repeat("k", 32)), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+// an in memory database. The seeded admin password is hashed again at the
+// test cost, as checking the production cost hash takes seconds under -race.
+func newTestDB(t *testing.T) dbquery.DBQueryHandler {
+	t.Helper()
+	dbqh, err := dbquery.NewSqlLiteHandler(dbquery.SqlLiteDBConfig{Path: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbqh.UpdateInternalUserByID(context.Background(), 1, 0, "", "", "", hash); err != nil {
+		t.Fatal(err)
+	}
+	return dbqh
+}
+
+// routes the session endpoints the same way main does, backed by an in memory database
+func newSessionTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dbqh := newTestDB(t)
+	issuer := newTestTokenIssuer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users/login", func(w http.ResponseWriter, r *http.Request) {
+		loginWithUsernameAndPassword(w, r, dbqh, issuer)
+	})
+	mux.HandleFunc("/api/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+		refreshSession(w, r, dbqh, issuer)
+	})
+	mux.HandleFunc("/api/auth/logout", requireSession(dbqh, issuer, func(w http.ResponseWriter, r *http.Request) {
+		logout(w, r, dbqh)
+	}))
+	mux.HandleFunc("/api/auth/introspect", requireSession(dbqh, issuer, introspect))
+	return mux
+}
+
+func doSessionRequest(h http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeTokens(t *testing.T, rec *httptest.ResponseRecorder) TokenResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var tr TokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	h := newSessionTestServer(t)
+
+	login := decodeTokens(t, doSessionRequest(h, "POST", "/api/users/login", "", `{"email":"admin@example.com","password":"password"}`))
+	if login.UserID != 1 || login.AccessToken == "" || login.RefreshToken == "" || login.ExpiresIn <= 0 {
+		t.Fatalf("unexpected login response %+v", login)
+	}
+
+	rec := doSessionRequest(h, "GET", "/api/auth/introspect", login.AccessToken, "")
+	var ir IntrospectResponse
+	if err := json.NewDecoder(rec.Body).Decode(&ir); err != nil || !ir.Active || ir.UserID != 1 {
+		t.Fatalf("introspect = %+v, %v", ir, err)
+	}
+
+	if rec := doSessionRequest(h, "GET", "/api/auth/introspect", login.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token accepted as an access token: status %d", rec.Code)
+	}
+
+	refreshed := decodeTokens(t, doSessionRequest(h, "POST", "/api/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`))
+	if refreshed.RefreshToken == login.RefreshToken {
+		t.Error("expected the refresh token to be rotated")
+	}
+
+	if rec := doSessionRequest(h, "POST", "/api/auth/logout", refreshed.AccessToken, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d", rec.Code)
+	}
+	for _, token := range []string{login.AccessToken, refreshed.AccessToken} {
+		if rec := doSessionRequest(h, "GET", "/api/auth/introspect", token, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token still valid after logout: status %d", rec.Code)
+		}
+	}
+	if rec := doSessionRequest(h, "POST", "/api/auth/refresh", "", `{"refresh_token":"`+refreshed.RefreshToken+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d", rec.Code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	h := newSessionTestServer(t)
+
+	login := decodeTokens(t, doSessionRequest(h, "POST", "/api/users/login", "", `{"email":"admin@example.com","password":"password"}`))
+	refreshed := decodeTokens(t, doSessionRequest(h, "POST", "/api/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`))
+
+	if rec := doSessionRequest(h, "POST", "/api/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status %d", rec.Code)
+	}
+	if rec := doSessionRequest(h, "GET", "/api/auth/introspect", refreshed.AccessToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session still valid after refresh token reuse: status %d", rec.Code)
+	}
+}
+
+func TestRequireSessionRejectsMissingToken(t *testing.T) {
+	h := newSessionTestServer(t)
+
+	for _, token := range []string{"", "not-a-token"} {
+		if rec := doSessionRequest(h, "GET", "/api/auth/introspect", token, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected status 401, got %d", token, rec.Code)
+		}
+	}
+}
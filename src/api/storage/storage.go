@@ -0,0 +1,32 @@
+// Package storage keeps the files uploaded as chat attachments, on local disk
+// or in an S3 compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// Store holds objects by key. Keys are chosen by the caller and only use
+// letters, digits, '-' and '_', so they are safe as file names and in urls.
+type Store interface {
+	// stores size bytes read from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// opens the object stored under key, ErrNotFound if there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func validKey(key string) error {
+	if key == "" || strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return ErrInvalidKey
+	}
+	return nil
+}
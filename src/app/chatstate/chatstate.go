@@ -15,6 +15,9 @@ var apiPort string = os.Getenv("apiPort")
 
 var apiBaseUrl string = fmt.Sprintf("http://%s:%s/api", apiHost, apiPort)
 
+// shared with the api, which only lets the chat-app services list the chats in progress
+var serviceToken string = os.Getenv("servicetoken")
+
 type ChatStateHandler interface {
 	populateFromDB() error
 	GetChats() []ChatInformation
@@ -72,6 +75,7 @@ func (suh *StateUpdateHandler) populateFromDB() error {
 	if err != nil {
 		return err
 	}
+	req.Header.Set("X-Service-Token", serviceToken)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -81,6 +85,9 @@ func (suh *StateUpdateHandler) populateFromDB() error {
 	if resp.StatusCode == 204 {
 		return nil
 	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing the chats in progress failed with status %d", resp.StatusCode)
+	}
 
 	var chatInfoSlice = []ChatInformation{}
 	data, _ := io.ReadAll(resp.Body)
@@ -2,4 +2,9 @@ module github.com/Ryan-Har/chat-app/src/app
 
 go 1.22
 
-require github.com/rabbitmq/amqp091-go v1.9.0
+require (
+	github.com/Ryan-Har/chat-app/src/api v0.0.0-00010101000000-000000000000
+	github.com/rabbitmq/amqp091-go v1.9.0
+)
+
+replace github.com/Ryan-Har/chat-app/src/api => ../api
@@ -1,5 +1,6 @@
 var chatSendButton = document.getElementById("chat-send-button");
 var messageInput = document.getElementById("message-input");
+var fileInput = document.getElementById("file-input");
 
 chatSendButton.addEventListener("click", function() {
   console.log("Send button clicked");
@@ -18,9 +19,10 @@ messageInput.addEventListener("keypress", function(event) {
 function sendMessage() {
   let message = messageInput.value;
   let parentwindow = window.parent
-  let dataToSend = {operation: "sendMessage", message: message};
+  let dataToSend = {operation: "sendMessage", message: message, file: fileInput.files[0]};
   parentwindow.postMessage(dataToSend, "*");
   messageInput.value = "";
+  fileInput.value = "";
 }
 
 console.log("chat.js loaded")
\ No newline at end of file
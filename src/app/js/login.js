@@ -20,17 +20,18 @@ function logIn() {
         })
     })
     .then((response) => {
-        console.log("response:", response);
+        if (!response.ok) {
+            return null;
+        }
         return response.json();
     })
     .then((data) => {
-        const result = parseInt(data);
-        if (result == 0) {
+        if (data === null) {
             alert("Login failed. Please try again.");
             return;
         }
         let parentwindow = window.parent;
-        let dataToSend = {operation: "Login", message: result};
+        let dataToSend = {operation: "Login", message: data};
         parentwindow.postMessage(dataToSend, "*");
     });
 }
\ No newline at end of file
@@ -2,6 +2,8 @@ sse = new SSEvents();
 sockets = new SocketConnections();
 
 let myid= 0;
+let accessToken = "";
+let refreshTimeoutId = null;
 let currentPage = "";
 let intervalId = null;
 
@@ -27,7 +29,11 @@ document.addEventListener("DOMContentLoaded", function() {
     });
 
     logoutButton.addEventListener("click", function(event) {
-        myid = 0;
+        fetch("/handlelogout", {
+            method: "POST",
+            headers: {"Authorization": `Bearer ${accessToken}`}
+        });
+        endSession();
         setNavbarVisibility(false);
         currentPage = "login";
         loadChildPageContent(event, "/login");
@@ -45,11 +51,11 @@ document.addEventListener("DOMContentLoaded", function() {
         let receivedData = event.data;
         console.log("received data from child page: ", receivedData)
         if (receivedData.operation === "sendMessage") {
-            sockets.sendMessage(receivedData.message);
+            sockets.sendMessage(receivedData.message, receivedData.file);
         }
         if (receivedData.operation === "Login") {
             console.log("received login message");
-            myid = receivedData.message;
+            startSession(receivedData.message);
             if (myid > 0) { 
                 setNavbarVisibility(true);
                 currentPage = "allChats";
@@ -68,6 +74,44 @@ document.addEventListener("DOMContentLoaded", function() {
 });
 
 
+// keeps the access token from a login or refresh response, and refreshes it
+// shortly before it expires
+function startSession(session) {
+    myid = session.userid;
+    accessToken = session.access_token;
+    sse.connect(accessToken);
+
+    clearTimeout(refreshTimeoutId);
+    let refreshIn = Math.max(session.expires_in - 30, 5) * 1000;
+    refreshTimeoutId = setTimeout(refreshSession, refreshIn);
+}
+
+function refreshSession() {
+    fetch("/handlerefresh", {method: "POST"})
+    .then((response) => {
+        if (!response.ok) {
+            throw new Error("session expired");
+        }
+        return response.json();
+    })
+    .then((session) => startSession(session))
+    .catch(() => {
+        endSession();
+        setNavbarVisibility(false);
+        currentPage = "login";
+        loadChildPageContent(null, "/login");
+    });
+}
+
+function endSession() {
+    myid = 0;
+    accessToken = "";
+    clearTimeout(refreshTimeoutId);
+    clearInterval(intervalId);
+    sse.disconnect();
+    sockets.closeAll();
+}
+
 function loadChildPageContent(event, pageUrl) {
     if (event !== null) {
         event.preventDefault();
@@ -163,7 +207,7 @@ function displayAvailableChats() {
         tilebutton.classList.add("btn", "btn-sm");
         tilebutton.textContent = "Join";
         tilebutton.addEventListener("click", function() {
-            sockets.connect(chat.chatuuid, myid);
+            sockets.connect(chat.chatuuid, accessToken);
           });
         tileAction.appendChild(tilebutton);
 
@@ -236,7 +280,7 @@ function displayMyChats() {
         tilebutton.classList.add("btn", "btn-sm");
         tilebutton.textContent = "Join";
         tilebutton.addEventListener("click", function() {
-            sockets.connect(chat.chatuuid, myid);
+            sockets.connect(chat.chatuuid, accessToken);
           });
         tileAction.appendChild(tilebutton);
         
@@ -306,7 +350,7 @@ function displayAllChats() {
         tilebutton.classList.add("btn", "btn-sm");
         tilebutton.textContent = "Join";
         tilebutton.addEventListener("click", function() {
-            sockets.connect(chat.chatuuid, myid);
+            sockets.connect(chat.chatuuid, accessToken);
           });
         tileAction.appendChild(tilebutton);
         
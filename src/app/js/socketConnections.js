@@ -1,28 +1,56 @@
+// WebSocket subprotocol for JSON frames, see the chat service's protocol.go
+const chatProtocol = "chat.v1.json";
+// frame types shown in the chat interface
+const displayedFrames = ["message", "system", "join", "leave", "error"];
+
 // Define a data structure to hold websocket connections and messages
 class SocketConnections {
     constructor() {
         this.connections = {}; // Object to store websocket connections
         this.messages = {};    // Object to store messages associated with each connection
+        this.olderMessages = {}; // whether the chat service has older messages to page back through, per connection
         this.activeConnection = "";
     }
   
-    // Method to connect to a websocket
-    connect(guid, myid) {
+    // Method to connect to a websocket, the access token is exchanged for a join token for the room first
+    async connect(guid, token) {
         if (!(guid in this.connections)) {
-            let ws = new WebSocket(`ws://${chatHost}:${chatPort}/ws?guid=${guid}&userid=${myid}`);
-            this.connections[guid] = ws;
-            let messages = sse.getMessagesFromGuid(guid);
-            this.messages[guid] = messages;
+            const resp = await fetch("/handlejoin", {
+                method: "POST",
+                headers: {"Authorization": `Bearer ${token}`, "Content-Type": "application/json"},
+                body: JSON.stringify({roomid: guid})
+            });
+            if (!resp.ok) {
+                console.error("Unable to join chat:", guid, resp.status);
+                return;
+            }
+            const join = await resp.json();
+            // another call may have connected while waiting for the token
+            if (!(guid in this.connections)) {
+                let ws = new WebSocket(`ws://${chatHost}:${chatPort}/ws?token=${encodeURIComponent(join.token)}`, [chatProtocol]);
+                this.connections[guid] = ws;
+                let messages = sse.getMessagesFromGuid(guid);
+                this.messages[guid] = messages;
+            }
         }
         this.activeConnection = guid;
         let ws = this.connections[guid];
         this.renderMessagesToChatInterface(guid);
         
         ws.onmessage = (event) => {
-        this.messages[guid].push(event.data); // Store the incoming message
+        const frame = JSON.parse(event.data);
+        if (frame.type === "history") {
+            this.addHistory(guid, frame);
+            return;
+        }
+        //acks and typing notifications are not shown in the history
+        if (!displayedFrames.includes(frame.type)) {
+            return;
+        }
+        this.messages[guid].push(frame); // Store the incoming message
         //append to the chat interface if this is the active connection
         if (this.activeConnection === guid) {
-            this.renderSingleMessageToChatInterface(event.data);
+            this.renderSingleMessageToChatInterface(frame);
         }
         };
 
@@ -30,6 +58,7 @@ class SocketConnections {
         console.error("WebSocket error:", error);
         delete this.connections[guid]; // Remove the connection from the connections object
         delete this.messages[guid];    // Remove messages associated with this connection
+        delete this.olderMessages[guid];
         if (this.activeConnection === guid) {
             this.activeConnection = "";
         }
@@ -38,20 +67,71 @@ class SocketConnections {
         ws.onclose = () => {
         delete this.connections[guid]; // Remove the connection from the connections object
         delete this.messages[guid];    // Remove messages associated with this connection
+        delete this.olderMessages[guid];
         if (this.activeConnection === guid) {
             this.activeConnection = "";
         }
         }; 
     }
   
-    // Method to send a message through a websocket connection
-    sendMessage(message) {
-        const ws = this.connections[this.activeConnection];
-        if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(message);
-        };
+    // history from the chat service is newer than the SSE snapshot, the batch sent on
+    // joining replaces it and later batches, asked for by loadOlderMessages, go before it
+    addHistory(guid, frame) {
+        const history = frame.messages || [];
+        this.olderMessages[guid] = frame.more === true;
+        if (history.length === 0) {
+            return;
+        }
+        const current = this.messages[guid].filter(message => message.id);
+        const isFirstBatch = current.length === 0;
+        this.messages[guid] = isFirstBatch ? history : history.concat(this.messages[guid]);
+        if (this.activeConnection === guid) {
+            this.renderMessagesToChatInterface(guid);
+        }
+    }
+
+    // asks the chat service for the messages before the oldest one held
+    loadOlderMessages(guid) {
+        const ws = this.connections[guid];
+        const oldest = (this.messages[guid] || []).find(message => message.type === "message" && message.id);
+        if (!this.olderMessages[guid] || !oldest || !ws || ws.readyState !== WebSocket.OPEN) {
+            return;
+        }
+        this.olderMessages[guid] = false; // until the answer says otherwise
+        ws.send(JSON.stringify({type: "history", before: oldest.id}));
+    }
+
+    // Method to send a message through a websocket connection, a file is uploaded first and sent as an attachment
+    async sendMessage(message, file) {
+        const guid = this.activeConnection;
+        const ws = this.connections[guid];
+        if (!ws || ws.readyState !== WebSocket.OPEN || (!message && !file)) {
+            return;
+        }
+        const attachments = [];
+        if (file) {
+            const form = new FormData();
+            form.append("file", file);
+            const resp = await fetch(`/handleupload?roomid=${encodeURIComponent(guid)}`, {
+                method: "POST",
+                headers: {"Authorization": `Bearer ${accessToken}`},
+                body: form
+            });
+            if (!resp.ok) {
+                alert(`Unable to upload ${file.name}: ${await resp.text()}`);
+                return;
+            }
+            attachments.push({id: (await resp.json()).id});
+        }
+        ws.send(JSON.stringify({type: "message", text: message, attachments: attachments}));
     }
   
+    closeAll() {
+        for (const guid in this.connections) {
+            this.connections[guid].close();
+        }
+    }
+
     // Method to close a websocket connection
     closeConnection(guid) {
         console.log("Closing connection:", guid)
@@ -71,6 +151,12 @@ class SocketConnections {
     renderMessagesToChatInterface(guid) {
         let displayLoc = document.getElementById("right-chat-body");
         displayLoc.innerHTML = "";
+        // scrolling to the top pages back through older messages
+        displayLoc.onscroll = () => {
+            if (displayLoc.scrollTop === 0) {
+                this.loadOlderMessages(guid);
+            }
+        };
         this.messages[guid].forEach(message => {
             displayLoc.appendChild(createTileDiv(message, ""));
         });
@@ -89,7 +175,7 @@ class SocketConnections {
         return this.activeConnection;
     }
 
-    //messageArray should be in the format of [name: message, name: message, ...], getmessagedFromGuid in the sseEvents.js file
+    //messageArray should be an array of message frames, as returned by getMessagesFromGuid in the sseEvents.js file
     addMessagesFromArray(guid, messageArray) {
         messageArray.forEach(message => {
             this.messages[guid].push(message);
@@ -100,25 +186,25 @@ class SocketConnections {
 }
 
 
-// Function to create a tile div for a chat participant
-function createTileDiv(nameMessage, avatarSrc) {
+// Function to create a tile div for a chat frame
+function createTileDiv(frame, avatarSrc) {
 
-    //special case for user join / leave messages
-    if (!nameMessage.includes(":")) {
+    //special case for user join / leave and server messages
+    if (frame.type !== "message") {
         let tileDiv = document.createElement('div');
         tileDiv.classList.add('tile');
         let tileContentDiv = document.createElement('div');
         tileContentDiv.classList.add('tile-content');
         let tileSubtitle = document.createElement('p');
         tileSubtitle.classList.add('tile-subtitle');
-        tileSubtitle.textContent = nameMessage;
+        tileSubtitle.textContent = frameNotice(frame);
         tileContentDiv.appendChild(tileSubtitle);
         tileDiv.appendChild(tileContentDiv);
         return tileDiv
     }
 
-    let name = nameMessage.split(":")[0];
-    let subtitle = nameMessage.split(":")[1].trim();
+    let name = frame.name;
+    let subtitle = frame.text;
 
     let tileDiv = document.createElement('div');
     tileDiv.classList.add('tile');
@@ -149,12 +235,45 @@ function createTileDiv(nameMessage, avatarSrc) {
     tileSubtitle.textContent = subtitle;
     tileContentDiv.appendChild(tileSubtitle);
 
+    (frame.attachments || []).forEach(attachment => {
+        tileContentDiv.appendChild(createAttachmentElement(attachment));
+    });
+
     tileDiv.appendChild(tileIconDiv);
     tileDiv.appendChild(tileContentDiv);
 
     return tileDiv;
 }
 
+// images are shown in the chat, anything else is linked for download
+function createAttachmentElement(attachment) {
+    const url = `/attachments/${encodeURIComponent(attachment.id)}`;
+    if (attachment.contenttype && attachment.contenttype.startsWith("image/")) {
+        let img = document.createElement('img');
+        img.classList.add('img-responsive');
+        img.src = url;
+        img.alt = attachment.name;
+        return img;
+    }
+    let link = document.createElement('a');
+    link.href = url;
+    link.download = attachment.name;
+    link.textContent = attachment.name;
+    return link;
+}
+
+// the text shown for frames other than messages
+function frameNotice(frame) {
+    switch (frame.type) {
+        case "join":
+            return `${frame.name} joined the chat`;
+        case "leave":
+            return `${frame.name} left the chat`;
+        default:
+            return frame.text;
+    }
+}
+
 function showleaveButton(guid) {
     let leaveButton = document.getElementById("leave");
     leaveButton.style.display = "block";
@@ -1,7 +1,16 @@
 class SSEvents {
     constructor() {
         this.allchats = [];
-        this.eventSource = new EventSource("/chatstream");
+        this.eventSource = null;
+        this.token = "";
+    }
+
+    // (re)connects the stream with the given access token, the server closes
+    // the stream when the token expires
+    connect(token) {
+        this.token = token;
+        this.close();
+        this.eventSource = new EventSource(`/chatstream?token=${encodeURIComponent(token)}`);
         this.eventSource.onmessage = (event) => {
             const message = JSON.parse(event.data);
             this.allchats = message;
@@ -10,14 +19,29 @@ class SSEvents {
 
         this.eventSource.onerror = (error) => {
             console.error("EventSource error:", error);  
-            // Reconnect after a delay
+            // Reconnect after a delay, with whichever token is current by then
+            this.eventSource.close();
             setTimeout(() => {
-                this.eventSource.close();
-                this.eventSource = new EventSource("/chatstream");
+                if (this.token !== "") {
+                    this.connect(this.token);
+                }
             }, 5000);            
         }
     }
 
+    close() {
+        if (this.eventSource !== null) {
+            this.eventSource.close();
+            this.eventSource = null;
+        }
+    }
+
+    disconnect() {
+        this.token = "";
+        this.allchats = [];
+        this.close();
+    }
+
     getAllChats() {
         return this.allchats;
     }
@@ -31,14 +55,14 @@ class SSEvents {
     }
 
 
-    //returns in the format name: message, for use with the socket Connections
+    //returns message frames in the same shape as the chat service sends, for use with the socket Connections
     getMessagesFromGuid(guid) {
         let messages = [];
         let chat = this.allchats.find(chat => chat.chatuuid === guid);
         chat.messages.forEach(message => {
             chat.participants.forEach(participant => {
                 if (participant.userid === message.userid) {
-                    messages.push(`${participant.name}: ${message.message}`);
+                    messages.push({type: "message", name: participant.name, senderid: participant.userid, text: message.message});
                 }
             });
         });
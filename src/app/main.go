@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/Ryan-Har/chat-app/src/app/chatstate"
+	"github.com/Ryan-Har/chat-app/src/api/events"
 	"github.com/rabbitmq/amqp091-go"
 )
 
@@ -25,15 +26,6 @@ const (
 	internalQueue = "AppQueue"
 )
 
-type BrokerMessage struct {
-	Roomid      string `json:"roomid"`
-	Name        string `json:"name"`
-	Address     string `json:"address"`
-	MessageText string `json:"messagetext"`
-	UserID      int64  `json:"userid"`
-	Time        string `json:"time"`
-}
-
 type worker struct {
 	id  int
 	err error
@@ -127,33 +119,37 @@ func (wk *worker) workConsume(workerChan chan<- *worker, stateHandler chatstate.
 
 func processMessage(msg amqp091.Delivery, stateHandler chatstate.ChatStateHandler) error {
 
-	bm := BrokerMessage{}
-	if err := json.Unmarshal(msg.Body, &bm); err != nil {
-		return err
+	event, err := events.Decode(msg.Body)
+	if err != nil {
+		log.Println("unable to decode event, rejecting:", err)
+		msg.Nack(false, false)
+		return nil
 	}
-	log.Println("Received message:", bm)
-	switch bm.MessageText {
-	case "End of chat":
-		stateHandler.RemoveChat(bm.Roomid)
+	log.Println("Received event:", event)
+	ep := event.Payload
+	switch event.Type {
+	case events.ChatEnded:
+		stateHandler.RemoveChat(ep.Roomid)
 		msg.Ack(false)
-	case "Start of chat":
-		stateHandler.AddChat(bm.Roomid, bm.Time)
+	case events.ChatStarted:
+		stateHandler.AddChat(ep.Roomid, ep.Time)
 		msg.Ack(false)
-	case "User joined chat":
-		stateHandler.AddParticipant(bm.Roomid, bm.UserID)
+	case events.ParticipantJoined:
+		stateHandler.AddParticipant(ep.Roomid, ep.UserID)
 		msg.Ack(false)
-	case "User left chat":
-		stateHandler.RemoveParticipant(bm.Roomid, bm.UserID)
+	case events.ParticipantLeft:
+		stateHandler.RemoveParticipant(ep.Roomid, ep.UserID)
 		msg.Ack(false)
-	default: //must be a message
-		stateHandler.AddMessage(bm.Roomid, bm.UserID, bm.MessageText, bm.Time)
+	case events.MessagePosted:
+		stateHandler.AddMessage(ep.Roomid, ep.UserID, ep.Text, ep.Time)
 		msg.Ack(false)
-
 	}
 	return nil
 }
 
-func streamChats(w http.ResponseWriter, r *http.Request, stateHandler chatstate.ChatStateHandler) {
+// streams the chat state until the client goes away or its access token
+// expires, the page reconnects with a refreshed token
+func streamChats(w http.ResponseWriter, r *http.Request, stateHandler chatstate.ChatStateHandler, expires time.Time) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -170,7 +166,14 @@ func streamChats(w http.ResponseWriter, r *http.Request, stateHandler chatstate.
 		fmt.Fprintf(w, "data: %s\n\n", string(data))
 		flusher.Flush()
 
-		time.Sleep(2 * time.Second)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+		if time.Now().After(expires) {
+			return
+		}
 	}
 }
 
@@ -213,41 +216,30 @@ type loginInfo struct {
 }
 
 func loginWithUsernameAndPassword(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Println(r.Body)
-	fmt.Printf("apiBaseUrl: %s\n", apiBaseUrl)
-
 	var li *loginInfo
 	err := json.NewDecoder(r.Body).Decode(&li)
 	if err != nil {
-		fmt.Fprintf(w, "0")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println(li)
 	payloadJson, err := json.Marshal(&li)
 	if err != nil {
-		fmt.Fprintf(w, "0")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println("sending post")
 	resp, err := sendPostRequest(fmt.Sprintf("%s/users/login", apiBaseUrl), bytes.NewReader(payloadJson))
 	if err != nil {
-		fmt.Fprintf(w, "0")
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	fmt.Println("received response")
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		fmt.Fprintf(w, "%s", string(data))
-		fmt.Printf("response: %v", data)
-		return
-	} else {
-		fmt.Fprintf(w, "0")
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "login failed", http.StatusUnauthorized)
 		return
 	}
+	writePageSession(w, resp)
 }
 
 func sendPostRequest(url string, body io.Reader) (*http.Response, error) {
@@ -280,12 +272,27 @@ func main() {
 	http.Handle("/js/", http.StripPrefix("/js/", jsfs))
 
 	//http.Handle("/login", http.StripPrefix("/web/", http.FileServer(http.Dir("web"))))
-	http.HandleFunc("/chatstream", func(w http.ResponseWriter, r *http.Request) {
-		streamChats(w, r, chatHandler)
-	})
+	http.HandleFunc("/chatstream", requireLogin(chatHandler.GetApiBaseUrl(), func(w http.ResponseWriter, r *http.Request, expires time.Time) {
+		streamChats(w, r, chatHandler, expires)
+	}))
 	http.HandleFunc("/handlelogin", func(w http.ResponseWriter, r *http.Request) {
 		loginWithUsernameAndPassword(w, r, chatHandler.GetApiBaseUrl())
 	})
+	http.HandleFunc("/handlerefresh", func(w http.ResponseWriter, r *http.Request) {
+		refreshLogin(w, r, chatHandler.GetApiBaseUrl())
+	})
+	http.HandleFunc("/handlelogout", func(w http.ResponseWriter, r *http.Request) {
+		logout(w, r, chatHandler.GetApiBaseUrl())
+	})
+	http.HandleFunc("/handlejoin", func(w http.ResponseWriter, r *http.Request) {
+		joinChat(w, r, chatHandler.GetApiBaseUrl())
+	})
+	http.HandleFunc("/handleupload", func(w http.ResponseWriter, r *http.Request) {
+		uploadAttachment(w, r, chatHandler.GetApiBaseUrl())
+	})
+	http.HandleFunc("/attachments/", func(w http.ResponseWriter, r *http.Request) {
+		downloadAttachment(w, r, chatHandler.GetApiBaseUrl())
+	})
 	http.HandleFunc("/", mainPage)
 	http.HandleFunc("/login", loginPage)
 	http.HandleFunc("/chats", chatPage)
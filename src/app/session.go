@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the refresh token is kept in an HttpOnly cookie so page scripts never see it,
+// the access token is handed to the page and kept in memory only
+const refreshCookie = "refresh_token"
+
+var errUnauthorized = errors.New("invalid or expired session")
+
+// token pair returned by the api on login and refresh
+type apiTokens struct {
+	UserID       int64  `json:"userid"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// what the browser receives, everything but the refresh token
+type pageSession struct {
+	UserID      int64  `json:"userid"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type introspection struct {
+	Active    bool   `json:"active"`
+	UserID    int64  `json:"userid"`
+	SessionID string `json:"sessionid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// checks an access token with the api, returning who it belongs to
+func introspectToken(apiBaseUrl string, token string) (introspection, error) {
+	var in introspection
+	req, err := http.NewRequest("GET", apiBaseUrl+"/auth/introspect", nil)
+	if err != nil {
+		return in, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return in, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return in, errUnauthorized
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&in); err != nil {
+		return in, err
+	}
+	if !in.Active {
+		return in, errUnauthorized
+	}
+	return in, nil
+}
+
+// the access token sent by the page, either as a bearer token or, for
+// EventSource which cannot set headers, the token query parameter
+func accessTokenFromRequest(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// hands the tokens from a login or refresh response to the page, keeping the
+// refresh token in the cookie
+func writePageSession(w http.ResponseWriter, resp *http.Response) {
+	var tokens apiTokens
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		log.Println("error decoding tokens from api", err)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    tokens.RefreshToken,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pageSession{
+		UserID:      tokens.UserID,
+		AccessToken: tokens.AccessToken,
+		ExpiresIn:   tokens.ExpiresIn,
+	})
+}
+
+func clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// swaps the refresh token cookie for a new token pair
+func refreshLogin(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
+	cookie, err := r.Cookie(refreshCookie)
+	if err != nil {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"refresh_token": cookie.Value})
+	resp, err := sendPostRequest(apiBaseUrl+"/auth/refresh", bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		clearRefreshCookie(w)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	writePageSession(w, resp)
+}
+
+// revokes the session with the api and forgets the refresh token
+func logout(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
+	clearRefreshCookie(w)
+
+	req, err := http.NewRequest("POST", apiBaseUrl+"/auth/logout", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+accessTokenFromRequest(r))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// wraps handler so it only runs for a page holding a valid access token.
+// handler is told when the token expires so long lived streams can stop then.
+func requireLogin(apiBaseUrl string, handler func(w http.ResponseWriter, r *http.Request, expires time.Time)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in, err := introspectToken(apiBaseUrl, accessTokenFromRequest(r))
+		if err != nil {
+			log.Println("rejecting request to", r.URL.Path, err)
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r, time.Unix(in.ExpiresAt, 0))
+	}
+}
+
+// passes a file upload from the page on to the api, for the room in the
+// roomid query parameter, authenticated with the agent's access token
+func uploadAttachment(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
+	req, err := http.NewRequest("POST", apiBaseUrl+"/chat/attachments?roomid="+url.QueryEscape(r.URL.Query().Get("roomid")), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	req.Header.Set("Authorization", "Bearer "+accessTokenFromRequest(r))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serves an attachment from the api, /attachments/<id>. Attachment ids are
+// unguessable so, like the api, this needs no token, which lets the page use
+// the url directly in img tags and links.
+func downloadAttachment(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
+	id := strings.TrimPrefix(r.URL.Path, "/attachments/")
+	resp, err := http.Get(apiBaseUrl + "/chat/attachments/" + url.PathEscape(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Disposition", "X-Content-Type-Options", "Content-Security-Policy"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// asks the api for a token letting the agent into a chat room. The page
+// passes it to the chat service when opening the WebSocket.
+func joinChat(w http.ResponseWriter, r *http.Request, apiBaseUrl string) {
+	req, err := http.NewRequest("POST", apiBaseUrl+"/chat/agentjoin", r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessTokenFromRequest(r))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
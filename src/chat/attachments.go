@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// most files a single message may carry
+	maxAttachments = 10
+	// how long looking an attachment up in the api may take, the client's
+	// messages wait on it
+	attachmentTimeout = 5 * time.Second
+)
+
+var (
+	errUnknownAttachment = errors.New("unknown attachment")
+	errAttachmentLookup  = errors.New("attachments could not be checked, try again")
+)
+
+// attachment describes an uploaded file sent with a message. Clients upload
+// files to the api and send only the id, the server fills in the rest.
+type attachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"contenttype,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// looks up uploaded files
+type attachmentStore interface {
+	// returns the attachment id, which has to have been uploaded to room
+	lookup(ctx context.Context, room string, id string) (attachment, error)
+}
+
+type attachmentInfo struct {
+	ID          string `json:"id"`
+	ChatUUID    string `json:"chatuuid"`
+	Name        string `json:"name"`
+	ContentType string `json:"contenttype"`
+	Size        int64  `json:"size"`
+}
+
+// looks attachments up in the api, which keeps them
+type apiAttachments struct {
+	apiBaseUrl   string
+	serviceToken string
+	client       *http.Client
+}
+
+func newAPIAttachments(apiBaseUrl string, serviceToken string) apiAttachments {
+	return apiAttachments{
+		apiBaseUrl:   apiBaseUrl,
+		serviceToken: serviceToken,
+		client:       &http.Client{Timeout: attachmentTimeout},
+	}
+}
+
+// failures other than the attachment not being found are logged and reported
+// as errAttachmentLookup, which the client is told
+func (aa apiAttachments) lookup(ctx context.Context, room string, id string) (attachment, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", aa.apiBaseUrl+"/chat/attachments/"+url.PathEscape(id)+"/info", nil)
+	if err != nil {
+		return attachment{}, err
+	}
+	req.Header.Set("X-Service-Token", aa.serviceToken)
+	resp, err := aa.client.Do(req)
+	if err != nil {
+		log.Println("error looking up attachment:", err)
+		return attachment{}, errAttachmentLookup
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusBadRequest, http.StatusNotFound:
+		return attachment{}, fmt.Errorf("%w: %s", errUnknownAttachment, id)
+	default:
+		log.Println("attachment lookup failed with status", resp.StatusCode)
+		return attachment{}, errAttachmentLookup
+	}
+
+	var info attachmentInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		log.Println("error reading attachment:", err)
+		return attachment{}, errAttachmentLookup
+	}
+	if info.ChatUUID != room {
+		return attachment{}, fmt.Errorf("%w: %s", errUnknownAttachment, id)
+	}
+	return attachment{ID: info.ID, Name: info.Name, ContentType: info.ContentType, Size: info.Size}, nil
+}
+
+// replaces the attachments a client referenced in a message with what is
+// stored for them, rejecting any not uploaded to room
+func resolveAttachments(ctx context.Context, store attachmentStore, room string, refs []attachment) ([]attachment, error) {
+	if len(refs) > maxAttachments {
+		return nil, fmt.Errorf("messages can have at most %d attachments", maxAttachments)
+	}
+	resolved := make([]attachment, 0, len(refs))
+	for _, ref := range refs {
+		a, err := store.lookup(ctx, room, ref.ID)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, a)
+	}
+	return resolved, nil
+}
+
+func attachmentIDs(attachments []attachment) []string {
+	ids := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/gorilla/websocket"
+)
+
+// attachments by id, standing in for the api
+type memoryAttachments map[string]attachmentInfo
+
+func (ma memoryAttachments) lookup(ctx context.Context, room string, id string) (attachment, error) {
+	info, ok := ma[id]
+	if !ok || info.ChatUUID != room {
+		return attachment{}, errUnknownAttachment
+	}
+	return attachment{ID: info.ID, Name: info.Name, ContentType: info.ContentType, Size: info.Size}, nil
+}
+
+func TestAPIAttachments(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Service-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/chat/attachments/a1/info" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(attachmentInfo{ID: "a1", ChatUUID: "room", Name: "cat.png", ContentType: "image/png", Size: 10})
+	}))
+	defer api.Close()
+	aa := newAPIAttachments(api.URL+"/api", "secret")
+	ctx := context.Background()
+
+	if a, err := aa.lookup(ctx, "room", "a1"); err != nil || a != (attachment{ID: "a1", Name: "cat.png", ContentType: "image/png", Size: 10}) {
+		t.Errorf("lookup = %+v, %v", a, err)
+	}
+	if _, err := aa.lookup(ctx, "other-room", "a1"); !errors.Is(err, errUnknownAttachment) {
+		t.Errorf("attachment from another room: expected errUnknownAttachment, got %v", err)
+	}
+	if _, err := aa.lookup(ctx, "room", "a2"); !errors.Is(err, errUnknownAttachment) {
+		t.Errorf("missing attachment: expected errUnknownAttachment, got %v", err)
+	}
+	aa.serviceToken = "wrong"
+	if _, err := aa.lookup(ctx, "room", "a1"); err != errAttachmentLookup {
+		t.Errorf("refused lookup: expected errAttachmentLookup, got %v", err)
+	}
+}
+
+// a hung api fails the lookup once it times out, rather than holding up the
+// client's messages
+func TestAPIAttachmentsTimeout(t *testing.T) {
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer api.Close()
+	defer close(release)
+	aa := newAPIAttachments(api.URL+"/api", "secret")
+	aa.client.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := aa.lookup(context.Background(), "room", "a1"); err != errAttachmentLookup {
+		t.Errorf("expected errAttachmentLookup, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %s", elapsed)
+	}
+}
+
+func TestMessageAttachments(t *testing.T) {
+	seen := captureBrokerEvents(t)
+	as := memoryAttachments{
+		"a1": {ID: "a1", ChatUUID: "room", Name: "cat.png", ContentType: "image/png", Size: 10},
+		"a2": {ID: "a2", ChatUUID: "other-room", Name: "secret.pdf", ContentType: "application/pdf", Size: 20},
+	}
+	srv := newTestChatServerWith(t, newHub(sendQueueSize), newMemoryPresence(), as)
+	dialer := &websocket.Dialer{Subprotocols: []string{jsonProtocol}}
+
+	agent := dialTestRoomWith(t, dialer, srv.URL, "room", "agent", 2)
+	defer agent.Close()
+	readFrame(t, agent, FrameSystem)
+	visitor := dialTestRoom(t, srv.URL, "room", "visitor", 1)
+	defer visitor.Close()
+	readUntil(t, visitor, "connected to chat")
+
+	// the client only sends the id, the rest comes from the store
+	agent.WriteJSON(frame{Type: FrameMessage, Text: "look", Attachments: []attachment{{ID: "a1", Name: "renamed.exe"}}})
+	msg := readFrame(t, agent, FrameMessage)
+	if len(msg.Attachments) != 1 || msg.Attachments[0] != (attachment{ID: "a1", Name: "cat.png", ContentType: "image/png", Size: 10}) {
+		t.Errorf("unexpected attachments %+v", msg.Attachments)
+	}
+	readUntil(t, visitor, "agent: look [attachment: cat.png]")
+
+	agent.WriteJSON(frame{Type: FrameMessage, Attachments: []attachment{{ID: "a2"}}})
+	readFrame(t, agent, FrameError)
+
+	visitor.WriteMessage(websocket.BinaryMessage, []byte{0x89, 'P', 'N', 'G'})
+	readUntil(t, visitor, "binary frames are not supported, upload files as attachments")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var posted []events.Event
+		for _, e := range seen() {
+			if e.Type == events.MessagePosted {
+				posted = append(posted, e)
+			}
+		}
+		if len(posted) == 1 && slices.Equal(posted[0].Payload.Attachments, []string{"a1"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one message_posted event with attachment a1, got %+v", posted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultPublishTimeout = 5 * time.Second
+	defaultPublishRetries = 3
+	// how long to wait before reconnecting to the broker, or between attempts
+	// to publish an event it did not confirm
+	publishRetryDelay = 5 * time.Second
+	confirmRetryDelay = 500 * time.Millisecond
+)
+
+var errNacked = errors.New("broker did not accept the event")
+
+// the part of a broker channel in confirm mode used to publish events
+type confirmChannel interface {
+	// publishes msg, returning once the broker has confirmed it. acked is false
+	// if the broker refused it, an error means the channel is no longer usable.
+	publish(ctx context.Context, msg amqp091.Publishing) (acked bool, err error)
+	close()
+}
+
+// eventPublisher publishes the events read from a channel to queueName,
+// waiting for the broker to confirm each one. While the broker is unavailable
+// events go to the spool, which is drained in order before anything newer is
+// published once it is reachable again.
+type eventPublisher struct {
+	dial       func() (confirmChannel, error)
+	spool      *spool
+	timeout    time.Duration //to wait for the broker to confirm an event
+	retries    int           //attempts to publish an event before giving up on the connection
+	retryDelay time.Duration
+	metrics    *metrics
+}
+
+func newEventPublisher(url string, sp *spool, m *metrics) *eventPublisher {
+	return &eventPublisher{
+		dial:       func() (confirmChannel, error) { return dialConfirmChannel(url) },
+		spool:      sp,
+		timeout:    envDuration("publishtimeout", defaultPublishTimeout),
+		retries:    envInt("publishretries", defaultPublishRetries),
+		retryDelay: publishRetryDelay,
+		metrics:    m,
+	}
+}
+
+// publishes events from in until ctx is done, reconnecting whenever the
+// broker is lost
+func (ep *eventPublisher) run(ctx context.Context, in <-chan amqp091.Publishing) {
+	for {
+		err := ep.session(ctx, in)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("event publisher disconnected, spooling events:", err)
+		retry := time.After(ep.retryDelay)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-in:
+				ep.store(msg)
+			case <-retry:
+				break wait
+			}
+		}
+	}
+}
+
+func (ep *eventPublisher) session(ctx context.Context, in <-chan amqp091.Publishing) error {
+	ch, err := ep.dial()
+	if err != nil {
+		return err
+	}
+	defer ch.close()
+	log.Println("event publisher connected")
+
+	for {
+		// the spool is drained first so events are published in order, new
+		// ones join the end of it meanwhile
+		if ep.spool.depth() > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case msg := <-in:
+				ep.store(msg)
+				continue
+			default:
+			}
+			msg, n, err := ep.spool.peek()
+			if err != nil && n == 0 {
+				return err
+			}
+			if err != nil {
+				log.Println("skipping unreadable event in spool:", err)
+			} else if err := ep.publish(ctx, ch, msg); err != nil {
+				return err
+			}
+			if err := ep.spool.pop(n); err != nil {
+				log.Println("error saving spool position:", err)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-in:
+			if err := ep.publish(ctx, ch, msg); err != nil {
+				ep.store(msg)
+				return err
+			}
+		}
+	}
+}
+
+// publishes msg, trying again if the broker does not confirm it. An error
+// means the connection should be given up on.
+func (ep *eventPublisher) publish(ctx context.Context, ch confirmChannel, msg amqp091.Publishing) error {
+	var err error
+	for attempt := 0; attempt < ep.retries; attempt++ {
+		if attempt > 0 {
+			ep.metrics.publishRetries.Add(1)
+			select {
+			case <-time.After(confirmRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		pctx, cancel := context.WithTimeout(ctx, ep.timeout)
+		var acked bool
+		acked, err = ch.publish(pctx, msg)
+		cancel()
+		if err == nil && acked {
+			ep.metrics.published.Add(1)
+			return nil
+		}
+		if err == nil {
+			err = errNacked
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			//the channel or connection has closed
+			return err
+		}
+	}
+	return err
+}
+
+// adds msg to the spool. If that fails too the event is lost.
+func (ep *eventPublisher) store(msg amqp091.Publishing) {
+	if err := ep.spool.append(msg); err != nil {
+		ep.metrics.dropped.Add(1)
+		log.Printf("error spooling %s event, dropping it: %s", msg.Type, err)
+		return
+	}
+	ep.metrics.spooled.Add(1)
+}
+
+// amqpConfirms is a confirmChannel on its own broker connection
+type amqpConfirms struct {
+	conn *amqp091.Connection
+	ch   *amqp091.Channel
+}
+
+func dialConfirmChannel(url string) (confirmChannel, error) {
+	conn, err := amqp091.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = ch.QueueDeclare(
+		queueName,
+		true,
+		false,
+		false,
+		false,
+		amqp091.Table{
+			"x-dead-letter-exchange": "message.deadletter",
+			"x-max-priority":         10,
+		},
+	)
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &amqpConfirms{conn: conn, ch: ch}, nil
+}
+
+func (ac *amqpConfirms) publish(ctx context.Context, msg amqp091.Publishing) (bool, error) {
+	dc, err := ac.ch.PublishWithDeferredConfirmWithContext(ctx, "", queueName, false, false, msg)
+	if err != nil {
+		return false, err
+	}
+	return dc.WaitContext(ctx)
+}
+
+func (ac *amqpConfirms) close() {
+	ac.conn.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker records the events it confirms. While down it refuses
+// connections and fails publishes on open channels.
+type fakeBroker struct {
+	mu        sync.Mutex
+	down      bool
+	nacks     int //events to refuse before accepting
+	published []string
+}
+
+func (fb *fakeBroker) setDown(down bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.down = down
+}
+
+func (fb *fakeBroker) bodies() []string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]string(nil), fb.published...)
+}
+
+func (fb *fakeBroker) dial() (confirmChannel, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.down {
+		return nil, errors.New("connection refused")
+	}
+	return fb, nil
+}
+
+func (fb *fakeBroker) publish(ctx context.Context, msg amqp091.Publishing) (bool, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.down {
+		return false, amqp091.ErrClosed
+	}
+	if fb.nacks > 0 {
+		fb.nacks--
+		return false, nil
+	}
+	fb.published = append(fb.published, string(msg.Body))
+	return true, nil
+}
+
+func (fb *fakeBroker) close() {}
+
+func startTestPublisher(t *testing.T, fb *fakeBroker) (*eventPublisher, chan amqp091.Publishing) {
+	t.Helper()
+	sp := openTestSpool(t, filepath.Join(t.TempDir(), "events.log"))
+	ep := &eventPublisher{
+		dial:       fb.dial,
+		spool:      sp,
+		timeout:    time.Second,
+		retries:    3,
+		retryDelay: 50 * time.Millisecond,
+		metrics:    &metrics{spool: sp},
+	}
+	in := make(chan amqp091.Publishing)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ep.run(ctx, in)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ep, in
+}
+
+func waitForPublished(t *testing.T, fb *fakeBroker, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := fb.bodies()
+		if len(got) >= len(want) {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("expected events %v in order, got %v", want, got)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected events %v, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublisherSpoolsWhileBrokerDown(t *testing.T) {
+	fb := &fakeBroker{down: true}
+	ep, in := startTestPublisher(t, fb)
+
+	for _, body := range []string{"1", "2", "3"} {
+		in <- spoolEvent(body)
+	}
+	// the send returns once the event is handled, so the last one may still
+	// be being spooled
+	in <- spoolEvent("4")
+	if d := ep.spool.depth(); d < 3 {
+		t.Fatalf("expected the events to be spooled while the broker is down, depth %d", d)
+	}
+
+	fb.setDown(false)
+	waitForPublished(t, fb, []string{"1", "2", "3", "4"})
+	in <- spoolEvent("5")
+	waitForPublished(t, fb, []string{"1", "2", "3", "4", "5"})
+	if d := ep.spool.depth(); d != 0 {
+		t.Errorf("expected the spool to be drained, depth %d", d)
+	}
+	if n := ep.metrics.spooled.Load(); n != 4 {
+		t.Errorf("expected 4 events spooled, got %d", n)
+	}
+}
+
+func TestPublisherRetriesNacks(t *testing.T) {
+	fb := &fakeBroker{nacks: 2}
+	ep, in := startTestPublisher(t, fb)
+
+	in <- spoolEvent("1")
+	waitForPublished(t, fb, []string{"1"})
+	if n := ep.metrics.publishRetries.Load(); n != 2 {
+		t.Errorf("expected 2 retries, got %d", n)
+	}
+	if d := ep.spool.depth(); d != 0 {
+		t.Errorf("expected nothing spooled, depth %d", d)
+	}
+}
@@ -3,8 +3,15 @@ module github.com/Ryan-Har/chat-app/src/chat
 go 1.22
 
 require (
+	github.com/Ryan-Har/chat-app/src/api v0.0.0-00010101000000-000000000000
 	github.com/gorilla/websocket v1.5.1
 	github.com/rabbitmq/amqp091-go v1.9.0
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	golang.org/x/crypto v0.22.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+)
+
+replace github.com/Ryan-Har/chat-app/src/api => ../api
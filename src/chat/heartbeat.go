@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// heartbeat controls how dead connections are found. The server pings each
+// client every pingInterval and drops it if nothing, pong or otherwise, is
+// read for pongTimeout, or if a single write takes longer than writeWait.
+// Without this a half open connection, such as a laptop closed mid chat,
+// would stay in its room forever.
+type heartbeat struct {
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	writeWait    time.Duration
+}
+
+var defaultHeartbeat = heartbeat{
+	pingInterval: 30 * time.Second,
+	pongTimeout:  60 * time.Second,
+	writeWait:    10 * time.Second,
+}
+
+// reads the heartbeat from the pinginterval, pongtimeout and writewait
+// environment variables. A ping interval which would not fit inside the pong
+// timeout would drop healthy clients, so the defaults are used instead, as
+// they are for a zero interval or write wait.
+func heartbeatFromEnv() heartbeat {
+	hb := heartbeat{
+		pingInterval: envDuration("pinginterval", defaultHeartbeat.pingInterval),
+		pongTimeout:  envDuration("pongtimeout", defaultHeartbeat.pongTimeout),
+		writeWait:    envDuration("writewait", defaultHeartbeat.writeWait),
+	}
+	if hb.pingInterval <= 0 || hb.writeWait <= 0 || hb.pingInterval >= hb.pongTimeout {
+		log.Printf("pinginterval %s must be less than pongtimeout %s, using defaults", hb.pingInterval, hb.pongTimeout)
+		return defaultHeartbeat
+	}
+	return hb
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/gorilla/websocket"
+)
+
+func TestHeartbeatFromEnv(t *testing.T) {
+	t.Setenv("pinginterval", "5s")
+	t.Setenv("pongtimeout", "15s")
+	t.Setenv("writewait", "2s")
+	want := heartbeat{pingInterval: 5 * time.Second, pongTimeout: 15 * time.Second, writeWait: 2 * time.Second}
+	if hb := heartbeatFromEnv(); hb != want {
+		t.Errorf("expected %+v, got %+v", want, hb)
+	}
+
+	t.Setenv("pinginterval", "20s")
+	if hb := heartbeatFromEnv(); hb != defaultHeartbeat {
+		t.Errorf("expected the defaults when pings do not fit in the pong timeout, got %+v", hb)
+	}
+
+	t.Setenv("pinginterval", "soon")
+	if hb := heartbeatFromEnv(); hb.pingInterval != defaultHeartbeat.pingInterval {
+		t.Errorf("expected the default ping interval for an invalid value, got %s", hb.pingInterval)
+	}
+}
+
+func TestDeadClientIsReaped(t *testing.T) {
+	captured := captureBrokerEvents(t)
+	h := newHub(sendQueueSize)
+	h.heartbeat = heartbeat{pingInterval: 50 * time.Millisecond, pongTimeout: 200 * time.Millisecond, writeWait: 100 * time.Millisecond}
+	srv := newTestChatServer(t, h, newMemoryPresence())
+
+	agent := dialTestRoom(t, srv.URL, "room", "agent", 2)
+	defer agent.Close()
+	readUntil(t, agent, "connected to chat")
+
+	// pongs are only sent while reading, so a client which never reads looks
+	// like a half open connection
+	ghost := dialTestRoom(t, srv.URL, "room", "ghost", 1)
+	defer ghost.Close()
+	readUntil(t, agent, "ghost joined the chat")
+	readUntil(t, agent, "ghost left the chat")
+
+	// the agent has been answering pings for longer than the pong timeout
+	agent.WriteMessage(websocket.TextMessage, []byte("still here"))
+	readUntil(t, agent, "agent: still here")
+
+	left := false
+	deadline := time.Now().Add(5 * time.Second)
+	for !left && time.Now().Before(deadline) {
+		for _, event := range captured() {
+			if event.Type == events.ParticipantLeft && event.Payload.Name == "ghost" {
+				left = true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !left {
+		t.Error("expected a participant_left event for the dead client")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHistoryPages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHub(sendQueueSize)
+	h.historySize, h.historyPage = 5, 2
+	go h.run(ctx)
+
+	sender := newClient(nil, "room", &UserInfo{Name: "sender"}, h.queueSize)
+	h.join(sender)
+	defer h.leave(sender)
+	for i := 0; i < 6; i++ {
+		h.broadcast("room", newFrame(FrameMessage, "room", sender.info, fmt.Sprint(i)), nil)
+	}
+
+	c := newClient(nil, "room", &UserInfo{Name: "reader"}, h.queueSize)
+	h.join(c)
+	page := func() (texts string, oldest string, more bool) {
+		f := <-c.send
+		if f.Type != FrameHistory {
+			t.Fatalf("expected a history frame, got %+v", f)
+		}
+		for _, m := range f.Messages {
+			texts += m.Text
+		}
+		if len(f.Messages) > 0 {
+			oldest = f.Messages[0].ID
+		}
+		return texts, oldest, f.More
+	}
+
+	// only the last five messages are kept, two are sent at a time
+	texts, oldest, more := page()
+	if texts != "45" || !more {
+		t.Errorf("history on join = %q, more %v", texts, more)
+	}
+	h.historyBefore(c, oldest)
+	if texts, oldest, more = page(); texts != "23" || !more {
+		t.Errorf("second page = %q, more %v", texts, more)
+	}
+	h.historyBefore(c, oldest)
+	if texts, _, more = page(); texts != "1" || more {
+		t.Errorf("last page = %q, more %v", texts, more)
+	}
+	h.historyBefore(c, "unknown")
+	if texts, _, more = page(); texts != "" || more {
+		t.Errorf("page before an unknown id = %q, more %v", texts, more)
+	}
+}
+
+func TestHistoryOnJoin(t *testing.T) {
+	captureBrokerEvents(t)
+	srv := newTestChatServer(t, newHub(sendQueueSize), newMemoryPresence())
+	dialer := &websocket.Dialer{Subprotocols: []string{jsonProtocol}}
+
+	agent := dialTestRoomWith(t, dialer, srv.URL, "room", "agent", 2)
+	defer agent.Close()
+	agent.WriteJSON(frame{Type: FrameMessage, Text: "first"})
+	agent.WriteJSON(frame{Type: FrameMessage, Text: "second"})
+	readFrame(t, agent, FrameMessage)
+	last := readFrame(t, agent, FrameMessage)
+
+	visitor := dialTestRoomWith(t, dialer, srv.URL, "room", "visitor", 1)
+	defer visitor.Close()
+	history := readFrame(t, visitor, FrameHistory)
+	if len(history.Messages) != 2 || history.Messages[0].Text != "first" || history.Messages[1].ID != last.ID || history.More {
+		t.Fatalf("unexpected history on join %+v", history)
+	}
+
+	visitor.WriteJSON(frame{Type: FrameHistory, Before: history.Messages[1].ID})
+	if older := readFrame(t, visitor, FrameHistory); len(older.Messages) != 1 || older.Messages[0].Text != "first" {
+		t.Errorf("unexpected older history %+v", older)
+	}
+
+	// legacy clients get the history as lines of text
+	legacy := dialTestRoom(t, srv.URL, "room", "legacy", 3)
+	defer legacy.Close()
+	readUntil(t, legacy, "agent: first\nagent: second")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// messages queued for a client before it is considered too slow and evicted
+	sendQueueSize = 256
+	// messages kept per room, for sending to clients as history
+	defaultHistorySize = 500
+	// messages in each history batch
+	defaultHistoryPage = 50
+)
+
+var errResumeUnavailable = errors.New("missed messages can not be replayed, showing the recent history")
+
+// client is one connection in a room. Only its writePump writes to conn, and
+// only the hub sends on or closes send.
+type client struct {
+	conn *websocket.Conn
+	room string
+	info *UserInfo
+	send chan frame
+	json bool //whether the client negotiated jsonProtocol
+	// id of the last message the client saw before reconnecting, the messages
+	// after it are replayed when it joins instead of the latest history
+	resumeAfter string
+
+	evicted bool //owned by the hub goroutine
+}
+
+func newClient(conn *websocket.Conn, room string, info *UserInfo, queueSize int) *client {
+	c := &client{
+		conn: conn,
+		room: room,
+		info: info,
+		send: make(chan frame, queueSize),
+	}
+	if conn != nil {
+		c.json = conn.Subprotocol() == jsonProtocol
+	}
+	return c
+}
+
+// encodes a frame for the client's protocol, returning nil for frames the
+// legacy protocol has no way to show
+func (c *client) encode(f frame) ([]byte, error) {
+	if c.json {
+		return json.Marshal(f)
+	}
+	if text := f.legacyText(); text != "" {
+		return []byte(text), nil
+	}
+	return nil, nil
+}
+
+// writes everything queued for the client, pinging it in between, until the
+// hub closes send or a write fails. Closing the connection on the way out
+// makes the reader fail too, which unregisters the client.
+func (c *client) writePump(hb heartbeat) {
+	ticker := time.NewTicker(hb.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case f, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(hb.writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			data, err := c.encode(f)
+			if err != nil {
+				log.Println("error encoding frame for", c.info.Name, err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Println("error writing to", c.info.Name, err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(hb.writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("error pinging", c.info.Name, err)
+				return
+			}
+		}
+	}
+}
+
+// makes reads fail once the client has been silent for the pong timeout. Each
+// pong, or anything else read, gives it another pong timeout.
+func (c *client) expectPongs(hb heartbeat) {
+	c.conn.SetReadDeadline(time.Now().Add(hb.pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(hb.pongTimeout))
+	})
+}
+
+type registration struct {
+	client  *client
+	created chan bool
+}
+
+type unregistration struct {
+	client *client
+	ended  chan bool
+}
+
+type historyRequest struct {
+	client *client
+	before string
+}
+
+type delivery struct {
+	room   string
+	msg    frame
+	to     *client //only this client, if set
+	except *client //everyone in the room but this client, if set
+}
+
+// recent messages in a room, oldest first
+type roomHistory struct {
+	frames     []frame
+	emptySince time.Time //when the last local client left, zero while it has clients
+}
+
+// hub keeps the room registry. It is only touched by the run goroutine, every
+// other goroutine goes through the channels.
+type hub struct {
+	rooms     map[string]map[*client]bool
+	history   map[string]*roomHistory
+	queueSize int
+	heartbeat heartbeat     //applied to each client's connection
+	limiter   *limiter      //limits what clients may send, nothing is limited if nil
+	retain    time.Duration //how long the history of an emptied room is kept, for clients resuming
+	// messages kept per room, and how many are sent in each history batch
+	historySize int
+	historyPage int
+
+	register   chan registration
+	unregister chan unregistration
+	deliver    chan delivery
+	pages      chan historyRequest
+	listRooms  chan chan []string
+
+	// signalled, without blocking, whenever localRooms may have changed
+	roomsChanged chan struct{}
+	// passes messages sent in rooms here on to the other chat instances, if set
+	relay publisher
+}
+
+type publisher interface {
+	publish(room string, f frame)
+}
+
+func newHub(queueSize int) *hub {
+	return &hub{
+		rooms:        make(map[string]map[*client]bool),
+		history:      make(map[string]*roomHistory),
+		queueSize:    queueSize,
+		heartbeat:    defaultHeartbeat,
+		historySize:  defaultHistorySize,
+		historyPage:  defaultHistoryPage,
+		register:     make(chan registration),
+		unregister:   make(chan unregistration),
+		deliver:      make(chan delivery),
+		pages:        make(chan historyRequest),
+		listRooms:    make(chan chan []string),
+		roomsChanged: make(chan struct{}, 1),
+	}
+}
+
+func (h *hub) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reg := <-h.register:
+			pruned := h.pruneHistory(time.Now())
+			c := reg.client
+			clients, ok := h.rooms[c.room]
+			if !ok {
+				clients = make(map[*client]bool)
+				h.rooms[c.room] = clients
+			}
+			clients[c] = true
+			hist, retained := h.history[c.room]
+			if !retained {
+				hist = &roomHistory{}
+				h.history[c.room] = hist
+			}
+			hist.emptySince = time.Time{}
+			if c.resumeAfter != "" {
+				h.replay(c, hist)
+			} else if len(hist.frames) > 0 {
+				h.sendHistory(c, hist, len(hist.frames))
+			}
+			reg.created <- !ok
+			if pruned || !retained {
+				h.notifyRoomsChanged()
+			}
+		case unreg := <-h.unregister:
+			ended := h.remove(unreg.client)
+			unreg.ended <- ended
+			if h.pruneHistory(time.Now()) {
+				h.notifyRoomsChanged()
+			}
+		case d := <-h.deliver:
+			h.fanOut(d)
+		case req := <-h.pages:
+			if hist := h.history[req.client.room]; hist != nil && h.rooms[req.client.room][req.client] {
+				//an id no longer kept gets an empty batch, there is nothing older to send
+				h.sendHistory(req.client, hist, max(hist.index(req.before), 0))
+			}
+		case reply := <-h.listRooms:
+			rooms := make([]string, 0, len(h.history))
+			for room := range h.history {
+				rooms = append(rooms, room)
+			}
+			reply <- rooms
+		}
+	}
+}
+
+func (h *hub) notifyRoomsChanged() {
+	select {
+	case h.roomsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// removes c from its room, reporting whether that left the room empty
+func (h *hub) remove(c *client) bool {
+	clients, ok := h.rooms[c.room]
+	if !ok || !clients[c] {
+		return false
+	}
+	delete(clients, c)
+	if !c.evicted {
+		close(c.send)
+	}
+	if len(clients) == 0 {
+		delete(h.rooms, c.room)
+		if hist := h.history[c.room]; hist != nil {
+			hist.emptySince = time.Now()
+		}
+		return true
+	}
+	return false
+}
+
+// drops the history of rooms which have been empty for longer than they are
+// retained, reporting whether any were dropped
+func (h *hub) pruneHistory(now time.Time) bool {
+	pruned := false
+	for room, hist := range h.history {
+		if !hist.emptySince.IsZero() && now.Sub(hist.emptySince) >= h.retain {
+			delete(h.history, room)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// queues the messages c missed, those after c.resumeAfter. Only this
+// instance's history is searched, so when that message is not kept here,
+// because it aged out or the client was on another instance, c is told its
+// missed messages can not be replayed and gets the recent history instead.
+func (h *hub) replay(c *client, hist *roomHistory) {
+	i := hist.index(c.resumeAfter)
+	if i < 0 {
+		h.queue(c, newFrame(FrameError, c.room, nil, errResumeUnavailable.Error()))
+		h.sendHistory(c, hist, len(hist.frames))
+		return
+	}
+	for _, f := range hist.frames[i+1:] {
+		h.queue(c, f)
+	}
+}
+
+// sends c a history batch of the messages before end, an index into the room's history
+func (h *hub) sendHistory(c *client, hist *roomHistory, end int) {
+	start := max(end-h.historyPage, 0)
+	f := newFrame(FrameHistory, c.room, nil, "")
+	f.Messages = append([]frame(nil), hist.frames[start:end]...)
+	f.More = start > 0
+	h.queue(c, f)
+}
+
+// the position of the message id in the history, or -1 if it is not kept
+func (hist *roomHistory) index(id string) int {
+	for i, f := range hist.frames {
+		if f.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// queues the message for each recipient, keeping messages sent to the whole
+// room in its history
+func (h *hub) fanOut(d delivery) {
+	if hist := h.history[d.room]; hist != nil && d.to == nil && d.msg.Type == FrameMessage {
+		hist.frames = append(hist.frames, d.msg)
+		if len(hist.frames) > h.historySize {
+			hist.frames = hist.frames[len(hist.frames)-h.historySize:]
+		}
+	}
+	for c := range h.rooms[d.room] {
+		if c == d.except || (d.to != nil && c != d.to) {
+			continue
+		}
+		h.queue(c, d.msg)
+	}
+}
+
+// queues a frame for c without blocking. A client whose queue is full is
+// evicted, its connection is closed once the writer has drained what it
+// already has.
+func (h *hub) queue(c *client, f frame) {
+	if c.evicted {
+		return
+	}
+	select {
+	case c.send <- f:
+	default:
+		log.Println("evicting slow client", c.info.Name, "from", c.room)
+		c.evicted = true
+		close(c.send)
+	}
+}
+
+// adds c to its room, creating the room if needed. Reports whether the room
+// was created.
+func (h *hub) join(c *client) bool {
+	created := make(chan bool)
+	h.register <- registration{client: c, created: created}
+	return <-created
+}
+
+// removes c from its room and stops its writer. Reports whether the room is
+// now empty here, which is only true for the last local client to leave.
+func (h *hub) leave(c *client) bool {
+	ended := make(chan bool)
+	h.unregister <- unregistration{client: c, ended: ended}
+	return <-ended
+}
+
+// sends a frame to everyone in the room, on this instance and any other,
+// except the given client if it is not nil
+func (h *hub) broadcast(room string, f frame, except *client) {
+	h.deliverLocal(room, f, except)
+	if h.relay != nil {
+		h.relay.publish(room, f)
+	}
+}
+
+// sends a frame to everyone in the room connected to this instance
+func (h *hub) deliverLocal(room string, f frame, except *client) {
+	h.deliver <- delivery{room: room, msg: f, except: except}
+}
+
+// the rooms with clients connected to this instance, or which have been left
+// recently enough that their history is kept for clients resuming
+func (h *hub) localRooms() []string {
+	reply := make(chan []string)
+	h.listRooms <- reply
+	return <-reply
+}
+
+// sends c a history batch of the messages before the message id
+func (h *hub) historyBefore(c *client, before string) {
+	h.pages <- historyRequest{client: c, before: before}
+}
+
+// sends a frame to a single client
+func (h *hub) sendTo(c *client, f frame) {
+	h.deliver <- delivery{room: c.room, msg: f, to: c}
+}
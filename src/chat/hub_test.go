@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/Ryan-Har/chat-app/src/api/origin"
+	"github.com/gorilla/websocket"
+)
+
+// counts room members in memory, standing in for the api
+type memoryPresence struct {
+	mu      sync.Mutex
+	members map[string]map[string]bool
+	grace   time.Duration
+	endsAt  map[string]time.Time //rooms in their grace period
+}
+
+func newMemoryPresence() *memoryPresence {
+	return &memoryPresence{members: make(map[string]map[string]bool), endsAt: make(map[string]time.Time)}
+}
+
+func (mp *memoryPresence) join(ctx context.Context, room string, member string) (bool, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.members[room] == nil {
+		mp.members[room] = make(map[string]bool)
+	}
+	mp.members[room][member] = true
+	_, resumed := mp.endsAt[room]
+	delete(mp.endsAt, room)
+	return len(mp.members[room]) == 1 && !resumed, nil
+}
+
+func (mp *memoryPresence) leave(ctx context.Context, room string, member string) (bool, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.members[room], member)
+	if len(mp.members[room]) > 0 {
+		return false, nil
+	}
+	if mp.grace > 0 {
+		mp.endsAt[room] = time.Now().Add(mp.grace)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (mp *memoryPresence) expire(ctx context.Context) ([]string, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	var ended []string
+	for room, endsAt := range mp.endsAt {
+		if !time.Now().Before(endsAt) {
+			ended = append(ended, room)
+			delete(mp.endsAt, room)
+		}
+	}
+	return ended, nil
+}
+
+// collects what handlers send to the broker, returning a func listing the
+// events seen so far
+func captureBrokerEvents(t *testing.T) func() []events.Event {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var mu sync.Mutex
+	var seen []events.Event
+	go func() {
+		for {
+			select {
+			case msg := <-brokerSendingChan:
+				event, err := events.Decode(msg.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				seen = append(seen, event)
+				mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() []events.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]events.Event(nil), seen...)
+	}
+}
+
+// serves handleWebSocket with h, which is run until the test ends
+func newTestChatServer(t *testing.T, h *hub, p presence) *httptest.Server {
+	t.Helper()
+	return newTestChatServerWith(t, h, p, memoryAttachments{})
+}
+
+func newTestChatServerWith(t *testing.T, h *hub, p presence, as attachmentStore) *httptest.Server {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	var err error
+	if joinTokens, err = auth.NewJoinTokenSigner([]byte(strings.Repeat("j", 32)), time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.run(ctx)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(w, r, h, p, as)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+	return srv
+}
+
+func dialTestRoom(t *testing.T, url string, room string, name string, userID int) *websocket.Conn {
+	t.Helper()
+	return dialTestRoomWith(t, websocket.DefaultDialer, url, room, name, userID)
+}
+
+func dialTestRoomWith(t *testing.T, dialer *websocket.Dialer, url string, room string, name string, userID int) *websocket.Conn {
+	t.Helper()
+	return dialTestURL(t, dialer, testRoomURL(t, url, room, name, userID))
+}
+
+// the websocket url for joining room, with a join token for the user
+func testRoomURL(t *testing.T, url string, room string, name string, userID int) string {
+	t.Helper()
+	token, _, err := joinTokens.Sign(int64(userID), auth.VisitorRole, name, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "ws" + strings.TrimPrefix(url, "http") + "/ws?token=" + token
+}
+
+func dialTestURL(t *testing.T, dialer *websocket.Dialer, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestHubManyClients(t *testing.T) {
+	captureBrokerEvents(t)
+	const clients, messages = 30, 20
+	// every client is sent everything at once, room enough for it all so
+	// none is dropped as too slow to keep up
+	srv := newTestChatServer(t, newHub(clients*messages), newMemoryPresence())
+
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		conns[i] = dialTestRoom(t, srv.URL, "room", fmt.Sprintf("user-%d", i), i+1)
+		defer conns[i].Close()
+		// once connected the client is in the room, so sees everything sent from here on
+		for {
+			_, msg, err := conns[i].ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) == "connected to chat" {
+				break
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(2)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			for m := 0; m < messages; m++ {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("message %d", m))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, conn)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			received := 0
+			for received < clients*messages {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					t.Errorf("client %d: received %d of %d messages: %v", i, received, clients*messages, err)
+					return
+				}
+				if strings.Contains(string(msg), ": message ") {
+					received++
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHub(2)
+	go h.run(ctx)
+
+	slow := newClient(nil, "room", &UserInfo{Name: "slow"}, h.queueSize)
+	fast := newClient(nil, "room", &UserInfo{Name: "fast"}, 10)
+	if !h.join(slow) {
+		t.Error("expected the first client to create the room")
+	}
+	if h.join(fast) {
+		t.Error("expected the second client to join the existing room")
+	}
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast.send {
+			n++
+		}
+		received <- n
+	}()
+
+	for i := 0; i < 5; i++ {
+		h.broadcast("room", newFrame(FrameMessage, "room", nil, fmt.Sprint("message ", i)), nil)
+	}
+
+	// the slow client only ever gets what fitted in its queue
+	n := 0
+	for range slow.send {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("slow client: expected 2 queued messages before eviction, got %d", n)
+	}
+
+	if h.leave(slow) {
+		t.Error("room ended while a client was still in it")
+	}
+	if !h.leave(fast) {
+		t.Error("expected the last client leaving to end the room")
+	}
+	if n := <-received; n != 5 {
+		t.Errorf("fast client: expected 5 messages, got %d", n)
+	}
+	if h.leave(fast) {
+		t.Error("leaving twice ended the room twice")
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	captureBrokerEvents(t)
+	srv := newTestChatServer(t, newHub(sendQueueSize), newMemoryPresence())
+	policy, err := origin.Parse("https://*.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	originPolicy = policy
+	defer func() { originPolicy = nil }()
+
+	dial := func(o string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(testRoomURL(t, srv.URL, "room", "visitor", 1), http.Header{"Origin": {o}})
+	}
+	conn, _, err := dial("https://chat.example.com")
+	if err != nil {
+		t.Fatalf("allowed origin: %v", err)
+	}
+	conn.Close()
+	if _, resp, err := dial("https://evil.com"); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other origin: expected status 403, got %v", err)
+	}
+}
+
+func TestJoinTokenChecked(t *testing.T) {
+	h := newHub(sendQueueSize)
+	srv := newTestChatServer(t, h, newMemoryPresence())
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token="
+
+	other, err := auth.NewJoinTokenSigner([]byte(strings.Repeat("o", 32)), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := auth.NewJoinTokenSigner([]byte(strings.Repeat("j", 32)), -time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(token string, _ time.Time, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tests := map[string]struct {
+		url    string
+		status int
+	}{
+		"another key":  {wsURL + sign(other.Sign(1, auth.VisitorRole, "v", "room")), http.StatusUnauthorized},
+		"expired":      {wsURL + sign(expired.Sign(1, auth.VisitorRole, "v", "room")), http.StatusUnauthorized},
+		"resume token": {wsURL + sign(expired.SignResume(1, "v", "room")), http.StatusUnauthorized},
+		"empty":        {wsURL, http.StatusUnauthorized},
+		"another room": {testRoomURL(t, srv.URL, "room", "v", 1) + "&guid=other", http.StatusForbidden},
+	}
+	for name, tt := range tests {
+		conn, resp, err := websocket.DefaultDialer.Dial(tt.url, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: expected the connection to be refused", name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %v", name, tt.status, resp)
+		}
+	}
+}
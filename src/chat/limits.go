@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBanned             = errors.New("too many violations, try again later")
+	errTooManyConnections = errors.New("too many connections from this address")
+	errRateLimited        = errors.New("sending too fast, message dropped")
+)
+
+// limits on what a client may send, set from the environment by
+// limitsFromEnv
+type limits struct {
+	maxFrameBytes  int64   //largest frame read from a client, larger ones close the connection
+	messageRate    float64 //frames per second allowed from one connection
+	messageBurst   int     //frames a connection may send at once before being limited
+	ipMessageRate  float64 //frames per second allowed from all connections from one address
+	ipMessageBurst int
+	maxConnsPerIP  int
+	// violations within violationWindow before a client is disconnected, and
+	// how long its address is then refused for, no ban if 0
+	maxViolations   int
+	violationWindow time.Duration
+	banDuration     time.Duration
+	// the header a trusted proxy puts the client's address in, e.g.
+	// X-Forwarded-For. Unset, addresses are taken from the connection.
+	clientIPHeader string
+}
+
+var defaultLimits = limits{
+	maxFrameBytes:   16 << 10,
+	messageRate:     5,
+	messageBurst:    10,
+	ipMessageRate:   20,
+	ipMessageBurst:  40,
+	maxConnsPerIP:   10,
+	maxViolations:   10,
+	violationWindow: time.Minute,
+	banDuration:     0,
+}
+
+func limitsFromEnv() limits {
+	l := limits{
+		maxFrameBytes:   int64(envInt("maxframebytes", int(defaultLimits.maxFrameBytes))),
+		messageRate:     envFloat("messagerate", defaultLimits.messageRate),
+		messageBurst:    envInt("messageburst", defaultLimits.messageBurst),
+		ipMessageRate:   envFloat("ipmessagerate", defaultLimits.ipMessageRate),
+		ipMessageBurst:  envInt("ipmessageburst", defaultLimits.ipMessageBurst),
+		maxConnsPerIP:   envInt("maxconnsperip", defaultLimits.maxConnsPerIP),
+		maxViolations:   envInt("maxviolations", defaultLimits.maxViolations),
+		violationWindow: envDuration("violationwindow", defaultLimits.violationWindow),
+		banDuration:     envDuration("banduration", defaultLimits.banDuration),
+		clientIPHeader:  os.Getenv("clientipheader"),
+	}
+	if l.violationWindow == 0 {
+		log.Printf("violationwindow must be more than 0, using default %s", defaultLimits.violationWindow)
+		l.violationWindow = defaultLimits.violationWindow
+	}
+	return l
+}
+
+// tokenBucket allows rate events a second on average, and up to burst at
+// once. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// takes a token if there is one, reporting whether there was
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// limiter applies the limits shared by every connection from an address. It
+// is safe for concurrent use.
+type limiter struct {
+	limits limits
+
+	mu      sync.Mutex
+	conns   map[string]int
+	buckets map[string]*tokenBucket
+	bans    map[string]time.Time //when each ban ends
+}
+
+func newLimiter(l limits) *limiter {
+	return &limiter{
+		limits:  l,
+		conns:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+		bans:    make(map[string]time.Time),
+	}
+}
+
+// records a new connection from ip, unless ip is banned or already has as
+// many connections as it may. Each successful acquire needs a release.
+func (l *limiter) acquire(ip string, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until, ok := l.bans[ip]; ok {
+		if now.Before(until) {
+			return errBanned
+		}
+		delete(l.bans, ip)
+	}
+	if l.conns[ip] >= l.limits.maxConnsPerIP {
+		return errTooManyConnections
+	}
+	if l.conns[ip] == 0 {
+		l.buckets[ip] = newTokenBucket(l.limits.ipMessageRate, l.limits.ipMessageBurst, now)
+	}
+	l.conns[ip]++
+	return nil
+}
+
+func (l *limiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+		delete(l.buckets, ip)
+	}
+}
+
+// takes a token from ip's shared bucket, reporting whether there was one
+func (l *limiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[ip]
+	return ok && bucket.allow(now)
+}
+
+// refuses new connections from ip for the ban duration, if there is one
+func (l *limiter) ban(ip string, now time.Time) {
+	if l.limits.banDuration <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[ip] = now.Add(l.limits.banDuration)
+}
+
+// connLimits tracks one connection against the limits. It belongs to the
+// connection's reader.
+type connLimits struct {
+	limiter    *limiter
+	ip         string
+	bucket     *tokenBucket
+	violations int
+	firstSeen  time.Time //of the first violation in the current window
+}
+
+func (l *limiter) forConn(ip string, now time.Time) *connLimits {
+	return &connLimits{
+		limiter: l,
+		ip:      ip,
+		bucket:  newTokenBucket(l.limits.messageRate, l.limits.messageBurst, now),
+	}
+}
+
+// checks a frame read from the connection, returning why it has to be
+// dropped if it does
+func (cl *connLimits) check(now time.Time) error {
+	// both buckets are always charged, so a connection can not save up
+	// tokens by sending while its address is limited
+	connOK := cl.bucket.allow(now)
+	ipOK := cl.limiter.allow(cl.ip, now)
+	if !connOK || !ipOK {
+		return errRateLimited
+	}
+	return nil
+}
+
+// counts a violation, reporting whether the client has had too many and
+// should be disconnected, in which case its address is banned
+func (cl *connLimits) violation(now time.Time) bool {
+	if cl.violations == 0 || now.Sub(cl.firstSeen) > cl.limiter.limits.violationWindow {
+		cl.violations, cl.firstSeen = 0, now
+	}
+	cl.violations++
+	if cl.violations < cl.limiter.limits.maxViolations {
+		return false
+	}
+	cl.limiter.ban(cl.ip, now)
+	return true
+}
+
+// the address a request came from, without its port. With clientIPHeader set
+// it is the last address in that header, the one added by the proxy in front
+// of this service, as any before it were sent by the client. A nil limiter
+// takes it from the connection.
+func (l *limiter) clientIP(r *http.Request) string {
+	if l != nil && l.limits.clientIPHeader != "" {
+		values := r.Header.Values(l.limits.clientIPHeader)
+		if len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !tb.allow(now) {
+			t.Fatalf("expected the burst of 3 to be allowed, refused at %d", i)
+		}
+	}
+	if tb.allow(now) {
+		t.Error("expected the bucket to be empty after its burst")
+	}
+	if !tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected a token after half a second at 2 a second")
+	}
+	if tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected only one token after half a second")
+	}
+	// refills stop at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		tb.allow(later)
+	}
+	if tb.allow(later) {
+		t.Error("expected no more than the burst after a long wait")
+	}
+}
+
+func TestLimitsFromEnv(t *testing.T) {
+	t.Setenv("messagerate", "0.5")
+	t.Setenv("ipmessagerate", "2.5")
+	t.Setenv("violationwindow", "30s")
+	t.Setenv("clientipheader", "X-Forwarded-For")
+	l := limitsFromEnv()
+	if l.messageRate != 0.5 || l.ipMessageRate != 2.5 || l.violationWindow != 30*time.Second || l.clientIPHeader != "X-Forwarded-For" {
+		t.Errorf("unexpected limits %+v", l)
+	}
+
+	t.Setenv("messagerate", "-1")
+	t.Setenv("violationwindow", "0s")
+	l = limitsFromEnv()
+	if l.messageRate != defaultLimits.messageRate || l.violationWindow != defaultLimits.violationWindow {
+		t.Errorf("expected invalid values to fall back to the defaults, got %+v", l)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.RemoteAddr = "10.0.0.9:5000"
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+
+	if ip := newLimiter(limits{}).clientIP(req); ip != "10.0.0.9" {
+		t.Errorf("without a header configured: expected the connection's address, got %q", ip)
+	}
+	if ip := (*limiter)(nil).clientIP(req); ip != "10.0.0.9" {
+		t.Errorf("without a limiter: expected the connection's address, got %q", ip)
+	}
+	behindProxy := newLimiter(limits{clientIPHeader: "X-Forwarded-For"})
+	if ip := behindProxy.clientIP(req); ip != "10.0.0.2" {
+		t.Errorf("expected the address added by the proxy, got %q", ip)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if ip := behindProxy.clientIP(req); ip != "10.0.0.9" {
+		t.Errorf("without the header: expected the connection's address, got %q", ip)
+	}
+}
+
+// messages are recorded under the address the limits apply to
+func TestMessageAddress(t *testing.T) {
+	seen := captureBrokerEvents(t)
+	h := newHub(sendQueueSize)
+	l := defaultLimits
+	l.clientIPHeader = "X-Forwarded-For"
+	h.limiter = newLimiter(l)
+	srv := newTestChatServer(t, h, newMemoryPresence())
+
+	header := http.Header{"X-Forwarded-For": {"1.2.3.4"}}
+	conn, _, err := websocket.DefaultDialer.Dial(testRoomURL(t, srv.URL, "room", "visitor", 1), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, "connected to chat")
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	readUntil(t, conn, "visitor: hello")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var posted []events.Event
+		for _, e := range seen() {
+			if e.Type == events.MessagePosted {
+				posted = append(posted, e)
+			}
+		}
+		if len(posted) == 1 && posted[0].Payload.Address == "1.2.3.4" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one message_posted event from 1.2.3.4, got %+v", posted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	l := newLimiter(limits{maxConnsPerIP: 2, ipMessageRate: 1, ipMessageBurst: 1, maxViolations: 2, violationWindow: time.Minute, banDuration: time.Minute})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire("10.0.0.1", now); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+	}
+	if err := l.acquire("10.0.0.1", now); !errors.Is(err, errTooManyConnections) {
+		t.Errorf("third connection: expected errTooManyConnections, got %v", err)
+	}
+	if err := l.acquire("10.0.0.2", now); err != nil {
+		t.Errorf("other address: %v", err)
+	}
+
+	// the address's connections share its bucket
+	if !l.allow("10.0.0.1", now) || l.allow("10.0.0.1", now) {
+		t.Error("expected one frame to be allowed across the address's connections")
+	}
+
+	l.release("10.0.0.1")
+	if err := l.acquire("10.0.0.1", now); err != nil {
+		t.Errorf("after a release: %v", err)
+	}
+
+	cl := l.forConn("10.0.0.1", now)
+	if cl.violation(now) {
+		t.Error("expected the first violation to be tolerated")
+	}
+	if cl.violation(now.Add(2 * time.Minute)) {
+		t.Error("expected violations to be forgotten once the window has passed")
+	}
+	if !cl.violation(now.Add(2*time.Minute + time.Second)) {
+		t.Error("expected the second violation in the window to disconnect")
+	}
+	l.release("10.0.0.1")
+	l.release("10.0.0.1")
+	if err := l.acquire("10.0.0.1", now.Add(2*time.Minute)); !errors.Is(err, errBanned) {
+		t.Errorf("while banned: expected errBanned, got %v", err)
+	}
+	if err := l.acquire("10.0.0.1", now.Add(4*time.Minute)); err != nil {
+		t.Errorf("after the ban: %v", err)
+	}
+}
+
+func TestRateLimitedClient(t *testing.T) {
+	captureBrokerEvents(t)
+	h := newHub(sendQueueSize)
+	h.limiter = newLimiter(limits{
+		maxFrameBytes:   64,
+		messageRate:     1,
+		messageBurst:    2,
+		ipMessageRate:   100,
+		ipMessageBurst:  100,
+		maxConnsPerIP:   2,
+		maxViolations:   3,
+		violationWindow: time.Minute,
+		banDuration:     time.Minute,
+	})
+	srv := newTestChatServer(t, h, newMemoryPresence())
+	dialer := &websocket.Dialer{Subprotocols: []string{jsonProtocol}}
+
+	conn := dialTestRoomWith(t, dialer, srv.URL, "room", "flooder", 1)
+	defer conn.Close()
+	readFrame(t, conn, FrameSystem)
+
+	other := dialTestRoomWith(t, dialer, srv.URL, "room", "other", 2)
+	defer other.Close()
+	if _, resp, err := dialer.Dial(testRoomURL(t, srv.URL, "room", "third", 3), nil); err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a third connection from the address to be refused, got %v", err)
+	}
+
+	// the burst gets through, the rest is dropped until the client is disconnected
+	for i := 0; i < 5; i++ {
+		conn.WriteJSON(frame{Type: FrameMessage, Text: "hi"})
+	}
+	readFrame(t, conn, FrameMessage)
+	readFrame(t, conn, FrameMessage)
+	// the third violation disconnects the client
+	for _, want := range []error{errRateLimited, errRateLimited, errRateLimited, errBanned} {
+		if f := readFrame(t, conn, FrameError); f.Text != want.Error() {
+			t.Errorf("flooding: expected error %q, got %q", want, f.Text)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	if _, resp, err := dialer.Dial(testRoomURL(t, srv.URL, "room", "flooder", 1), nil); err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected the banned address to be refused, got %v", err)
+	}
+
+	// a frame over the size limit is not read, the connection is closed
+	other.WriteJSON(frame{Type: FrameMessage, Text: strings.Repeat("x", 100)})
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := other.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("oversized frame: expected the connection to be closed as too big, got %v", err)
+			}
+			break
+		}
+	}
+}
@@ -1,24 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
+	"math"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/Ryan-Har/chat-app/src/api/auth"
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/Ryan-Har/chat-app/src/api/origin"
 	"github.com/gorilla/websocket"
 	"github.com/rabbitmq/amqp091-go"
 )
 
 type UserInfo struct {
-	Conn   *websocket.Conn
 	Name   string
 	UserID int64 //corresponding id of user in database, if it exists
 	IPAddr string
@@ -26,409 +26,322 @@ type UserInfo struct {
 
 var lavinmqHost string = os.Getenv("lavinmqHost")
 var lavinmqPort string = os.Getenv("lavinmqPort")
+
 var apiHost string = os.Getenv("apiHost")
 var apiPort string = os.Getenv("apiPort")
 
 var lavinMQURL string = fmt.Sprintf("amqp://guest:guest@%s:%s/", lavinmqHost, lavinmqPort)
 var apiBaseUrl string = fmt.Sprintf("http://%s:%s/api", apiHost, apiPort)
 
-const (
-	queueName   = "ChatUpdateQueue"
-	workerCount = 5
-)
+// shared with the api, which only lets the chat-app services record presence
+// and look attachments up
+var serviceToken string = os.Getenv("servicetoken")
 
-type worker struct {
-	id  int
-	err error
-}
+// checks the join tokens the api signs, with the key shared with it
+var joinTokens *auth.JoinTokenSigner
 
-type BrokerMessage struct {
-	Roomid      string `json:"roomid"`
-	Name        string `json:"name"`
-	Address     string `json:"address"`
-	MessageText string `json:"messagetext"`
-	UserID      int64  `json:"userid"`
-	Time        string `json:"time"`
-}
+const queueName = "ChatUpdateQueue"
 
-var brokerSendingChan = make(chan amqp091.Publishing)
+// events for the broker, published by an eventPublisher. The buffer lets
+// senders carry on while the publisher waits on the broker.
+var brokerSendingChan = make(chan amqp091.Publishing, envInt("brokerqueuesize", defaultBrokerQueueSize))
 
-func sendToBroker(message *BrokerMessage) error {
-	b, err := json.Marshal(message)
+const defaultBrokerQueueSize = 1024
+
+func sendToBroker(event events.Event) error {
+	b, err := event.Marshal()
 	if err != nil {
 		return err
 	}
-	var newMessage BrokerMessage
-	json.Unmarshal(b, &newMessage)
-	fmt.Println(newMessage)
+	fmt.Println(string(b))
 
 	msg := amqp091.Publishing{
 		DeliveryMode: amqp091.Persistent,
 		Timestamp:    time.Now(),
-		ContentType:  "application/javascript",
+		ContentType:  "application/json",
+		MessageId:    event.ID,
+		Type:         string(event.Type),
 		Body:         b,
 	}
 	brokerSendingChan <- msg
 	return nil
 }
 
-func amqpManager() {
-	workerChan := make(chan *worker, workerCount)
-
-	for i := 0; i < workerCount; i++ {
-		i := i
-		wk := &worker{id: i}
-		go wk.work(workerChan, brokerSendingChan)
-	}
-	for wk := range workerChan {
-		log.Printf("amqpWorker %d stopped with err: %s", wk.id, wk.err)
-		// reset err
-		wk.err = nil
-		// a goroutine has ended, restart it
-		go wk.work(workerChan, brokerSendingChan)
-	}
-}
-
-func (wk *worker) work(workerChan chan<- *worker, brokerchan chan amqp091.Publishing) (err error) {
-	// make goroutine signal its death, whether it's a panic or a return
-	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				wk.err = err
-			} else {
-				wk.err = fmt.Errorf("panic happened with %v", r)
-			}
-		} else {
-			wk.err = err
-		}
-		workerChan <- wk
-	}()
-
-	conn, err := amqp091.Dial(lavinMQURL)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-	fmt.Println("connected to lavin instance successfully")
-
-	ch, err := conn.Channel()
-	if err != nil {
-		panic(err)
-	}
-	defer ch.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	_, err = ch.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		amqp091.Table{
-			"x-dead-letter-exchange": "message.deadletter",
-			"x-max-priority":         10,
-		},
-	)
-	if err != nil {
-		wk.err = err
-		workerChan <- wk
-	}
-
-	for msg := range brokerchan {
-		err = ch.PublishWithContext(
-			ctx,
-			"",
-			queueName,
-			false,
-			false,
-			msg,
-		)
-		if err != nil {
-			//if it has this exception, something happened to make the connection close
-			//we must resend the message if we don't want to lose it.
-			if strings.HasPrefix(err.Error(), "Exception (504)") {
-				var messageBack BrokerMessage
-				err = json.Unmarshal(msg.Body, &messageBack)
-				if err == nil {
-					sendToBroker(&messageBack)
-					panic(err)
-				}
-				panic(err)
-			}
-		}
-	}
-	return err
-}
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Add your origin validation logic here if needed
-		return true
-	},
+	Subprotocols:    []string{jsonProtocol},
+	CheckOrigin:     checkOrigin,
 }
 
-// Room to store connected clients
-var room = make(map[string]map[*websocket.Conn]*UserInfo)
-
-type ExternalUserInfo struct {
-	ID        int64  `json:"id,omitempty"`
-	Name      string `json:"name"`
-	IPAddr    string `json:"ipaddr"`
-	EmailAddr string `json:"email,omitempty"`
-}
+// browser origins allowed to connect, set from the environment in main.
+// Every origin is allowed while it is nil.
+var originPolicy *origin.Policy
 
-type InternalUserInfo struct {
-	ID             int64  `json:"id,omitempty"`
-	RoleID         int64  `json:"roleid"`
-	FirstName      string `json:"firstname"`
-	Surname        string `json:"surname"`
-	EmailAddr      string `json:"email,omitempty"`
-	HashedPassword string `json:"password"`
+func checkOrigin(r *http.Request) bool {
+	if originPolicy == nil {
+		return true
+	}
+	if err := originPolicy.CheckRequest(r); err != nil {
+		log.Println("rejecting connection:", err)
+		return false
+	}
+	return true
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// handles a participant joining a room. The join token, issued by the api,
+// decides who they are and which room they join, so it is checked before the
+// upgrade and nothing else the client sends is trusted.
+func handleWebSocket(w http.ResponseWriter, r *http.Request, h *hub, p presence, as attachmentStore) {
+	claims, err := joinTokens.Parse(r.URL.Query().Get("token"))
 	if err != nil {
-		log.Println(err)
+		log.Println("rejecting connection:", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	defer conn.Close()
-
-	// Read the GUID from the request URL
-	guid := r.URL.Query().Get("guid")
-	if guid == "" {
-		log.Println("GUID is required.")
+	guid := claims.Room
+	//clients may still send the guid, it must match the room in the token
+	if g := r.URL.Query().Get("guid"); g != "" && g != guid {
+		log.Println("rejecting connection: token is for another room")
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusForbidden)
 		return
 	}
-	name := r.URL.Query().Get("name")
-
-	urluserid := r.URL.Query().Get("userid")
-	var userid int64
-	// connect to api and check if user exists already by comparing the
-	// the ip and name provided to records.
-	// if it doesn't exist then create an external user for them and retrieve the
-	// new id for use here
-	if urluserid == "" && name != "" { //external users will provide name and no id
-		log.Println("external user joining")
-		body := ExternalUserInfo{
-			Name:   name,
-			IPAddr: r.RemoteAddr,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			log.Println("error marshalling json:", body)
-			return
-		}
-		resp, err := sendGetRequest(apiBaseUrl+"/users/getexternal", bytes.NewReader(jsonBody))
-		if err != nil {
-			return
-		}
-		defer resp.Body.Close()
-		//no content - nothing was updated, likely dealt with out of order, requeue
-		if resp.StatusCode == 204 {
-			resp2, err := sendPostRequest(apiBaseUrl+"/users/addexternal", bytes.NewReader(jsonBody))
-			if err != nil {
-				return
-			}
-			defer resp2.Body.Close()
-			data, _ := io.ReadAll(resp2.Body)
-			if err := json.Unmarshal(data, &body); err != nil {
-				log.Println("error unmarshalling json with status code 204", err)
-			}
-			userid = body.ID
-		} else {
-			data, _ := io.ReadAll(resp.Body)
-			if err := json.Unmarshal(data, &body); err != nil {
-				log.Printf("error unmarshalling json with status code %d: %v \n", resp.StatusCode, err.Error())
-			}
-			userid = body.ID
-		}
-	} else if name == "" && urluserid != "" { //internal users will provide id but no name
-		log.Println("internal user joining")
-		var iui *InternalUserInfo
+	//Parse only accepts tokens with a numeric user id
+	userid, _ := claims.UserID()
+	name := claims.Name
+	if claims.Role != auth.VisitorRole {
+		log.Println("internal user joining:", userid, guid)
+	} else {
+		log.Println("external user joining:", userid, guid)
+	}
 
-		resp, err := sendGetRequest(apiBaseUrl+"/users/getinternalbyid/"+urluserid, nil)
-		if err != nil {
-			return
-		}
-		defer resp.Body.Close()
-		data, _ := io.ReadAll(resp.Body)
-		if err := json.Unmarshal(data, &iui); err != nil {
-			log.Println(string(data))
-			log.Println("error unmarshalling json", err)
+	clientIP := h.limiter.clientIP(r)
+	if h.limiter != nil {
+		if err := h.limiter.acquire(clientIP, time.Now()); err != nil {
+			log.Println("rejecting connection from", clientIP+":", err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
 		}
-		name = fmt.Sprintf("%s %s", iui.FirstName, iui.Surname)
-		userid = iui.ID
+		defer h.limiter.release(clientIP)
 	}
 
-	//extract just the ip address from the remote connection
-	var ip string
-	//this might not work correctly, need to test externally
-	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		fmt.Println("Not a TCP connection.")
-		ip = ""
-	} else {
-		ip = tcpAddr.String()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	fmt.Println(ip)
+	// the connection is closed by c.writePump once it has written everything
+	// queued, so the frames explaining a disconnect reach the client
+
+	//recorded under the address the limits apply to
 	userinfo := UserInfo{
-		Conn:   conn,
 		Name:   name,
 		UserID: userid,
-		IPAddr: ip,
+		IPAddr: clientIP,
 	}
 
-	// Create a room for the GUID if it doesn't exist
-	if _, err := room[guid]; !err {
-		room[guid] = make(map[*websocket.Conn]*UserInfo)
+	c := newClient(conn, guid, &userinfo, h.queueSize)
+	//set by clients reconnecting, to have the messages they missed replayed
+	c.resumeAfter = r.URL.Query().Get("after")
+	c.expectPongs(h.heartbeat)
+	go c.writePump(h.heartbeat)
+
+	// identifies this connection to the room, the same user may have several
+	memberID := newID()
+	// Add the client to the room, creating it on this instance if needed
+	created := h.join(c)
+	// the chat starts with its first member on any instance, falling back to
+	// this instance's view if the api cannot be reached
+	started, err := p.join(r.Context(), guid, memberID)
+	if err != nil {
+		log.Println("error recording room member, deciding locally:", err)
+		started = created
+	}
+	if started {
 		log.Println("Start of chat:", guid)
-		brokerMessage := BrokerMessage{
-			Roomid:      guid,
-			MessageText: "Start of chat",
-			Time:        getTimeNow(),
-		}
-
-		if err := sendToBroker(&brokerMessage); err != nil {
+		event := events.New(events.ChatStarted, events.Payload{
+			Roomid: guid,
+			Time:   getTimeNow(),
+		})
+		if err := sendToBroker(event); err != nil {
 			log.Println(err)
-			return
 		}
 	}
 
-	// Add the client to the room
-	room[guid][conn] = &userinfo
-
-	// Broadcast the user joined message to all clients in the room
-	for client := range room[guid] {
-		if room[guid][client].Conn == conn {
-			if err := client.WriteMessage(websocket.TextMessage, []byte("connected to chat")); err != nil {
-				log.Println(err)
-				return
-			}
-		} else {
-			if err := client.WriteMessage(websocket.TextMessage, []byte(userinfo.Name+" joined the chat")); err != nil {
-				log.Println(err)
-				return
-			}
-		}
-	}
+	h.sendTo(c, newFrame(FrameSystem, guid, nil, "connected to chat"))
+	h.broadcast(guid, newFrame(FrameJoin, guid, &userinfo, ""), c)
 
 	//send user joined message to broker
-	brokerMessage := BrokerMessage{
-		Roomid:      guid,
-		MessageText: "User joined chat",
-		UserID:      userinfo.UserID,
-		Time:        getTimeNow(),
+	joinEvent := events.New(events.ParticipantJoined, events.Payload{
+		Roomid: guid,
+		Name:   userinfo.Name,
+		UserID: userinfo.UserID,
+		Time:   getTimeNow(),
+	})
+	if err := sendToBroker(joinEvent); err != nil {
+		log.Println(err)
 	}
 
-	if err := sendToBroker(&brokerMessage); err != nil {
-		log.Println(err)
-		return
+	var cl *connLimits
+	if h.limiter != nil {
+		cl = h.limiter.forConn(clientIP, time.Now())
+		//reading a larger frame fails, closing the connection with CloseMessageTooBig
+		conn.SetReadLimit(h.limiter.limits.maxFrameBytes)
 	}
 
-	// Listen for messages from the client
+	// Listen for messages from the client, until it disconnects, stops
+	// answering pings, is evicted or breaks the limits too often
 	for {
 		messageType, payload, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			log.Println("disconnecting", userinfo.Name, "from", clientIP, "for sending a frame over the size limit")
+			break
+		}
 		if err != nil {
 			log.Println(err)
 			break
 		}
-		//only handle text messagetype currently. Need to add Binary types upload
-		brokerMessage := BrokerMessage{
+		conn.SetReadDeadline(time.Now().Add(h.heartbeat.pongTimeout))
+		if cl != nil {
+			if err := cl.check(time.Now()); err != nil {
+				h.sendTo(c, newFrame(FrameError, guid, nil, err.Error()))
+				if cl.violation(time.Now()) {
+					log.Println("disconnecting", userinfo.Name, "from", clientIP, "after too many violations")
+					h.sendTo(c, newFrame(FrameError, guid, nil, errBanned.Error()))
+					break
+				}
+				continue
+			}
+		}
+		if messageType == websocket.BinaryMessage {
+			h.sendTo(c, newFrame(FrameError, guid, nil, "binary frames are not supported, upload files as attachments"))
+			continue
+		}
+		in := frame{Type: FrameMessage, Text: string(payload)}
+		if c.json {
+			if in, err = decodeClientFrame(payload); err != nil {
+				h.sendTo(c, newFrame(FrameError, guid, nil, err.Error()))
+				continue
+			}
+		}
+		if in.Type == FrameTyping {
+			h.broadcast(guid, newFrame(FrameTyping, guid, &userinfo, ""), c)
+			continue
+		}
+		if in.Type == FrameHistory {
+			h.historyBefore(c, in.Before)
+			continue
+		}
+
+		attachments, err := resolveAttachments(r.Context(), as, guid, in.Attachments)
+		if err != nil {
+			log.Println("rejecting message from", userinfo.Name, err)
+			h.sendTo(c, newFrame(FrameError, guid, nil, err.Error()))
+			continue
+		}
+		messageEvent := events.New(events.MessagePosted, events.Payload{
 			Roomid:      guid,
 			Name:        userinfo.Name,
 			UserID:      userinfo.UserID,
 			Address:     userinfo.IPAddr,
-			MessageText: string(payload),
+			Text:        in.Text,
 			Time:        getTimeNow(),
-		}
-
-		if err := sendToBroker(&brokerMessage); err != nil {
+			Attachments: attachmentIDs(attachments),
+		})
+		if err := sendToBroker(messageEvent); err != nil {
 			log.Println(err)
 			break
 		}
 		// Broadcast the message to all clients in the room
-		for client := range room[guid] {
-			if err := client.WriteMessage(messageType, []byte(userinfo.Name+": "+string(payload))); err != nil {
-				log.Println(err)
-				return
-			}
+		msg := newFrame(FrameMessage, guid, &userinfo, in.Text)
+		if len(attachments) > 0 {
+			msg.Attachments = attachments
+		}
+		h.broadcast(guid, msg, nil)
+		if c.json {
+			ack := newFrame(FrameAck, guid, nil, "")
+			ack.ID, ack.ClientID = msg.ID, in.ClientID
+			h.sendTo(c, ack)
 		}
 	}
 
 	// Remove the client from the room when the connection is closed
-	delete(room[guid], conn)
-
-	// Broadcast the user left message to all clients in the room
-	for client := range room[guid] {
-		if err := client.WriteMessage(websocket.TextMessage, []byte(userinfo.Name+" left the chat")); err != nil {
-			log.Println(err)
-			return
-		}
+	emptied := h.leave(c)
+	// the connection has gone, but the member still has to be removed
+	ended, err := p.leave(context.WithoutCancel(r.Context()), guid, memberID)
+	if err != nil {
+		log.Println("error removing room member, deciding locally:", err)
+		ended = emptied
 	}
+	h.broadcast(guid, newFrame(FrameLeave, guid, &userinfo, ""), nil)
 
 	//send user left message to broker
-	brokerMessage = BrokerMessage{
-		Roomid:      guid,
-		MessageText: "User left chat",
-		UserID:      userinfo.UserID,
-		Time:        getTimeNow(),
+	leaveEvent := events.New(events.ParticipantLeft, events.Payload{
+		Roomid: guid,
+		Name:   userinfo.Name,
+		UserID: userinfo.UserID,
+		Time:   getTimeNow(),
+	})
+	if err := sendToBroker(leaveEvent); err != nil {
+		log.Println(err)
 	}
 
-	if err := sendToBroker(&brokerMessage); err != nil {
-		log.Println(err)
-		return
+	if ended {
+		endChat(guid)
 	}
+}
 
-	if len(room[guid]) == 0 {
-		brokerMessage := BrokerMessage{
-			Roomid:      guid,
-			MessageText: "End of chat",
-			Time:        getTimeNow(),
-		}
-		log.Println("End of chat:", guid)
-		if err := sendToBroker(&brokerMessage); err != nil {
-			log.Println(err)
-			return
-		}
+func endChat(guid string) {
+	endEvent := events.New(events.ChatEnded, events.Payload{
+		Roomid: guid,
+		Time:   getTimeNow(),
+	})
+	log.Println("End of chat:", guid)
+	if err := sendToBroker(endEvent); err != nil {
+		log.Println(err)
 	}
 }
 
-func sendPostRequest(url string, content *bytes.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, content)
-	if err != nil {
-		return nil, err
+// returns the int value of the environment variable, or def if unset or not a positive number
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 {
+		log.Printf("invalid value %q for %s, using default %d", v, name, def)
+		return def
 	}
-	return resp, err
+	return i
 }
 
-func sendGetRequest(url string, content *bytes.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// returns the float value of the environment variable, or def if unset or not a positive number
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
-
-	if content != nil {
-		req.Body = io.NopCloser(content)
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(f > 0) || math.IsInf(f, 0) {
+		log.Printf("invalid value %q for %s, using default %g", v, name, def)
+		return def
 	}
+	return f
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// returns the duration value (e.g. 5s, 1m) of the environment variable, or def if unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid value %q for %s, using default %s", v, name, def)
+		return def
 	}
-	return resp, nil
+	return d
 }
 
 func getTimeNow() string {
@@ -436,8 +349,64 @@ func getTimeNow() string {
 }
 
 func main() {
-	http.HandleFunc("/ws", handleWebSocket)
-	go amqpManager()
+	var err error
+	//only parses tokens, so the lifetimes it signs with are not used
+	if joinTokens, err = auth.NewJoinTokenSigner([]byte(os.Getenv("jointokensecret")), 0, 0); err != nil {
+		log.Panicln("error reading join token key", err.Error())
+	}
+	if originPolicy, err = origin.FromEnv(); err != nil {
+		log.Panicln("error reading the origin policy", err.Error())
+	}
+
+	spoolPath := os.Getenv("spoolpath")
+	if spoolPath == "" {
+		spoolPath = defaultSpoolPath
+	}
+	sp, err := openSpool(spoolPath)
+	if err != nil {
+		log.Panicln("error opening the event spool", err.Error())
+	}
+	m := &metrics{spool: sp}
+	go newEventPublisher(lavinMQURL, sp, m).run(context.Background(), brokerSendingChan)
+
+	instance := instanceName()
+	//how long a chat waits for someone to rejoin once its last participant has left
+	grace := envDuration("resumegrace", 2*time.Minute)
+	lease := envDuration("instancelease", defaultInstanceLease)
+	if lease < time.Second {
+		log.Printf("instancelease must be at least 1s, using default %s", defaultInstanceLease)
+		lease = defaultInstanceLease
+	}
+	p := newAPIPresence(apiBaseUrl, serviceToken, instance, grace, lease)
+	//members left over from before a restart will never leave, so end their chats now
+	if rooms, err := p.clear(context.Background()); err != nil {
+		log.Println("error clearing room members from a previous run:", err)
+	} else {
+		for _, room := range rooms {
+			endChat(room)
+		}
+	}
+	if err := p.renew(context.Background()); err != nil {
+		log.Println("error taking the instance lease:", err)
+	}
+	go keepLease(context.Background(), p)
+
+	h := newHub(sendQueueSize)
+	h.heartbeat = heartbeatFromEnv()
+	h.limiter = newLimiter(limitsFromEnv())
+	h.retain = grace
+	h.historySize = envInt("historysize", defaultHistorySize)
+	h.historyPage = envInt("historypage", defaultHistoryPage)
+	rl := newRelay(instance, lavinMQURL, h)
+	h.relay = rl
+	go h.run(context.Background())
+	go rl.run(context.Background())
+	go expireRooms(context.Background(), p, expireInterval)
+
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(w, r, h, p, newAPIAttachments(apiBaseUrl, serviceToken))
+	})
+	http.Handle("/metrics", m)
 	fmt.Printf("Starting server  at port 8002\n")
 	log.Fatal(http.ListenAndServe(":8002", nil))
 }
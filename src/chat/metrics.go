@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics counts what happens to the events sent to the broker. They are
+// served at /metrics in the Prometheus text format.
+type metrics struct {
+	spool          *spool
+	published      atomic.Int64
+	publishRetries atomic.Int64
+	spooled        atomic.Int64
+	dropped        atomic.Int64
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	write := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	write("chat_spool_depth", "gauge", "Events in the spool waiting for the broker.", m.spool.depth())
+	write("chat_events_published_total", "counter", "Events confirmed by the broker.", m.published.Load())
+	write("chat_events_publish_retries_total", "counter", "Attempts to publish an event again after the broker did not confirm it.", m.publishRetries.Load())
+	write("chat_events_spooled_total", "counter", "Events added to the spool while the broker was unavailable.", m.spooled.Load())
+	write("chat_events_dropped_total", "counter", "Events lost because they could not be spooled.", m.dropped.Load())
+}
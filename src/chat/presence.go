@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+)
+
+// how often the api is asked for chats whose grace period has passed
+const expireInterval = 5 * time.Second
+
+// how long a presence request to the api may take, so a slow api cannot hold
+// up members joining and leaving
+const presenceTimeout = 5 * time.Second
+
+// how long the api takes this instance to be running after it last renewed
+// its lease. Once it runs out, its members are removed and the chats left
+// empty are ended, so a crashed instance does not keep its chats open.
+const defaultInstanceLease = 30 * time.Second
+
+// decides, across every chat instance, when a chat starts and ends
+type presence interface {
+	// records member joining room, reporting whether they were the first.
+	// Rejoining a room in its grace period resumes the chat, which is not
+	// reported as a start.
+	join(ctx context.Context, room string, member string) (started bool, err error)
+	// records member leaving room, reporting whether the chat has ended. With
+	// a grace period the last member leaving does not end it straight away,
+	// it is returned by expire once nobody has rejoined in time.
+	leave(ctx context.Context, room string, member string) (ended bool, err error)
+	// returns the rooms whose grace period has passed, each only once
+	expire(ctx context.Context) (ended []string, err error)
+}
+
+// the name this instance records its members under. Members left behind by a
+// crash are cleared on startup if it restarts under the same name, which the
+// hostname gives a restarted container, and otherwise once its lease runs out.
+func instanceName() string {
+	if name := os.Getenv("instanceid"); name != "" {
+		return name
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "chat"
+}
+
+type presenceRequest struct {
+	RoomID   string `json:"roomid,omitempty"`
+	MemberID string `json:"memberid,omitempty"`
+	Instance string `json:"instance"`
+	Grace    int64  `json:"grace,omitempty"`
+	Lease    int64  `json:"lease,omitempty"`
+}
+
+type presenceResponse struct {
+	Started bool     `json:"started"`
+	Ended   bool     `json:"ended"`
+	Rooms   []string `json:"rooms"`
+}
+
+// keeps room membership in the api, which serialises changes to each room
+type apiPresence struct {
+	apiBaseUrl   string
+	serviceToken string
+	instance     string
+	grace        time.Duration //how long an emptied room can be resumed for
+	lease        time.Duration //how long each renewal keeps this instance's members
+	client       *http.Client
+}
+
+func newAPIPresence(apiBaseUrl string, serviceToken string, instance string, grace time.Duration, lease time.Duration) apiPresence {
+	return apiPresence{
+		apiBaseUrl:   apiBaseUrl,
+		serviceToken: serviceToken,
+		instance:     instance,
+		grace:        grace,
+		lease:        lease,
+		client:       &http.Client{Timeout: presenceTimeout},
+	}
+}
+
+func (ap apiPresence) join(ctx context.Context, room string, member string) (bool, error) {
+	resp, err := ap.post(ctx, "/chat/presence/join", presenceRequest{RoomID: room, MemberID: member, Instance: ap.instance})
+	return resp.Started, err
+}
+
+func (ap apiPresence) leave(ctx context.Context, room string, member string) (bool, error) {
+	resp, err := ap.post(ctx, "/chat/presence/leave", presenceRequest{RoomID: room, MemberID: member, Instance: ap.instance, Grace: int64(math.Ceil(ap.grace.Seconds()))})
+	return resp.Ended, err
+}
+
+func (ap apiPresence) expire(ctx context.Context) ([]string, error) {
+	resp, err := ap.post(ctx, "/chat/presence/expire", presenceRequest{Instance: ap.instance})
+	return resp.Rooms, err
+}
+
+// forgets the members this instance had before it restarted, returning the
+// rooms which ended as a result
+func (ap apiPresence) clear(ctx context.Context) ([]string, error) {
+	resp, err := ap.post(ctx, "/chat/presence/clear", presenceRequest{Instance: ap.instance})
+	return resp.Rooms, err
+}
+
+// renews this instance's lease, which has to happen well within ap.lease
+func (ap apiPresence) renew(ctx context.Context) error {
+	_, err := ap.post(ctx, "/chat/presence/renew", presenceRequest{Instance: ap.instance, Lease: int64(math.Ceil(ap.lease.Seconds()))})
+	return err
+}
+
+func (ap apiPresence) post(ctx context.Context, path string, body presenceRequest) (presenceResponse, error) {
+	var pr presenceResponse
+	b, err := json.Marshal(body)
+	if err != nil {
+		return pr, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ap.apiBaseUrl+path, bytes.NewReader(b))
+	if err != nil {
+		return pr, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", ap.serviceToken)
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return pr, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pr, fmt.Errorf("presence request to %s failed with status %d", path, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pr)
+	return pr, err
+}
+
+// ends the chats whose grace period has passed, until ctx is done
+func expireRooms(ctx context.Context, p presence, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rooms, err := p.expire(ctx)
+			if err != nil {
+				log.Println("error expiring rooms:", err)
+				continue
+			}
+			for _, room := range rooms {
+				endChat(room)
+			}
+		}
+	}
+}
+
+// renews the instance's lease three times in each lease, so one failed
+// renewal does not lose it, until ctx is done
+func keepLease(ctx context.Context, ap apiPresence) {
+	ticker := time.NewTicker(ap.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ap.renew(ctx); err != nil {
+				log.Println("error renewing the instance lease:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIPresenceSendsServiceToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Service-Token") != "secret" {
+			http.Error(w, "service token required", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(presenceResponse{Started: true})
+	}))
+	defer srv.Close()
+
+	p := newAPIPresence(srv.URL, "secret", "chat-1", 0, time.Minute)
+	if started, err := p.join(context.Background(), "room", "m1"); err != nil || !started {
+		t.Errorf("join = %v, %v", started, err)
+	}
+	p.serviceToken = "wrong"
+	if _, err := p.join(context.Background(), "room", "m1"); err == nil {
+		t.Error("expected an error when the api rejects the token")
+	}
+}
+
+func TestAPIPresenceGivesUpOnSlowAPI(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := newAPIPresence(srv.URL, "secret", "chat-1", 0, time.Minute)
+	p.client.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := p.leave(context.Background(), "room", "m1"); err == nil {
+		t.Error("expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("leave took %s", elapsed)
+	}
+
+	p.client.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.expire(ctx); err == nil {
+		t.Error("expected a cancelled context to stop the request")
+	}
+}
+
+func TestKeepLease(t *testing.T) {
+	renewed := make(chan presenceRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pr presenceRequest
+		json.NewDecoder(r.Body).Decode(&pr)
+		if r.URL.Path == "/chat/presence/renew" {
+			renewed <- pr
+		}
+		json.NewEncoder(w).Encode(presenceResponse{})
+	}))
+	defer srv.Close()
+
+	p := newAPIPresence(srv.URL, "secret", "chat-1", 0, 1500*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keepLease(ctx, p)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case pr := <-renewed:
+			if pr.Instance != "chat-1" || pr.Lease != 2 {
+				t.Errorf("expected chat-1 to renew for 2s, got %+v", pr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the lease to be renewed within a third of it")
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// jsonProtocol is the WebSocket subprotocol for JSON frames. Clients which do
+// not ask for it in Sec-WebSocket-Protocol get the legacy text protocol,
+// sending raw text and receiving strings such as "Bob: hello".
+const jsonProtocol = "chat.v1.json"
+
+type FrameType string
+
+const (
+	FrameMessage FrameType = "message" //text sent by a participant
+	FrameSystem  FrameType = "system"  //notices from the server, such as the connection being accepted
+	FrameJoin    FrameType = "join"    //a participant joined the room
+	FrameLeave   FrameType = "leave"   //a participant left the room
+	FrameTyping  FrameType = "typing"  //a participant is typing
+	FrameAck     FrameType = "ack"     //confirms a message frame from this client was accepted
+	FrameError   FrameType = "error"   //a frame from this client was rejected
+	// a batch of earlier messages, sent on joining and in answer to a client's
+	// history frame asking for the messages before a message id
+	FrameHistory FrameType = "history"
+)
+
+var errUnsupportedFrame = errors.New("unsupported frame type")
+
+// frame is the unit of the JSON protocol. Frames sent by the server always
+// carry its timestamp and, apart from acks, errors and history, the sender.
+// Clients send message frames, setting text and optionally clientid, which is
+// echoed back in the ack so the message can be matched up, typing frames, and
+// history frames setting before to page back through the room's messages.
+// Message frames may reference uploaded files by id in attachments, which
+// the server sends on with their names, types and sizes.
+type frame struct {
+	Type     FrameType `json:"type"`
+	ID       string    `json:"id,omitempty"` //assigned by the server to every frame it sends
+	ClientID string    `json:"clientid,omitempty"`
+	Room     string    `json:"room,omitempty"`
+	SenderID int64     `json:"senderid,omitempty"`
+	Name     string    `json:"name,omitempty"` //display name of the sender
+	Text     string    `json:"text,omitempty"`
+	Time     time.Time `json:"time"`
+
+	Attachments []attachment `json:"attachments,omitempty"` //messages, files sent with the text
+
+	Before   string  `json:"before,omitempty"`   //history requests, the id of the oldest message the client has
+	Messages []frame `json:"messages,omitempty"` //history, oldest first
+	More     bool    `json:"more,omitempty"`     //history, whether older messages can be asked for
+}
+
+// builds a server frame, stamped with a new id and the current time
+func newFrame(frameType FrameType, room string, sender *UserInfo, text string) frame {
+	f := frame{
+		Type: frameType,
+		ID:   newID(),
+		Room: room,
+		Text: text,
+		Time: time.Now().UTC(),
+	}
+	if sender != nil {
+		f.SenderID, f.Name = sender.UserID, sender.Name
+	}
+	return f
+}
+
+// reads a frame sent by a client using the JSON protocol
+func decodeClientFrame(data []byte) (frame, error) {
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, err
+	}
+	switch f.Type {
+	case FrameMessage:
+		if f.Text == "" && len(f.Attachments) == 0 {
+			return f, errors.New("message frames need text or attachments")
+		}
+		for _, a := range f.Attachments {
+			if a.ID == "" {
+				return f, errors.New("attachments need an id")
+			}
+		}
+	case FrameTyping:
+	case FrameHistory:
+		if f.Before == "" {
+			return f, errors.New("history frames need before")
+		}
+	default:
+		return f, fmt.Errorf("%w: %q", errUnsupportedFrame, f.Type)
+	}
+	return f, nil
+}
+
+// renders the frame for the legacy text protocol, which has no equivalent for
+// some frame types. Those return an empty string and are not sent.
+func (f frame) legacyText() string {
+	switch f.Type {
+	case FrameMessage:
+		text := f.Name + ": " + f.Text
+		for _, a := range f.Attachments {
+			text += " [attachment: " + a.Name + "]"
+		}
+		return text
+	case FrameJoin:
+		return f.Name + " joined the chat"
+	case FrameLeave:
+		return f.Name + " left the chat"
+	case FrameSystem, FrameError:
+		return f.Text
+	case FrameHistory:
+		lines := make([]string, 0, len(f.Messages))
+		for _, m := range f.Messages {
+			lines = append(lines, m.legacyText())
+		}
+		return strings.Join(lines, "\n")
+	}
+	return ""
+}
+
+// returns a random 128 bit hex id, used for frames and room members
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
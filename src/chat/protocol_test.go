@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDecodeClientFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    FrameType
+		wantErr bool
+	}{
+		{"message", `{"type":"message","text":"hello","clientid":"c1"}`, FrameMessage, false},
+		{"typing", `{"type":"typing"}`, FrameTyping, false},
+		{"history", `{"type":"history","before":"m1"}`, FrameHistory, false},
+		{"history without before", `{"type":"history"}`, "", true},
+		{"attachments only", `{"type":"message","attachments":[{"id":"a1"}]}`, FrameMessage, false},
+		{"empty message", `{"type":"message"}`, "", true},
+		{"attachment without id", `{"type":"message","attachments":[{"name":"cat.png"}]}`, "", true},
+		{"server only type", `{"type":"join"}`, "", true},
+		{"not json", `hello`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := decodeClientFrame([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && f.Type != tt.want {
+				t.Errorf("expected type %q, got %q", tt.want, f.Type)
+			}
+		})
+	}
+	if _, err := decodeClientFrame([]byte(`{"type":"ack"}`)); !errors.Is(err, errUnsupportedFrame) {
+		t.Errorf("expected errUnsupportedFrame, got %v", err)
+	}
+}
+
+func TestFrameLegacyText(t *testing.T) {
+	bob := &UserInfo{Name: "Bob", UserID: 1}
+	tests := []struct {
+		f    frame
+		want string
+	}{
+		{newFrame(FrameMessage, "room", bob, "hello"), "Bob: hello"},
+		{frame{Type: FrameMessage, Name: "Bob", Text: "look", Attachments: []attachment{{ID: "a1", Name: "cat.png"}}}, "Bob: look [attachment: cat.png]"},
+		{newFrame(FrameJoin, "room", bob, ""), "Bob joined the chat"},
+		{newFrame(FrameLeave, "room", bob, ""), "Bob left the chat"},
+		{newFrame(FrameSystem, "room", nil, "connected to chat"), "connected to chat"},
+		{newFrame(FrameTyping, "room", bob, ""), ""},
+		{newFrame(FrameAck, "room", nil, ""), ""},
+	}
+	for _, tt := range tests {
+		if got := tt.f.legacyText(); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.f.Type, tt.want, got)
+		}
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	captureBrokerEvents(t)
+	srv := newTestChatServer(t, newHub(sendQueueSize), newMemoryPresence())
+	dialer := &websocket.Dialer{Subprotocols: []string{jsonProtocol}}
+
+	agent := dialTestRoomWith(t, dialer, srv.URL, "room", "agent", 2)
+	defer agent.Close()
+	if agent.Subprotocol() != jsonProtocol {
+		t.Fatalf("expected the %s subprotocol, got %q", jsonProtocol, agent.Subprotocol())
+	}
+	readFrame(t, agent, FrameSystem)
+
+	//legacy clients share the room with json ones
+	visitor := dialTestRoom(t, srv.URL, "room", "visitor", 1)
+	defer visitor.Close()
+	readUntil(t, visitor, "connected to chat")
+	if f := readFrame(t, agent, FrameJoin); f.Name != "visitor" || f.SenderID != 1 {
+		t.Errorf("unexpected join frame %+v", f)
+	}
+
+	agent.WriteJSON(frame{Type: FrameTyping})
+	agent.WriteJSON(frame{Type: FrameMessage, Text: "hi", ClientID: "c1"})
+	msg := readFrame(t, agent, FrameMessage)
+	if msg.Name != "agent" || msg.SenderID != 2 || msg.Text != "hi" || msg.ID == "" || msg.Time.IsZero() {
+		t.Errorf("unexpected message frame %+v", msg)
+	}
+	if ack := readFrame(t, agent, FrameAck); ack.ID != msg.ID || ack.ClientID != "c1" {
+		t.Errorf("expected the ack to carry message id %q and client id c1, got %+v", msg.ID, ack)
+	}
+	readUntil(t, visitor, "agent: hi")
+
+	agent.WriteJSON(frame{Type: FrameJoin})
+	readFrame(t, agent, FrameError)
+
+	visitor.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if f := readFrame(t, agent, FrameMessage); f.Text != "hello" || f.Name != "visitor" {
+		t.Errorf("unexpected message frame %+v", f)
+	}
+	visitor.Close()
+	readFrame(t, agent, FrameLeave)
+}
+
+// reads frames until one of the given type arrives
+func readFrame(t *testing.T, conn *websocket.Conn, want FrameType) frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("waiting for a %s frame: %v", want, err)
+		}
+		if f.Type == want {
+			return f
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// topic exchange carrying room messages between chat instances, routed by
+	// roomRoutingKey
+	roomExchange = "chat.rooms"
+	// messages waiting to be relayed before new ones are dropped
+	relayQueueSize  = 1024
+	relayRetryDelay = 5 * time.Second
+)
+
+func roomRoutingKey(room string) string {
+	return "room." + room
+}
+
+// a frame sent in a room, as carried between instances
+type relayMessage struct {
+	Origin string `json:"origin"` //instance the frame was sent on
+	Room   string `json:"room"`
+	Frame  frame  `json:"frame"`
+}
+
+// the part of amqp091.Channel used to follow rooms
+type binder interface {
+	QueueBind(name, key, exchange string, noWait bool, args amqp091.Table) error
+	QueueUnbind(name, key, exchange string, args amqp091.Table) error
+}
+
+// relay shares room messages with the other chat instances. Each instance has
+// its own queue on roomExchange, bound to the rooms it has local clients in, so
+// a conversation works whichever instances its participants are connected to.
+type relay struct {
+	instance string
+	url      string
+	hub      *hub
+	outgoing chan relayMessage
+}
+
+func newRelay(instance string, url string, h *hub) *relay {
+	return &relay{
+		instance: instance,
+		url:      url,
+		hub:      h,
+		outgoing: make(chan relayMessage, relayQueueSize),
+	}
+}
+
+// queues a message for the other instances. Local clients already have it, so
+// if the broker has been unreachable for long enough to fill the queue it is
+// dropped rather than holding up the sender.
+func (rl *relay) publish(room string, f frame) {
+	select {
+	case rl.outgoing <- relayMessage{Origin: rl.instance, Room: room, Frame: f}:
+	default:
+		log.Println("room relay queue full, dropping message for", room)
+	}
+}
+
+// keeps a connection to the broker open until ctx is done, reconnecting
+// whenever it is lost
+func (rl *relay) run(ctx context.Context) {
+	for {
+		err := rl.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("room relay disconnected, reconnecting:", err)
+		select {
+		case <-time.After(relayRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rl *relay) session(ctx context.Context) error {
+	conn, err := amqp091.Dial(rl.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.ExchangeDeclare(roomExchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	//a fresh queue per connection, deleted by the broker when it closes
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+	closed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+
+	bound := make(map[string]bool)
+	if err := rl.follow(ch, q.Name, bound); err != nil {
+		return err
+	}
+	log.Println("room relay connected as", rl.instance)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			return err
+		case <-rl.hub.roomsChanged:
+			if err := rl.follow(ch, q.Name, bound); err != nil {
+				return err
+			}
+		case msg := <-rl.outgoing:
+			body, err := json.Marshal(msg)
+			if err != nil {
+				log.Println("error encoding relay message", err)
+				continue
+			}
+			err = ch.PublishWithContext(ctx, roomExchange, roomRoutingKey(msg.Room), false, false, amqp091.Publishing{
+				ContentType: "application/json",
+				Timestamp:   time.Now(),
+				Body:        body,
+			})
+			if err != nil {
+				return err
+			}
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("room relay deliveries closed")
+			}
+			rl.receive(d.Body)
+		}
+	}
+}
+
+// binds the queue to the rooms with local clients and unbinds it from the rest,
+// bound holds what is currently bound and is updated to match
+func (rl *relay) follow(b binder, queue string, bound map[string]bool) error {
+	want := make(map[string]bool)
+	for _, room := range rl.hub.localRooms() {
+		want[room] = true
+		if bound[room] {
+			continue
+		}
+		if err := b.QueueBind(queue, roomRoutingKey(room), roomExchange, false, nil); err != nil {
+			return err
+		}
+		bound[room] = true
+	}
+	for room := range bound {
+		if want[room] {
+			continue
+		}
+		if err := b.QueueUnbind(queue, roomRoutingKey(room), roomExchange, nil); err != nil {
+			return err
+		}
+		delete(bound, room)
+	}
+	return nil
+}
+
+// hands a message from another instance to the local clients in its room
+func (rl *relay) receive(body []byte) {
+	var msg relayMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		log.Println("error decoding relay message", err)
+		return
+	}
+	if msg.Origin == rl.instance {
+		return
+	}
+	rl.hub.deliverLocal(msg.Room, msg.Frame, nil)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/gorilla/websocket"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+type fakeBinder struct {
+	bound map[string]bool
+}
+
+func (fb *fakeBinder) QueueBind(name, key, exchange string, noWait bool, args amqp091.Table) error {
+	fb.bound[key] = true
+	return nil
+}
+
+func (fb *fakeBinder) QueueUnbind(name, key, exchange string, args amqp091.Table) error {
+	delete(fb.bound, key)
+	return nil
+}
+
+func TestRelayFollowsLocalRooms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHub(sendQueueSize)
+	go h.run(ctx)
+	rl := newRelay("chat-1", "", h)
+
+	a := newClient(nil, "a", &UserInfo{Name: "a"}, h.queueSize)
+	b := newClient(nil, "b", &UserInfo{Name: "b"}, h.queueSize)
+	h.join(a)
+	h.join(b)
+
+	fb := &fakeBinder{bound: make(map[string]bool)}
+	bound := make(map[string]bool)
+	if err := rl.follow(fb, "queue", bound); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.bound) != 2 || !fb.bound[roomRoutingKey("a")] || !fb.bound[roomRoutingKey("b")] {
+		t.Errorf("expected both rooms bound, got %v", fb.bound)
+	}
+
+	h.leave(a)
+	if err := rl.follow(fb, "queue", bound); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.bound) != 1 || !fb.bound[roomRoutingKey("b")] {
+		t.Errorf("expected only room b bound, got %v", fb.bound)
+	}
+}
+
+func TestRelayReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHub(sendQueueSize)
+	go h.run(ctx)
+	rl := newRelay("chat-1", "", h)
+
+	c := newClient(nil, "room", &UserInfo{Name: "c"}, h.queueSize)
+	h.join(c)
+
+	for _, msg := range []relayMessage{
+		{Origin: "chat-1", Room: "room", Frame: newFrame(FrameSystem, "room", nil, "sent here")},
+		{Origin: "chat-2", Room: "room", Frame: newFrame(FrameSystem, "room", nil, "sent elsewhere")},
+	} {
+		body, _ := json.Marshal(msg)
+		rl.receive(body)
+	}
+	h.leave(c)
+
+	var got []string
+	for f := range c.send {
+		got = append(got, f.Text)
+	}
+	if len(got) != 1 || got[0] != "sent elsewhere" {
+		t.Errorf("expected only the message from the other instance, got %v", got)
+	}
+}
+
+// stands in for the broker, handing messages published on one hub to the others
+type testBus struct {
+	hubs []*hub
+}
+
+type testBusPublisher struct {
+	bus  *testBus
+	from *hub
+}
+
+func (p testBusPublisher) publish(room string, f frame) {
+	for _, h := range p.bus.hubs {
+		if h != p.from {
+			h.deliverLocal(room, f, nil)
+		}
+	}
+}
+
+func TestRoomAcrossInstances(t *testing.T) {
+	captured := captureBrokerEvents(t)
+	p := newMemoryPresence()
+	bus := &testBus{}
+	var servers []string
+	for i := 0; i < 2; i++ {
+		h := newHub(sendQueueSize)
+		h.relay = testBusPublisher{bus: bus, from: h}
+		bus.hubs = append(bus.hubs, h)
+		servers = append(servers, newTestChatServer(t, h, p).URL)
+	}
+
+	visitor := dialTestRoom(t, servers[0], "room", "visitor", 1)
+	readUntil(t, visitor, "connected to chat")
+	agent := dialTestRoom(t, servers[1], "room", "agent", 2)
+	readUntil(t, agent, "connected to chat")
+	readUntil(t, visitor, "agent joined the chat")
+
+	visitor.WriteMessage(websocket.TextMessage, []byte("hello"))
+	readUntil(t, agent, "visitor: hello")
+	agent.WriteMessage(websocket.TextMessage, []byte("hi"))
+	readUntil(t, visitor, "agent: hi")
+
+	visitor.Close()
+	readUntil(t, agent, "visitor left the chat")
+	agent.Close()
+
+	count := func(eventType events.EventType) int {
+		n := 0
+		for _, event := range captured() {
+			if event.Type == eventType {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(events.ChatEnded) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if started, ended := count(events.ChatStarted), count(events.ChatEnded); started != 1 || ended != 1 {
+		t.Errorf("expected the chat to start and end once, got %d starts and %d ends", started, ended)
+	}
+}
+
+func readUntil(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.TrimSpace(string(msg)) == want {
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/gorilla/websocket"
+)
+
+func TestHubReplaysMissedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHub(sendQueueSize)
+	h.retain = time.Minute
+	go h.run(ctx)
+
+	first := newClient(nil, "room", &UserInfo{Name: "first"}, h.queueSize)
+	h.join(first)
+	var sent []frame
+	for i := 0; i < 3; i++ {
+		f := newFrame(FrameMessage, "room", first.info, fmt.Sprint("message ", i))
+		sent = append(sent, f)
+		h.broadcast("room", f, nil)
+	}
+	h.sendTo(first, newFrame(FrameSystem, "room", nil, "only for first"))
+	if !h.leave(first) {
+		t.Fatal("expected the room to be empty")
+	}
+	if rooms := h.localRooms(); len(rooms) != 1 {
+		t.Errorf("expected the emptied room to be kept while it can be resumed, got %v", rooms)
+	}
+
+	replayed := func(after string) []string {
+		c := newClient(nil, "room", &UserInfo{Name: "resumed"}, h.queueSize)
+		c.resumeAfter = after
+		h.join(c)
+		h.leave(c)
+		var got []string
+		for f := range c.send {
+			switch f.Type {
+			case FrameHistory:
+				for _, m := range f.Messages {
+					got = append(got, "history: "+m.Text)
+				}
+			default:
+				got = append(got, string(f.Type)+": "+f.Text)
+			}
+		}
+		return got
+	}
+	if got := replayed(sent[0].ID); fmt.Sprint(got) != "[message: message 1 message: message 2]" {
+		t.Errorf("expected the messages after the first, got %v", got)
+	}
+	// an id this instance does not have, such as one seen on another instance
+	want := fmt.Sprintf("[error: %s history: message 0 history: message 1 history: message 2]", errResumeUnavailable)
+	if got := replayed("unknown"); fmt.Sprint(got) != want {
+		t.Errorf("expected the resume to be refused with the recent history for an unknown id, got %v", got)
+	}
+}
+
+func TestVisitorResumesChat(t *testing.T) {
+	captured := captureBrokerEvents(t)
+	p := newMemoryPresence()
+	p.grace = 300 * time.Millisecond
+	h := newHub(sendQueueSize)
+	h.retain = p.grace
+	srv := newTestChatServer(t, h, p)
+	dialer := &websocket.Dialer{Subprotocols: []string{jsonProtocol}}
+
+	visitorURL := testRoomURL(t, srv.URL, "room", "visitor", 1)
+	visitor := dialTestURL(t, dialer, visitorURL)
+	readFrame(t, visitor, FrameSystem)
+	visitor.WriteJSON(frame{Type: FrameMessage, Text: "hello"})
+	last := readFrame(t, visitor, FrameMessage)
+
+	agent := dialTestRoom(t, srv.URL, "room", "agent", 2)
+	defer agent.Close()
+	readUntil(t, agent, "connected to chat")
+
+	visitor.Close()
+	readUntil(t, agent, "visitor left the chat")
+	agent.WriteMessage(websocket.TextMessage, []byte("are you there?"))
+	readUntil(t, agent, "agent: are you there?")
+
+	visitor = dialTestURL(t, dialer, visitorURL+"&after="+last.ID)
+	if f := readFrame(t, visitor, FrameMessage); f.Text != "are you there?" {
+		t.Errorf("expected the missed message to be replayed, got %+v", f)
+	}
+
+	// everyone leaving only ends the chat once the grace period has passed
+	visitor.Close()
+	agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go expireRooms(ctx, p, 20*time.Millisecond)
+
+	count := func(eventType events.EventType) int {
+		n := 0
+		for _, event := range captured() {
+			if event.Type == eventType {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(events.ChatEnded) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if started, ended := count(events.ChatStarted), count(events.ChatEnded); started != 1 || ended != 1 {
+		t.Errorf("expected the chat to start and end once, got %d starts and %d ends", started, ended)
+	}
+}
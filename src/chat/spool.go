@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// where the spool is kept unless spoolpath is set
+const defaultSpoolPath = "spool/events.log"
+
+// spool is an append-only file of events waiting to be published, kept while
+// the broker is unavailable so they survive a restart. Events are read back
+// in the order they were added. How far it has been read is kept in a
+// position file next to it, and the file is emptied once everything in it has
+// been read. It is not safe for concurrent use, apart from depth.
+type spool struct {
+	path   string
+	f      *os.File
+	offset int64 //of the first event not yet read
+	size   int64
+	count  atomic.Int64 //events not yet read
+}
+
+// one event in the spool, a line of JSON
+type spoolRecord struct {
+	Type      string          `json:"type"`
+	MessageID string          `json:"messageid,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// opens the spool at path, creating it if needed. Events left in it by a
+// previous run are kept. A partly written event at the end, from a crash
+// while appending, is removed.
+func openSpool(path string) (*spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{path: path, f: f}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) posPath() string {
+	return s.path + ".pos"
+}
+
+// reads the position and counts the events after it
+func (s *spool) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		if err := s.f.Truncate(int64(end)); err != nil {
+			return err
+		}
+		data = data[:end]
+	}
+	s.size = int64(len(data))
+
+	if pos, err := os.ReadFile(s.posPath()); err == nil {
+		s.offset, err = strconv.ParseInt(strings.TrimSpace(string(pos)), 10, 64)
+		if err != nil || s.offset < 0 {
+			return errors.New("invalid spool position in " + s.posPath())
+		}
+		// past the end if the spool was emptied but the position not saved
+		if s.offset > s.size {
+			s.offset = 0
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	s.count.Store(int64(bytes.Count(data[s.offset:], []byte{'\n'})))
+	return nil
+}
+
+// the number of events waiting in the spool
+func (s *spool) depth() int64 {
+	return s.count.Load()
+}
+
+// adds msg to the end of the spool, returning once it is on disk
+func (s *spool) append(msg amqp091.Publishing) error {
+	line, err := json.Marshal(spoolRecord{Type: msg.Type, MessageID: msg.MessageId, Timestamp: msg.Timestamp, Body: msg.Body})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.f.Write(line); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(line))
+	s.count.Add(1)
+	return nil
+}
+
+// returns the first event in the spool without removing it, and the length
+// of its line for pop. An event that can not be decoded is returned as an
+// error, along with its length so it can be skipped.
+func (s *spool) peek() (amqp091.Publishing, int64, error) {
+	if s.depth() == 0 {
+		return amqp091.Publishing{}, 0, io.EOF
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(s.f, s.offset, s.size-s.offset)).ReadBytes('\n')
+	if err != nil {
+		return amqp091.Publishing{}, 0, err
+	}
+	var rec spoolRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return amqp091.Publishing{}, int64(len(line)), err
+	}
+	return amqp091.Publishing{
+		DeliveryMode: amqp091.Persistent,
+		Timestamp:    rec.Timestamp,
+		ContentType:  "application/json",
+		MessageId:    rec.MessageID,
+		Type:         rec.Type,
+		Body:         rec.Body,
+	}, int64(len(line)), nil
+}
+
+// removes the first event, of length n as returned by peek. The file is
+// emptied once nothing is left in it.
+func (s *spool) pop(n int64) error {
+	s.offset += n
+	s.count.Add(-1)
+	if s.depth() == 0 {
+		if err := s.f.Truncate(0); err != nil {
+			return err
+		}
+		s.offset, s.size = 0, 0
+	}
+	return s.savePosition()
+}
+
+// writes the position to a temporary file and renames it over the old one,
+// so a crash leaves either position. Events published before a crash but
+// after the last save are published again.
+func (s *spool) savePosition() error {
+	tmp := s.posPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(s.offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.posPath())
+}
+
+func (s *spool) close() error {
+	return s.f.Close()
+}
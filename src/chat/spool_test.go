@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func spoolEvent(body string) amqp091.Publishing {
+	return amqp091.Publishing{Type: "NewMessage", MessageId: "id" + body, Timestamp: time.Now(), Body: []byte(body)}
+}
+
+func openTestSpool(t *testing.T, path string) *spool {
+	t.Helper()
+	sp, err := openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.close() })
+	return sp
+}
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool", "events.log")
+	sp := openTestSpool(t, path)
+	for _, body := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if err := sp.append(spoolEvent(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sp.depth() != 3 {
+		t.Fatalf("expected a depth of 3, got %d", sp.depth())
+	}
+
+	msg, n, err := sp.peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != `{"n":1}` || msg.Type != "NewMessage" || msg.MessageId != `id{"n":1}` || msg.DeliveryMode != amqp091.Persistent {
+		t.Errorf("unexpected first event %+v", msg)
+	}
+	if err := sp.pop(n); err != nil {
+		t.Fatal(err)
+	}
+	sp.close()
+
+	// a reopened spool carries on after the events already read, dropping a
+	// partly written one
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"NewMess`)
+	f.Close()
+	sp = openTestSpool(t, path)
+	if sp.depth() != 2 {
+		t.Fatalf("expected a depth of 2 after reopening, got %d", sp.depth())
+	}
+	for _, want := range []string{`{"n":2}`, `{"n":3}`} {
+		msg, n, err := sp.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Body) != want {
+			t.Errorf("expected %s, got %s", want, msg.Body)
+		}
+		if err := sp.pop(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// emptied once drained
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty spool file once drained, got %v %v", info.Size(), err)
+	}
+	if err := sp.append(spoolEvent(`{"n":4}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _, err := sp.peek(); err != nil || string(msg.Body) != `{"n":4}` {
+		t.Errorf("expected the event added after draining, got %s %v", msg.Body, err)
+	}
+}
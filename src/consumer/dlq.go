@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const dlqUsage = `usage: consumer dlq <command>
+
+commands:
+  list            list the dead lettered events, numbered oldest first
+  show <n>        show event n with its headers
+  replay <n|all>  send event n, or every event, back to be processed
+  purge <n|all>   delete event n, or every event`
+
+// the part of amqp091.Channel used to inspect the dead letter queue
+type deadLetters interface {
+	eventPublisher
+	Get(queue string, autoAck bool) (amqp091.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+// runs the dlq subcommand against the broker
+func dlqCommand(args []string, out io.Writer) error {
+	conn, err := amqp091.Dial(lavinMQURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	// events fetched but not acked go back on the queue when it closes
+	defer ch.Close()
+	if err := declareRetryQueues(ch, envInt("maxattempts", defaultMaxAttempts)); err != nil {
+		return err
+	}
+	return runDLQ(args, ch, out)
+}
+
+func runDLQ(args []string, ch deadLetters, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(dlqUsage)
+	}
+	if args[0] == "list" {
+		dead, err := fetchDeadLetters(ch)
+		if err != nil {
+			return err
+		}
+		listDeadLetters(dead, out)
+		return nil
+	}
+	if len(args) != 2 || (args[0] != "show" && args[0] != "replay" && args[0] != "purge") {
+		return errors.New(dlqUsage)
+	}
+
+	if args[1] == "all" && args[0] == "purge" {
+		n, err := ch.QueuePurge(deadLetterQueue, false)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "purged %d events\n", n)
+		return nil
+	}
+	dead, err := fetchDeadLetters(ch)
+	if err != nil {
+		return err
+	}
+	selected := dead
+	if args[1] != "all" || args[0] == "show" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 || n > len(dead) {
+			return fmt.Errorf("no dead lettered event %s, there are %d", args[1], len(dead))
+		}
+		selected = dead[n-1 : n]
+	}
+
+	switch args[0] {
+	case "show":
+		showDeadLetter(selected[0], out)
+	case "replay":
+		for _, d := range selected {
+			if err := replayDeadLetter(ch, d); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "replayed %d events\n", len(selected))
+	case "purge":
+		for _, d := range selected {
+			if err := d.Ack(false); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "purged %d events\n", len(selected))
+	}
+	return nil
+}
+
+// fetches every event in the dead letter queue without acking them, so they
+// stay on it unless acked
+func fetchDeadLetters(ch deadLetters) ([]amqp091.Delivery, error) {
+	var dead []amqp091.Delivery
+	for {
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return dead, nil
+		}
+		dead = append(dead, d)
+	}
+}
+
+func listDeadLetters(dead []amqp091.Delivery, out io.Writer) {
+	if len(dead) == 0 {
+		fmt.Fprintln(out, "no dead lettered events")
+		return
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tTYPE\tROOM\tATTEMPTS\tFAILED AT\tREASON")
+	for i, d := range dead {
+		eventType, room := d.Type, ""
+		if event, err := events.Decode(d.Body); err == nil {
+			eventType, room = string(event.Type), event.Payload.Roomid
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%v\t%v\n", i+1, eventType, room, headerInt(d.Headers, attemptsHeader), d.Headers[failedAtHeader], d.Headers[reasonHeader])
+	}
+	tw.Flush()
+}
+
+func showDeadLetter(d amqp091.Delivery, out io.Writer) {
+	names := make([]string, 0, len(d.Headers))
+	for name := range d.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "type:", d.Type)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s: %v\n", name, d.Headers[name])
+	}
+	var body bytes.Buffer
+	if err := json.Indent(&body, d.Body, "", "  "); err != nil {
+		body.Reset()
+		body.Write(d.Body)
+	}
+	fmt.Fprintf(out, "\n%s\n", body.String())
+}
+
+// publishes a dead lettered event back onto chatQueue as a new event, without
+// its failure headers, then removes it from the dead letter queue
+func replayDeadLetter(ch deadLetters, d amqp091.Delivery) error {
+	msg := republishing(d, nil)
+	for _, name := range []string{attemptsHeader, roomSeqHeader, reasonHeader, failedAtHeader, "x-death"} {
+		delete(msg.Headers, name)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", chatQueue, false, false, msg); err != nil {
+		return err
+	}
+	return d.Ack(false)
+}
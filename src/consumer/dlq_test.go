@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fakeDeadLetters is a dead letter queue holding events, which Get hands out
+// in order
+type fakeDeadLetters struct {
+	fakePublisher
+	acks    *fakeAcks
+	queue   []amqp091.Delivery
+	fetched int
+	purged  bool
+}
+
+func (fd *fakeDeadLetters) Get(queue string, autoAck bool) (amqp091.Delivery, bool, error) {
+	if queue != deadLetterQueue || fd.fetched == len(fd.queue) {
+		return amqp091.Delivery{}, false, nil
+	}
+	fd.fetched++
+	return fd.queue[fd.fetched-1], true, nil
+}
+
+func (fd *fakeDeadLetters) QueuePurge(name string, noWait bool) (int, error) {
+	fd.purged = true
+	return len(fd.queue), nil
+}
+
+func newFakeDeadLetters(t *testing.T) *fakeDeadLetters {
+	fd := &fakeDeadLetters{acks: &fakeAcks{}}
+	for i, room := range []string{"room-a", "room-b"} {
+		event := events.New(events.MessagePosted, events.Payload{Roomid: room, Text: "hi", Time: "2024-01-01 00:00:00"})
+		re := testDelivery(t, fd.acks, uint64(i+1), event, amqp091.Table{
+			attemptsHeader: int64(5),
+			reasonHeader:   "addmsg api request for uuid " + room + " resulted in 500",
+			failedAtHeader: "2024-01-01T00:00:10Z",
+			"x-death":      []any{},
+		})
+		fd.queue = append(fd.queue, re.delivery)
+	}
+	return fd
+}
+
+func TestDLQList(t *testing.T) {
+	fd := newFakeDeadLetters(t)
+	var out bytes.Buffer
+	if err := runDLQ([]string{"list"}, fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "1 ") || !strings.Contains(lines[2], "room-b") || !strings.Contains(lines[2], "resulted in 500") {
+		t.Errorf("unexpected list:\n%s", out.String())
+	}
+	if fd.acks.get(1) != "" || fd.acks.get(2) != "" {
+		t.Error("expected listing to leave the events on the queue")
+	}
+
+	out.Reset()
+	fd.fetched = 0
+	if err := runDLQ([]string{"show", "2"}, fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "x-failure-reason: addmsg api request for uuid room-b") || !strings.Contains(out.String(), `"roomid": "room-b"`) {
+		t.Errorf("unexpected event:\n%s", out.String())
+	}
+
+	fd.fetched = 0
+	if err := runDLQ([]string{"show", "3"}, fd, &out); err == nil {
+		t.Error("expected an error showing an event that is not there")
+	}
+}
+
+func TestDLQReplayAndPurge(t *testing.T) {
+	fd := newFakeDeadLetters(t)
+	var out bytes.Buffer
+	if err := runDLQ([]string{"replay", "2"}, fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	p := fd.take(t)
+	if p.exchange != "" || p.key != chatQueue {
+		t.Errorf("expected the event to be sent back to %s, got %+v", chatQueue, p)
+	}
+	for _, name := range []string{attemptsHeader, reasonHeader, failedAtHeader, "x-death"} {
+		if _, ok := p.msg.Headers[name]; ok {
+			t.Errorf("expected %s to be removed from the replayed event", name)
+		}
+	}
+	if fd.acks.get(1) != "" || fd.acks.get(2) != "ack" {
+		t.Errorf("expected only the replayed event to be removed, got %v", fd.acks.acks)
+	}
+
+	fd.fetched = 0
+	if err := runDLQ([]string{"purge", "1"}, fd, &out); err != nil {
+		t.Fatal(err)
+	}
+	if fd.acks.get(1) != "ack" || len(fd.sent) != 0 {
+		t.Errorf("expected the event to be removed without being replayed, got %v", fd.acks.acks)
+	}
+
+	if err := runDLQ([]string{"purge", "all"}, fd, &out); err != nil || !fd.purged {
+		t.Errorf("expected the queue to be purged, got %v", err)
+	}
+	if err := runDLQ([]string{"drop"}, fd, &out); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Ryan-Har/chat-app/src/api/events"
 	"github.com/rabbitmq/amqp091-go"
 )
 
@@ -23,21 +26,23 @@ var apiPort string = os.Getenv("apiPort")
 var lavinMQURL string = fmt.Sprintf("amqp://guest:guest@%s:%s/", lavinmqHost, lavinmqPort)
 var apiBaseUrl string = fmt.Sprintf("http://%s:%s/api", apiHost, apiPort)
 
+// shared with the api, which only lets the chat-app services record chat events
+var serviceToken string = os.Getenv("servicetoken")
+
 const (
 	chatQueue     = "ChatUpdateQueue"
 	workerCount   = 5
 	internalQueue = "AppQueue"
+	// events fetched from chatQueue ahead of being handled, and how many of
+	// them may wait for each room partition
+	consumerPrefetch = 100
+	partitionQueue   = 20
+	// how long to wait before reconnecting to the broker
+	reconnectDelay = 5 * time.Second
+	// where /metrics is served unless metricsaddr is set
+	defaultMetricsAddr = ":8080"
 )
 
-type BrokerMessage struct {
-	Roomid      string `json:"roomid"`
-	Name        string `json:"name"`
-	Address     string `json:"address"`
-	MessageText string `json:"messagetext"`
-	UserID      int64  `json:"userid"`
-	Time        string `json:"time"`
-}
-
 type worker struct {
 	id  int
 	err error
@@ -45,8 +50,10 @@ type worker struct {
 
 var brokerSendingChan = make(chan amqp091.Publishing)
 
-func sendToInternalQueue(message *BrokerMessage) error {
-	b, err := json.Marshal(message)
+// forwards the event to the app service. Legacy messages are forwarded as
+// envelopes so the app only ever has to deal with one format.
+func sendToInternalQueue(event events.Event) error {
+	b, err := event.Marshal()
 	if err != nil {
 		return err
 	}
@@ -54,7 +61,8 @@ func sendToInternalQueue(message *BrokerMessage) error {
 	msg := amqp091.Publishing{
 		DeliveryMode: amqp091.Persistent,
 		Timestamp:    time.Now(),
-		ContentType:  "application/javascript",
+		ContentType:  "application/json",
+		Type:         string(event.Type),
 		Body:         b,
 	}
 	brokerSendingChan <- msg
@@ -65,11 +73,6 @@ func workerManager() {
 	workerChan := make(chan *worker, workerCount)
 
 	for i := 0; i < workerCount; i++ {
-		i := i
-		wk := &worker{id: i}
-		go wk.workConsume(workerChan)
-	}
-	for i := workerCount; i < workerCount*2; i++ {
 		i := i
 		wk := &worker{id: i}
 		go wk.workSend(workerChan, brokerSendingChan)
@@ -79,11 +82,7 @@ func workerManager() {
 		// reset err
 		wk.err = nil
 		// a goroutine has ended, restart it
-		if wk.id < workerCount {
-			go wk.workConsume(workerChan)
-		} else {
-			go wk.workSend(workerChan, brokerSendingChan)
-		}
+		go wk.workSend(workerChan, brokerSendingChan)
 	}
 }
 
@@ -146,10 +145,9 @@ func (wk *worker) workSend(workerChan chan<- *worker, brokerchan chan amqp091.Pu
 			//if it has this exception, something happened to make the connection close
 			//we must resend the message if we don't want to lose it.
 			if strings.HasPrefix(err.Error(), "Exception (504)") {
-				var messageBack BrokerMessage
-				err = json.Unmarshal(msg.Body, &messageBack)
-				if err == nil {
-					sendToInternalQueue(&messageBack)
+				event, decodeErr := events.Decode(msg.Body)
+				if decodeErr == nil {
+					sendToInternalQueue(event)
 					panic(err)
 				}
 				panic(err)
@@ -159,37 +157,41 @@ func (wk *worker) workSend(workerChan chan<- *worker, brokerchan chan amqp091.Pu
 	return err
 }
 
-func (wk *worker) workConsume(workerChan chan<- *worker) (err error) {
-	// make my goroutine signal its death, whether it's a panic or a return
-	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				wk.err = err
-			} else {
-				wk.err = fmt.Errorf("panic happened with %v", r)
-			}
-		} else {
-			wk.err = err
+// consumes chatQueue until ctx is done, reconnecting whenever the broker is
+// lost
+func consumeEvents(ctx context.Context, rt *retrier) {
+	for {
+		err := consumeSession(ctx, rt)
+		if ctx.Err() != nil {
+			return
 		}
-		workerChan <- wk
-	}()
+		log.Println("event consumer disconnected, reconnecting:", err)
+		select {
+		case <-time.After(reconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
+// reads events from a single consumer on chatQueue and hands them to a
+// worker for their room, so each room's events are applied in the order the
+// chat service published them. Events not yet acked when the connection is
+// lost are redelivered by the broker.
+func consumeSession(ctx context.Context, rt *retrier) error {
 	conn, err := amqp091.Dial(lavinMQURL)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer conn.Close()
 	fmt.Println("connected to lavin instance successfully")
 
 	ch, err := conn.Channel()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer ch.Close()
 
-	// ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	// defer cancel()
-
 	_, err = ch.QueueDeclare(
 		chatQueue,
 		true,
@@ -202,12 +204,18 @@ func (wk *worker) workConsume(workerChan chan<- *worker) (err error) {
 		},
 	)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := declareRetryQueues(ch, rt.maxAttempts); err != nil {
+		return err
+	}
+	if err := ch.Qos(consumerPrefetch, 0, false); err != nil {
+		return err
 	}
 
 	msgs, err := ch.Consume(
 		chatQueue,
-		fmt.Sprintf("consumer %d", wk.id),
+		"consumer",
 		false,
 		false,
 		false,
@@ -215,17 +223,31 @@ func (wk *worker) workConsume(workerChan chan<- *worker) (err error) {
 		nil,
 	)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for msg := range msgs {
-		if err = processMessage(msg); err != nil {
-			fmt.Println(err.Error())
-			panic(err)
+	p := startPartitions(workerCount, partitionQueue, func(ctx context.Context, batch []roomEvent) {
+		rt.handleBatch(ctx, ch, batch)
+	})
+	defer p.stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return errors.New("deliveries closed")
+			}
+			event, err := events.Decode(msg.Body)
+			if err != nil {
+				//an event we can't read will never succeed, dead letter it rather than retry
+				log.Println("unable to decode event, dead lettering it:", err)
+				deadLetter(ctx, ch, msg, 1, "unable to decode event: "+err.Error())
+				continue
+			}
+			p.dispatch(roomEvent{delivery: msg, event: event})
 		}
-		time.Sleep(time.Second)
 	}
-	return err
 }
 
 type ChatUuidTime struct {
@@ -234,10 +256,11 @@ type ChatUuidTime struct {
 }
 
 type ChatMessage struct {
-	ChatUUID string `json:"chatuuid"`
-	UserID   int64  `json:"userid"`
-	Message  string `json:"message"`
-	Time     string `json:"time"`
+	ChatUUID    string   `json:"chatuuid"`
+	UserID      int64    `json:"userid"`
+	Message     string   `json:"message"`
+	Time        string   `json:"time"`
+	Attachments []string `json:"attachments,omitempty"`
 }
 
 type JoinLeave struct {
@@ -246,165 +269,72 @@ type JoinLeave struct {
 	UserID   int64  `json:"userid"`
 }
 
-func processMessage(msg amqp091.Delivery) error {
+// applies an event through the api. An error means it could not be applied
+// yet and should be tried again. The event's id is sent as the
+// Idempotency-Key, so the api ignores events it has already applied.
+func processEvent(event events.Event) error {
+	ep := event.Payload
+
+	var body any
+	var url, what string
+	send := sendPostRequest
+	switch event.Type {
+	case events.ChatEnded:
+		body = ChatUuidTime{ChatUUID: ep.Roomid, Time: ep.Time}
+		url, what, send = apiBaseUrl+"/chat/statusupdate", "end of chat", sendPutRequest
+	case events.ChatStarted:
+		body = ChatUuidTime{ChatUUID: ep.Roomid, Time: ep.Time}
+		url, what = apiBaseUrl+"/chat/statusupdate", "start of chat"
+	case events.ParticipantJoined:
+		body = JoinLeave{ChatUUID: ep.Roomid, Time: ep.Time, UserID: ep.UserID}
+		url, what = apiBaseUrl+"/chat/participantupdate", "participant join"
+	case events.ParticipantLeft:
+		body = JoinLeave{ChatUUID: ep.Roomid, Time: ep.Time, UserID: ep.UserID}
+		url, what, send = apiBaseUrl+"/chat/participantupdate", "participant leave", sendPutRequest
+	case events.MessagePosted:
+		body = ChatMessage{
+			ChatUUID:    ep.Roomid,
+			UserID:      ep.UserID,
+			Message:     ep.Text,
+			Time:        ep.Time,
+			Attachments: ep.Attachments,
+		}
+		url, what = apiBaseUrl+"/chat/addmessage", "add message"
+	default:
+		return nil
+	}
 
-	bm := BrokerMessage{}
-	if err := json.Unmarshal(msg.Body, &bm); err != nil {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
 		return err
 	}
-
-	switch bm.MessageText {
-	case "End of chat":
-		body := ChatUuidTime{
-			ChatUUID: bm.Roomid,
-			Time:     bm.Time,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			return err
-		}
-		resp, err := sendPutRequest(apiBaseUrl+"/chat/statusupdate", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		//no content - nothing was updated, likely dealt with out of order, requeue
-		if resp.StatusCode == 422 {
-			log.Printf("End of chat api request for uuid %s resulted in 422, requeue", body.ChatUUID)
-			msg.Nack(false, true)
-			return err
-		}
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			return err
-		}
-		fmt.Println("resp body:", string(respBody))
-		sendToInternalQueue(&bm)
-		msg.Ack(false)
-
-	case "Start of chat":
-		body := ChatUuidTime{
-			ChatUUID: bm.Roomid,
-			Time:     bm.Time,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			log.Println("error marshalling json:", body)
-			return err
-		}
-		resp, err := sendPostRequest(apiBaseUrl+"/chat/statusupdate", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			return err
-		}
-		fmt.Println("resp body:", string(respBody))
-		fmt.Println(err)
-		sendToInternalQueue(&bm)
-		msg.Ack(false)
-
-	case "User joined chat":
-		body := JoinLeave{
-			ChatUUID: bm.Roomid,
-			Time:     bm.Time,
-			UserID:   bm.UserID,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			log.Println("error marshalling json:", body)
-			return err
-		}
-		resp, err := sendPostRequest(apiBaseUrl+"/chat/participantupdate", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == 422 {
-			log.Printf("Participant join api request for uuid %s resulted in 422, requeue", body.ChatUUID)
-			msg.Nack(false, true)
-			return err
-		}
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			return err
-		}
-		fmt.Println("resp body:", string(respBody))
-		sendToInternalQueue(&bm)
-		msg.Ack(false)
-
-	case "User left chat":
-		body := JoinLeave{
-			ChatUUID: bm.Roomid,
-			Time:     bm.Time,
-			UserID:   bm.UserID,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			log.Println("error marshalling json:", body)
-			return err
-		}
-		resp, err := sendPutRequest(apiBaseUrl+"/chat/participantupdate", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == 422 {
-			log.Printf("Participant leave api request for uuid %s resulted in 422, requeue", body.ChatUUID)
-			msg.Nack(false, true)
-			return err
-		}
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			return err
-		}
-		fmt.Println("resp body:", string(respBody))
-		sendToInternalQueue(&bm)
-		msg.Ack(false)
-
-	default: //must be a message
-		body := ChatMessage{
-			ChatUUID: bm.Roomid,
-			UserID:   bm.UserID,
-			Message:  bm.MessageText,
-			Time:     bm.Time,
-		}
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			log.Println("error marshalling json:", body)
-			return err
-		}
-		resp, err := sendPostRequest(apiBaseUrl+"/chat/addmessage", bytes.NewReader(jsonBody))
-		if err != nil {
-			return err
-		}
-		if resp.StatusCode != 200 { //requeue
-			log.Printf("Addmsg api request for uuid %s resulted in %v, requeue", body.ChatUUID, resp.StatusCode)
-			msg.Nack(false, true)
-			return err
-		}
-		sendToInternalQueue(&bm)
-		msg.Ack(false)
+	resp, err := send(url, bytes.NewReader(jsonBody), event.ID)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
+	//already started, the event has been applied before
+	if event.Type == events.ChatStarted && resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s api request for uuid %s resulted in %d: %s", what, ep.Roomid, resp.StatusCode, bytes.TrimSpace(msg))
+	}
 	return nil
 }
 
-func sendPutRequest(url string, content *bytes.Reader) (*http.Response, error) {
+func sendPutRequest(url string, content *bytes.Reader, idempotencyKey string) (*http.Response, error) {
 	req, err := http.NewRequest("PUT", url, content)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", serviceToken)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -413,12 +343,16 @@ func sendPutRequest(url string, content *bytes.Reader) (*http.Response, error) {
 	return resp, err
 }
 
-func sendPostRequest(url string, content *bytes.Reader) (*http.Response, error) {
+func sendPostRequest(url string, content *bytes.Reader, idempotencyKey string) (*http.Response, error) {
 	req, err := http.NewRequest("POST", url, content)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", serviceToken)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -432,6 +366,7 @@ func sendGetRequest(url string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("X-Service-Token", serviceToken)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -440,11 +375,67 @@ func sendGetRequest(url string) (*http.Response, error) {
 	return resp, nil
 }
 
+// returns the int value of the environment variable, or def if unset or not a positive number
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 {
+		log.Printf("invalid value %q for %s, using default %d", v, name, def)
+		return def
+	}
+	return i
+}
+
+// returns the duration value (e.g. 5s, 1m) of the environment variable, or def if unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid value %q for %s, using default %s", v, name, def)
+		return def
+	}
+	return d
+}
+
 func getTimeNow() string {
 	return time.Now().Format("2006-01-02 15:04:05.999999")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		if err := dlqCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	store, err := newEventStore()
+	if err != nil {
+		log.Fatalln("error setting up persistence:", err)
+	}
+	pl, err := newPipelineFromEnv()
+	if err != nil {
+		log.Fatalln("error setting up plugins:", err)
+	}
+	rt := newRetrier(store, envInt("maxattempts", defaultMaxAttempts))
+	rt.pipeline = pl
+
+	metricsAddr := os.Getenv("metricsaddr")
+	if metricsAddr == "" {
+		metricsAddr = defaultMetricsAddr
+	}
+	http.Handle("/metrics", pl)
+	go func() {
+		log.Println("error serving metrics:", http.ListenAndServe(metricsAddr, nil))
+	}()
+
 	go workerManager()
-	select {}
+	consumeEvents(context.Background(), rt)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// a delivery along with the event decoded from it
+type roomEvent struct {
+	delivery amqp091.Delivery
+	event    events.Event
+}
+
+// partitions spreads events over a fixed set of workers by room. Every event
+// for a room goes to the same worker, which handles them in the order they
+// arrived, while different rooms are handled in parallel. Events waiting for
+// a worker are handed to it together, so they can be written at once.
+type partitions struct {
+	queues []chan roomEvent
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// starts n workers calling handle with each batch of events, oldest first.
+// handle should give up once ctx is done.
+func startPartitions(n int, queueSize int, handle func(ctx context.Context, batch []roomEvent)) *partitions {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &partitions{queues: make([]chan roomEvent, n), cancel: cancel}
+	for i := range p.queues {
+		q := make(chan roomEvent, queueSize)
+		p.queues[i] = q
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for re := range q {
+				batch := collect(re, q, queueSize+1)
+				if ctx.Err() != nil {
+					continue //drain, the deliveries can no longer be acked
+				}
+				handle(ctx, batch)
+			}
+		}()
+	}
+	return p
+}
+
+// takes up to max-1 events already waiting behind first
+func collect(first roomEvent, q <-chan roomEvent, max int) []roomEvent {
+	batch := []roomEvent{first}
+	for len(batch) < max {
+		select {
+		case re, ok := <-q:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, re)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// the worker handling room's events
+func partitionFor(room string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(room))
+	return int(h.Sum32() % uint32(n))
+}
+
+// queues re for its room's worker, waiting if that worker is behind
+func (p *partitions) dispatch(re roomEvent) {
+	p.queues[partitionFor(re.event.Payload.Roomid, len(p.queues))] <- re
+}
+
+// stops the workers, abandoning events not yet handled, and waits for them
+// to finish
+func (p *partitions) stop() {
+	p.cancel()
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+func testRoomEvent(room string, text string) roomEvent {
+	return roomEvent{event: events.New(events.MessagePosted, events.Payload{Roomid: room, Text: text})}
+}
+
+func TestPartitionsKeepRoomOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]string)
+	p := startPartitions(4, 2, func(ctx context.Context, batch []roomEvent) {
+		for _, re := range batch {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			mu.Lock()
+			seen[re.event.Payload.Roomid] = append(seen[re.event.Payload.Roomid], re.event.Payload.Text)
+			mu.Unlock()
+		}
+	})
+
+	rooms := []string{"a", "b", "c", "d", "e", "f"}
+	for i := 0; i < 20; i++ {
+		for _, room := range rooms {
+			p.dispatch(testRoomEvent(room, fmt.Sprint(i)))
+		}
+	}
+	// stop abandons events not yet handled, so wait for them all first
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		total := 0
+		for _, texts := range seen {
+			total += len(texts)
+		}
+		mu.Unlock()
+		if total == 20*len(rooms) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.stop()
+
+	for _, room := range rooms {
+		if len(seen[room]) != 20 {
+			t.Fatalf("expected 20 events for room %s, got %d", room, len(seen[room]))
+		}
+		for i, text := range seen[room] {
+			if text != fmt.Sprint(i) {
+				t.Fatalf("room %s events out of order: %v", room, seen[room])
+			}
+		}
+	}
+}
+
+func TestPartitionsRunRoomsInParallel(t *testing.T) {
+	// two rooms handled by different workers
+	slow, fast := "room-0", ""
+	for i := 1; fast == ""; i++ {
+		if room := fmt.Sprintf("room-%d", i); partitionFor(room, 2) != partitionFor(slow, 2) {
+			fast = room
+		}
+	}
+
+	release := make(chan struct{})
+	handled := make(chan string, 1)
+	p := startPartitions(2, 1, func(ctx context.Context, batch []roomEvent) {
+		for _, re := range batch {
+			if re.event.Payload.Roomid == slow {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+				continue
+			}
+			handled <- re.event.Payload.Roomid
+		}
+	})
+	defer p.stop()
+	defer close(release)
+
+	p.dispatch(testRoomEvent(slow, "stuck"))
+	p.dispatch(testRoomEvent(fast, "hello"))
+	select {
+	case room := <-handled:
+		if room != fast {
+			t.Errorf("expected %s to be handled, got %s", fast, room)
+		}
+	case <-time.After(time.Second):
+		t.Error("a room was held up by another room's stuck event")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+// plugin processes chat events before they are applied. Handle returns what
+// to carry on with in place of event: nothing to drop it, a changed copy to
+// modify it, or several events to fan it out. An error fails the event, which
+// is retried like any other failure, so a plugin may see an event more than
+// once.
+//
+// Events a plugin adds should be given an id with derivedID, so that when the
+// event they came from is retried they are only applied once.
+type plugin interface {
+	Handle(ctx context.Context, event events.Event) ([]events.Event, error)
+}
+
+// builds a plugin from its configuration, the plugin_<name>_<key>
+// environment variables by key
+type pluginFactory func(config map[string]string) (plugin, error)
+
+var pluginFactories = map[string]pluginFactory{}
+
+// makes a plugin available to the plugins environment variable as name,
+// called from init
+func registerPlugin(name string, factory pluginFactory) {
+	if _, ok := pluginFactories[name]; ok {
+		panic("plugin registered twice: " + name)
+	}
+	pluginFactories[name] = factory
+}
+
+// the id of the n'th event a plugin adds for event, the same each time event
+// is handled. Legacy events have no id, and neither do the events added for
+// them.
+func derivedID(event events.Event, n int) string {
+	if event.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.%d", event.ID, n)
+}
+
+// pipeline runs events through plugins, in the order they were added. Each
+// event a plugin returns goes through the rest of the plugins.
+type pipeline struct {
+	stages []*pipelineStage
+}
+
+type pipelineStage struct {
+	name   string
+	plugin plugin
+
+	handled atomic.Int64 //events given to the plugin
+	dropped atomic.Int64 //of those, ones it returned nothing for
+	emitted atomic.Int64 //events it returned
+	failed  atomic.Int64
+	nanos   atomic.Int64 //time spent in Handle
+}
+
+// adds a plugin to the end of the pipeline
+func (p *pipeline) add(name string, pl plugin) {
+	p.stages = append(p.stages, &pipelineStage{name: name, plugin: pl})
+}
+
+// builds the pipeline from the plugins environment variable, a comma
+// separated list of plugin names run in the order given. Without it events
+// are applied as they are.
+func newPipelineFromEnv() (*pipeline, error) {
+	return newPipeline(os.Getenv("plugins"), os.Environ())
+}
+
+func newPipeline(names string, environ []string) (*pipeline, error) {
+	p := &pipeline{}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("plugin %s listed twice", name)
+		}
+		seen[name] = true
+		factory, ok := pluginFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown plugin %q", name)
+		}
+		pl, err := factory(pluginConfig(name, environ))
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		p.add(name, pl)
+	}
+	return p, nil
+}
+
+// the plugin_<name>_<key>=value entries of environ, by key
+func pluginConfig(name string, environ []string) map[string]string {
+	prefix := "plugin_" + name + "_"
+	config := make(map[string]string)
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if key, ok := strings.CutPrefix(k, prefix); ok && key != "" {
+			config[key] = v
+		}
+	}
+	return config
+}
+
+// runs event through every plugin, returning the events to apply in its
+// place, in order
+func (p *pipeline) run(ctx context.Context, event events.Event) ([]events.Event, error) {
+	out := []events.Event{event}
+	for _, s := range p.stages {
+		var next []events.Event
+		for _, e := range out {
+			handled, err := s.handle(ctx, e)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", s.name, err)
+			}
+			next = append(next, handled...)
+		}
+		out = next
+	}
+	return out, nil
+}
+
+func (s *pipelineStage) handle(ctx context.Context, event events.Event) ([]events.Event, error) {
+	start := time.Now()
+	out, err := s.plugin.Handle(ctx, event)
+	s.nanos.Add(int64(time.Since(start)))
+	s.handled.Add(1)
+	if err != nil {
+		s.failed.Add(1)
+		return nil, err
+	}
+	if len(out) == 0 {
+		s.dropped.Add(1)
+	}
+	s.emitted.Add(int64(len(out)))
+	return out, nil
+}
+
+// serves each plugin's counts in the Prometheus text format
+func (p *pipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counters := []struct {
+		name, help string
+		value      func(s *pipelineStage) any
+	}{
+		{"consumer_plugin_events_total", "Events handled by the plugin.", func(s *pipelineStage) any { return s.handled.Load() }},
+		{"consumer_plugin_events_dropped_total", "Events the plugin dropped.", func(s *pipelineStage) any { return s.dropped.Load() }},
+		{"consumer_plugin_events_emitted_total", "Events the plugin passed on, including ones it added.", func(s *pipelineStage) any { return s.emitted.Load() }},
+		{"consumer_plugin_errors_total", "Events the plugin failed.", func(s *pipelineStage) any { return s.failed.Load() }},
+		{"consumer_plugin_duration_seconds_total", "Time spent in the plugin.", func(s *pipelineStage) any { return time.Duration(s.nanos.Load()).Seconds() }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, s := range p.stages {
+			fmt.Fprintf(w, "%s{plugin=%q} %v\n", c.name, s.name, c.value(s))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+// a plugin made from a function
+type pluginFunc func(ctx context.Context, event events.Event) ([]events.Event, error)
+
+func (f pluginFunc) Handle(ctx context.Context, event events.Event) ([]events.Event, error) {
+	return f(ctx, event)
+}
+
+// a pipeline which drops joins, replaces "darn" in messages, copies messages
+// mentioning "everyone" into a second message, and fails on "fail"
+func newTestPipeline() *pipeline {
+	p := &pipeline{}
+	p.add("drop", pluginFunc(func(ctx context.Context, event events.Event) ([]events.Event, error) {
+		if event.Type == events.ParticipantJoined {
+			return nil, nil
+		}
+		return []events.Event{event}, nil
+	}))
+	p.add("censor", pluginFunc(func(ctx context.Context, event events.Event) ([]events.Event, error) {
+		if event.Payload.Text == "fail" {
+			return nil, errors.New("filter unavailable")
+		}
+		event.Payload.Text = strings.ReplaceAll(event.Payload.Text, "darn", "****")
+		return []events.Event{event}, nil
+	}))
+	p.add("fanout", pluginFunc(func(ctx context.Context, event events.Event) ([]events.Event, error) {
+		if event.Type != events.MessagePosted || !strings.Contains(event.Payload.Text, "everyone") {
+			return []events.Event{event}, nil
+		}
+		copied := event
+		copied.ID = derivedID(event, 1)
+		copied.Payload.Text = "notified: " + event.Payload.Text
+		return []events.Event{event, copied}, nil
+	}))
+	return p
+}
+
+func TestPipeline(t *testing.T) {
+	p := newTestPipeline()
+	ctx := context.Background()
+
+	joined := events.New(events.ParticipantJoined, events.Payload{Roomid: "room", UserID: 1})
+	if out, err := p.run(ctx, joined); err != nil || len(out) != 0 {
+		t.Errorf("expected the join to be dropped, got %+v %v", out, err)
+	}
+
+	posted := events.New(events.MessagePosted, events.Payload{Roomid: "room", Text: "darn it everyone"})
+	out, err := p.run(ctx, posted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].Payload.Text != "**** it everyone" || out[1].Payload.Text != "notified: **** it everyone" {
+		t.Fatalf("expected the censored message then its copy, got %+v", out)
+	}
+	if out[0].ID != posted.ID || out[1].ID != posted.ID+".1" {
+		t.Errorf("expected the copy to get an id derived from the message's, got %q and %q", out[0].ID, out[1].ID)
+	}
+
+	if _, err := p.run(ctx, events.New(events.MessagePosted, events.Payload{Roomid: "room", Text: "fail"})); err == nil || !strings.Contains(err.Error(), "plugin censor") {
+		t.Errorf("expected the failing plugin to be named in the error, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`consumer_plugin_events_total{plugin="drop"} 3`,
+		`consumer_plugin_events_dropped_total{plugin="drop"} 1`,
+		`consumer_plugin_events_total{plugin="censor"} 2`,
+		`consumer_plugin_errors_total{plugin="censor"} 1`,
+		`consumer_plugin_events_emitted_total{plugin="fanout"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics, got:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestNewPipeline(t *testing.T) {
+	environ := []string{"plugin_logging_types=message_posted,chat_ended", "plugin_logging_text=true", "plugin_loggingx_text=nonsense"}
+	p, err := newPipeline(" logging, noop ", environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.stages) != 2 || p.stages[0].name != "logging" || p.stages[1].name != "noop" {
+		t.Fatalf("expected logging then noop, got %+v", p.stages)
+	}
+	lp := p.stages[0].plugin.(*loggingPlugin)
+	if !lp.text || len(lp.types) != 2 || !lp.types[events.ChatEnded] {
+		t.Errorf("expected the logging plugin's own configuration, got %+v", lp)
+	}
+	event := events.New(events.MessagePosted, events.Payload{Roomid: "room", Text: "hi"})
+	if out, err := p.run(context.Background(), event); err != nil || len(out) != 1 || out[0].ID != event.ID || out[0].Payload.Text != "hi" {
+		t.Errorf("expected the event passed on unchanged, got %+v %v", out, err)
+	}
+
+	if p, err := newPipeline("", nil); err != nil || len(p.stages) != 0 {
+		t.Errorf("expected an empty pipeline, got %+v %v", p, err)
+	}
+	for _, names := range []string{"missing", "noop,noop"} {
+		if _, err := newPipeline(names, nil); err == nil {
+			t.Errorf("%s: expected an error", names)
+		}
+	}
+	if _, err := newPipeline("logging", []string{"plugin_logging_text=sometimes"}); err == nil {
+		t.Error("expected an error for bad configuration")
+	}
+}
+
+func TestRetrierRunsPipeline(t *testing.T) {
+	ds := newTestDBStore(t)
+	drainInternalQueue(t)
+	fp := &fakePublisher{}
+	acks := &fakeAcks{}
+	rt := newRetrier(ds, 5)
+	rt.pipeline = newTestPipeline()
+	ctx := context.Background()
+
+	message := func(text string) events.Event {
+		return events.New(events.MessagePosted, events.Payload{Roomid: testChat, UserID: 1, Text: text, Time: "2024-02-20 15:50:21.000000"})
+	}
+	// in another room, so testChat's later events need not wait for its retry
+	failing := events.New(events.MessagePosted, events.Payload{Roomid: "6f1c0000-0000-0000-0000-000000000000", UserID: 1, Text: "fail", Time: "2024-02-20 15:50:21.000000"})
+	rt.handleBatch(ctx, fp, []roomEvent{
+		testDelivery(t, acks, 1, message("darn"), nil),
+		testDelivery(t, acks, 2, events.New(events.ParticipantJoined, events.Payload{Roomid: testChat, UserID: 1, Time: "2024-02-20 15:50:21.000000"}), nil),
+		testDelivery(t, acks, 3, failing, nil),
+		testDelivery(t, acks, 4, message("hello everyone"), nil),
+		testDelivery(t, acks, 5, message("bye"), nil),
+	})
+	for tag := uint64(1); tag <= 5; tag++ {
+		if acks.get(tag) != "ack" {
+			t.Errorf("expected event %d to be acked, got %q", tag, acks.get(tag))
+		}
+	}
+	if p := fp.take(t); p.key != retryQueue(1) || !strings.Contains(p.msg.Headers[reasonHeader].(string), "filter unavailable") {
+		t.Errorf("expected the event the pipeline failed to be retried, got %+v", p)
+	}
+
+	messages, err := ds.dbqh.GetAllMessagesByUUID(ctx, testChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, m := range messages {
+		texts = append(texts, m.Message)
+	}
+	if strings.Join(texts, ",") != "****,hello everyone,notified: hello everyone,bye" {
+		t.Errorf("expected the pipeline's messages to be stored, got %q", texts)
+	}
+	if participants, err := ds.dbqh.GetOngoingChatParticipants(ctx); err != nil || len(participants) != 0 {
+		t.Errorf("expected the dropped join not to be stored, got %+v %v", participants, err)
+	}
+}
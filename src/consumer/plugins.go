@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+// the plugins built into the consumer
+func init() {
+	registerPlugin("noop", newNoopPlugin)
+	registerPlugin("logging", newLoggingPlugin)
+}
+
+// noopPlugin passes every event on unchanged
+type noopPlugin struct{}
+
+func newNoopPlugin(config map[string]string) (plugin, error) {
+	return noopPlugin{}, nil
+}
+
+func (noopPlugin) Handle(ctx context.Context, event events.Event) ([]events.Event, error) {
+	return []events.Event{event}, nil
+}
+
+// loggingPlugin logs the events passing through it and passes them on
+// unchanged. It is configured with:
+//
+//	types  comma separated event types to log, all of them if unset
+//	text   true to include message text, which is left out by default
+type loggingPlugin struct {
+	types map[events.EventType]bool
+	text  bool
+}
+
+func newLoggingPlugin(config map[string]string) (plugin, error) {
+	lp := &loggingPlugin{}
+	if types := config["types"]; types != "" {
+		lp.types = make(map[events.EventType]bool)
+		for _, t := range strings.Split(types, ",") {
+			lp.types[events.EventType(strings.TrimSpace(t))] = true
+		}
+	}
+	if text := config["text"]; text != "" {
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, fmt.Errorf("text %q is not true or false", text)
+		}
+		lp.text = b
+	}
+	return lp, nil
+}
+
+func (lp *loggingPlugin) Handle(ctx context.Context, event events.Event) ([]events.Event, error) {
+	if lp.types == nil || lp.types[event.Type] {
+		ep := event.Payload
+		if lp.text && event.Type == events.MessagePosted {
+			log.Printf("%s event %s for room %s from user %d at %s: %q", event.Type, event.ID, ep.Roomid, ep.UserID, ep.Time, ep.Text)
+		} else {
+			log.Printf("%s event %s for room %s from user %d at %s", event.Type, event.ID, ep.Roomid, ep.UserID, ep.Time)
+		}
+	}
+	return []events.Event{event}, nil
+}
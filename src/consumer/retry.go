@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// events that fail maxattempts times are sent to deadLetterQueue through
+	// deadLetterExchange, with the reason they failed
+	deadLetterExchange = "message.deadletter"
+	deadLetterQueue    = chatQueue + ".deadletter"
+	defaultMaxAttempts = 5
+	// the first retry waits baseRetryDelay, each one after twice as long
+	baseRetryDelay = time.Second
+
+	// headers set on events being retried or dead lettered
+	attemptsHeader = "x-attempts"       //failed attempts so far
+	roomSeqHeader  = "x-room-seq"       //position among the room's events waiting to be retried
+	reasonHeader   = "x-failure-reason" //why the last attempt failed
+	failedAtHeader = "x-failed-at"
+)
+
+// the part of amqp091.Channel used to retry and dead letter events
+type eventPublisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error
+}
+
+// the delay queue for an event's attempt'th retry. Each one holds events for
+// its delay then dead letters them back onto chatQueue.
+func retryQueue(attempt int) string {
+	return fmt.Sprintf("%s.retry.%s", chatQueue, retryDelay(attempt))
+}
+
+func retryDelay(attempt int) time.Duration {
+	return baseRetryDelay << (attempt - 1)
+}
+
+// the part of amqp091.Channel used to declare the retry queues
+type declarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp091.Table) error
+}
+
+// declares the dead letter exchange and queue, and a delay queue for each
+// retry
+func declareRetryQueues(ch declarer, maxAttempts int) error {
+	if err := ch.ExchangeDeclare(deadLetterExchange, "direct", true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(deadLetterQueue, chatQueue, deadLetterExchange, false, nil); err != nil {
+		return err
+	}
+	for attempt := 1; attempt < maxAttempts; attempt++ {
+		_, err := ch.QueueDeclare(retryQueue(attempt), true, false, false, false, amqp091.Table{
+			"x-message-ttl":             retryDelay(attempt).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": chatQueue,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retrier applies events, sending those that fail to a delay queue to be
+// tried again, and dead lettering them once they have failed maxAttempts
+// times.
+//
+// While one of a room's events is waiting to be retried, the room's later
+// events wait in the delay queues behind it, and come back to be applied in
+// their original order. Which events are waiting is only known to this
+// process, so after a restart events already waiting are applied as they come
+// back.
+type retrier struct {
+	store       eventStore
+	pipeline    *pipeline
+	maxAttempts int
+
+	mu    sync.Mutex
+	holds map[string]*roomHold
+}
+
+// the events of a room waiting to be retried, by their x-room-seq
+type roomHold struct {
+	nextSeq int64
+	waiting map[int64]bool
+}
+
+func newRetrier(store eventStore, maxAttempts int) *retrier {
+	return &retrier{store: store, pipeline: &pipeline{}, maxAttempts: maxAttempts, holds: make(map[string]*roomHold)}
+}
+
+// an event along with what the pipeline turned it into
+type processedEvent struct {
+	roomEvent
+	out []events.Event
+	err error
+}
+
+func (rt *retrier) process(ctx context.Context, re roomEvent) processedEvent {
+	out, err := rt.pipeline.run(ctx, re.event)
+	return processedEvent{roomEvent: re, out: out, err: err}
+}
+
+// handles a batch of events in order. With a batchable store, runs of
+// messages which can be applied straight away, and which the pipeline leaves
+// as messages, are written together, and if that fails they are handled one
+// at a time.
+func (rt *retrier) handleBatch(ctx context.Context, pub eventPublisher, batch []roomEvent) {
+	bs, ok := rt.store.(batchStore)
+	for len(batch) > 0 {
+		var run []processedEvent
+		for ok && len(batch) > 0 && rt.batchable(batch[0]) {
+			pe := rt.process(ctx, batch[0])
+			batch = batch[1:]
+			if pe.err != nil || !plainMessages(pe.out) {
+				rt.writeTogether(ctx, pub, bs, run)
+				run = nil
+				rt.settle(ctx, pub, pe)
+				continue
+			}
+			run = append(run, pe)
+		}
+		rt.writeTogether(ctx, pub, bs, run)
+		if len(batch) > 0 {
+			rt.handle(ctx, pub, batch[0])
+			batch = batch[1:]
+		}
+	}
+}
+
+// writes the messages the events in run were turned into at once, handling
+// the events one at a time if that fails
+func (rt *retrier) writeTogether(ctx context.Context, pub eventPublisher, bs batchStore, run []processedEvent) {
+	if len(run) < 2 {
+		for _, pe := range run {
+			rt.settle(ctx, pub, pe)
+		}
+		return
+	}
+	var messages []events.Event
+	for _, pe := range run {
+		messages = append(messages, pe.out...)
+	}
+	if len(messages) > 0 {
+		if err := bs.addMessages(ctx, messages); err != nil {
+			log.Printf("error writing %d messages together, writing them one at a time: %s", len(messages), err)
+			for _, pe := range run {
+				rt.settle(ctx, pub, pe)
+			}
+			return
+		}
+	}
+	for _, pe := range run {
+		for _, event := range pe.out {
+			sendToInternalQueue(event)
+		}
+		pe.delivery.Ack(false)
+	}
+}
+
+// reports whether events are all new messages without attachments
+func plainMessages(out []events.Event) bool {
+	for _, event := range out {
+		if event.Type != events.MessagePosted || len(event.Payload.Attachments) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reports whether an event can be written along with other messages: a new
+// message without attachments, for a room with nothing waiting to be retried
+func (rt *retrier) batchable(re roomEvent) bool {
+	if re.event.Type != events.MessagePosted || len(re.event.Payload.Attachments) > 0 {
+		return false
+	}
+	if _, held := re.delivery.Headers[roomSeqHeader]; held {
+		return false
+	}
+	return rt.mayApply(re.event.Payload.Roomid, 0, false)
+}
+
+// applies an event, acking it once it has been applied, sent to be retried or
+// dead lettered
+func (rt *retrier) handle(ctx context.Context, pub eventPublisher, re roomEvent) {
+	d := re.delivery
+	room := re.event.Payload.Roomid
+	_, held := d.Headers[roomSeqHeader]
+	seq := headerInt(d.Headers, roomSeqHeader)
+
+	if !rt.mayApply(room, seq, held) {
+		// an earlier event for the room is still waiting, wait behind it
+		seq = rt.hold(room, seq, held)
+		rt.requeue(ctx, pub, d, retryQueue(1), amqp091.Table{roomSeqHeader: seq})
+		return
+	}
+	rt.settle(ctx, pub, rt.process(ctx, re))
+}
+
+// applies the events the pipeline turned an event into, which may be none,
+// then acks it, forwarding them to the app. If the pipeline or applying them
+// failed it is sent to be retried or dead lettered instead.
+func (rt *retrier) settle(ctx context.Context, pub eventPublisher, pe processedEvent) {
+	d := pe.delivery
+	room := pe.event.Payload.Roomid
+	attempts := int(headerInt(d.Headers, attemptsHeader))
+	_, held := d.Headers[roomSeqHeader]
+	seq := headerInt(d.Headers, roomSeqHeader)
+
+	err := pe.err
+	for i := 0; err == nil && i < len(pe.out); i++ {
+		err = rt.store.apply(ctx, pe.out[i])
+	}
+	if err == nil {
+		rt.release(room, seq, held)
+		for _, event := range pe.out {
+			sendToInternalQueue(event)
+		}
+		d.Ack(false)
+		return
+	}
+
+	attempts++
+	if attempts >= rt.maxAttempts {
+		log.Printf("%s event for room %s failed %d times, dead lettering it: %s", pe.event.Type, room, attempts, err)
+		rt.release(room, seq, held)
+		deadLetter(ctx, pub, d, attempts, err.Error())
+		return
+	}
+	seq = rt.hold(room, seq, held)
+	log.Printf("%s event for room %s failed, retrying in %s: %s", pe.event.Type, room, retryDelay(attempts), err)
+	rt.requeue(ctx, pub, d, retryQueue(attempts), amqp091.Table{
+		attemptsHeader: int64(attempts),
+		roomSeqHeader:  seq,
+		reasonHeader:   err.Error(),
+	})
+}
+
+// reports whether an event may be applied now. A room's new events wait
+// while it has events waiting to be retried, and those are applied in order.
+func (rt *retrier) mayApply(room string, seq int64, held bool) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	hold, ok := rt.holds[room]
+	if !ok {
+		return true
+	}
+	if !held {
+		return false
+	}
+	for s := range hold.waiting {
+		if s < seq {
+			return false
+		}
+	}
+	return true
+}
+
+// records that one of room's events is waiting to be retried, returning its
+// place among the room's waiting events. An event already held keeps its
+// place.
+func (rt *retrier) hold(room string, seq int64, held bool) int64 {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	hold, ok := rt.holds[room]
+	if !ok {
+		hold = &roomHold{waiting: make(map[int64]bool)}
+		rt.holds[room] = hold
+	}
+	if !held {
+		seq = hold.nextSeq
+	}
+	hold.nextSeq = max(hold.nextSeq, seq+1)
+	hold.waiting[seq] = true
+	return seq
+}
+
+// records that a held event is no longer waiting
+func (rt *retrier) release(room string, seq int64, held bool) {
+	if !held {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if hold, ok := rt.holds[room]; ok {
+		delete(hold.waiting, seq)
+		if len(hold.waiting) == 0 {
+			delete(rt.holds, room)
+		}
+	}
+}
+
+// republishes d to queue with headers added, then acks it. If it can't be
+// republished it is left for the broker to redeliver.
+func (rt *retrier) requeue(ctx context.Context, pub eventPublisher, d amqp091.Delivery, queue string, headers amqp091.Table) {
+	if err := pub.PublishWithContext(ctx, "", queue, false, false, republishing(d, headers)); err != nil {
+		log.Println("error sending event to be retried:", err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// sends d to the dead letter queue with the reason it failed, then acks it
+func deadLetter(ctx context.Context, pub eventPublisher, d amqp091.Delivery, attempts int, reason string) {
+	msg := republishing(d, amqp091.Table{
+		attemptsHeader: int64(attempts),
+		reasonHeader:   reason,
+		failedAtHeader: time.Now().UTC().Format(time.RFC3339),
+	})
+	delete(msg.Headers, roomSeqHeader)
+	if err := pub.PublishWithContext(ctx, deadLetterExchange, chatQueue, false, false, msg); err != nil {
+		log.Println("error dead lettering event:", err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// a copy of d to publish again, with headers added to its own
+func republishing(d amqp091.Delivery, headers amqp091.Table) amqp091.Publishing {
+	h := amqp091.Table{}
+	for k, v := range d.Headers {
+		h[k] = v
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	return amqp091.Publishing{
+		Headers:      h,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp091.Persistent,
+		Timestamp:    d.Timestamp,
+		Type:         d.Type,
+		Body:         d.Body,
+	}
+}
+
+// reads an integer header, which may have any of the integer types the
+// broker decodes them as. 0 if it is missing.
+func headerInt(h amqp091.Table, name string) int64 {
+	switch v := h[name].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	}
+	return 0
+}
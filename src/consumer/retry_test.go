@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/events"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+type published struct {
+	exchange string
+	key      string
+	msg      amqp091.Publishing
+}
+
+type fakePublisher struct {
+	mu   sync.Mutex
+	sent []published
+}
+
+func (fp *fakePublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.sent = append(fp.sent, published{exchange: exchange, key: key, msg: msg})
+	return nil
+}
+
+// takes the one event published since the last call
+func (fp *fakePublisher) take(t *testing.T) published {
+	t.Helper()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if len(fp.sent) != 1 {
+		t.Fatalf("expected one event to be published, got %d", len(fp.sent))
+	}
+	p := fp.sent[0]
+	fp.sent = nil
+	return p
+}
+
+// fakeAcks records what was done with each delivery, by delivery tag
+type fakeAcks struct {
+	mu   sync.Mutex
+	acks map[uint64]string
+}
+
+func (fa *fakeAcks) record(tag uint64, what string) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.acks == nil {
+		fa.acks = make(map[uint64]string)
+	}
+	fa.acks[tag] = what
+	return nil
+}
+
+func (fa *fakeAcks) get(tag uint64) string {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.acks[tag]
+}
+
+func (fa *fakeAcks) Ack(tag uint64, multiple bool) error { return fa.record(tag, "ack") }
+func (fa *fakeAcks) Nack(tag uint64, multiple bool, requeue bool) error {
+	return fa.record(tag, "nack")
+}
+func (fa *fakeAcks) Reject(tag uint64, requeue bool) error { return fa.record(tag, "reject") }
+
+// an api whose statusupdate reports nothing updated while failing is set
+func startFakeApi(t *testing.T, failing *atomic.Bool) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/chat/statusupdate" && failing.Load() {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	saved := apiBaseUrl
+	apiBaseUrl = srv.URL + "/api"
+	t.Cleanup(func() { apiBaseUrl = saved })
+
+	drainInternalQueue(t)
+}
+
+// events applied are forwarded to the app, throw them away as nothing is
+// listening in tests
+func drainInternalQueue(tb testing.TB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	go func() {
+		for {
+			select {
+			case <-brokerSendingChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func testDelivery(t *testing.T, acks *fakeAcks, tag uint64, event events.Event, headers amqp091.Table) roomEvent {
+	t.Helper()
+	body, err := event.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roomEvent{
+		delivery: amqp091.Delivery{Acknowledger: acks, DeliveryTag: tag, Headers: headers, Body: body, Type: string(event.Type)},
+		event:    event,
+	}
+}
+
+// a published event as it comes back from its delay queue
+func redelivered(t *testing.T, acks *fakeAcks, tag uint64, p published) roomEvent {
+	t.Helper()
+	event, err := events.Decode(p.msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testDelivery(t, acks, tag, event, p.msg.Headers)
+}
+
+func TestRetrierKeepsRoomOrder(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	startFakeApi(t, &failing)
+	fp := &fakePublisher{}
+	acks := &fakeAcks{}
+	rt := newRetrier(apiStore{}, 5)
+	ctx := context.Background()
+
+	ended := events.New(events.ChatEnded, events.Payload{Roomid: "room", Time: "2024-01-01 00:00:00"})
+	rt.handle(ctx, fp, testDelivery(t, acks, 1, ended, nil))
+	blocker := fp.take(t)
+	if blocker.key != retryQueue(1) || headerInt(blocker.msg.Headers, attemptsHeader) != 1 || blocker.msg.Headers[reasonHeader] == nil {
+		t.Fatalf("expected the failed event to be sent for its first retry, got %+v", blocker)
+	}
+	if acks.get(1) != "ack" {
+		t.Errorf("expected the failed event to be acked once sent to be retried, got %q", acks.get(1))
+	}
+
+	// a later event for the room waits behind it, though it would succeed
+	posted := events.New(events.MessagePosted, events.Payload{Roomid: "room", Text: "hi", Time: "2024-01-01 00:00:01"})
+	rt.handle(ctx, fp, testDelivery(t, acks, 2, posted, nil))
+	follower := fp.take(t)
+	if follower.key != retryQueue(1) || headerInt(follower.msg.Headers, attemptsHeader) != 0 {
+		t.Fatalf("expected the later event to wait without counting an attempt, got %+v", follower)
+	}
+	// other rooms carry on
+	other := events.New(events.MessagePosted, events.Payload{Roomid: "other", Text: "hi", Time: "2024-01-01 00:00:01"})
+	rt.handle(ctx, fp, testDelivery(t, acks, 3, other, nil))
+	if acks.get(3) != "ack" || len(fp.sent) != 0 {
+		t.Errorf("expected another room's event to be applied, got %q", acks.get(3))
+	}
+
+	// coming back before the event it waits for, it waits again
+	rt.handle(ctx, fp, redelivered(t, acks, 4, follower))
+	follower = fp.take(t)
+	if follower.key != retryQueue(1) {
+		t.Fatalf("expected the later event to wait again, got %+v", follower)
+	}
+
+	failing.Store(false)
+	rt.handle(ctx, fp, redelivered(t, acks, 5, blocker))
+	if acks.get(5) != "ack" || len(fp.sent) != 0 {
+		t.Fatalf("expected the retried event to be applied, got %q", acks.get(5))
+	}
+	rt.handle(ctx, fp, redelivered(t, acks, 6, follower))
+	if acks.get(6) != "ack" || len(fp.sent) != 0 {
+		t.Fatalf("expected the waiting event to be applied after it, got %q", acks.get(6))
+	}
+	if len(rt.holds) != 0 {
+		t.Errorf("expected no rooms held, got %v", rt.holds)
+	}
+}
+
+func TestRetrierDeadLetters(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	startFakeApi(t, &failing)
+	fp := &fakePublisher{}
+	acks := &fakeAcks{}
+	rt := newRetrier(apiStore{}, 3)
+	ctx := context.Background()
+
+	ended := events.New(events.ChatEnded, events.Payload{Roomid: "room", Time: "2024-01-01 00:00:00"})
+	re := testDelivery(t, acks, 1, ended, nil)
+	for attempt := 1; attempt < 3; attempt++ {
+		rt.handle(ctx, fp, re)
+		p := fp.take(t)
+		if p.key != retryQueue(attempt) {
+			t.Fatalf("attempt %d: expected %s, got %s", attempt, retryQueue(attempt), p.key)
+		}
+		re = redelivered(t, acks, uint64(attempt+1), p)
+	}
+	rt.handle(ctx, fp, re)
+	p := fp.take(t)
+	if p.exchange != deadLetterExchange || p.key != chatQueue {
+		t.Fatalf("expected the event to be dead lettered after 3 attempts, got %+v", p)
+	}
+	if headerInt(p.msg.Headers, attemptsHeader) != 3 || p.msg.Headers[reasonHeader] == nil || p.msg.Headers[failedAtHeader] == nil {
+		t.Errorf("expected the attempts and failure reason on the dead lettered event, got %v", p.msg.Headers)
+	}
+	if _, ok := p.msg.Headers[roomSeqHeader]; ok {
+		t.Error("expected the room position to be removed from the dead lettered event")
+	}
+	if len(rt.holds) != 0 {
+		t.Errorf("expected the room to be released, got %v", rt.holds)
+	}
+}
+
+func TestProcessEventStatuses(t *testing.T) {
+	var status atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Service-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	saved, savedToken := apiBaseUrl, serviceToken
+	apiBaseUrl, serviceToken = srv.URL+"/api", "secret"
+	t.Cleanup(func() { apiBaseUrl, serviceToken = saved, savedToken })
+
+	started := events.New(events.ChatStarted, events.Payload{Roomid: "room", Time: "2024-01-01 00:00:00"})
+	joined := events.New(events.ParticipantJoined, events.Payload{Roomid: "room", UserID: 1, Time: "2024-01-01 00:00:00"})
+	tests := []struct {
+		event  events.Event
+		status int
+		fails  bool
+	}{
+		{started, http.StatusOK, false},
+		{started, http.StatusConflict, false}, //started already
+		{started, http.StatusBadGateway, true},
+		{started, http.StatusInternalServerError, true},
+		{joined, http.StatusNoContent, false},
+		{joined, http.StatusServiceUnavailable, true},
+		{joined, http.StatusConflict, true},
+	}
+	for _, tt := range tests {
+		status.Store(int64(tt.status))
+		if err := processEvent(tt.event); (err != nil) != tt.fails {
+			t.Errorf("%s answered with %d: expected failure %v, got %v", tt.event.Type, tt.status, tt.fails, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+// eventStore applies chat events to the chat history. An error means the
+// event could not be applied yet and should be tried again.
+type eventStore interface {
+	apply(ctx context.Context, event events.Event) error
+}
+
+// a store which can also write a run of message_posted events without
+// attachments at once, all or none of them
+type batchStore interface {
+	eventStore
+	addMessages(ctx context.Context, messages []events.Event) error
+}
+
+// apiStore applies events by calling the api, the default
+type apiStore struct{}
+
+func (apiStore) apply(ctx context.Context, event events.Event) error {
+	return processEvent(event)
+}
+
+// dbStore writes events straight to the database, skipping the api
+type dbStore struct {
+	dbqh dbquery.DBQueryHandler
+}
+
+// applies event, doing nothing if it has been applied before
+func (ds dbStore) apply(ctx context.Context, event events.Event) error {
+	err := ds.write(dbquery.WithEventID(ctx, event.ID), event)
+	if errors.Is(err, dbquery.ErrAlreadyProcessed) {
+		return nil
+	}
+	return err
+}
+
+func (ds dbStore) write(ctx context.Context, event events.Event) error {
+	ep := event.Payload
+	t, err := eventTime(ep.Time)
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case events.ChatStarted:
+		err = ds.dbqh.ChatStart(ctx, ep.Roomid, t)
+		//already started, the event has been applied before
+		if errors.Is(err, dbquery.ErrConflict) {
+			return nil
+		}
+		return err
+	case events.ChatEnded:
+		return ds.dbqh.ChatEnd(ctx, ep.Roomid, t)
+	case events.ParticipantJoined:
+		return ds.dbqh.JoinChatParticipant(ctx, ep.Roomid, ep.UserID, t)
+	case events.ParticipantLeft:
+		return ds.dbqh.LeaveChatParticipant(ctx, ep.Roomid, ep.UserID, t)
+	case events.MessagePosted:
+		if len(ep.Attachments) > 0 {
+			return ds.dbqh.AddMessageWithAttachments(ctx, ep.Roomid, ep.UserID, ep.Text, t, ep.Attachments)
+		}
+		return ds.dbqh.AddMessageByUUID(ctx, ep.Roomid, ep.UserID, ep.Text, t)
+	}
+	return nil
+}
+
+func (ds dbStore) addMessages(ctx context.Context, messages []events.Event) error {
+	rows := make([]dbquery.ChatMessage, len(messages))
+	for i, event := range messages {
+		t, err := eventTime(event.Payload.Time)
+		if err != nil {
+			return err
+		}
+		rows[i] = dbquery.ChatMessage{ChatUUID: event.Payload.Roomid, UserID: event.Payload.UserID, Message: event.Payload.Text, Time: t, EventID: event.ID}
+	}
+	return ds.dbqh.AddMessages(ctx, rows)
+}
+
+// checks an event's time is in the format the database expects, as the api
+// does
+func eventTime(st string) (string, error) {
+	const layout = "2006-01-02 15:04:05.999999"
+	t, err := time.Parse(layout, st)
+	if err != nil {
+		return st, fmt.Errorf("time not valid for this application, format needed: %s", layout)
+	}
+	return t.Format(layout), nil
+}
+
+// chooses how events are applied from the persistence environment variable,
+// api (the default) or db. The database is set up with the same variables as
+// the api's, and the api is left to migrate it.
+func newEventStore() (eventStore, error) {
+	switch mode := os.Getenv("persistence"); mode {
+	case "", "api":
+		return apiStore{}, nil
+	case "db":
+		dbqh, err := newDBQueryHandler()
+		if err != nil {
+			return nil, err
+		}
+		return dbStore{dbqh: dbqh}, nil
+	default:
+		return nil, fmt.Errorf("unknown persistence %q, expected api or db", mode)
+	}
+}
+
+func newDBQueryHandler() (dbquery.DBQueryHandler, error) {
+	queryTimeout := envDuration("dbquerytimeout", 0)
+	switch backend := os.Getenv("dbbackend"); backend {
+	case "", "postgres":
+		return dbquery.NewPostgresHandler(dbquery.PostgresDBConfig{
+			DBUser:         os.Getenv("POSTGRES_USER"),
+			DBPassword:     os.Getenv("POSTGRES_PASSWORD"),
+			DBName:         os.Getenv("POSTGRES_DB"),
+			DBHost:         os.Getenv("dbhost"),
+			DBPort:         os.Getenv("dbport"),
+			MaxOpenConns:   envInt("dbmaxopenconns", workerCount),
+			QueryTimeout:   queryTimeout,
+			SkipMigrations: true,
+		})
+	case "sqlite":
+		path := os.Getenv("sqlitepath")
+		if path == "" {
+			path = "chat-app.db"
+		}
+		return dbquery.NewSqlLiteHandler(dbquery.SqlLiteDBConfig{Path: path, QueryTimeout: queryTimeout, SkipMigrations: true})
+	default:
+		return nil, fmt.Errorf("unknown dbbackend %q, expected postgres or sqlite", backend)
+	}
+}
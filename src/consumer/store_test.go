@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Ryan-Har/chat-app/src/api/dbquery"
+	"github.com/Ryan-Har/chat-app/src/api/events"
+)
+
+const testChat = "d935fb72-796d-4418-8a36-bc228d143790"
+
+// a dbStore on a fresh sqlite database with testChat started
+func newTestDBStore(tb testing.TB) dbStore {
+	tb.Helper()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dbqh, err := dbquery.NewSqlLiteHandler(dbquery.SqlLiteDBConfig{Path: ":memory:"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ds := dbStore{dbqh: dbqh}
+	if err := ds.apply(context.Background(), events.New(events.ChatStarted, events.Payload{Roomid: testChat, Time: "2024-02-20 15:50:20.123456"})); err != nil {
+		tb.Fatal(err)
+	}
+	return ds
+}
+
+func testMessage(room string, i int) events.Event {
+	return events.New(events.MessagePosted, events.Payload{Roomid: room, UserID: 1, Text: fmt.Sprint(i), Time: "2024-02-20 15:50:21.000000"})
+}
+
+func TestDBStore(t *testing.T) {
+	ds := newTestDBStore(t)
+	ctx := context.Background()
+
+	// started again on redelivery
+	if err := ds.apply(ctx, events.New(events.ChatStarted, events.Payload{Roomid: testChat, Time: "2024-02-20 15:50:20.123456"})); err != nil {
+		t.Errorf("expected a chat started twice to be applied, got %v", err)
+	}
+	message := testMessage(testChat, 0)
+	joined := events.New(events.ParticipantJoined, events.Payload{Roomid: testChat, UserID: 1, Time: "2024-02-20 15:50:21.000000"})
+	for i := 0; i < 2; i++ {
+		if err := ds.apply(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.apply(ctx, joined); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same event written again in a batch
+	if err := ds.addMessages(ctx, []events.Event{message, testMessage(testChat, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := ds.dbqh.GetAllMessagesByUUID(ctx, testChat); err != nil || len(messages) != 2 {
+		t.Errorf("expected redelivered messages to be stored once, got %d %v", len(messages), err)
+	}
+	if participants, err := ds.dbqh.GetOngoingChatParticipants(ctx); err != nil || len(participants) != 1 {
+		t.Errorf("expected a redelivered join to be stored once, got %+v %v", participants, err)
+	}
+
+	if err := ds.apply(ctx, events.New(events.ChatEnded, events.Payload{Roomid: testChat, Time: "2024-02-20"})); err == nil {
+		t.Error("expected an error for a badly formatted time")
+	}
+	if err := ds.apply(ctx, events.New(events.ChatEnded, events.Payload{Roomid: "6f1c0000-0000-0000-0000-000000000000", Time: "2024-02-20 15:50:22.000000"})); err == nil {
+		t.Error("expected an error ending a chat that was never started")
+	}
+}
+
+func TestBatchedMessages(t *testing.T) {
+	ds := newTestDBStore(t)
+	drainInternalQueue(t)
+	fp := &fakePublisher{}
+	acks := &fakeAcks{}
+	rt := newRetrier(ds, 5)
+	ctx := context.Background()
+
+	var batch []roomEvent
+	for i := 0; i < 3; i++ {
+		batch = append(batch, testDelivery(t, acks, uint64(i+1), testMessage(testChat, i), nil))
+	}
+	rt.handleBatch(ctx, fp, batch)
+	for tag := uint64(1); tag <= 3; tag++ {
+		if acks.get(tag) != "ack" {
+			t.Errorf("expected message %d to be acked, got %q", tag, acks.get(tag))
+		}
+	}
+
+	// a message for a chat that does not exist fails the batch, the others
+	// are then written one at a time
+	missing := "6f1c0000-0000-0000-0000-000000000000"
+	batch = []roomEvent{
+		testDelivery(t, acks, 4, testMessage(testChat, 3), nil),
+		testDelivery(t, acks, 5, testMessage(missing, 4), nil),
+		testDelivery(t, acks, 6, testMessage(testChat, 5), nil),
+	}
+	rt.handleBatch(ctx, fp, batch)
+	if acks.get(4) != "ack" || acks.get(5) != "ack" || acks.get(6) != "ack" {
+		t.Errorf("expected every event to be acked, got %v", acks.acks)
+	}
+	if p := fp.take(t); p.key != retryQueue(1) {
+		t.Errorf("expected the failed message to be sent to be retried, got %+v", p)
+	}
+	messages, err := ds.dbqh.GetAllMessagesByUUID(ctx, testChat)
+	if err != nil || len(messages) != 5 {
+		t.Errorf("expected 5 messages stored, got %d %v", len(messages), err)
+	}
+}
+
+// the api's addmessage handler, writing to the same kind of database
+func startTestMessageApi(b *testing.B, dbqh dbquery.DBQueryHandler) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cm ChatMessage
+		if err := json.NewDecoder(r.Body).Decode(&cm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbqh.AddMessageByUUID(r.Context(), cm.ChatUUID, cm.UserID, cm.Message, cm.Time); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	b.Cleanup(srv.Close)
+	saved := apiBaseUrl
+	apiBaseUrl = srv.URL + "/api"
+	b.Cleanup(func() { apiBaseUrl = saved })
+}
+
+func BenchmarkApplyMessages(b *testing.B) {
+	ctx := context.Background()
+	b.Run("http", func(b *testing.B) {
+		ds := newTestDBStore(b)
+		startTestMessageApi(b, ds.dbqh)
+		drainInternalQueue(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := (apiStore{}).apply(ctx, testMessage(testChat, i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("db", func(b *testing.B) {
+		ds := newTestDBStore(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := ds.apply(ctx, testMessage(testChat, i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("db batched", func(b *testing.B) {
+		ds := newTestDBStore(b)
+		batch := make([]events.Event, 0, partitionQueue+1)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			batch = append(batch, testMessage(testChat, i))
+			if len(batch) == cap(batch) || i == b.N-1 {
+				if err := ds.addMessages(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+				batch = batch[:0]
+			}
+		}
+	})
+}
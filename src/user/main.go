@@ -1,11 +1,116 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
+var apiBaseUrl string = fmt.Sprintf("http://%s:%s/api", os.Getenv("apiHost"), os.Getenv("apiPort"))
+
+// shared with the api, which trusts the visitor addresses this site passes on
+var serviceToken string = os.Getenv("servicetoken")
+
+// starts a chat for a visitor. The api creates the room and returns a join
+// token for it, which the page passes to the chat service.
+func joinChat(w http.ResponseWriter, r *http.Request) {
+	var visitor struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&visitor); err != nil || visitor.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	body, _ := json.Marshal(visitor)
+	proxyToApi(w, r, "/chat/visitorjoin", body)
+}
+
+// exchanges the visitor's resume token for a new join token to their room
+func resumeChat(w http.ResponseWriter, r *http.Request) {
+	var resume struct {
+		ResumeToken string `json:"resume_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resume); err != nil || resume.ResumeToken == "" {
+		http.Error(w, "resume_token is required", http.StatusBadRequest)
+		return
+	}
+	body, _ := json.Marshal(resume)
+	proxyToApi(w, r, "/chat/visitorresume", body)
+}
+
+// posts body to the api and passes its response back unchanged. The api is
+// told the visitor's address, which it only takes from the chat-app services.
+func proxyToApi(w http.ResponseWriter, r *http.Request, path string, body []byte) {
+	req, err := http.NewRequest("POST", apiBaseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", ip)
+	req.Header.Set("X-Service-Token", serviceToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// passes a file upload from the page on to the api. The page authenticates
+// it with the visitor's resume token, which only allows uploads to their room.
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequest("POST", apiBaseUrl+"/chat/attachments", r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serves an attachment from the api, /attachments/<id>
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/attachments/")
+	resp, err := http.Get(apiBaseUrl + "/chat/attachments/" + url.PathEscape(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Disposition", "X-Content-Type-Options", "Content-Security-Policy"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
 func main() {
 
 	data := struct {
@@ -31,6 +136,11 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/handlejoin", joinChat)
+	http.HandleFunc("/handleresume", resumeChat)
+	http.HandleFunc("/handleupload", uploadAttachment)
+	http.HandleFunc("/attachments/", downloadAttachment)
+
 	// Serve static files
 	http.Handle("/web/", http.StripPrefix("/web/", http.FileServer(http.Dir("web"))))
 	http.ListenAndServe(":8080", nil)
@@ -11,41 +11,99 @@ messageInput.addEventListener("keypress", function(event) {
 let ws;
 const chatMessages = document.getElementById("chat-messages");
 const nameInput = document.getElementById("name-input");
-  
+const fileInput = document.getElementById("file-input");
+
+// WebSocket subprotocol for JSON frames, see the chat service's protocol.go
+const chatProtocol = "chat.v1.json";
+// the resume token and the id of the last message seen are kept for the
+// session, so a refresh or dropped connection rejoins the same chat
+const resumeTokenKey = "chatResumeToken";
+const lastMessageKey = "chatLastMessageId";
+const reconnectDelay = 2000;
+
+// asks the api for a join token, for the visitor's existing chat if they have
+// one that has not ended, otherwise for a new one
+async function requestJoin() {
+    const resumeToken = sessionStorage.getItem(resumeTokenKey);
+    if (resumeToken) {
+        const resp = await fetch("/handleresume", {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({resume_token: resumeToken})
+        });
+        if (resp.ok) {
+            return {join: await resp.json(), resumed: true};
+        }
+        // the chat has ended, or the token expired
+        sessionStorage.removeItem(resumeTokenKey);
+        sessionStorage.removeItem(lastMessageKey);
+    }
+
+    const name = nameInput.value.trim();
+    if (!name) {
+        alert("Please enter your name");
+        return null;
+    }
+    // the api creates the room and a join token for it
+    const resp = await fetch("/handlejoin", {
+        method: "POST",
+        headers: {"Content-Type": "application/json"},
+        body: JSON.stringify({name: name})
+    });
+    if (!resp.ok) {
+        throw new Error(`unable to start chat: ${resp.status}`);
+    }
+    return {join: await resp.json(), resumed: false};
+}
+
 function connectToChat() {
-    return new Promise((resolve, reject) => {
-        const name = nameInput.value.trim();
-        if (!name) {
-            alert("Please enter your name");
+    return new Promise(async (resolve, reject) => {
+        let request;
+        try {
+            request = await requestJoin();
+        } catch (error) {
+            reject(error);
+            return;
+        }
+        if (!request) {
             return;
         }
+        const join = request.join;
+        sessionStorage.setItem(resumeTokenKey, join.resume_token);
         nameInput.style.visibility = "hidden";
-        
-        const guid = crypto.randomUUID();
 
-        // WebSocket connection URL with the GUID and user's name
-        const wsUrl = `ws://${chatHost}:${chatPort}/ws?guid=${guid}&name=${name}`;
-        console.log(wsUrl);
+        // WebSocket connection URL with the join token. When reconnecting with
+        // messages already on the page, the last one seen is sent so only the
+        // ones missed are replayed, otherwise the recent history is sent.
+        let wsUrl = `ws://${chatHost}:${chatPort}/ws?token=${encodeURIComponent(join.token)}`;
+        const lastMessage = sessionStorage.getItem(lastMessageKey);
+        if (request.resumed && lastMessage && chatMessages.childElementCount > 0) {
+            wsUrl += `&after=${encodeURIComponent(lastMessage)}`;
+        }
 
         // Establish WebSocket connection
-        ws = new WebSocket(wsUrl);
+        ws = new WebSocket(wsUrl, [chatProtocol]);
+        let opened = false;
 
         // Set up event listeners for WebSocket
         ws.onopen = () => {
             console.log("WebSocket connection established");
+            opened = true;
             resolve();
         };
 
         ws.onmessage = (event) => {
-            let newMessage = document.createElement('div');
-            newMessage.className = 'message';
-            newMessage.textContent = event.data;
-
-            chatMessages.appendChild(newMessage);
+            const frame = JSON.parse(event.data);
+            const frames = frame.type === "history" ? frame.messages || [] : [frame];
+            frames.forEach(showFrame);
         };
 
-        ws.onclose = () => {
+        ws.onclose = (event) => {
             console.log("WebSocket connection closed");
+            // rejoin if the connection dropped, rather than the page closing it
+            if (opened && !event.wasClean) {
+                setTimeout(() => connectToChat().catch(error => console.error(error)), reconnectDelay);
+            }
         };
 
         ws.onerror = (error) => {
@@ -55,19 +113,102 @@ function connectToChat() {
     });
 }
 
+function showFrame(frame) {
+    if (frame.type === "message") {
+        sessionStorage.setItem(lastMessageKey, frame.id);
+    }
+    const text = frameText(frame);
+    if (!text) {
+        return;
+    }
+    let newMessage = document.createElement('div');
+    newMessage.className = 'message';
+    newMessage.textContent = text;
+    (frame.attachments || []).forEach(attachment => newMessage.appendChild(attachmentElement(attachment)));
+
+    chatMessages.appendChild(newMessage);
+}
+
+// images are shown in the chat, anything else is linked for download
+function attachmentElement(attachment) {
+    const url = `/attachments/${encodeURIComponent(attachment.id)}`;
+    if (attachment.contenttype && attachment.contenttype.startsWith("image/")) {
+        const img = document.createElement("img");
+        img.className = "attachment";
+        img.src = url;
+        img.alt = attachment.name;
+        return img;
+    }
+    const link = document.createElement("a");
+    link.className = "attachment";
+    link.href = url;
+    link.download = attachment.name;
+    link.textContent = attachment.name;
+    return link;
+}
+
+// uploads a file to the visitor's chat, returning its attachment id
+async function uploadFile(file) {
+    const form = new FormData();
+    form.append("file", file);
+    const resp = await fetch("/handleupload", {
+        method: "POST",
+        headers: {"Authorization": `Bearer ${sessionStorage.getItem(resumeTokenKey)}`},
+        body: form
+    });
+    if (!resp.ok) {
+        throw new Error(`unable to upload ${file.name}: ${await resp.text()}`);
+    }
+    return (await resp.json()).id;
+}
+
+// the text shown for a frame, or an empty string for those not shown
+function frameText(frame) {
+    switch (frame.type) {
+        case "message":
+            return `${frame.name}: ${frame.text || ""}`;
+        case "join":
+            return `${frame.name} joined the chat`;
+        case "leave":
+            return `${frame.name} left the chat`;
+        case "system":
+        case "error":
+            return frame.text;
+        default:
+            return "";
+    }
+}
+
 async function sendMessage() {
     const messageInput = document.getElementById("message-input");
     const message = messageInput.value.trim();
-    if (message && (!ws || ws.readyState != WebSocket.OPEN)) {
+    const file = fileInput.files[0];
+    if ((message || file) && (!ws || ws.readyState != WebSocket.OPEN)) {
         await connectToChat();
     }
 
-    if (message && ws && ws.readyState === WebSocket.OPEN) {
+    if ((message || file) && ws && ws.readyState === WebSocket.OPEN) {
+        // files are uploaded first, the message only carries their ids
+        const attachments = [];
+        if (file) {
+            try {
+                attachments.push({id: await uploadFile(file)});
+            } catch (error) {
+                alert(error.message);
+                return;
+            }
+        }
         // Send message to the server
-        ws.send(message);
+        ws.send(JSON.stringify({type: "message", text: message, attachments: attachments}));
     }
       
     messageInput.value = "";
+    fileInput.value = "";
+}
+
+// carry on with a chat started before the page was refreshed
+if (sessionStorage.getItem(resumeTokenKey)) {
+    connectToChat().catch(error => console.error(error));
 }
 
 